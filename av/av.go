@@ -131,11 +131,19 @@ var (
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
 	PCM        = MakeAudioCodecType(avCodecTypeMagic + 6)
 	OPUS       = MakeAudioCodecType(avCodecTypeMagic + 7)
+	MP3        = MakeAudioCodecType(avCodecTypeMagic + 8)
+	AC3        = MakeAudioCodecType(avCodecTypeMagic + 9)
+	EAC3       = MakeAudioCodecType(avCodecTypeMagic + 10)
+	KLV        = MakeDataCodecType(avCodecTypeMagic + 1)
 )
 
 const codecTypeAudioBit = 0x1
 const codecTypeOtherBits = 1
 
+// codecTypeDataBit is far above the base values so that adding it did not
+// renumber the audio and video codec types.
+const codecTypeDataBit = 0x80000000
+
 func (ct CodecType) String() string {
 	switch ct {
 	case H264:
@@ -164,6 +172,14 @@ func (ct CodecType) String() string {
 		return "PCM"
 	case OPUS:
 		return "OPUS"
+	case MP3:
+		return "MP3"
+	case AC3:
+		return "AC3"
+	case EAC3:
+		return "EAC3"
+	case KLV:
+		return "KLV"
 	}
 	return ""
 }
@@ -173,7 +189,12 @@ func (ct CodecType) IsAudio() bool {
 }
 
 func (ct CodecType) IsVideo() bool {
-	return ct&codecTypeAudioBit == 0
+	return ct&(codecTypeAudioBit|codecTypeDataBit) == 0
+}
+
+// IsData reports a timed metadata stream, neither audio nor video.
+func (ct CodecType) IsData() bool {
+	return ct&codecTypeDataBit != 0
 }
 
 // MakeAudioCodecType creates a new audio codec type.
@@ -188,6 +209,12 @@ func MakeVideoCodecType(base uint32) (c CodecType) {
 	return
 }
 
+// MakeDataCodecType creates a new data codec type.
+func MakeDataCodecType(base uint32) (c CodecType) {
+	c = CodecType(base)<<codecTypeOtherBits | CodecType(codecTypeDataBit)
+	return
+}
+
 const avCodecTypeMagic = 233333
 
 // CodecData is some important bytes for initializing audio/video decoder,
@@ -0,0 +1,236 @@
+// Package ac3parser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ac3parser
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/utils/bits"
+)
+
+const HeaderLength = 7
+
+const (
+	StreamTypeIndependent = 0
+	StreamTypeDependent   = 1
+	StreamTypeAC3Convert  = 2
+)
+
+var sampleRates = []int{48000, 44100, 32000}
+var reducedSampleRates = []int{24000, 22050, 16000}
+
+// AC-3 bitrates in kbit/s, indexed by frmsizecod/2
+var bitRates = []int{
+	32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640,
+}
+
+var blocksPerFrame = []int{1, 2, 3, 6}
+
+var channelLayouts = []av.ChannelLayout{
+	av.CH_STEREO, // 1+1 dual mono
+	av.CH_MONO,
+	av.CH_STEREO,
+	av.CH_SURROUND,
+	av.CH_2_1,
+	av.CH_SURROUND | av.CH_BACK_CENTER,
+	av.CH_STEREO | av.CH_SIDE_LEFT | av.CH_SIDE_RIGHT,
+	av.CH_SURROUND | av.CH_SIDE_LEFT | av.CH_SIDE_RIGHT,
+}
+
+// SyncFrameHeader holds the fields of an AC-3 (ATSC A/52) or E-AC-3
+// (A/52 Annex E) syncframe header that describe the decoded audio.
+type SyncFrameHeader struct {
+	BSID          uint
+	StreamType    uint // E-AC-3 only
+	SubstreamID   uint // E-AC-3 only
+	SampleRate    int
+	Samples       int
+	FrameLength   int
+	ACMod         uint
+	LFEOn         bool
+	ChannelLayout av.ChannelLayout
+}
+
+func (h SyncFrameHeader) IsEAC3() bool {
+	return h.BSID > 10
+}
+
+func ParseSyncFrameHeader(b []byte) (h SyncFrameHeader, err error) {
+	if len(b) < HeaderLength || b[0] != 0x0b || b[1] != 0x77 {
+		err = fmt.Errorf("ac3parser: syncword invalid")
+		return
+	}
+	h.BSID = uint(b[5] >> 3)
+	if h.BSID > 16 {
+		err = fmt.Errorf("ac3parser: bsid=%d not supported", h.BSID)
+		return
+	}
+
+	br := &bits.Reader{R: bytes.NewReader(b[2:])}
+	if h.IsEAC3() {
+		err = h.parseEAC3(br)
+	} else {
+		err = h.parseAC3(br)
+	}
+	if err != nil {
+		return
+	}
+
+	h.ChannelLayout = channelLayouts[h.ACMod]
+	if h.LFEOn {
+		h.ChannelLayout |= av.CH_LOW_FREQ
+	}
+	return
+}
+
+func (h *SyncFrameHeader) parseAC3(br *bits.Reader) (err error) {
+	var fscod, frmsizecod uint
+	// crc1
+	if _, err = br.ReadBits(16); err != nil {
+		return
+	}
+	if fscod, err = br.ReadBits(2); err != nil {
+		return
+	}
+	if frmsizecod, err = br.ReadBits(6); err != nil {
+		return
+	}
+	if fscod == 3 || int(frmsizecod>>1) >= len(bitRates) {
+		err = fmt.Errorf("ac3parser: fscod=%d frmsizecod=%d invalid", fscod, frmsizecod)
+		return
+	}
+	h.SampleRate = sampleRates[fscod]
+	h.Samples = 1536
+
+	// frame size in 16-bit words
+	bitrate := bitRates[frmsizecod>>1]
+	switch fscod {
+	case 0:
+		h.FrameLength = bitrate * 2 * 2
+	case 1:
+		h.FrameLength = (bitrate*320/147 + int(frmsizecod&1)) * 2
+	case 2:
+		h.FrameLength = bitrate * 3 * 2
+	}
+
+	// bsid, bsmod
+	if _, err = br.ReadBits(8); err != nil {
+		return
+	}
+	if h.ACMod, err = br.ReadBits(3); err != nil {
+		return
+	}
+	skip := 0
+	if h.ACMod&1 != 0 && h.ACMod != 1 {
+		skip += 2 // cmixlev
+	}
+	if h.ACMod&4 != 0 {
+		skip += 2 // surmixlev
+	}
+	if h.ACMod == 2 {
+		skip += 2 // dsurmod
+	}
+	if skip > 0 {
+		if _, err = br.ReadBits(skip); err != nil {
+			return
+		}
+	}
+	var lfeon uint
+	if lfeon, err = br.ReadBits(1); err != nil {
+		return
+	}
+	h.LFEOn = lfeon != 0
+	return
+}
+
+func (h *SyncFrameHeader) parseEAC3(br *bits.Reader) (err error) {
+	var frmsiz, fscod, numblkscod, lfeon uint
+	if h.StreamType, err = br.ReadBits(2); err != nil {
+		return
+	}
+	if h.SubstreamID, err = br.ReadBits(3); err != nil {
+		return
+	}
+	if frmsiz, err = br.ReadBits(11); err != nil {
+		return
+	}
+	h.FrameLength = (int(frmsiz) + 1) * 2
+
+	if fscod, err = br.ReadBits(2); err != nil {
+		return
+	}
+	if fscod == 3 {
+		var fscod2 uint
+		if fscod2, err = br.ReadBits(2); err != nil {
+			return
+		}
+		if fscod2 == 3 {
+			err = fmt.Errorf("ac3parser: fscod2 invalid")
+			return
+		}
+		h.SampleRate = reducedSampleRates[fscod2]
+		numblkscod = 3
+	} else {
+		h.SampleRate = sampleRates[fscod]
+		if numblkscod, err = br.ReadBits(2); err != nil {
+			return
+		}
+	}
+	h.Samples = blocksPerFrame[numblkscod] * 256
+
+	if h.ACMod, err = br.ReadBits(3); err != nil {
+		return
+	}
+	if lfeon, err = br.ReadBits(1); err != nil {
+		return
+	}
+	h.LFEOn = lfeon != 0
+	return
+}
+
+type CodecData struct {
+	Header SyncFrameHeader
+}
+
+func (cd CodecData) Type() av.CodecType {
+	if cd.Header.IsEAC3() {
+		return av.EAC3
+	}
+	return av.AC3
+}
+
+func (cd CodecData) SampleRate() int {
+	return cd.Header.SampleRate
+}
+
+func (cd CodecData) ChannelLayout() av.ChannelLayout {
+	return cd.Header.ChannelLayout
+}
+
+func (cd CodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+func (cd CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	samples := cd.Header.Samples
+	if len(data) >= HeaderLength {
+		var h SyncFrameHeader
+		if h, err = ParseSyncFrameHeader(data); err != nil {
+			return
+		}
+		samples = h.Samples
+	}
+	dur = time.Duration(samples) * time.Second / time.Duration(cd.Header.SampleRate)
+	return
+}
+
+func NewCodecDataFromSyncFrame(frame []byte) (self CodecData, err error) {
+	if self.Header, err = ParseSyncFrameHeader(frame); err != nil {
+		return
+	}
+	return
+}
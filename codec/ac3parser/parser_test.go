@@ -0,0 +1,108 @@
+// Package ac3parser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ac3parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+)
+
+func TestParseSyncFrameHeader(t *testing.T) {
+	values := []struct {
+		Name     string
+		Header   []byte
+		Expected SyncFrameHeader
+	}{
+		{"ac3 48k stereo", []byte{0x0b, 0x77, 0, 0, 0x08, 0x40, 0x40},
+			SyncFrameHeader{BSID: 8, SampleRate: 48000, Samples: 1536, FrameLength: 256, ACMod: 2, ChannelLayout: av.CH_STEREO}},
+		// an odd frmsizecod adds a word at 44.1 kHz
+		{"ac3 44.1k 5.1", []byte{0x0b, 0x77, 0, 0, 0x51, 0x40, 0xe1},
+			SyncFrameHeader{BSID: 8, SampleRate: 44100, Samples: 1536, FrameLength: 558, ACMod: 7, LFEOn: true,
+				ChannelLayout: av.CH_SURROUND | av.CH_SIDE_LEFT | av.CH_SIDE_RIGHT | av.CH_LOW_FREQ}},
+		{"ac3 32k mono", []byte{0x0b, 0x77, 0, 0, 0x80, 0x40, 0x20},
+			SyncFrameHeader{BSID: 8, SampleRate: 32000, Samples: 1536, FrameLength: 192, ACMod: 1, ChannelLayout: av.CH_MONO}},
+		{"eac3 independent", []byte{0x0b, 0x77, 0x00, 0x7f, 0x34, 0x80, 0},
+			SyncFrameHeader{BSID: 16, SampleRate: 48000, Samples: 1536, FrameLength: 256, ACMod: 2, ChannelLayout: av.CH_STEREO}},
+		{"eac3 dependent", []byte{0x0b, 0x77, 0x40, 0x7f, 0x34, 0x80, 0},
+			SyncFrameHeader{BSID: 16, StreamType: StreamTypeDependent, SampleRate: 48000, Samples: 1536, FrameLength: 256, ACMod: 2, ChannelLayout: av.CH_STEREO}},
+		{"eac3 one block", []byte{0x0b, 0x77, 0x08, 0x3f, 0x04, 0x80, 0},
+			SyncFrameHeader{BSID: 16, SubstreamID: 1, SampleRate: 48000, Samples: 256, FrameLength: 128, ACMod: 2, ChannelLayout: av.CH_STEREO}},
+		// fscod=3 selects the half sample rates and 6 blocks
+		{"eac3 22.05k", []byte{0x0b, 0x77, 0x00, 0x7f, 0xd3, 0x80, 0},
+			SyncFrameHeader{BSID: 16, SampleRate: 22050, Samples: 1536, FrameLength: 256, ACMod: 1, LFEOn: true, ChannelLayout: av.CH_MONO | av.CH_LOW_FREQ}},
+	}
+	for _, ex := range values {
+		h, err := ParseSyncFrameHeader(ex.Header)
+		if err != nil {
+			t.Errorf("%s: %v", ex.Name, err)
+			continue
+		}
+		if h != ex.Expected {
+			t.Errorf("%s: expected %+v, got %+v", ex.Name, ex.Expected, h)
+		}
+		if h.IsEAC3() != (ex.Expected.BSID > 10) {
+			t.Errorf("%s: IsEAC3=%v", ex.Name, h.IsEAC3())
+		}
+	}
+}
+
+func TestParseSyncFrameHeaderErrors(t *testing.T) {
+	values := []struct {
+		Name   string
+		Header []byte
+	}{
+		{"short", []byte{0x0b, 0x77, 0, 0, 0x08, 0x40}},
+		{"syncword", []byte{0x0b, 0x78, 0, 0, 0x08, 0x40, 0x40}},
+		{"bsid", []byte{0x0b, 0x77, 0, 0, 0x08, 0x88, 0x40}},
+		{"ac3 fscod", []byte{0x0b, 0x77, 0, 0, 0xc8, 0x40, 0x40}},
+		{"ac3 frmsizecod", []byte{0x0b, 0x77, 0, 0, 0x26, 0x40, 0x40}},
+		{"eac3 fscod2", []byte{0x0b, 0x77, 0x00, 0x7f, 0xf4, 0x80, 0}},
+	}
+	for _, ex := range values {
+		if _, err := ParseSyncFrameHeader(ex.Header); err == nil {
+			t.Errorf("%s: expected an error", ex.Name)
+		}
+	}
+}
+
+func TestCodecData(t *testing.T) {
+	ac3 := []byte{0x0b, 0x77, 0, 0, 0x08, 0x40, 0x40}
+	cd, err := NewCodecDataFromSyncFrame(ac3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cd.Type() != av.AC3 || cd.SampleRate() != 48000 || cd.ChannelLayout() != av.CH_STEREO {
+		t.Errorf("unexpected codec data %+v", cd)
+	}
+
+	eac3, err := NewCodecDataFromSyncFrame([]byte{0x0b, 0x77, 0x00, 0x7f, 0x34, 0x80, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eac3.Type() != av.EAC3 {
+		t.Errorf("expected E-AC-3, got %v", eac3.Type())
+	}
+
+	values := []struct {
+		Data     []byte
+		Duration time.Duration
+	}{
+		{ac3, 32 * time.Millisecond},
+		// one block of E-AC-3 in an AC-3 stream
+		{[]byte{0x0b, 0x77, 0x08, 0x3f, 0x04, 0x80, 0}, 256 * time.Second / 48000},
+		// too short to hold a header, the stream's frame size
+		{[]byte{0x0b, 0x77}, 32 * time.Millisecond},
+	}
+	for _, ex := range values {
+		dur, err := cd.PacketDuration(ex.Data)
+		if err != nil || dur != ex.Duration {
+			t.Errorf("%x: expected %s, got %s %v", ex.Data, ex.Duration, dur, err)
+		}
+	}
+	if _, err = cd.PacketDuration([]byte{0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("expected an error for a packet without a syncword")
+	}
+}
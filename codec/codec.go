@@ -101,3 +101,48 @@ func NewSpeexCodecData(sr int, cl av.ChannelLayout) SpeexCodecData {
 	codec.ChannelLayout_ = cl
 	return codec
 }
+
+// PCMCodecData is G.711 or uncompressed PCM audio of any sample rate and
+// channel layout. G.711 samples are one byte whatever SampleFormat says.
+type PCMCodecData struct {
+	typ            av.CodecType
+	SampleRate_    int
+	ChannelLayout_ av.ChannelLayout
+	SampleFormat_  av.SampleFormat
+}
+
+func (pcd PCMCodecData) Type() av.CodecType {
+	return pcd.typ
+}
+
+func (pcd PCMCodecData) SampleRate() int {
+	return pcd.SampleRate_
+}
+
+func (pcd PCMCodecData) ChannelLayout() av.ChannelLayout {
+	return pcd.ChannelLayout_
+}
+
+func (pcd PCMCodecData) SampleFormat() av.SampleFormat {
+	return pcd.SampleFormat_
+}
+
+func (pcd PCMCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	size := pcd.ChannelLayout_.Count()
+	if pcd.typ == av.PCM {
+		size *= pcd.SampleFormat_.BytesPerSample()
+	}
+	if size == 0 || pcd.SampleRate_ == 0 {
+		return 0, nil
+	}
+	return time.Duration(len(data)/size) * time.Second / time.Duration(pcd.SampleRate_), nil
+}
+
+func NewPCMCodecDataWithFormat(typ av.CodecType, sr int, cl av.ChannelLayout, sf av.SampleFormat) av.AudioCodecData {
+	return PCMCodecData{
+		typ:            typ,
+		SampleRate_:    sr,
+		ChannelLayout_: cl,
+		SampleFormat_:  sf,
+	}
+}
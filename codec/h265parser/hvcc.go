@@ -0,0 +1,104 @@
+// Package h265parser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package h265parser
+
+import (
+	"errors"
+
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// HEVCDecoderConfRecordBytes marshals the HEVCDecoderConfigurationRecord of
+// ISO/IEC 14496-15 8.3.3.1, the hvcC box of mp4 files. complete sets
+// array_completeness, telling that no parameter set of these types is in the
+// samples.
+func (self CodecData) HEVCDecoderConfRecordBytes(complete bool) ([]byte, error) {
+	info := self.RecordInfo
+	if len(info.VPS) == 0 || len(info.SPS) == 0 || len(info.PPS) == 0 {
+		return nil, errors.New("h265parser: missing parameter sets")
+	}
+	sps := self.SPSInfo
+	b := make([]byte, 23)
+	b[0] = 1 // configurationVersion
+	b[1] = byte(sps.GeneralProfileSpace<<6 | sps.GeneralTierFlag<<5 | sps.GeneralProfileIDC)
+	pio.PutU32BE(b[2:], sps.GeneralProfileCompatibilityFlags)
+	pio.PutU16BE(b[6:], uint16(sps.GeneralConstraintIndicatorFlags>>32))
+	pio.PutU32BE(b[8:], uint32(sps.GeneralConstraintIndicatorFlags))
+	b[12] = byte(sps.GeneralLevelIDC)
+	b[13] = 0xf0 // min_spatial_segmentation_idc 0
+	b[14] = 0x00
+	b[15] = 0xfc // parallelismType unknown
+	b[16] = 0xfc | byte(sps.ChromaFormat)
+	b[17] = 0xf8 | byte(sps.BitDepthLumaMinus8)
+	b[18] = 0xf8 | byte(sps.BitDepthChromaMinus8)
+	// avgFrameRate unspecified, then 4 byte NALU lengths
+	b[21] = byte(sps.NumTemporalLayers&0x7)<<3 | byte(sps.TemporalIDNested&0x1)<<2 | 3
+	b[22] = 3 // numOfArrays
+	for _, array := range []struct {
+		typ   byte
+		nalus [][]byte
+	}{
+		{NAL_UNIT_VPS, info.VPS},
+		{NAL_UNIT_SPS, info.SPS},
+		{NAL_UNIT_PPS, info.PPS},
+	} {
+		hdr := array.typ
+		if complete {
+			hdr |= 0x80
+		}
+		b = append(b, hdr, byte(len(array.nalus)>>8), byte(len(array.nalus)))
+		for _, nalu := range array.nalus {
+			b = append(b, byte(len(nalu)>>8), byte(len(nalu)))
+			b = append(b, nalu...)
+		}
+	}
+	return b, nil
+}
+
+// NewCodecDataFromHEVCDecoderConfRecord reads the first parameter set of each
+// type from a HEVCDecoderConfigurationRecord.
+func NewCodecDataFromHEVCDecoderConfRecord(conf []byte) (self CodecData, err error) {
+	if len(conf) < 23 {
+		err = errors.New("h265parser: hvcC too short")
+		return
+	}
+	var vps, sps, pps []byte
+	n := 23
+	for i := 0; i < int(conf[22]); i++ {
+		if len(conf) < n+3 {
+			err = errors.New("h265parser: truncated hvcC array")
+			return
+		}
+		typ := conf[n] & 0x3f
+		count := int(pio.U16BE(conf[n+1:]))
+		n += 3
+		for j := 0; j < count; j++ {
+			if len(conf) < n+2 {
+				err = errors.New("h265parser: truncated hvcC NALU")
+				return
+			}
+			size := int(pio.U16BE(conf[n:]))
+			n += 2
+			if len(conf) < n+size {
+				err = errors.New("h265parser: truncated hvcC NALU")
+				return
+			}
+			nalu := conf[n : n+size]
+			n += size
+			switch {
+			case typ == NAL_UNIT_VPS && vps == nil:
+				vps = nalu
+			case typ == NAL_UNIT_SPS && sps == nil:
+				sps = nalu
+			case typ == NAL_UNIT_PPS && pps == nil:
+				pps = nalu
+			}
+		}
+	}
+	if vps == nil || sps == nil || pps == nil {
+		err = errors.New("h265parser: missing parameter sets in hvcC")
+		return
+	}
+	return NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+}
@@ -24,19 +24,19 @@ type SPSInfo struct {
 	CropBottom                       uint
 	Width                            uint
 	Height                           uint
-	numTemporalLayers                uint
-	temporalIdNested                 uint
-	chromaFormat                     uint
+	NumTemporalLayers                uint
+	TemporalIDNested                 uint
+	ChromaFormat                     uint
 	PicWidthInLumaSamples            uint
 	PicHeightInLumaSamples           uint
-	bitDepthLumaMinus8               uint
-	bitDepthChromaMinus8             uint
-	generalProfileSpace              uint
-	generalTierFlag                  uint
-	generalProfileIDC                uint
-	generalProfileCompatibilityFlags uint32
-	generalConstraintIndicatorFlags  uint64
-	generalLevelIDC                  uint
+	BitDepthLumaMinus8               uint
+	BitDepthChromaMinus8             uint
+	GeneralProfileSpace              uint
+	GeneralTierFlag                  uint
+	GeneralProfileIDC                uint
+	GeneralProfileCompatibilityFlags uint32
+	GeneralConstraintIndicatorFlags  uint64
+	GeneralLevelIDC                  uint
 }
 
 const (
@@ -224,12 +224,15 @@ func ParseSPS(sps []byte) (ctx SPSInfo, err error) {
 		return
 	}
 
-	if spsMaxSubLayersMinus1+1 > ctx.numTemporalLayers {
-		ctx.numTemporalLayers = spsMaxSubLayersMinus1 + 1
+	if spsMaxSubLayersMinus1+1 > ctx.NumTemporalLayers {
+		ctx.NumTemporalLayers = spsMaxSubLayersMinus1 + 1
 	}
-	if ctx.temporalIdNested, err = br.ReadBit(); err != nil {
+	if ctx.TemporalIDNested, err = br.ReadBit(); err != nil {
 		return
 	}
+	// the flags are the intersection of all the profile tier levels
+	ctx.GeneralProfileCompatibilityFlags = 0xffffffff
+	ctx.GeneralConstraintIndicatorFlags = 0xffffffffffff
 	if err = parsePTL(br, &ctx, spsMaxSubLayersMinus1); err != nil {
 		return
 	}
@@ -240,8 +243,8 @@ func ParseSPS(sps []byte) (ctx SPSInfo, err error) {
 	if cf, err = br.ReadExponentialGolombCode(); err != nil {
 		return
 	}
-	ctx.chromaFormat = uint(cf)
-	if ctx.chromaFormat == 3 {
+	ctx.ChromaFormat = uint(cf)
+	if ctx.ChromaFormat == 3 {
 		if _, err = br.ReadBit(); err != nil {
 			return
 		}
@@ -277,12 +280,12 @@ func ParseSPS(sps []byte) (ctx SPSInfo, err error) {
 	if bdlm8, err = br.ReadExponentialGolombCode(); err != nil {
 		return
 	}
-	ctx.bitDepthChromaMinus8 = uint(bdlm8)
+	ctx.BitDepthLumaMinus8 = uint(bdlm8)
 	var bdcm8 uint
 	if bdcm8, err = br.ReadExponentialGolombCode(); err != nil {
 		return
 	}
-	ctx.bitDepthChromaMinus8 = uint(bdcm8)
+	ctx.BitDepthChromaMinus8 = uint(bdcm8)
 
 	_, err = br.ReadExponentialGolombCode()
 	if err != nil {
@@ -334,22 +337,22 @@ func ParseSPS(sps []byte) (ctx SPSInfo, err error) {
 func parsePTL(br *bits.GolombBitReader, ctx *SPSInfo, maxSubLayersMinus1 uint) error {
 	var err error
 	var ptl SPSInfo
-	if ptl.generalProfileSpace, err = br.ReadBits(2); err != nil {
+	if ptl.GeneralProfileSpace, err = br.ReadBits(2); err != nil {
 		return err
 	}
-	if ptl.generalTierFlag, err = br.ReadBit(); err != nil {
+	if ptl.GeneralTierFlag, err = br.ReadBit(); err != nil {
 		return err
 	}
-	if ptl.generalProfileIDC, err = br.ReadBits(5); err != nil {
+	if ptl.GeneralProfileIDC, err = br.ReadBits(5); err != nil {
 		return err
 	}
-	if ptl.generalProfileCompatibilityFlags, err = br.ReadBits32(32); err != nil {
+	if ptl.GeneralProfileCompatibilityFlags, err = br.ReadBits32(32); err != nil {
 		return err
 	}
-	if ptl.generalConstraintIndicatorFlags, err = br.ReadBits64(48); err != nil {
+	if ptl.GeneralConstraintIndicatorFlags, err = br.ReadBits64(48); err != nil {
 		return err
 	}
-	if ptl.generalLevelIDC, err = br.ReadBits(8); err != nil {
+	if ptl.GeneralLevelIDC, err = br.ReadBits(8); err != nil {
 		return err
 	}
 	updatePTL(ctx, &ptl)
@@ -396,25 +399,25 @@ func parsePTL(br *bits.GolombBitReader, ctx *SPSInfo, maxSubLayersMinus1 uint) e
 }
 
 func updatePTL(ctx, ptl *SPSInfo) {
-	ctx.generalProfileSpace = ptl.generalProfileSpace
+	ctx.GeneralProfileSpace = ptl.GeneralProfileSpace
 
-	if ptl.generalTierFlag > ctx.generalTierFlag {
-		ctx.generalLevelIDC = ptl.generalLevelIDC
+	if ptl.GeneralTierFlag > ctx.GeneralTierFlag {
+		ctx.GeneralLevelIDC = ptl.GeneralLevelIDC
 
-		ctx.generalTierFlag = ptl.generalTierFlag
+		ctx.GeneralTierFlag = ptl.GeneralTierFlag
 	} else {
-		if ptl.generalLevelIDC > ctx.generalLevelIDC {
-			ctx.generalLevelIDC = ptl.generalLevelIDC
+		if ptl.GeneralLevelIDC > ctx.GeneralLevelIDC {
+			ctx.GeneralLevelIDC = ptl.GeneralLevelIDC
 		}
 	}
 
-	if ptl.generalProfileIDC > ctx.generalProfileIDC {
-		ctx.generalProfileIDC = ptl.generalProfileIDC
+	if ptl.GeneralProfileIDC > ctx.GeneralProfileIDC {
+		ctx.GeneralProfileIDC = ptl.GeneralProfileIDC
 	}
 
-	ctx.generalProfileCompatibilityFlags &= ptl.generalProfileCompatibilityFlags
+	ctx.GeneralProfileCompatibilityFlags &= ptl.GeneralProfileCompatibilityFlags
 
-	ctx.generalConstraintIndicatorFlags &= ptl.generalConstraintIndicatorFlags
+	ctx.GeneralConstraintIndicatorFlags &= ptl.GeneralConstraintIndicatorFlags
 }
 
 func nal2rbsp(nal []byte) []byte {
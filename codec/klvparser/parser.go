@@ -0,0 +1,318 @@
+// Package klvparser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package klvparser
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// KLV encoding, SMPTE ST 336, and the UAS Datalink Local Set, MISB ST 0601.
+
+const ULLength = 16
+
+// UASDatalinkUL is the Universal Label key of the MISB ST 0601 local set.
+var UASDatalinkUL = []byte{
+	0x06, 0x0e, 0x2b, 0x34, 0x02, 0x0b, 0x01, 0x01,
+	0x0e, 0x01, 0x03, 0x01, 0x01, 0x00, 0x00, 0x00,
+}
+
+// MISB ST 0601 tags
+const (
+	TagChecksum             = 1
+	TagPrecisionTimeStamp   = 2
+	TagMissionID            = 3
+	TagPlatformTailNumber   = 4
+	TagPlatformHeadingAngle = 5
+	TagPlatformPitchAngle   = 6
+	TagPlatformRollAngle    = 7
+	TagPlatformDesignation  = 10
+	TagImageSourceSensor    = 11
+	TagSensorLatitude       = 13
+	TagSensorLongitude      = 14
+	TagSensorTrueAltitude   = 15
+	TagFrameCenterLatitude  = 23
+	TagFrameCenterLongitude = 24
+	TagFrameCenterElevation = 25
+	TagUASDatalinkLSVersion = 65
+)
+
+var ErrParseKLV = fmt.Errorf("klvparser: invalid KLV")
+
+// ParseBERLength decodes a BER short or long form length.
+func ParseBERLength(b []byte) (length int, n int, err error) {
+	if len(b) < 1 {
+		err = ErrParseKLV
+		return
+	}
+	if b[0]&0x80 == 0 {
+		length = int(b[0])
+		n = 1
+		return
+	}
+	count := int(b[0] & 0x7f)
+	if count == 0 || count > 4 || len(b) < 1+count {
+		err = fmt.Errorf("klvparser: BER length of %d bytes not supported", count)
+		return
+	}
+	for i := 1; i <= count; i++ {
+		length = length<<8 | int(b[i])
+	}
+	n = 1 + count
+	return
+}
+
+// FillBERLength encodes length in the shortest BER form.
+func FillBERLength(b []byte, length int) (n int) {
+	if length < 0x80 {
+		b[0] = byte(length)
+		return 1
+	}
+	count := 0
+	for v := length; v > 0; v >>= 8 {
+		count++
+	}
+	b[0] = 0x80 | byte(count)
+	for i := count; i > 0; i-- {
+		b[i] = byte(length)
+		length >>= 8
+	}
+	return 1 + count
+}
+
+// ParseBEROID decodes a BER-OID encoded tag as used by local sets.
+func ParseBEROID(b []byte) (tag uint64, n int, err error) {
+	for {
+		if n >= len(b) || n >= 9 {
+			err = ErrParseKLV
+			return
+		}
+		v := b[n]
+		n++
+		tag = tag<<7 | uint64(v&0x7f)
+		if v&0x80 == 0 {
+			return
+		}
+	}
+}
+
+// ParsePacket splits the first universal label keyed KLV packet off b.
+func ParsePacket(b []byte) (key []byte, value []byte, n int, err error) {
+	if len(b) < ULLength+1 {
+		err = ErrParseKLV
+		return
+	}
+	key = b[:ULLength]
+	n = ULLength
+	var length, ln int
+	if length, ln, err = ParseBERLength(b[n:]); err != nil {
+		return
+	}
+	n += ln
+	if len(b) < n+length {
+		err = fmt.Errorf("klvparser: value length=%d exceeds data=%d", length, len(b)-n)
+		return
+	}
+	value = b[n : n+length]
+	n += length
+	return
+}
+
+// SplitPackets splits b into universal label keyed KLV packets.
+func SplitPackets(b []byte) (packets [][]byte, err error) {
+	for len(b) > 0 {
+		var n int
+		if _, _, n, err = ParsePacket(b); err != nil {
+			return
+		}
+		packets = append(packets, b[:n])
+		b = b[n:]
+	}
+	return
+}
+
+type LocalSetItem struct {
+	Tag   uint64
+	Value []byte
+}
+
+// ParseLocalSet decodes the BER-OID tagged items of a local set value.
+func ParseLocalSet(b []byte) (items []LocalSetItem, err error) {
+	for len(b) > 0 {
+		var tag uint64
+		var n, length, ln int
+		if tag, n, err = ParseBEROID(b); err != nil {
+			return
+		}
+		if length, ln, err = ParseBERLength(b[n:]); err != nil {
+			return
+		}
+		n += ln
+		if len(b) < n+length {
+			err = fmt.Errorf("klvparser: tag=%d length=%d exceeds data", tag, length)
+			return
+		}
+		items = append(items, LocalSetItem{Tag: tag, Value: b[n : n+length]})
+		b = b[n+length:]
+	}
+	return
+}
+
+// Checksum is the MISB ST 0601 running 16-bit sum of b.
+func Checksum(b []byte) (sum uint16) {
+	for i, v := range b {
+		sum += uint16(v) << (8 * uint((i+1)%2))
+	}
+	return
+}
+
+// UASDatalink holds the commonly used MISB ST 0601 items. The Has fields
+// report whether the matching item was present and not an error value.
+type UASDatalink struct {
+	Version   int
+	Timestamp time.Time
+
+	HasHeading bool
+	Heading    float64 // platform heading in degrees, 0..360
+
+	HasPosition bool
+	Latitude    float64 // sensor latitude in degrees
+	Longitude   float64 // sensor longitude in degrees
+
+	HasAltitude bool
+	Altitude    float64 // sensor true altitude in meters
+
+	Items []LocalSetItem
+}
+
+// ParseUASDatalink decodes one MISB ST 0601 packet, key included, and
+// validates its checksum.
+func ParseUASDatalink(packet []byte) (ls UASDatalink, err error) {
+	var key, value []byte
+	var n int
+	if key, value, n, err = ParsePacket(packet); err != nil {
+		return
+	}
+	if !bytes.Equal(key, UASDatalinkUL) {
+		err = fmt.Errorf("klvparser: not a UAS Datalink local set")
+		return
+	}
+	packet = packet[:n]
+
+	if ls.Items, err = ParseLocalSet(value); err != nil {
+		return
+	}
+	if len(ls.Items) == 0 {
+		err = fmt.Errorf("klvparser: empty local set")
+		return
+	}
+
+	// the checksum is the last item and covers everything before its value
+	last := ls.Items[len(ls.Items)-1]
+	if last.Tag != TagChecksum || len(last.Value) != 2 {
+		err = fmt.Errorf("klvparser: checksum missing")
+		return
+	}
+	if want, got := pio.U16BE(last.Value), Checksum(packet[:len(packet)-2]); want != got {
+		err = fmt.Errorf("klvparser: checksum mismatch %04x != %04x", got, want)
+		return
+	}
+
+	var haslat, haslon bool
+	for _, item := range ls.Items {
+		v := item.Value
+		switch item.Tag {
+		case TagUASDatalinkLSVersion:
+			if len(v) >= 1 {
+				ls.Version = int(v[0])
+			}
+		case TagPrecisionTimeStamp:
+			if len(v) == 8 {
+				us := int64(pio.U64BE(v))
+				ls.Timestamp = time.Unix(us/1e6, us%1e6*1e3).UTC()
+			}
+		case TagPlatformHeadingAngle:
+			if len(v) == 2 {
+				ls.Heading = float64(pio.U16BE(v)) * 360 / 0xffff
+				ls.HasHeading = true
+			}
+		case TagSensorLatitude:
+			if len(v) == 4 && pio.U32BE(v) != 0x80000000 {
+				ls.Latitude = float64(int32(pio.U32BE(v))) * 180 / 0xfffffffe
+				haslat = true
+			}
+		case TagSensorLongitude:
+			if len(v) == 4 && pio.U32BE(v) != 0x80000000 {
+				ls.Longitude = float64(int32(pio.U32BE(v))) * 360 / 0xfffffffe
+				haslon = true
+			}
+		case TagSensorTrueAltitude:
+			if len(v) == 2 {
+				ls.Altitude = float64(pio.U16BE(v))*19900/0xffff - 900
+				ls.HasAltitude = true
+			}
+		}
+	}
+	ls.HasPosition = haslat && haslon
+	return
+}
+
+// Marshal writes a MISB ST 0601 packet with the fields that are set, a
+// precision time stamp when Timestamp is not zero, and the checksum.
+func (ls UASDatalink) Marshal() []byte {
+	var value []byte
+	put := func(tag int, v []byte) {
+		value = append(value, byte(tag), byte(len(v)))
+		value = append(value, v...)
+	}
+	if !ls.Timestamp.IsZero() {
+		b := make([]byte, 8)
+		pio.PutU64BE(b, uint64(ls.Timestamp.UnixNano()/1e3))
+		put(TagPrecisionTimeStamp, b)
+	}
+	if ls.HasHeading {
+		b := make([]byte, 2)
+		pio.PutU16BE(b, uint16(math.Round(ls.Heading*0xffff/360)))
+		put(TagPlatformHeadingAngle, b)
+	}
+	if ls.HasPosition {
+		b := make([]byte, 4)
+		pio.PutU32BE(b, uint32(int32(math.Round(ls.Latitude*0xfffffffe/180))))
+		put(TagSensorLatitude, b)
+		b = make([]byte, 4)
+		pio.PutU32BE(b, uint32(int32(math.Round(ls.Longitude*0xfffffffe/360))))
+		put(TagSensorLongitude, b)
+	}
+	if ls.HasAltitude {
+		b := make([]byte, 2)
+		pio.PutU16BE(b, uint16(math.Round((ls.Altitude+900)*0xffff/19900)))
+		put(TagSensorTrueAltitude, b)
+	}
+	if ls.Version != 0 {
+		put(TagUASDatalinkLSVersion, []byte{byte(ls.Version)})
+	}
+	value = append(value, TagChecksum, 2, 0, 0)
+
+	hdr := make([]byte, ULLength+5)
+	copy(hdr, UASDatalinkUL)
+	n := ULLength + FillBERLength(hdr[ULLength:], len(value))
+	packet := append(hdr[:n], value...)
+	pio.PutU16BE(packet[len(packet)-2:], Checksum(packet[:len(packet)-2]))
+	return packet
+}
+
+type CodecData struct{}
+
+func (cd CodecData) Type() av.CodecType {
+	return av.KLV
+}
+
+func NewCodecData() CodecData {
+	return CodecData{}
+}
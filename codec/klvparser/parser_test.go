@@ -0,0 +1,246 @@
+// Package klvparser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package klvparser
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+// uasPacket is the MISB ST 0601 example local set, tags 2 to 25 with the
+// example values of the standard, a version 13 item and the checksum.
+// Its 149 byte value takes a long form BER length.
+func uasPacket(t *testing.T) []byte {
+	t.Helper()
+	b, err := hex.DecodeString("" +
+		"060e2b34020b01010e0103010100000081950208000459f4a6aa4aa803094d49" +
+		"5353494f4e3031040641462d313031050271c20602fd3d070208b80801930901" +
+		"9f0a054d51312d420b02454f0c0e47656f64657469632057475338340d045595" +
+		"b66d0e045b5360c40f02c2211002cd9c1102d9171204724a0a20130487f84b86" +
+		"14047dc55ece150403830926160212811704f101a229180414bc082b190234f3" +
+		"41010d0102468a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseUASDatalink(t *testing.T) {
+	packet := uasPacket(t)
+	ls, err := ParseUASDatalink(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls.Items) != 26 || ls.Items[0].Tag != TagPrecisionTimeStamp || ls.Items[len(ls.Items)-1].Tag != TagChecksum {
+		t.Fatalf("unexpected items %v", ls.Items)
+	}
+	if string(ls.Items[1].Value) != "MISSION01" || string(ls.Items[8].Value) != "MQ1-B" {
+		t.Errorf("unexpected mission %q and platform %q", ls.Items[1].Value, ls.Items[8].Value)
+	}
+	ts := time.Date(2008, time.October, 24, 0, 13, 29, 913e6, time.UTC)
+	if ls.Version != 13 || !ls.Timestamp.Equal(ts) {
+		t.Errorf("version %d at %s", ls.Version, ls.Timestamp)
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-4
+	}
+	if !ls.HasHeading || !near(ls.Heading, 159.9744) {
+		t.Errorf("heading %v", ls.Heading)
+	}
+	if !ls.HasPosition || !near(ls.Latitude, 60.17682297) || !near(ls.Longitude, 128.42675904) {
+		t.Errorf("position %v %v", ls.Latitude, ls.Longitude)
+	}
+	if !ls.HasAltitude || math.Abs(ls.Altitude-14190.72) > 0.01 {
+		t.Errorf("altitude %v", ls.Altitude)
+	}
+
+	// trailing data is not part of the packet
+	if _, err = ParseUASDatalink(append(packet, 0x06, 0x0e)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	packet := uasPacket(t)
+	if sum := Checksum(packet[:len(packet)-2]); sum != 0x468a {
+		t.Errorf("checksum %04x, want 468a", sum)
+	}
+
+	// a changed value byte, either half of the checksum
+	for _, i := range []int{ULLength + 10, len(packet) - 2, len(packet) - 1} {
+		b := append([]byte{}, packet...)
+		b[i] ^= 0x01
+		if _, err := ParseUASDatalink(b); err == nil {
+			t.Errorf("expected a checksum error for byte %d", i)
+		}
+	}
+
+	// the checksum must be the last item
+	b := append([]byte{}, packet[:len(packet)-4]...)
+	b[ULLength+1] -= 4
+	if _, err := ParseUASDatalink(b); err == nil {
+		t.Error("expected an error for a packet without checksum")
+	}
+}
+
+func TestParseBERLength(t *testing.T) {
+	values := []struct {
+		Data   []byte
+		Length int
+		N      int
+	}{
+		{[]byte{0x00}, 0, 1},
+		{[]byte{0x7f, 0xff}, 127, 1},
+		{[]byte{0x81, 0x80}, 128, 2},
+		{[]byte{0x81, 0x95}, 149, 2},
+		{[]byte{0x82, 0x01, 0x00}, 256, 3},
+		{[]byte{0x83, 0x01, 0x00, 0x00}, 65536, 4},
+		{[]byte{0x84, 0x01, 0x00, 0x00, 0x00}, 1 << 24, 5},
+		// long form need not be the shortest
+		{[]byte{0x82, 0x00, 0x05}, 5, 3},
+	}
+	for _, ex := range values {
+		length, n, err := ParseBERLength(ex.Data)
+		if err != nil || length != ex.Length || n != ex.N {
+			t.Errorf("%x: expected %d %d, got %d %d %v", ex.Data, ex.Length, ex.N, length, n, err)
+		}
+	}
+
+	for _, b := range [][]byte{
+		nil,
+		{0x80},
+		{0x85, 1, 0, 0, 0, 0},
+		{0x81},
+		{0x82, 0x01},
+	} {
+		if _, _, err := ParseBERLength(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+
+	for _, length := range []int{0, 127, 128, 255, 256, 65535, 65536, 1 << 24} {
+		b := make([]byte, 5)
+		n := FillBERLength(b, length)
+		got, m, err := ParseBERLength(b[:n])
+		if err != nil || got != length || m != n {
+			t.Errorf("%d: round trip gave %d %d %v", length, got, m, err)
+		}
+		if (length < 0x80) != (n == 1) {
+			t.Errorf("%d: %d bytes is not the shortest form", length, n)
+		}
+	}
+}
+
+func TestParseBEROID(t *testing.T) {
+	values := []struct {
+		Data []byte
+		Tag  uint64
+		N    int
+	}{
+		{[]byte{0x01}, 1, 1},
+		{[]byte{0x7f, 0x81}, 127, 1},
+		{[]byte{0x81, 0x00}, 128, 2},
+		{[]byte{0x81, 0x01}, 129, 2},
+		{[]byte{0xff, 0x7f}, 16383, 2},
+		{[]byte{0x81, 0x80, 0x00}, 16384, 3},
+	}
+	for _, ex := range values {
+		tag, n, err := ParseBEROID(ex.Data)
+		if err != nil || tag != ex.Tag || n != ex.N {
+			t.Errorf("%x: expected %d %d, got %d %d %v", ex.Data, ex.Tag, ex.N, tag, n, err)
+		}
+	}
+
+	for _, b := range [][]byte{
+		nil,
+		{0x81},
+		{0x81, 0x80},
+		// more than 9 bytes
+		append(bytes.Repeat([]byte{0x80}, 9), 0x01),
+	} {
+		if _, _, err := ParseBEROID(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+
+	// a two byte tag in a local set
+	items, err := ParseLocalSet([]byte{0x81, 0x01, 0x01, 0xaa, 0x02, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Tag != 129 || !bytes.Equal(items[0].Value, []byte{0xaa}) || items[1].Tag != 2 || len(items[1].Value) != 0 {
+		t.Errorf("unexpected items %v", items)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	packet := uasPacket(t)
+	value := packet[ULLength+2:]
+	for i := 0; i < len(packet); i++ {
+		if _, _, _, err := ParsePacket(packet[:i]); err == nil {
+			t.Errorf("ParsePacket: expected an error at %d bytes", i)
+		}
+		if _, err := ParseUASDatalink(packet[:i]); err == nil {
+			t.Errorf("ParseUASDatalink: expected an error at %d bytes", i)
+		}
+		if _, err := SplitPackets(packet[:i]); i > 0 && err == nil {
+			t.Errorf("SplitPackets: expected an error at %d bytes", i)
+		}
+	}
+	// every cut inside an item, rather than between two
+	var ends []int
+	for n := 0; n < len(value); {
+		n += 2 + int(value[n+1])
+		ends = append(ends, n)
+	}
+	for i := 1; i < len(value); i++ {
+		_, err := ParseLocalSet(value[:i])
+		between := false
+		for _, end := range ends {
+			between = between || end == i
+		}
+		if between != (err == nil) {
+			t.Errorf("ParseLocalSet: %d bytes gave %v", i, err)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	ls := UASDatalink{
+		Version:     17,
+		Timestamp:   time.Date(2008, time.October, 24, 0, 13, 29, 913e6, time.UTC),
+		HasHeading:  true,
+		Heading:     159.9744,
+		HasPosition: true,
+		Latitude:    60.17682297,
+		Longitude:   128.42675904,
+		HasAltitude: true,
+		Altitude:    14190.72,
+	}
+	packet := ls.Marshal()
+	got, err := ParseUASDatalink(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != ls.Version || !got.Timestamp.Equal(ls.Timestamp) || !got.HasPosition || !got.HasHeading || !got.HasAltitude ||
+		math.Abs(got.Heading-ls.Heading) > 0.01 || math.Abs(got.Latitude-ls.Latitude) > 1e-6 ||
+		math.Abs(got.Longitude-ls.Longitude) > 1e-6 || math.Abs(got.Altitude-ls.Altitude) > 0.2 {
+		t.Errorf("expected %+v, got %+v", ls, got)
+	}
+	// the example items marshal to the same bytes
+	b := uasPacket(t)
+	want := map[uint64][]byte{}
+	items, _ := ParseLocalSet(b[ULLength+2:])
+	for _, item := range items {
+		want[item.Tag] = item.Value
+	}
+	for _, item := range got.Items {
+		if v, ok := want[item.Tag]; ok && item.Tag != TagChecksum && item.Tag != TagUASDatalinkLSVersion && !bytes.Equal(v, item.Value) {
+			t.Errorf("tag %d: expected %x, got %x", item.Tag, v, item.Value)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package mp3parser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package mp3parser
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+)
+
+const (
+	MPEG1  = 3
+	MPEG2  = 2
+	MPEG25 = 0
+)
+
+const HeaderLength = 4
+
+var sampleRates = [4][3]int{
+	MPEG1:  {44100, 48000, 32000},
+	MPEG2:  {22050, 24000, 16000},
+	MPEG25: {11025, 12000, 8000},
+}
+
+// bitrates of Layer III in kbit/s, indexed by MPEG1 or not
+var bitRates = [2][16]int{
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+}
+
+type FrameHeader struct {
+	Version    uint
+	BitRate    int
+	SampleRate int
+	Channels   int
+	Padding    bool
+}
+
+func (h FrameHeader) Samples() int {
+	if h.Version == MPEG1 {
+		return 1152
+	}
+	return 576
+}
+
+func (h FrameHeader) FrameLength() int {
+	var pad int
+	if h.Padding {
+		pad = 1
+	}
+	return h.Samples()/8*h.BitRate/h.SampleRate + pad
+}
+
+// ParseFrameHeader parses the 4 byte header of an MPEG audio Layer III frame.
+func ParseFrameHeader(b []byte) (h FrameHeader, framelen int, samples int, err error) {
+	if len(b) < HeaderLength || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		err = fmt.Errorf("mp3parser: frame sync invalid")
+		return
+	}
+	h.Version = uint(b[1]>>3) & 0x3
+	if h.Version == 1 {
+		err = fmt.Errorf("mp3parser: reserved version")
+		return
+	}
+	if layer := b[1] >> 1 & 0x3; layer != 1 {
+		err = fmt.Errorf("mp3parser: layer=%d is not layer 3", 4-layer)
+		return
+	}
+
+	rateidx := b[2] >> 4
+	if rateidx == 0 || rateidx == 0xf {
+		err = fmt.Errorf("mp3parser: bitrate index=%d invalid", rateidx)
+		return
+	}
+	if h.Version == MPEG1 {
+		h.BitRate = bitRates[1][rateidx] * 1000
+	} else {
+		h.BitRate = bitRates[0][rateidx] * 1000
+	}
+
+	sridx := b[2] >> 2 & 0x3
+	if sridx == 3 {
+		err = fmt.Errorf("mp3parser: sample rate index invalid")
+		return
+	}
+	h.SampleRate = sampleRates[h.Version][sridx]
+	h.Padding = b[2]&0x2 != 0
+
+	if b[3]>>6 == 3 {
+		h.Channels = 1
+	} else {
+		h.Channels = 2
+	}
+
+	framelen = h.FrameLength()
+	samples = h.Samples()
+	return
+}
+
+type CodecData struct {
+	Header FrameHeader
+}
+
+func (cd CodecData) Type() av.CodecType {
+	return av.MP3
+}
+
+func (cd CodecData) SampleRate() int {
+	return cd.Header.SampleRate
+}
+
+func (cd CodecData) ChannelLayout() av.ChannelLayout {
+	if cd.Header.Channels == 1 {
+		return av.CH_MONO
+	}
+	return av.CH_STEREO
+}
+
+func (cd CodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+func (cd CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	dur = time.Duration(cd.Header.Samples()) * time.Second / time.Duration(cd.Header.SampleRate)
+	return
+}
+
+// IsMPEG1 reports whether the stream uses MPEG-1 sample rates.
+func (cd CodecData) IsMPEG1() bool {
+	return cd.Header.Version == MPEG1
+}
+
+func NewCodecDataFromFrame(frame []byte) (self CodecData, err error) {
+	if self.Header, _, _, err = ParseFrameHeader(frame); err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,91 @@
+// Package mp3parser
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package mp3parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+)
+
+func TestParseFrameHeader(t *testing.T) {
+	values := []struct {
+		Header   []byte
+		Expected FrameHeader
+		FrameLen int
+		Samples  int
+	}{
+		// 128 kbit/s, 44.1 kHz, joint stereo
+		{[]byte{0xff, 0xfb, 0x90, 0x64}, FrameHeader{MPEG1, 128000, 44100, 2, false}, 417, 1152},
+		// padded, mono
+		{[]byte{0xff, 0xfb, 0x92, 0xc4}, FrameHeader{MPEG1, 128000, 44100, 1, true}, 418, 1152},
+		// 320 kbit/s, 48 kHz
+		{[]byte{0xff, 0xfb, 0xe4, 0x00}, FrameHeader{MPEG1, 320000, 48000, 2, false}, 960, 1152},
+		// MPEG-2 low sample rates
+		{[]byte{0xff, 0xf3, 0x80, 0xc4}, FrameHeader{MPEG2, 64000, 22050, 1, false}, 208, 576},
+		// MPEG-2.5
+		{[]byte{0xff, 0xe3, 0x18, 0xc4}, FrameHeader{MPEG25, 8000, 8000, 1, false}, 72, 576},
+	}
+	for _, ex := range values {
+		h, framelen, samples, err := ParseFrameHeader(ex.Header)
+		if err != nil {
+			t.Errorf("%x: %v", ex.Header, err)
+			continue
+		}
+		if h != ex.Expected || framelen != ex.FrameLen || samples != ex.Samples {
+			t.Errorf("%x: expected %+v %d %d, got %+v %d %d", ex.Header,
+				ex.Expected, ex.FrameLen, ex.Samples, h, framelen, samples)
+		}
+	}
+}
+
+func TestParseFrameHeaderErrors(t *testing.T) {
+	values := []struct {
+		Name   string
+		Header []byte
+	}{
+		{"short", []byte{0xff, 0xfb, 0x90}},
+		{"sync", []byte{0xff, 0x7b, 0x90, 0x64}},
+		{"reserved version", []byte{0xff, 0xeb, 0x90, 0x64}},
+		{"layer 2", []byte{0xff, 0xfd, 0x90, 0x64}},
+		{"layer 1", []byte{0xff, 0xff, 0x90, 0x64}},
+		{"free bitrate", []byte{0xff, 0xfb, 0x00, 0x64}},
+		{"bad bitrate", []byte{0xff, 0xfb, 0xf0, 0x64}},
+		{"reserved sample rate", []byte{0xff, 0xfb, 0x9c, 0x64}},
+	}
+	for _, ex := range values {
+		if _, _, _, err := ParseFrameHeader(ex.Header); err == nil {
+			t.Errorf("%s: expected an error", ex.Name)
+		}
+	}
+}
+
+func TestCodecData(t *testing.T) {
+	values := []struct {
+		Header   []byte
+		MPEG1    bool
+		Layout   av.ChannelLayout
+		Duration time.Duration
+	}{
+		{[]byte{0xff, 0xfb, 0x90, 0x64}, true, av.CH_STEREO, 1152 * time.Second / 44100},
+		{[]byte{0xff, 0xf3, 0x80, 0xc4}, false, av.CH_MONO, 576 * time.Second / 22050},
+	}
+	for _, ex := range values {
+		cd, err := NewCodecDataFromFrame(ex.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dur, err := cd.PacketDuration(ex.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cd.Type() != av.MP3 || cd.IsMPEG1() != ex.MPEG1 || cd.ChannelLayout() != ex.Layout || dur != ex.Duration {
+			t.Errorf("%x: got mpeg1=%v %v %s", ex.Header, cd.IsMPEG1(), cd.ChannelLayout(), dur)
+		}
+	}
+	if _, err := NewCodecDataFromFrame([]byte{0xff, 0xfb}); err == nil {
+		t.Error("expected an error for a short frame")
+	}
+}
@@ -0,0 +1,114 @@
+// Package dash
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+const (
+	ProfileLiveURN     = "urn:mpeg:dash:profile:isoff-live:2011"
+	ProfileOnDemandURN = "urn:mpeg:dash:profile:isoff-on-demand:2011"
+
+	channelConfigurationScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+)
+
+// MPD is the media presentation description, the subset of ISO/IEC
+// 23009-1 written by the Muxer.
+type MPD struct {
+	XMLName                   xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr,omitempty"`
+	AvailabilityStartTime     string   `xml:"availabilityStartTime,attr,omitempty"`
+	PublishTime               string   `xml:"publishTime,attr,omitempty"`
+	MinimumUpdatePeriod       string   `xml:"minimumUpdatePeriod,attr,omitempty"`
+	TimeShiftBufferDepth      string   `xml:"timeShiftBufferDepth,attr,omitempty"`
+	MaxSegmentDuration        string   `xml:"maxSegmentDuration,attr,omitempty"`
+	Periods                   []Period `xml:"Period"`
+}
+
+type Period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+type AdaptationSet struct {
+	ID               int              `xml:"id,attr"`
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	Representations  []Representation `xml:"Representation"`
+}
+
+type Representation struct {
+	ID                        string           `xml:"id,attr"`
+	Codecs                    string           `xml:"codecs,attr"`
+	Bandwidth                 int              `xml:"bandwidth,attr"`
+	Width                     int              `xml:"width,attr,omitempty"`
+	Height                    int              `xml:"height,attr,omitempty"`
+	AudioSamplingRate         int              `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannelConfiguration *Descriptor      `xml:"AudioChannelConfiguration"`
+	BaseURL                   string           `xml:"BaseURL,omitempty"`
+	SegmentBase               *SegmentBase     `xml:"SegmentBase"`
+	SegmentTemplate           *SegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type Descriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// SegmentBase addresses the subsegments of a single file through its sidx.
+type SegmentBase struct {
+	Timescale      uint32   `xml:"timescale,attr"`
+	IndexRange     string   `xml:"indexRange,attr"`
+	Initialization *URLType `xml:"Initialization"`
+}
+
+type URLType struct {
+	Range string `xml:"range,attr"`
+}
+
+type SegmentTemplate struct {
+	Timescale              uint32           `xml:"timescale,attr"`
+	PresentationTimeOffset uint64           `xml:"presentationTimeOffset,attr,omitempty"`
+	Initialization         string           `xml:"initialization,attr"`
+	Media                  string           `xml:"media,attr"`
+	StartNumber            uint64           `xml:"startNumber,attr,omitempty"`
+	SegmentTimeline        *SegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type SegmentTimeline struct {
+	S []S `xml:"S"`
+}
+
+// S is a run of R+1 segments of duration D starting at T.
+type S struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+func (m *MPD) Marshal() ([]byte, error) {
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// isoDuration formats d as an xs:duration.
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+func isoTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
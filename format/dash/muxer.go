@@ -0,0 +1,573 @@
+// Package dash
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package dash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/format/fmp4/timescale"
+	"github.com/teocci/go-stream-av/format/hls"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// Profile selects how segments are stored and addressed.
+type Profile int
+
+const (
+	// ProfileLive writes one file per segment, addressed by SegmentTemplate.
+	ProfileLive Profile = iota
+	// ProfileOnDemand writes one file per track with a sidx, addressed by
+	// SegmentBase. Only static presentations can use it.
+	ProfileOnDemand
+)
+
+// TemplateType is the identifier in the SegmentTemplate media URLs.
+type TemplateType int
+
+const (
+	TemplateNumber TemplateType = iota // $Number$
+	TemplateTime                       // $Time$
+)
+
+const (
+	DefaultSegmentDuration = 4 * time.Second
+	DefaultWindowSize      = 10
+	DefaultMPDName         = "manifest.mpd"
+	DefaultMasterName      = "master.m3u8"
+)
+
+// Muxer writes every audio and video stream as its own CMAF track, each in
+// its own adaptation set, and an MPD describing them. Segments are cut on
+// video keyframes once SegmentDuration is reached, at the same time on all
+// tracks. With HLS set the same segments are also listed in HLS media
+// playlists and a master playlist, so one set of files serves both.
+type Muxer struct {
+	Storage         hls.Storage
+	Profile         Profile
+	Template        TemplateType
+	Dynamic         bool // live presentation, the MPD is updated per segment
+	SegmentDuration time.Duration
+	WindowSize      int // segments listed by a dynamic MPD
+	MinBufferTime   time.Duration
+	MPDName         string
+	HLS             bool
+	MasterName      string
+
+	tracks   []*track // by stream index, nil for other streams
+	vidx     int
+	started  bool
+	origin   time.Duration // time of the first packet
+	segstart time.Duration
+	lastTime time.Duration
+	target   time.Duration // EXT-X-TARGETDURATION, fits every segment so far
+	ast      time.Time
+	master   []byte
+}
+
+type track struct {
+	id        string // representation id
+	cd        av.CodecData
+	frag      *fmp4.TrackFragmenter
+	timeScale uint32
+	init      []byte
+
+	started  bool
+	start    time.Duration // first packet of the segment in progress
+	last     time.Duration // last packet written, held by the fragmenter
+	lastDur  time.Duration // duration of the last packet
+	number   uint64        // number of the last segment, the first is 1
+	segments []segment
+	expired  []string
+	peak     int
+
+	fragments [][]byte // fragments of an on-demand file
+}
+
+type segment struct {
+	number   uint64
+	t, d     uint64 // in the track timescale
+	duration time.Duration
+	name     string
+	size     int
+}
+
+func NewMuxer(storage hls.Storage) *Muxer {
+	return &Muxer{
+		Storage:         storage,
+		SegmentDuration: DefaultSegmentDuration,
+		WindowSize:      DefaultWindowSize,
+		MinBufferTime:   2 * time.Second,
+		MPDName:         DefaultMPDName,
+		MasterName:      DefaultMasterName,
+	}
+}
+
+func (m *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	if m.tracks != nil {
+		return errors.New("dash: streams cannot change")
+	}
+	if m.Profile == ProfileOnDemand && (m.Dynamic || m.HLS) {
+		return errors.New("dash: the on-demand profile is static and DASH only")
+	}
+
+	m.vidx = -1
+	m.tracks = make([]*track, len(streams))
+	n := 0
+	for i, cd := range streams {
+		var kind string
+		switch {
+		case cd.Type().IsVideo():
+			kind = "video"
+			if m.vidx < 0 {
+				m.vidx = i
+			}
+		case cd.Type().IsAudio():
+			kind = "audio"
+		default:
+			continue
+		}
+
+		tr := &track{
+			id: fmt.Sprintf("%s%d", kind, i),
+			cd: cd,
+		}
+		if tr.frag, err = fmp4.NewTrack(cd); err != nil {
+			return
+		}
+		tr.timeScale = tr.frag.TimeScale()
+		_, _, tr.init = tr.frag.MovieHeader()
+		if m.Profile == ProfileLive {
+			if err = m.Storage.WriteFile(tr.initName(), tr.init); err != nil {
+				return
+			}
+		}
+		m.tracks[i] = tr
+		n++
+	}
+	if n == 0 {
+		err = errors.New("dash: no audio or video stream")
+	}
+	return
+}
+
+func (tr *track) initName() string {
+	return tr.id + "_init.mp4"
+}
+
+func (m *Muxer) mediaTemplate() string {
+	if m.Template == TemplateTime {
+		return "$RepresentationID$_$Time$.m4s"
+	}
+	return "$RepresentationID$_$Number$.m4s"
+}
+
+func (m *Muxer) mediaName(tr *track, seg segment) string {
+	name := strings.Replace(m.mediaTemplate(), "$RepresentationID$", tr.id, 1)
+	name = strings.Replace(name, "$Number$", strconv.FormatUint(seg.number, 10), 1)
+	return strings.Replace(name, "$Time$", strconv.FormatUint(seg.t, 10), 1)
+}
+
+func (m *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if m.tracks == nil {
+		return errors.New("dash: WriteHeader not called")
+	}
+	if int(pkt.Idx) >= len(m.tracks) || m.tracks[pkt.Idx] == nil {
+		return
+	}
+	tr := m.tracks[pkt.Idx]
+	if !m.started {
+		m.started = true
+		m.origin = pkt.Time
+		m.segstart = pkt.Time
+		m.ast = time.Now()
+	}
+
+	if err = tr.frag.WritePacket(pkt); err != nil {
+		return
+	}
+	if !tr.started {
+		tr.started = true
+		tr.start = pkt.Time
+	} else if pkt.Time > tr.last {
+		tr.lastDur = pkt.Time - tr.last
+	}
+	if pkt.Duration > 0 {
+		tr.lastDur = pkt.Duration
+	}
+	tr.last = pkt.Time
+	if pkt.Time > m.lastTime {
+		m.lastTime = pkt.Time
+	}
+
+	// the fragmenters hold back the packet just written, so the cut lands
+	// right before it
+	cut := m.vidx < 0 || (int(pkt.Idx) == m.vidx && pkt.IsKeyFrame)
+	if !cut || pkt.Time-m.segstart < m.SegmentDuration {
+		return
+	}
+	m.segstart = pkt.Time
+	for _, tr := range m.tracks {
+		if tr != nil {
+			if err = m.flushTrack(tr, tr.last); err != nil {
+				return
+			}
+		}
+	}
+	if m.Dynamic {
+		err = m.writeManifests(false)
+	}
+	return
+}
+
+// flushTrack ends the segment in progress of a track at end.
+func (m *Muxer) flushTrack(tr *track, end time.Duration) (err error) {
+	frag, err := tr.frag.Fragment()
+	if err != nil || len(frag.Bytes) == 0 {
+		return
+	}
+	tr.frag.NewSegment()
+
+	tr.number++
+	t := timescale.ToScale(tr.start, tr.timeScale)
+	seg := segment{
+		number:   tr.number,
+		t:        t,
+		d:        timescale.ToScale(end, tr.timeScale) - t,
+		duration: end - tr.start,
+		size:     len(frag.Bytes),
+	}
+	tr.start = end
+	m.target = hls.FitTarget(m.target, seg.duration)
+	if seg.duration > 0 {
+		if bw := int(float64(seg.size*8) / seg.duration.Seconds()); bw > tr.peak {
+			tr.peak = bw
+		}
+	}
+
+	if m.Profile == ProfileOnDemand {
+		tr.fragments = append(tr.fragments, stripSegmentType(frag.Bytes))
+		tr.segments = append(tr.segments, seg)
+		return
+	}
+
+	seg.name = m.mediaName(tr, seg)
+	if err = m.Storage.WriteFile(seg.name, frag.Bytes); err != nil {
+		return
+	}
+	tr.segments = append(tr.segments, seg)
+	if m.Dynamic && m.WindowSize > 0 {
+		for len(tr.segments) > m.WindowSize {
+			tr.expired = append(tr.expired, tr.segments[0].name)
+			tr.segments = tr.segments[1:]
+		}
+		// clients may still fetch what the previous MPD listed
+		for len(tr.expired) > m.WindowSize {
+			if err = m.Storage.Remove(tr.expired[0]); err != nil {
+				return
+			}
+			tr.expired = tr.expired[1:]
+		}
+	}
+	return
+}
+
+// stripSegmentType removes the styp that starts a segment, it has no place
+// in the middle of an on-demand file.
+func stripSegmentType(b []byte) []byte {
+	if len(b) >= 8 && fmp4io.Tag(pio.U32BE(b[4:])) == fmp4io.STYP {
+		return b[pio.U32BE(b):]
+	}
+	return b
+}
+
+// WriteTrailer writes the last segments and the final manifests.
+func (m *Muxer) WriteTrailer() (err error) {
+	if m.tracks == nil {
+		return
+	}
+	for _, tr := range m.tracks {
+		if tr != nil {
+			// the last packets end one packet duration later
+			end := tr.last + tr.lastDur
+			if err = m.flushTrack(tr, end); err != nil {
+				return
+			}
+			if end > m.lastTime {
+				m.lastTime = end
+			}
+		}
+	}
+	if m.Profile == ProfileOnDemand {
+		for _, tr := range m.tracks {
+			if tr != nil {
+				if err = m.Storage.WriteFile(tr.id+".mp4", m.onDemandFile(tr)); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return m.writeManifests(true)
+}
+
+// onDemandFile lays out the init section, a sidx with one reference per
+// segment, and the fragments. It records the byte ranges for the MPD.
+func (m *Muxer) onDemandFile(tr *track) []byte {
+	sidx := &fmp4io.SegmentIndex{
+		FullAtom:    fmp4io.FullAtom{Version: 1},
+		ReferenceID: tr.frag.TrackID(),
+		TimeScale:   tr.timeScale,
+	}
+	if len(tr.segments) != 0 {
+		sidx.EarliestPTS = tr.segments[0].t
+	}
+	for i, seg := range tr.segments {
+		sidx.References = append(sidx.References, fmp4io.SegmentReference{
+			ReferencedSize:     uint32(len(tr.fragments[i])),
+			SubsegmentDuration: uint32(seg.d),
+			StartsWithSAP:      true,
+			SAPType:            1,
+		})
+	}
+
+	b := make([]byte, len(tr.init)+sidx.Len())
+	copy(b, tr.init)
+	sidx.Marshal(b[len(tr.init):])
+	for _, frag := range tr.fragments {
+		b = append(b, frag...)
+	}
+	return b
+}
+
+func (m *Muxer) writeManifests(final bool) (err error) {
+	mpd := m.MPD(final)
+	var b []byte
+	if b, err = mpd.Marshal(); err != nil {
+		return
+	}
+	if err = m.Storage.WriteFile(m.MPDName, b); err != nil {
+		return
+	}
+	if m.HLS {
+		err = m.writeHLS(final)
+	}
+	return
+}
+
+// MPD returns the current manifest, final once the stream has ended.
+func (m *Muxer) MPD(final bool) *MPD {
+	mpd := &MPD{
+		Profiles:      ProfileLiveURN,
+		Type:          "static",
+		MinBufferTime: isoDuration(m.MinBufferTime),
+	}
+	if m.Profile == ProfileOnDemand {
+		mpd.Profiles = ProfileOnDemandURN
+	}
+	if m.Dynamic {
+		mpd.Type = "dynamic"
+		mpd.AvailabilityStartTime = isoTime(m.ast)
+		mpd.PublishTime = isoTime(time.Now())
+		if m.WindowSize > 0 {
+			mpd.TimeShiftBufferDepth = isoDuration(time.Duration(m.WindowSize) * m.SegmentDuration)
+		}
+		if !final {
+			mpd.MinimumUpdatePeriod = isoDuration(m.SegmentDuration)
+		}
+	}
+	if final {
+		// without minimumUpdatePeriod a dynamic MPD is not reloaded
+		mpd.MediaPresentationDuration = isoDuration(m.lastTime - m.origin)
+	}
+
+	period := Period{ID: "0", Start: isoDuration(0)}
+	var maxSegment time.Duration
+	for _, tr := range m.tracks {
+		if tr == nil {
+			continue
+		}
+		as := AdaptationSet{
+			ID:               len(period.AdaptationSets),
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+		rep := Representation{
+			ID:        tr.id,
+			Bandwidth: tr.peak,
+		}
+		rep.Codecs, _ = hls.CodecString(tr.cd)
+		switch cd := tr.cd.(type) {
+		case av.VideoCodecData:
+			as.ContentType = "video"
+			as.MimeType = "video/mp4"
+			rep.Width, rep.Height = cd.Width(), cd.Height()
+		case av.AudioCodecData:
+			rep.AudioSamplingRate = cd.SampleRate()
+			rep.AudioChannelConfiguration = &Descriptor{
+				SchemeIDURI: channelConfigurationScheme,
+				Value:       strconv.Itoa(cd.ChannelLayout().Count()),
+			}
+		}
+
+		if m.Profile == ProfileOnDemand {
+			sidxEnd := len(tr.init) + m.sidxLen(tr)
+			rep.BaseURL = tr.id + ".mp4"
+			rep.SegmentBase = &SegmentBase{
+				Timescale:      tr.timeScale,
+				IndexRange:     fmt.Sprintf("%d-%d", len(tr.init), sidxEnd-1),
+				Initialization: &URLType{Range: fmt.Sprintf("0-%d", len(tr.init)-1)},
+			}
+		} else {
+			st := &SegmentTemplate{
+				Timescale:              tr.timeScale,
+				PresentationTimeOffset: timescale.ToScale(m.origin, tr.timeScale),
+				Initialization:         "$RepresentationID$_init.mp4",
+				Media:                  m.mediaTemplate(),
+				SegmentTimeline:        &SegmentTimeline{},
+			}
+			if m.Template == TemplateNumber {
+				st.StartNumber = 1
+				if len(tr.segments) != 0 {
+					st.StartNumber = tr.segments[0].number
+				}
+			}
+			st.SegmentTimeline.S = timeline(tr.segments)
+			rep.SegmentTemplate = st
+		}
+		for _, seg := range tr.segments {
+			if seg.duration > maxSegment {
+				maxSegment = seg.duration
+			}
+		}
+
+		as.Representations = append(as.Representations, rep)
+		period.AdaptationSets = append(period.AdaptationSets, as)
+	}
+	if maxSegment != 0 {
+		mpd.MaxSegmentDuration = isoDuration(maxSegment)
+	}
+	mpd.Periods = []Period{period}
+	return mpd
+}
+
+func (m *Muxer) sidxLen(tr *track) int {
+	sidx := fmp4io.SegmentIndex{
+		FullAtom:   fmp4io.FullAtom{Version: 1},
+		References: make([]fmp4io.SegmentReference, len(tr.segments)),
+	}
+	return sidx.Len()
+}
+
+// timeline run length encodes the segment durations.
+func timeline(segments []segment) (s []S) {
+	for i, seg := range segments {
+		if n := len(s); n != 0 && s[n-1].D == seg.d && segments[i-1].t+segments[i-1].d == seg.t {
+			s[n-1].R++
+			continue
+		}
+		s = append(s, S{T: seg.t, D: seg.d})
+	}
+	return
+}
+
+// writeHLS lists the same segments in HLS media playlists, one per track,
+// and a master playlist with the audio tracks as an alternate group.
+func (m *Muxer) writeHLS(final bool) (err error) {
+	var video []*track
+	var audio []*track
+	for _, tr := range m.tracks {
+		if tr == nil {
+			continue
+		}
+		pl := hls.MediaPlaylist{
+			Version:             7,
+			TargetDuration:      hls.FitTarget(m.SegmentDuration, m.target),
+			IndependentSegments: true,
+			Ended:               final,
+		}
+		if !m.Dynamic {
+			pl.Type = hls.VOD
+		}
+		if len(tr.segments) != 0 {
+			pl.MediaSequence = tr.segments[0].number
+		}
+		for _, seg := range tr.segments {
+			pl.Segments = append(pl.Segments, hls.Segment{
+				URI:      seg.name,
+				Duration: seg.duration,
+				Map:      tr.initName(),
+			})
+		}
+		if err = m.Storage.WriteFile(tr.id+".m3u8", pl.Marshal()); err != nil {
+			return
+		}
+		if tr.cd.Type().IsVideo() {
+			video = append(video, tr)
+		} else {
+			audio = append(audio, tr)
+		}
+	}
+
+	master := hls.MasterPlaylist{Version: 7, IndependentSegments: true}
+	variants := video
+	group := ""
+	audioPeak := 0
+	if len(video) == 0 {
+		variants = audio
+	} else if len(audio) != 0 {
+		group = "audio"
+		for i, tr := range audio {
+			master.Media = append(master.Media, hls.Rendition{
+				Type:       "AUDIO",
+				GroupID:    group,
+				Name:       tr.id,
+				Default:    i == 0,
+				AutoSelect: true,
+				URI:        tr.id + ".m3u8",
+			})
+			if tr.peak > audioPeak {
+				audioPeak = tr.peak
+			}
+		}
+	}
+	for _, tr := range variants {
+		variant := hls.Variant{
+			URI:       tr.id + ".m3u8",
+			Bandwidth: tr.peak + audioPeak,
+			Audio:     group,
+		}
+		codecs := []av.CodecData{tr.cd}
+		if group != "" {
+			codecs = append(codecs, audio[0].cd)
+		}
+		for _, cd := range codecs {
+			if codec, err := hls.CodecString(cd); err == nil {
+				if variant.Codecs != "" {
+					variant.Codecs += ","
+				}
+				variant.Codecs += codec
+			}
+		}
+		if vcd, ok := tr.cd.(av.VideoCodecData); ok {
+			variant.Width, variant.Height = vcd.Width(), vcd.Height()
+		}
+		master.Variants = append(master.Variants, variant)
+	}
+
+	b := master.Marshal()
+	if bytes.Equal(b, m.master) {
+		return
+	}
+	m.master = b
+	return m.Storage.WriteFile(m.MasterName, b)
+}
@@ -0,0 +1,348 @@
+// Package dash
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package dash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/format/fmp4"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/format/hls"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// writeTestPackets writes 25fps video with a keyframe every second and one
+// audio packet per frame, from start until end.
+func writeTestPackets(t *testing.T, m *Muxer, start, end time.Duration) {
+	t.Helper()
+	for tm := start; tm < end; tm += 40 * time.Millisecond {
+		for idx := 0; idx < 2; idx++ {
+			pkt := av.Packet{Idx: int8(idx), Time: tm, Data: make([]byte, 100)}
+			if idx == 0 {
+				pkt.IsKeyFrame = tm%time.Second == 0
+				pio.PutU32BE(pkt.Data, uint32(len(pkt.Data)-4))
+				pkt.Data[4] = 0x41
+				if pkt.IsKeyFrame {
+					pkt.Data[4] = 0x65
+				}
+			}
+			if err := m.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func readMPD(t *testing.T, storage *hls.MemoryStorage) *MPD {
+	t.Helper()
+	b, ok := storage.ReadFile(DefaultMPDName)
+	if !ok {
+		t.Fatal("MPD not written")
+	}
+	mpd := &MPD{}
+	if err := xml.Unmarshal(b, mpd); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if len(mpd.Periods) != 1 || len(mpd.Periods[0].AdaptationSets) != 2 {
+		t.Fatalf("unexpected MPD\n%s", b)
+	}
+	return mpd
+}
+
+func TestMuxerStatic(t *testing.T) {
+	storage := hls.NewMemoryStorage()
+	m := NewMuxer(storage)
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 10*time.Second)
+	if _, ok := storage.ReadFile(DefaultMPDName); ok {
+		t.Error("a static MPD is written by WriteTrailer only")
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	mpd := readMPD(t, storage)
+	if mpd.Type != "static" || mpd.Profiles != ProfileLiveURN || mpd.MediaPresentationDuration != "PT10.000S" || mpd.MinimumUpdatePeriod != "" {
+		t.Errorf("unexpected MPD %+v", mpd)
+	}
+	if mpd.MaxSegmentDuration != "PT4.000S" {
+		t.Errorf("maxSegmentDuration=%s", mpd.MaxSegmentDuration)
+	}
+
+	video := mpd.Periods[0].AdaptationSets[0]
+	rep := video.Representations[0]
+	if video.ContentType != "video" || video.MimeType != "video/mp4" || rep.ID != "video0" || rep.Codecs != "avc1.42c01e" || rep.Width != 1280 || rep.Height != 720 || rep.Bandwidth == 0 {
+		t.Errorf("unexpected video representation %+v", rep)
+	}
+	st := rep.SegmentTemplate
+	if st == nil || st.Timescale != 90000 || st.StartNumber != 1 || st.Initialization != "$RepresentationID$_init.mp4" || st.Media != "$RepresentationID$_$Number$.m4s" {
+		t.Fatalf("unexpected SegmentTemplate %+v", st)
+	}
+	// two 4s segments in one run, then the last 2s
+	want := []S{{T: 0, D: 4 * 90000, R: 1}, {T: 8 * 90000, D: 2 * 90000}}
+	if fmt.Sprint(st.SegmentTimeline.S) != fmt.Sprint(want) {
+		t.Errorf("SegmentTimeline %v, want %v", st.SegmentTimeline.S, want)
+	}
+
+	audio := mpd.Periods[0].AdaptationSets[1]
+	rep = audio.Representations[0]
+	if audio.ContentType != "audio" || rep.Codecs != "mp4a.40.2" || rep.AudioSamplingRate != 44100 || rep.AudioChannelConfiguration == nil || rep.AudioChannelConfiguration.Value != "2" {
+		t.Errorf("unexpected audio representation %+v", rep)
+	}
+	if st := rep.SegmentTemplate; st == nil || st.Timescale != 48000 || len(st.SegmentTimeline.S) == 0 {
+		t.Errorf("unexpected audio SegmentTemplate %+v", st)
+	}
+
+	for _, name := range []string{"video0_init.mp4", "audio1_init.mp4", "video0_1.m4s", "video0_3.m4s", "audio1_3.m4s"} {
+		if _, ok := storage.ReadFile(name); !ok {
+			t.Errorf("%s not stored", name)
+		}
+	}
+}
+
+func TestMuxerTimeTemplate(t *testing.T) {
+	storage := hls.NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Template = TemplateTime
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 10*time.Second)
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := readMPD(t, storage).Periods[0].AdaptationSets[0].Representations[0].SegmentTemplate
+	if st.Media != "$RepresentationID$_$Time$.m4s" || st.StartNumber != 0 {
+		t.Errorf("unexpected SegmentTemplate %+v", st)
+	}
+	for _, tm := range []int{0, 4, 8} {
+		if name := fmt.Sprintf("video0_%d.m4s", tm*90000); !hasFile(storage, name) {
+			t.Errorf("%s not stored", name)
+		}
+	}
+}
+
+func hasFile(storage *hls.MemoryStorage, name string) bool {
+	_, ok := storage.ReadFile(name)
+	return ok
+}
+
+func TestMuxerDynamic(t *testing.T) {
+	storage := hls.NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Dynamic = true
+	m.WindowSize = 2
+	m.SegmentDuration = 2 * time.Second
+	m.HLS = true
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 12*time.Second)
+
+	// five segments are complete, the window keeps the last two
+	mpd := readMPD(t, storage)
+	if mpd.Type != "dynamic" || mpd.MinimumUpdatePeriod != "PT2.000S" || mpd.TimeShiftBufferDepth != "PT4.000S" || mpd.AvailabilityStartTime == "" || mpd.MediaPresentationDuration != "" {
+		t.Errorf("unexpected MPD %+v", mpd)
+	}
+	st := mpd.Periods[0].AdaptationSets[0].Representations[0].SegmentTemplate
+	if st.StartNumber != 4 || len(st.SegmentTimeline.S) != 1 || st.SegmentTimeline.S[0] != (S{T: 6 * 90000, D: 2 * 90000, R: 1}) {
+		t.Errorf("unexpected SegmentTemplate %+v %v", st, st.SegmentTimeline.S)
+	}
+	// segments that left the window are removed one window later
+	for i, name := range []string{"video0_1.m4s", "video0_2.m4s", "video0_5.m4s"} {
+		if hasFile(storage, name) != (i > 0) {
+			t.Errorf("%s stored=%v", name, i == 0)
+		}
+	}
+
+	// the HLS playlists list the same segments
+	b, _ := storage.ReadFile("video0.m3u8")
+	p, err := hls.ParseMediaPlaylist(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MediaSequence != 4 || len(p.Segments) != 2 || p.Segments[0].URI != "video0_4.m4s" || p.Segments[0].Map != "video0_init.mp4" || p.Ended {
+		t.Errorf("unexpected media playlist %+v", p)
+	}
+	b, _ = storage.ReadFile(DefaultMasterName)
+	master, err := hls.ParseMasterPlaylist(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(master.Variants) != 1 || len(master.Media) != 1 || master.Variants[0].Codecs != "avc1.42c01e,mp4a.40.2" || master.Variants[0].Audio != "audio" || master.Media[0].URI != "audio1.m3u8" {
+		t.Errorf("unexpected master playlist\n%s", b)
+	}
+
+	if err = m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if mpd = readMPD(t, storage); mpd.MinimumUpdatePeriod != "" || mpd.MediaPresentationDuration != "PT12.000S" {
+		t.Errorf("unexpected final MPD %+v", mpd)
+	}
+}
+
+func TestMuxerOnDemand(t *testing.T) {
+	storage := hls.NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Profile = ProfileOnDemand
+	m.SegmentDuration = 2 * time.Second
+	streams := testStreams(t)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 10*time.Second)
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	mpd := readMPD(t, storage)
+	if mpd.Profiles != ProfileOnDemandURN {
+		t.Errorf("profiles=%s", mpd.Profiles)
+	}
+	for i, as := range mpd.Periods[0].AdaptationSets {
+		rep := as.Representations[0]
+		sb := rep.SegmentBase
+		if sb == nil || rep.SegmentTemplate != nil {
+			t.Fatalf("unexpected representation %+v", rep)
+		}
+		b, ok := storage.ReadFile(rep.BaseURL)
+		if !ok {
+			t.Fatalf("%s not stored", rep.BaseURL)
+		}
+
+		var start, end int
+		fmt.Sscanf(sb.Initialization.Range, "0-%d", &end)
+		if init, err := fmp4.ParseInit(b[:end+1]); err != nil || len(init.Streams()) != 1 {
+			t.Errorf("%s: Initialization range %s: %v", rep.ID, sb.Initialization.Range, err)
+		}
+		fmt.Sscanf(sb.IndexRange, "%d-%d", &start, &end)
+		sidx := &fmp4io.SegmentIndex{}
+		if _, err := sidx.Unmarshal(b[start:end+1], 0); err != nil {
+			t.Fatal(err)
+		}
+		if sidx.TimeScale != sb.Timescale || sidx.ReferenceID == 0 || len(sidx.References) != 5 {
+			t.Fatalf("%s: unexpected sidx %+v", rep.ID, sidx)
+		}
+		// the references follow the sidx and each start with a moof
+		offset := end + 1 + int(sidx.FirstOffset)
+		var duration uint64
+		for _, ref := range sidx.References {
+			if !ref.StartsWithSAP || ref.SAPType != 1 || ref.ReferencesBox {
+				t.Errorf("%s: unexpected reference %+v", rep.ID, ref)
+			}
+			if tag := fmp4io.Tag(pio.U32BE(b[offset+4:])); tag != fmp4io.MOOF {
+				t.Errorf("%s: reference at %d starts with %v", rep.ID, offset, tag)
+			}
+			offset += int(ref.ReferencedSize)
+			duration += uint64(ref.SubsegmentDuration)
+		}
+		if offset != len(b) {
+			t.Errorf("%s: references end at %d of %d bytes", rep.ID, offset, len(b))
+		}
+		if want := uint64(10000) * uint64(sb.Timescale) / 1000; i == 0 && duration != want {
+			t.Errorf("%s: references last %d, want %d", rep.ID, duration, want)
+		}
+
+		// the whole file demuxes
+		d := fmp4.NewDemuxer(bytes.NewReader(b))
+		n := 0
+		for {
+			if _, err := d.ReadPacket(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", rep.ID, err)
+			}
+			n++
+		}
+		if n < 249 {
+			t.Errorf("%s: demuxed %d packets", rep.ID, n)
+		}
+	}
+	if len(storage.Files()) != 3 {
+		t.Errorf("stored %v, want one file per track and the MPD", storage.Files())
+	}
+}
+
+func TestMuxerHLSTargetDuration(t *testing.T) {
+	storage := hls.NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.HLS = true
+	if err := m.WriteHeader(testStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// a keyframe every 3s, so 4s segments are cut every 6s
+	for tm := time.Duration(0); tm < 14*time.Second; tm += 40 * time.Millisecond {
+		pkt := av.Packet{Time: tm, IsKeyFrame: tm%(3*time.Second) == 0, Data: make([]byte, 100)}
+		pio.PutU32BE(pkt.Data, uint32(len(pkt.Data)-4))
+		pkt.Data[4] = 0x41
+		if pkt.IsKeyFrame {
+			pkt.Data[4] = 0x65
+		}
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := storage.ReadFile("video0.m3u8")
+	p, err := hls.ParseMediaPlaylist(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{6 * time.Second, 6 * time.Second, 2 * time.Second}
+	if p.TargetDuration != 6*time.Second || len(p.Segments) != len(want) {
+		t.Fatalf("unexpected media playlist\n%s", b)
+	}
+	for i, seg := range p.Segments {
+		if seg.Duration != want[i] {
+			t.Errorf("segment %d lasts %s, want %s", i, seg.Duration, want[i])
+		}
+	}
+}
+
+func TestMuxerProfileErrors(t *testing.T) {
+	m := NewMuxer(hls.NewMemoryStorage())
+	m.Profile = ProfileOnDemand
+	m.Dynamic = true
+	if err := m.WriteHeader(testStreams(t)); err == nil || !strings.Contains(err.Error(), "static") {
+		t.Errorf("expected an error for a dynamic on-demand MPD, got %v", err)
+	}
+	m = NewMuxer(hls.NewMemoryStorage())
+	if err := m.WritePacket(av.Packet{}); err == nil {
+		t.Error("expected an error before WriteHeader")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/av/avutil"
@@ -20,6 +21,10 @@ import (
 
 var MaxProbePacketCount = 20
 
+// MaxKeyframeIndexSize is the number of keyframes reserved in onMetaData when
+// the muxer output is seekable. Longer recordings get a sparser index.
+var MaxKeyframeIndexSize = 2000
+
 func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err error) {
 	metadata = flvio.AMFMap{}
 
@@ -318,9 +323,18 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 }
 
 type Muxer struct {
-	bufw    writeFlusher
-	b       []byte
-	streams []av.CodecData
+	bufw      *countWriter
+	b         []byte
+	streams   []av.CodecData
+	ws        io.WriteSeeker
+	base      int64
+	metadata  flvio.AMFMap
+	metapos   int64
+	metasize  int
+	keyframes []keyframe
+	videosize int64
+	audiosize int64
+	duration  time.Duration
 }
 
 type writeFlusher interface {
@@ -328,15 +342,31 @@ type writeFlusher interface {
 	Flush() error
 }
 
+type countWriter struct {
+	writeFlusher
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (n int, err error) {
+	n, err = w.writeFlusher.Write(b)
+	w.n += int64(n)
+	return
+}
+
 func NewMuxerWriteFlusher(w writeFlusher) *Muxer {
 	return &Muxer{
-		bufw: w,
+		bufw: &countWriter{writeFlusher: w},
 		b:    make([]byte, 256),
 	}
 }
 
+// NewMuxer creates a muxer writing to w. When w is an io.WriteSeeker,
+// WriteTrailer rewrites onMetaData with duration, filesize, data rates and
+// the keyframes index so that players can seek in the file.
 func NewMuxer(w io.Writer) *Muxer {
-	return NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
+	self := NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
+	self.ws, _ = w.(io.WriteSeeker)
+	return self
 }
 
 var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX}
@@ -351,11 +381,31 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 		}
 	}
 
+	if self.ws != nil {
+		if self.base, err = self.ws.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+
 	n := flvio.FillFileHeader(self.b, flags)
 	if _, err = self.bufw.Write(self.b[:n]); err != nil {
 		return
 	}
 
+	if self.metadata, err = NewMetadataByStreams(streams); err != nil {
+		return
+	}
+	self.metapos = self.bufw.n
+	if self.ws != nil {
+		// reserve room for the final metadata, see WriteTrailer
+		metadata := self.finalMetadata(MaxKeyframeIndexSize)
+		metadata["reserved"] = ""
+		self.metasize = lenScriptData(metadata)
+	}
+	if err = self.writeMetadata(self.bufw, self.metadata); err != nil {
+		return
+	}
+
 	for _, stream := range streams {
 		var tag flvio.Tag
 		var ok bool
@@ -377,6 +427,21 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 	stream := self.streams[pkt.Idx]
 	tag, timestamp := PacketToTag(pkt, stream)
 
+	if stream.Type().IsVideo() {
+		if pkt.IsKeyFrame {
+			self.addKeyframe(pkt.Time)
+		}
+		self.videosize += int64(len(pkt.Data))
+	} else {
+		if !self.hasVideo() && (len(self.keyframes) == 0 || pkt.Time-self.keyframes[len(self.keyframes)-1].time >= time.Second) {
+			self.addKeyframe(pkt.Time)
+		}
+		self.audiosize += int64(len(pkt.Data))
+	}
+	if pkt.Time > self.duration {
+		self.duration = pkt.Time
+	}
+
 	if err = flvio.WriteTag(self.bufw, tag, timestamp, self.b); err != nil {
 		return
 	}
@@ -387,24 +452,217 @@ func (self *Muxer) WriteTrailer() (err error) {
 	if err = self.bufw.Flush(); err != nil {
 		return
 	}
+	if self.ws == nil {
+		return
+	}
+
+	size := len(self.keyframes)
+	if size > MaxKeyframeIndexSize {
+		size = MaxKeyframeIndexSize
+	}
+	if _, err = self.ws.Seek(self.base+self.metapos, io.SeekStart); err != nil {
+		return
+	}
+	if err = self.writeMetadata(self.ws, self.finalMetadata(size)); err != nil {
+		return
+	}
+	if _, err = self.ws.Seek(0, io.SeekEnd); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Muxer) hasVideo() bool {
+	for _, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// addKeyframe records the position of the tag about to be written.
+func (self *Muxer) addKeyframe(tm time.Duration) {
+	self.keyframes = append(self.keyframes, keyframe{time: tm, pos: self.bufw.n})
+}
+
+// finalMetadata returns the stream metadata completed with what is known once
+// all packets are written, with the keyframes index reduced to size entries.
+func (self *Muxer) finalMetadata(size int) flvio.AMFMap {
+	metadata := flvio.AMFMap{}
+	for k, v := range self.metadata {
+		metadata[k] = v
+	}
+
+	times := flvio.AMFArray{}
+	positions := flvio.AMFArray{}
+	if size > 0 {
+		step := float64(len(self.keyframes)) / float64(size)
+		for i := 0; i < size; i++ {
+			var kf keyframe
+			if j := int(float64(i) * step); j < len(self.keyframes) {
+				kf = self.keyframes[j]
+			}
+			times = append(times, kf.time.Seconds())
+			positions = append(positions, float64(kf.pos))
+		}
+	}
+
+	duration := self.duration.Seconds()
+	datarate := func(size int64) float64 {
+		if duration <= 0 {
+			return 0
+		}
+		return float64(size) * 8 / 1000 / duration
+	}
+
+	metadata["duration"] = duration
+	metadata["filesize"] = float64(self.bufw.n)
+	metadata["videodatarate"] = datarate(self.videosize)
+	metadata["audiodatarate"] = datarate(self.audiosize)
+	metadata["hasKeyframes"] = len(self.keyframes) > 0
+	metadata["keyframes"] = flvio.AMFMap{
+		"times":         times,
+		"filepositions": positions,
+	}
+	return metadata
+}
+
+func lenScriptData(metadata flvio.AMFMap) int {
+	return flvio.LenAMF0Val("onMetaData") + flvio.LenAMF0Val(flvio.AMFECMAArray(metadata))
+}
+
+// writeMetadata writes the onMetaData tag, padded to the reserved size if any.
+func (self *Muxer) writeMetadata(w io.Writer, _metadata flvio.AMFMap) (err error) {
+	metadata := flvio.AMFMap{}
+	for k, v := range _metadata {
+		metadata[k] = v
+	}
+	if self.metasize > 0 {
+		// AMF0 strings over 65535 bytes have a longer header, pad with
+		// several short ones, leaving room for the next key each time
+		for i := 0; ; i++ {
+			key := "reserved"
+			if i > 0 {
+				key = fmt.Sprintf("reserved%d", i)
+			}
+			metadata[key] = ""
+			pad := self.metasize - lenScriptData(metadata)
+			if pad <= 0xffff {
+				if pad > 0 {
+					metadata[key] = string(make([]byte, pad))
+				}
+				break
+			}
+			metadata[key] = string(make([]byte, 0xff00))
+		}
+	}
+
+	b := make([]byte, lenScriptData(metadata))
+	n := flvio.FillAMF0Val(b, "onMetaData")
+	n += flvio.FillAMF0Val(b[n:], flvio.AMFECMAArray(metadata))
+
+	tag := flvio.Tag{
+		Type: flvio.TAG_SCRIPTDATA,
+		Data: b[:n],
+	}
+	if err = flvio.WriteTag(w, tag, 0, self.b); err != nil {
+		return
+	}
 	return
 }
 
 type Demuxer struct {
-	prober *Prober
-	bufr   *bufio.Reader
-	b      []byte
-	stage  int
+	prober    *Prober
+	r         io.Reader
+	bufr      *bufio.Reader
+	b         []byte
+	stage     int
+	pos       int64
+	bodypos   int64
+	metadata  flvio.AMFMap
+	keyframes []keyframe
+	scanned   bool
+	curtime   time.Duration
+}
+
+type keyframe struct {
+	time time.Duration
+	pos  int64
 }
 
+// NewDemuxer creates a forward-only demuxer, SeekToTime works when r is an io.ReadSeeker.
 func NewDemuxer(r io.Reader) *Demuxer {
 	return &Demuxer{
+		r:      r,
 		bufr:   bufio.NewReaderSize(r, pio.RecommendBufioSize),
 		prober: &Prober{},
 		b:      make([]byte, 256),
 	}
 }
 
+type posReader struct {
+	*Demuxer
+}
+
+func (r posReader) Read(b []byte) (n int, err error) {
+	n, err = r.bufr.Read(b)
+	r.pos += int64(n)
+	return
+}
+
+// readTag reads the next tag and keeps track of its position and onMetaData.
+func (self *Demuxer) readTag() (tag flvio.Tag, timestamp int32, err error) {
+	if tag, timestamp, err = flvio.ReadTag(posReader{self}, self.b); err != nil {
+		return
+	}
+	if tag.Type == flvio.TAG_SCRIPTDATA {
+		self.parseScriptData(tag.Data)
+	}
+	return
+}
+
+func (self *Demuxer) parseScriptData(b []byte) {
+	name, n, err := flvio.ParseAMF0Val(b)
+	if err != nil || name != "onMetaData" {
+		return
+	}
+	val, _, err := flvio.ParseAMF0Val(b[n:])
+	if err != nil {
+		return
+	}
+	metadata, ok := val.(flvio.AMFMap)
+	if !ok {
+		return
+	}
+	self.metadata = metadata
+
+	obj, _ := metadata["keyframes"].(flvio.AMFMap)
+	times, _ := obj["times"].(flvio.AMFArray)
+	positions, _ := obj["filepositions"].(flvio.AMFArray)
+	if len(times) == 0 || len(times) != len(positions) || self.scanned {
+		return
+	}
+	self.keyframes = self.keyframes[:0]
+	for i := range times {
+		tm, _ := times[i].(float64)
+		pos, _ := positions[i].(float64)
+		self.keyframes = append(self.keyframes, keyframe{
+			time: time.Duration(tm * float64(time.Second)),
+			pos:  int64(pos),
+		})
+	}
+}
+
+// Metadata returns the onMetaData object, if one was found while probing.
+func (self *Demuxer) Metadata() (metadata flvio.AMFMap, err error) {
+	if err = self.prepare(); err != nil {
+		return
+	}
+	metadata = self.metadata
+	return
+}
+
 func (self *Demuxer) prepare() (err error) {
 	for self.stage < 2 {
 		switch self.stage {
@@ -420,6 +678,8 @@ func (self *Demuxer) prepare() (err error) {
 			if _, err = self.bufr.Discard(skip); err != nil {
 				return
 			}
+			self.pos = int64(flvio.FileHeaderLength + skip)
+			self.bodypos = self.pos
 			if flags&flvio.FILE_HAS_AUDIO != 0 {
 				self.prober.HasAudio = true
 			}
@@ -432,7 +692,7 @@ func (self *Demuxer) prepare() (err error) {
 			for !self.prober.Probed() {
 				var tag flvio.Tag
 				var timestamp int32
-				if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
+				if tag, timestamp, err = self.readTag(); err != nil {
 					return
 				}
 				if err = self.prober.PushTag(tag, timestamp); err != nil {
@@ -460,18 +720,20 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 
 	if !self.prober.Empty() {
 		pkt = self.prober.PopPacket()
+		self.curtime = pkt.Time
 		return
 	}
 
 	for {
 		var tag flvio.Tag
 		var timestamp int32
-		if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
+		if tag, timestamp, err = self.readTag(); err != nil {
 			return
 		}
 
 		var ok bool
 		if pkt, ok = self.prober.TagToPacket(tag, timestamp); ok {
+			self.curtime = pkt.Time
 			return
 		}
 	}
@@ -479,6 +741,142 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 	return
 }
 
+// CurrentTime returns the time of the last packet read or of the seek position.
+func (self *Demuxer) CurrentTime() (tm time.Duration) {
+	return self.curtime
+}
+
+// SeekToTime moves to the last video keyframe at or before tm, so the next
+// ReadPacket starts a decodable GOP. The onMetaData keyframes index is used
+// when present, otherwise the tags are scanned once to build it.
+func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	rs, ok := self.r.(io.ReadSeeker)
+	if !ok {
+		err = fmt.Errorf("flv: SeekToTime needs an io.ReadSeeker")
+		return
+	}
+	if err = self.prepare(); err != nil {
+		return
+	}
+
+	if len(self.keyframes) == 0 && !self.scanned {
+		if err = self.scanKeyframes(rs); err != nil {
+			return
+		}
+	}
+
+	kf := keyframe{pos: self.bodypos}
+	for _, k := range self.keyframes {
+		if k.time > tm {
+			break
+		}
+		kf = k
+	}
+
+	if err = self.seekTo(rs, kf.pos); err != nil {
+		if self.scanned {
+			return
+		}
+		// onMetaData positions do not point at tags, fall back to scanning
+		if err = self.scanKeyframes(rs); err != nil {
+			return
+		}
+		return self.SeekToTime(tm)
+	}
+
+	self.prober.CachedPkts = nil
+	self.curtime = kf.time
+	return
+}
+
+// seekTo moves to pos after checking that a tag header starts there.
+func (self *Demuxer) seekTo(rs io.ReadSeeker, pos int64) (err error) {
+	if err = self.checkTagAt(rs, pos); err != nil {
+		self.restorePos(rs)
+		return
+	}
+	if _, err = rs.Seek(pos, io.SeekStart); err != nil {
+		return
+	}
+	self.bufr.Reset(rs)
+	self.pos = pos
+	return
+}
+
+func (self *Demuxer) checkTagAt(rs io.ReadSeeker, pos int64) (err error) {
+	if _, err = rs.Seek(pos, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(rs, self.b[:flvio.TagHeaderLength]); err != nil {
+		return
+	}
+	if _, _, _, err = flvio.ParseTagHeader(self.b); err != nil {
+		return
+	}
+	if pio.U24BE(self.b[8:11]) != 0 {
+		err = fmt.Errorf("flv: tag streamid invalid at pos=%d", pos)
+		return
+	}
+	return
+}
+
+// restorePos puts rs back where the buffered reader expects it.
+func (self *Demuxer) restorePos(rs io.ReadSeeker) {
+	if _, err := rs.Seek(self.pos, io.SeekStart); err == nil {
+		self.bufr.Reset(rs)
+	}
+}
+
+// scanKeyframes builds the keyframe index by walking the tag headers.
+// Without a video stream every audio tag is a sync point.
+func (self *Demuxer) scanKeyframes(rs io.ReadSeeker) (err error) {
+	defer self.restorePos(rs)
+
+	self.keyframes = self.keyframes[:0]
+	self.scanned = true
+	audioonly := !self.prober.GotVideo
+
+	b := self.b[:flvio.TagHeaderLength+2]
+	pos := self.bodypos
+	for {
+		if _, err = rs.Seek(pos, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(rs, b); err != nil {
+			break
+		}
+		var tag flvio.Tag
+		var timestamp int32
+		var datalen int
+		if tag, timestamp, datalen, err = flvio.ParseTagHeader(b); err != nil {
+			break
+		}
+		sync := false
+		switch tag.Type {
+		case flvio.TAG_VIDEO:
+			frametype := b[flvio.TagHeaderLength] >> 4
+			sync = datalen >= 2 && frametype == flvio.FRAME_KEY && b[flvio.TagHeaderLength+1] == flvio.AVC_NALU
+		case flvio.TAG_AUDIO:
+			soundformat := b[flvio.TagHeaderLength] >> 4
+			sync = audioonly && !(soundformat == flvio.SOUND_AAC && b[flvio.TagHeaderLength+1] == flvio.AAC_SEQHDR)
+		}
+		if sync {
+			self.keyframes = append(self.keyframes, keyframe{
+				time: flvio.TsToTime(timestamp),
+				pos:  pos,
+			})
+		}
+		pos += int64(flvio.TagHeaderLength + datalen + flvio.TagTrailerLength)
+	}
+
+	// a truncated last tag only ends the scan
+	err = nil
+	if len(self.keyframes) == 0 {
+		err = fmt.Errorf("flv: no keyframes found")
+	}
+	return
+}
+
 func Handler(h *avutil.RegisterHandler) {
 	h.Probe = func(b []byte) bool {
 		return b[0] == 'F' && b[1] == 'L' && b[2] == 'V'
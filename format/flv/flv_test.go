@@ -0,0 +1,255 @@
+// Package flv
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package flv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+)
+
+// memFile is an in-memory io.ReadWriteSeeker.
+type memFile struct {
+	b   []byte
+	pos int64
+}
+
+func (f *memFile) Write(b []byte) (n int, err error) {
+	if end := f.pos + int64(len(b)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	n = copy(f.b[f.pos:], b)
+	f.pos += int64(n)
+	return
+}
+
+func (f *memFile) Read(b []byte) (n int, err error) {
+	if f.pos >= int64(len(f.b)) {
+		err = io.EOF
+		return
+	}
+	n = copy(b, f.b[f.pos:])
+	f.pos += int64(n)
+	return
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.b))
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// writeOnly hides the Seek method of the underlying writer.
+type writeOnly struct {
+	io.Writer
+}
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// muxTestFile writes count frames 40ms apart to w, a keyframe every gop
+// frames when there is video, each followed by an audio packet.
+func muxTestFile(t *testing.T, w io.Writer, streams []av.CodecData, count, gop int) {
+	m := NewMuxer(w)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		for idx, stream := range streams {
+			pkt := av.Packet{
+				Idx:        int8(idx),
+				IsKeyFrame: stream.Type().IsVideo() && i%gop == 0,
+				Time:       time.Duration(i) * 40 * time.Millisecond,
+				Data:       []byte{byte(idx), byte(i), byte(i >> 8)},
+			}
+			if err := m.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSeek seeks to tm and checks that the next packet is the one at want,
+// a video keyframe unless the file is audio only.
+func checkSeek(t *testing.T, d *Demuxer, tm, want time.Duration, video bool) {
+	t.Helper()
+	if err := d.SeekToTime(tm); err != nil {
+		t.Fatal(err)
+	}
+	if d.CurrentTime() != want {
+		t.Errorf("seeking to %s: current time %s, want %s", tm, d.CurrentTime(), want)
+	}
+	pkt, err := d.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Time != want || (video && (pkt.Idx != 0 || !pkt.IsKeyFrame)) {
+		t.Errorf("seeking to %s: got packet %d key=%v at %s, want %s", tm, pkt.Idx, pkt.IsKeyFrame, pkt.Time, want)
+	}
+	if i := int(pkt.Data[1]) | int(pkt.Data[2])<<8; time.Duration(i)*40*time.Millisecond != pkt.Time {
+		t.Errorf("seeking to %s: packet %d has time %s", tm, i, pkt.Time)
+	}
+}
+
+func TestSeekToTimeIndex(t *testing.T) {
+	f := &memFile{}
+	muxTestFile(t, f, testStreams(t), 250, 25)
+
+	d := NewDemuxer(bytes.NewReader(f.b))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.keyframes) != 10 {
+		t.Fatalf("expected 10 keyframes in onMetaData, got %d", len(d.keyframes))
+	}
+	checkSeek(t, d, 3500*time.Millisecond, 3*time.Second, true)
+	checkSeek(t, d, 9*time.Second, 9*time.Second, true)
+	checkSeek(t, d, 0, 0, true)
+	checkSeek(t, d, time.Hour, 9*time.Second, true)
+	if d.scanned {
+		t.Error("the tags were scanned although onMetaData has an index")
+	}
+}
+
+func TestSeekToTimeScan(t *testing.T) {
+	var b bytes.Buffer
+	muxTestFile(t, writeOnly{&b}, testStreams(t), 250, 25)
+
+	d := NewDemuxer(bytes.NewReader(b.Bytes()))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.keyframes) != 0 {
+		t.Fatalf("expected no keyframes in onMetaData, got %d", len(d.keyframes))
+	}
+	checkSeek(t, d, 5100*time.Millisecond, 5*time.Second, true)
+	if !d.scanned || len(d.keyframes) != 10 {
+		t.Errorf("expected 10 scanned keyframes, got %d", len(d.keyframes))
+	}
+	checkSeek(t, d, 999*time.Millisecond, 0, true)
+}
+
+func TestSeekToTimeBadIndex(t *testing.T) {
+	f := &memFile{}
+	muxTestFile(t, f, testStreams(t), 250, 25)
+
+	d := NewDemuxer(bytes.NewReader(f.b))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	// positions that do not point at tags make it scan
+	for i := range d.keyframes {
+		d.keyframes[i].pos += 3
+	}
+	checkSeek(t, d, 2*time.Second, 2*time.Second, true)
+	if !d.scanned {
+		t.Error("expected a scan after a bad onMetaData index")
+	}
+}
+
+func TestSeekToTimeAudioOnly(t *testing.T) {
+	var b bytes.Buffer
+	muxTestFile(t, writeOnly{&b}, testStreams(t)[1:], 100, 1)
+
+	d := NewDemuxer(bytes.NewReader(b.Bytes()))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	// every audio tag is a sync point
+	checkSeek(t, d, 1010*time.Millisecond, 1*time.Second, false)
+	if len(d.keyframes) != 100 {
+		t.Errorf("expected 100 scanned sync points, got %d", len(d.keyframes))
+	}
+}
+
+func TestSeekToTimeNotSeekable(t *testing.T) {
+	var b bytes.Buffer
+	muxTestFile(t, writeOnly{&b}, testStreams(t), 10, 5)
+
+	d := NewDemuxer(&b)
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SeekToTime(0); err == nil {
+		t.Error("expected an error seeking in an io.Reader")
+	}
+}
+
+func TestTrailerRewrite(t *testing.T) {
+	defer func(n int) { MaxKeyframeIndexSize = n }(MaxKeyframeIndexSize)
+
+	// with a large index the onMetaData written first needs more than
+	// 65535 bytes of padding, the final one hardly any
+	for _, c := range []struct{ size, count, gop int }{
+		{2000, 250, 25},
+		{4000, 4000, 1},
+	} {
+		MaxKeyframeIndexSize = c.size
+		f := &memFile{}
+		muxTestFile(t, f, testStreams(t), c.count, c.gop)
+
+		d := NewDemuxer(bytes.NewReader(f.b))
+		metadata, err := d.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration := (time.Duration(c.count-1) * 40 * time.Millisecond).Seconds()
+		if v, _ := metadata["duration"].(float64); v != duration {
+			t.Errorf("index size %d: duration %v, want %v", c.size, metadata["duration"], duration)
+		}
+		if v, _ := metadata["filesize"].(float64); int(v) != len(f.b) {
+			t.Errorf("index size %d: filesize %v, want %d", c.size, metadata["filesize"], len(f.b))
+		}
+		if v, _ := metadata["hasKeyframes"].(bool); !v || len(d.keyframes) != c.count/c.gop {
+			t.Errorf("index size %d: hasKeyframes %v with %d keyframes, want %d", c.size, metadata["hasKeyframes"], len(d.keyframes), c.count/c.gop)
+		}
+
+		// the rewritten onMetaData keeps its room, all tags after it read back
+		n := 0
+		for {
+			pkt, err := d.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("index size %d: packet %d: %v", c.size, n, err)
+			}
+			if want := time.Duration(n/2) * 40 * time.Millisecond; pkt.Time != want || int(pkt.Idx) != n%2 {
+				t.Fatalf("index size %d: packet %d is %d at %s", c.size, n, pkt.Idx, pkt.Time)
+			}
+			n++
+		}
+		if n != 2*c.count {
+			t.Errorf("index size %d: read %d packets, want %d", c.size, n, 2*c.count)
+		}
+	}
+}
@@ -127,7 +127,7 @@ func LenAMF0Val(_val interface{}) (n int) {
 
 	case string:
 		u := len(val)
-		if u <= 65536 {
+		if u <= 65535 {
 			n += 3
 		} else {
 			n += 5
@@ -200,7 +200,7 @@ func FillAMF0Val(b []byte, _val interface{}) (n int) {
 
 	case string:
 		u := len(val)
-		if u <= 65536 {
+		if u <= 65535 {
 			b[n] = stringmarker
 			n++
 			pio.PutU16BE(b[n:], uint16(u))
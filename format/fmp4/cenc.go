@@ -0,0 +1,356 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// Encryption configures the Common Encryption (ISO/IEC 23001-7) of a track.
+type Encryption struct {
+	// Scheme is fmp4io.SchemeCENC for AES-CTR, or fmp4io.SchemeCBCS for
+	// AES-CBC with a 1:9 pattern on video.
+	Scheme fmp4io.Tag
+	KeyID  [16]byte
+	// Key is the 16 byte AES key.
+	Key []byte
+	// IV is the 8 or 16 byte IV of the first sample for cenc, incremented for
+	// every sample, or a random one when empty. It is the constant 16 byte IV
+	// of all samples for cbcs.
+	IV []byte
+	// PSSH boxes of the DRM systems, written as they are to the init segment.
+	PSSH []*fmp4io.ProtectionSystemHeader
+}
+
+type trackEncryption struct {
+	Encryption
+	block  cipher.Block
+	iv     []byte
+	video  bool
+	hevc   bool
+	slices sliceHeaderParser
+}
+
+// SetEncryption encrypts the samples of the track from now on.
+func (f *TrackFragmenter) SetEncryption(enc Encryption) (err error) {
+	if err = f.setEncryption(enc); err != nil {
+		return
+	}
+	f.fhdr, err = MovieHeader([]*fmp4io.Track{f.atom}, f.pssh()...)
+	return
+}
+
+// SetEncryption encrypts the samples of all tracks with the same key from
+// now on. For cenc, the IVs of each track differ in their first byte.
+func (f *MovieFragmenter) SetEncryption(enc Encryption) (err error) {
+	atoms := make([]*fmp4io.Track, len(f.tracks))
+	for i, track := range f.tracks {
+		trackEnc := enc
+		if enc.Scheme == fmp4io.SchemeCENC && len(enc.IV) != 0 {
+			trackEnc.IV = append([]byte{}, enc.IV...)
+			trackEnc.IV[0] ^= byte(i)
+		}
+		if err = track.setEncryption(trackEnc); err != nil {
+			return fmt.Errorf("track %d: %w", i, err)
+		}
+		atoms[i] = track.atom
+	}
+	f.fhdr, err = MovieHeader(atoms, f.tracks[0].pssh()...)
+	return
+}
+
+func (f *TrackFragmenter) setEncryption(enc Encryption) (err error) {
+	e := &trackEncryption{
+		Encryption: enc,
+		video:      f.codecData.Type().IsVideo(),
+	}
+	switch cd := f.codecData.(type) {
+	case h264parser.CodecData:
+		e.slices, err = newH264Params(cd.SPS(), cd.PPS())
+	case h265parser.CodecData:
+		e.hevc = true
+		e.slices, err = newHEVCParams(cd.SPS(), cd.PPS())
+	}
+	if err != nil {
+		return
+	}
+	if len(enc.Key) != 16 {
+		return fmt.Errorf("mp4: encryption key must be 16 bytes, not %d", len(enc.Key))
+	}
+	if e.block, err = aes.NewCipher(enc.Key); err != nil {
+		return
+	}
+	switch enc.Scheme {
+	case fmp4io.SchemeCENC:
+		switch len(enc.IV) {
+		case 0:
+			e.iv = make([]byte, 8)
+			if _, err = rand.Read(e.iv); err != nil {
+				return
+			}
+		case 8, 16:
+			e.iv = append([]byte{}, enc.IV...)
+		default:
+			return fmt.Errorf("mp4: cenc IV must be 8 or 16 bytes, not %d", len(enc.IV))
+		}
+	case fmp4io.SchemeCBCS:
+		if len(enc.IV) != 16 {
+			return fmt.Errorf("mp4: cbcs IV must be 16 bytes, not %d", len(enc.IV))
+		}
+		e.iv = append([]byte{}, enc.IV...)
+	default:
+		return fmt.Errorf("mp4: unsupported protection scheme %v", enc.Scheme)
+	}
+	f.enc = e
+	f.atom, err = f.Track()
+	return
+}
+
+// pssh returns the PSSH boxes of the init segment
+func (f *TrackFragmenter) pssh() (r []fmp4io.Atom) {
+	if f.enc == nil {
+		return
+	}
+	for _, atom := range f.enc.PSSH {
+		r = append(r, atom)
+	}
+	return
+}
+
+// protect replaces the sample entry of a track by an encv or enca one.
+func (e *trackEncryption) protect(desc *fmp4io.SampleDesc) {
+	var entry fmp4io.Atom
+	switch {
+	case desc.AVC1Desc != nil:
+		entry, desc.AVC1Desc = desc.AVC1Desc, nil
+	case desc.HEVCDesc != nil:
+		entry, desc.HEVCDesc = desc.HEVCDesc, nil
+	case desc.MP4ADesc != nil:
+		entry, desc.MP4ADesc = desc.MP4ADesc, nil
+	case desc.OpusDesc != nil:
+		entry, desc.OpusDesc = desc.OpusDesc, nil
+	default:
+		return
+	}
+	tenc := &fmp4io.TrackEncryption{
+		IsProtected: true,
+		KID:         e.KeyID,
+	}
+	if e.Scheme == fmp4io.SchemeCBCS {
+		tenc.Version = 1
+		if e.video {
+			tenc.CryptByteBlock, tenc.SkipByteBlock = 1, 9
+		}
+		tenc.ConstantIV = e.iv
+	} else {
+		tenc.PerSampleIVSize = uint8(len(e.iv))
+	}
+	tag := fmp4io.ENCA
+	if e.video {
+		tag = fmp4io.ENCV
+	}
+	desc.Encrypted = &fmp4io.EncryptedSampleEntry{
+		Tag_:  tag,
+		Entry: entry,
+		Sinf: &fmp4io.ProtectionSchemeInfo{
+			OriginalFormat: &fmp4io.OriginalFormat{Format: entry.Tag()},
+			SchemeType:     &fmp4io.SchemeType{Type: e.Scheme, Version: 0x10000},
+			SchemeInfo:     &fmp4io.SchemeInfo{TrackEncryption: tenc},
+		},
+	}
+}
+
+// encrypt returns encrypted copies of the samples of a fragment and adds
+// their senc, saiz and saio boxes to its traf box. The saio offset is set
+// when the fragment is marshaled.
+func (e *trackEncryption) encrypt(traf *fmp4io.TrackFrag, packets []av.Packet) []av.Packet {
+	senc := &fmp4io.SampleEncryption{}
+	if e.video {
+		senc.Flags = fmp4io.SampleEncryptionUseSubsamples
+	}
+	saiz := &fmp4io.SampleAuxInfoSizes{SampleCount: uint32(len(packets))}
+	r := make([]av.Packet, len(packets))
+	for i, pkt := range packets {
+		data := append([]byte{}, pkt.Data...)
+		var entry fmp4io.SampleEncryptionEntry
+		if e.video {
+			entry.Subsamples = e.subsamples(data)
+		}
+		if e.Scheme == fmp4io.SchemeCBCS {
+			crypt, skip := 0, 0
+			if e.video {
+				crypt, skip = 1, 9
+			}
+			forEachProtected(data, entry.Subsamples, func(b []byte) {
+				encryptPattern(e.block, e.iv, crypt, skip, b)
+			})
+		} else {
+			entry.IV = append([]byte{}, e.iv...)
+			encryptCTR(e.block, entry.IV, data, entry.Subsamples)
+			e.nextIV(data, entry.Subsamples)
+		}
+		saiz.Sizes = append(saiz.Sizes, uint8(entry.Len(e.video)))
+		senc.Samples = append(senc.Samples, entry)
+		pkt.Data = data
+		r[i] = pkt
+	}
+	same := true
+	for _, size := range saiz.Sizes {
+		if size != saiz.Sizes[0] {
+			same = false
+		}
+	}
+	if same && len(saiz.Sizes) != 0 && saiz.Sizes[0] != 0 {
+		saiz.DefaultSize, saiz.Sizes = saiz.Sizes[0], nil
+	}
+	traf.AuxInfoSizes = saiz
+	traf.AuxInfoOffsets = &fmp4io.SampleAuxInfoOffsets{Offsets: []uint64{0}}
+	traf.SampleEncryption = senc
+	return r
+}
+
+// subsamples splits a length prefixed video sample into clear and protected
+// ranges. Only the slice data of VCL NALUs is protected, in whole blocks,
+// the NALU header and slice header stay in the clear. NALUs whose slice
+// header can not be parsed stay in the clear altogether.
+func (e *trackEncryption) subsamples(data []byte) (subs []fmp4io.Subsample) {
+	var clear int
+	n := 0
+	for n+4 <= len(data) {
+		size := 4 + int(pio.U32BE(data[n:]))
+		if size < 4 || n+size > len(data) {
+			size = len(data) - n
+		}
+		var protected int
+		if size > 4 && e.slices != nil && e.isVCL(data[n+4]) {
+			header, err := e.slices.sliceHeaderSize(data[n+4 : n+size])
+			if err == nil && header < size-4 {
+				protected = (size - 4 - header) &^ 15
+			}
+		}
+		clear += size - protected
+		n += size
+		if protected == 0 {
+			continue
+		}
+		for clear > 0xffff {
+			subs = append(subs, fmp4io.Subsample{ClearBytes: 0xffff})
+			clear -= 0xffff
+		}
+		subs = append(subs, fmp4io.Subsample{ClearBytes: uint16(clear), ProtectedBytes: uint32(protected)})
+		clear = 0
+	}
+	clear += len(data) - n
+	for clear > 0 {
+		c := clear
+		if c > 0xffff {
+			c = 0xffff
+		}
+		subs = append(subs, fmp4io.Subsample{ClearBytes: uint16(c)})
+		clear -= c
+	}
+	return
+}
+
+// isVCL tells whether a NALU header is the one of a coded slice
+func (e *trackEncryption) isVCL(hdr byte) bool {
+	if e.hevc {
+		return (hdr>>1)&0x3f < 32
+	}
+	typ := hdr & 0x1f
+	return typ >= 1 && typ <= 5
+}
+
+// forEachProtected calls fn on each protected range of a sample, or on the
+// whole sample when it has no subsamples.
+func forEachProtected(data []byte, subs []fmp4io.Subsample, fn func([]byte)) {
+	if len(subs) == 0 {
+		fn(data)
+		return
+	}
+	n := 0
+	for _, s := range subs {
+		n += int(s.ClearBytes)
+		end := n + int(s.ProtectedBytes)
+		if end > len(data) {
+			return
+		}
+		if s.ProtectedBytes != 0 {
+			fn(data[n:end])
+		}
+		n = end
+	}
+}
+
+// encryptCTR encrypts a sample with AES-CTR for cenc. The counter goes on
+// from one protected range to the next.
+func encryptCTR(block cipher.Block, iv, data []byte, subs []fmp4io.Subsample) {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	stream := cipher.NewCTR(block, counter)
+	forEachProtected(data, subs, func(b []byte) {
+		stream.XORKeyStream(b, b)
+	})
+}
+
+// encryptPattern encrypts a protected range with AES-CBC for cbcs, crypt
+// blocks out of every crypt+skip ones, or all of them when crypt is 0. The
+// trailing partial block stays in the clear.
+func encryptPattern(block cipher.Block, iv []byte, crypt, skip int, b []byte) {
+	mode := cipher.NewCBCEncrypter(block, iv)
+	for len(b) >= aes.BlockSize {
+		n := len(b) &^ (aes.BlockSize - 1)
+		if crypt > 0 && n > crypt*aes.BlockSize {
+			n = crypt * aes.BlockSize
+		}
+		mode.CryptBlocks(b[:n], b[:n])
+		b = b[n:]
+		n = skip * aes.BlockSize
+		if n > len(b) {
+			n = len(b)
+		}
+		b = b[n:]
+	}
+}
+
+// nextIV moves the cenc IV past the sample just encrypted. An 8-byte IV
+// is the high half of the counter and goes up by one, a 16-byte IV is the
+// whole counter and goes past every block the sample used, so that no two
+// samples share keystream.
+func (e *trackEncryption) nextIV(data []byte, subs []fmp4io.Subsample) {
+	if len(e.iv) != 16 {
+		addIV(e.iv, 1)
+		return
+	}
+	protected := uint64(len(data))
+	if len(subs) != 0 {
+		protected = 0
+		for _, s := range subs {
+			protected += uint64(s.ProtectedBytes)
+		}
+	}
+	blocks := (protected + aes.BlockSize - 1) / aes.BlockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	addIV(e.iv, blocks)
+}
+
+// addIV adds n to a big endian IV
+func addIV(iv []byte, n uint64) {
+	for i := len(iv) - 1; i >= 0 && n != 0; i-- {
+		sum := uint64(iv[i]) + n&0xff
+		iv[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+}
@@ -0,0 +1,422 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+// AES-128 test vectors of NIST SP 800-38A, F.2.1 and F.5.1
+var (
+	nistKey       = unhex("2b7e151628aed2a6abf7158809cf4f3c")
+	nistPlaintext = unhex("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710")
+	nistCBCIV         = unhex("000102030405060708090a0b0c0d0e0f")
+	nistCBCCiphertext = unhex("7649abac8119b246cee98e9b12e9197d" +
+		"5086cb9b507219ee95db113a917678b2" +
+		"73bed6b8e3c1743b7116e69e22229516" +
+		"3ff1caa1681fac09120eca307586e1a7")
+	nistCTRCounter    = unhex("f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	nistCTRCiphertext = unhex("874d6191b620e3261bef6864990db6ce" +
+		"9806f66b7970fdff8617187bb9fffdff" +
+		"5ae4df3edbd5d35e5b4f09020db03eab" +
+		"1e031dda2fbe03d1792170a0f3009cee")
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestEncryptCTR(t *testing.T) {
+	block, _ := aes.NewCipher(nistKey)
+	data := append([]byte{}, nistPlaintext...)
+	encryptCTR(block, nistCTRCounter, data, nil)
+	if !bytes.Equal(data, nistCTRCiphertext) {
+		t.Errorf("full sample: got %x", data)
+	}
+
+	// the counter goes on across subsamples
+	subs := []fmp4io.Subsample{
+		{ClearBytes: 5, ProtectedBytes: 16},
+		{ClearBytes: 3, ProtectedBytes: 48},
+		{ClearBytes: 2},
+	}
+	clear := bytes.Repeat([]byte{0xaa}, 10)
+	data = append(append(append(append(append([]byte{}, clear[:5]...), nistPlaintext[:16]...),
+		clear[5:8]...), nistPlaintext[16:]...), clear[8:]...)
+	encryptCTR(block, nistCTRCounter, data, subs)
+	expected := append(append(append(append(append([]byte{}, clear[:5]...), nistCTRCiphertext[:16]...),
+		clear[5:8]...), nistCTRCiphertext[16:]...), clear[8:]...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("subsamples: got %x", data)
+	}
+}
+
+func TestEncryptPattern(t *testing.T) {
+	block, _ := aes.NewCipher(nistKey)
+	values := []struct {
+		Crypt, Skip int
+		Expected    []byte
+	}{
+		// no pattern, all the blocks
+		{0, 0, nistCBCCiphertext},
+		// 1:9 only leaves room for the first block
+		{1, 9, append(append([]byte{}, nistCBCCiphertext[:16]...), nistPlaintext[16:]...)},
+	}
+	for _, ex := range values {
+		data := append([]byte{}, nistPlaintext...)
+		encryptPattern(block, nistCBCIV, ex.Crypt, ex.Skip, data)
+		if !bytes.Equal(data, ex.Expected) {
+			t.Errorf("%d:%d: got %x", ex.Crypt, ex.Skip, data)
+		}
+	}
+
+	// a trailing partial block stays in the clear
+	data := append(append([]byte{}, nistPlaintext[:32]...), 1, 2, 3)
+	encryptPattern(block, nistCBCIV, 0, 0, data)
+	if !bytes.Equal(data[:32], nistCBCCiphertext[:32]) || !bytes.Equal(data[32:], []byte{1, 2, 3}) {
+		t.Errorf("partial block: got %x", data)
+	}
+}
+
+// lengthPrefixed joins nalus with 4 byte lengths.
+func lengthPrefixed(nalus ...[]byte) (b []byte) {
+	for _, nalu := range nalus {
+		b = append(b, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return
+}
+
+// h264IDRHeader returns the NAL unit header and slice header of an IDR
+// slice of testH264.
+func h264IDRHeader() []byte {
+	w := &bitWriter{}
+	w.u(0x65, 8).ue(0).ue(7).ue(0).u(0, 4).ue(3).u(0, 2).se(-4).ue(1)
+	return w.nalu()
+}
+
+func TestSubsamples(t *testing.T) {
+	sps, pps := testHEVCParams()
+	slices, err := newHEVCParams(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &trackEncryption{video: true, hevc: true, slices: slices}
+	w := &bitWriter{}
+	w.u(20<<9|1, 16).flag(true).flag(false).ue(0).u(0, 2).ue(2).flag(true)
+	w.flag(true).flag(true).se(-2).se(1).se(0).flag(false).flag(false).flag(true).ue(0).ue(0)
+	header := w.align().nalu()
+	sei := []byte{39 << 1, 1, 5, 1, 0xff, 0x80}
+
+	// the slice header and what does not fill a block stay in the clear
+	data := lengthPrefixed(sei, append(header, bytes.Repeat([]byte{0xaa}, 100)...))
+	subs := e.subsamples(data)
+	expected := fmp4io.Subsample{ClearBytes: uint16(4 + len(sei) + 4 + len(header) + 4), ProtectedBytes: 96}
+	if len(subs) != 1 || subs[0] != expected {
+		t.Errorf("expected %v, got %v", expected, subs)
+	}
+
+	// a slice of another PPS is not protected
+	other := append((&bitWriter{}).u(1<<9|1, 16).flag(true).ue(1).nalu(), bytes.Repeat([]byte{0xaa}, 100)...)
+	data = lengthPrefixed(other)
+	subs = e.subsamples(data)
+	if len(subs) != 1 || subs[0] != (fmp4io.Subsample{ClearBytes: uint16(len(data))}) {
+		t.Errorf("unparsed slice: got %v", subs)
+	}
+}
+
+// TestEncryptedSampleVectors encrypts IDR slices whose slice data is the
+// plaintext of NIST SP 800-38A, in cenc with its CTR counter block and in
+// cbcs with its CBC IV, and checks the senc box and the sample against the
+// published ciphertext.
+func TestEncryptedSampleVectors(t *testing.T) {
+	header := h264IDRHeader()
+	skip := bytes.Repeat([]byte{0x5a}, 9*aes.BlockSize)
+	var pattern []byte
+	for i := 0; i < 4; i++ {
+		if i != 0 {
+			pattern = append(pattern, skip...)
+		}
+		pattern = append(pattern, nistPlaintext[16*i:16*(i+1)]...)
+	}
+	values := []struct {
+		Scheme   fmp4io.Tag
+		IV       []byte
+		Data     []byte
+		Expected []byte
+		AuxSize  uint8
+	}{
+		{fmp4io.SchemeCENC, nistCTRCounter, nistPlaintext, nistCTRCiphertext, 16 + 2 + 6},
+		// 1:9, the encrypted blocks chain as if they followed each other
+		{fmp4io.SchemeCBCS, nistCBCIV, pattern, nil, 2 + 6},
+	}
+	for _, ex := range values {
+		if ex.Expected == nil {
+			for i := 0; i < 4; i++ {
+				if i != 0 {
+					ex.Expected = append(ex.Expected, skip...)
+				}
+				ex.Expected = append(ex.Expected, nistCBCCiphertext[16*i:16*(i+1)]...)
+			}
+		}
+		f, err := NewTrack(testH264(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.SetEncryption(Encryption{Scheme: ex.Scheme, Key: nistKey, IV: ex.IV}); err != nil {
+			t.Fatal(err)
+		}
+		sample := lengthPrefixed(append(append([]byte{}, header...), ex.Data...))
+		for i := 0; i < 2; i++ {
+			pkt := av.Packet{Data: append([]byte{}, sample...), IsKeyFrame: true, Time: time.Duration(i) * 40 * time.Millisecond}
+			if err = f.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		frag, err := f.Fragment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var moof *fmp4io.MovieFrag
+		var mdat []byte
+		_ = forEachBox(frag.Bytes, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+			switch tag {
+			case fmp4io.MOOF:
+				moof = &fmp4io.MovieFrag{}
+				_, err = moof.Unmarshal(box, offset)
+			case fmp4io.MDAT:
+				mdat = box[8:]
+			}
+			return
+		})
+		if moof == nil || len(moof.Tracks) != 1 || moof.Tracks[0].SampleEncryption == nil {
+			t.Fatalf("%v: no senc box", ex.Scheme)
+		}
+		traf := moof.Tracks[0]
+		senc := traf.SampleEncryption
+		if senc.Flags&fmp4io.SampleEncryptionUseSubsamples == 0 || len(senc.Samples) != 1 || traf.AuxInfoSizes.DefaultSize != ex.AuxSize {
+			t.Fatalf("%v: unexpected senc %+v", ex.Scheme, senc)
+		}
+		entry := senc.Samples[0]
+		iv := ex.IV
+		if ex.Scheme == fmp4io.SchemeCBCS {
+			// the constant IV is in the tenc box
+			iv = nil
+		}
+		subs := []fmp4io.Subsample{{ClearBytes: uint16(4 + len(header)), ProtectedBytes: uint32(len(ex.Data))}}
+		if !bytes.Equal(entry.IV, iv) || len(entry.Subsamples) != 1 || entry.Subsamples[0] != subs[0] {
+			t.Errorf("%v: senc entry %+v, want IV %x and subsamples %v", ex.Scheme, entry, iv, subs)
+		}
+		if !bytes.Equal(mdat[:4+len(header)], sample[:4+len(header)]) {
+			t.Errorf("%v: the slice header is not in the clear", ex.Scheme)
+		}
+		if got := mdat[4+len(header) : len(sample)]; !bytes.Equal(got, ex.Expected) {
+			t.Errorf("%v: encrypted slice data %x", ex.Scheme, got)
+		}
+	}
+}
+
+func TestEncryptedFragment(t *testing.T) {
+	cd, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x11, 0x90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewTrack(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	iv := []byte{0, 0, 0, 0, 0, 0, 0, 0xff}
+	err = f.SetEncryption(Encryption{
+		Scheme: fmp4io.SchemeCENC,
+		KeyID:  kid,
+		Key:    nistKey,
+		IV:     iv,
+		PSSH:   []*fmp4io.ProtectionSystemHeader{{Data: []byte("pssh")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// init segment
+	_, _, init := f.MovieHeader()
+	var moov *fmp4io.Movie
+	_ = forEachBox(init, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag == fmp4io.MOOV {
+			moov = &fmp4io.Movie{}
+			_, err = moov.Unmarshal(box, offset)
+		}
+		return
+	})
+	if moov == nil {
+		t.Fatal("no moov")
+	}
+	entry, ok := fmp4io.FindChildren(moov, fmp4io.ENCA).(*fmp4io.EncryptedSampleEntry)
+	if !ok || entry.Sinf.OriginalFormat.Format != fmp4io.MP4A || entry.Sinf.SchemeType.Type != fmp4io.SchemeCENC {
+		t.Fatal("no enca sample entry")
+	}
+	tenc := entry.Sinf.SchemeInfo.TrackEncryption
+	if tenc.KID != kid || tenc.PerSampleIVSize != 8 {
+		t.Errorf("unexpected tenc %+v", tenc)
+	}
+	if pssh, ok := fmp4io.FindChildren(moov, fmp4io.PSSH).(*fmp4io.Dummy); !ok || !bytes.HasSuffix(pssh.Data, []byte("pssh")) {
+		t.Error("no pssh box")
+	}
+	if _, err = ParseInit(init); err != nil {
+		t.Error(err)
+	}
+
+	// fragment
+	var samples [][]byte
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100+i)
+		samples = append(samples, data)
+		if err = f.WritePacket(av.Packet{Data: append([]byte{}, data...), Time: time.Duration(i) * 20 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frag, err := f.Fragment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moof *fmp4io.MovieFrag
+	var moofStart int
+	var mdat []byte
+	_ = forEachBox(frag.Bytes, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		switch tag {
+		case fmp4io.MOOF:
+			moof, moofStart = &fmp4io.MovieFrag{}, offset
+			_, err = moof.Unmarshal(box, offset)
+		case fmp4io.MDAT:
+			mdat = box[8:]
+		}
+		return
+	})
+	if moof == nil || len(moof.Tracks) != 1 {
+		t.Fatal("no moof")
+	}
+	traf := moof.Tracks[0]
+	if traf.SampleEncryption == nil || traf.AuxInfoSizes == nil || traf.AuxInfoOffsets == nil {
+		t.Fatal("missing senc, saiz or saio")
+	}
+	senc := traf.SampleEncryption.Samples
+	if len(senc) != 3 || traf.AuxInfoSizes.DefaultSize != 8 {
+		t.Fatalf("expected 3 samples of 8 byte IVs, got %d", len(senc))
+	}
+	offset := moofStart + int(traf.AuxInfoOffsets.Offsets[0])
+	if !bytes.Equal(frag.Bytes[offset:offset+8], iv) {
+		t.Errorf("saio does not point to the first IV")
+	}
+	block, _ := aes.NewCipher(nistKey)
+	for i, s := range senc {
+		expected := []byte{0, 0, 0, 0, 0, 0, 1, byte(i - 1)}
+		if i == 0 {
+			expected = iv
+		}
+		if !bytes.Equal(s.IV, expected) {
+			t.Errorf("sample %d: expected IV %x, got %x", i, expected, s.IV)
+		}
+		data := mdat[:len(samples[i])]
+		mdat = mdat[len(data):]
+		counter := make([]byte, 16)
+		copy(counter, s.IV)
+		cipher.NewCTR(block, counter).XORKeyStream(data, data)
+		if !bytes.Equal(data, samples[i]) {
+			t.Errorf("sample %d does not decrypt", i)
+		}
+	}
+}
+
+func TestCENCCounter(t *testing.T) {
+	header := h264IDRHeader()
+	values := []struct {
+		Name   string
+		Codec  av.CodecData
+		IV     []byte
+		Sample func(i int) []byte
+		// IVs of the three samples of the fragment
+		Expected []string
+	}{
+		// 20 bytes use two blocks of the counter
+		{"audio", testAAC(t), unhex("0000000000000000fffffffffffffffe"), func(i int) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 20)
+		}, []string{"0000000000000000fffffffffffffffe", "00000000000000010000000000000000", "00000000000000010000000000000002"}},
+		// 40 bytes of slice data, of which two blocks are protected
+		{"video", testH264(t), unhex("000000000000000000000000000000ff"), func(i int) []byte {
+			return lengthPrefixed(append(append([]byte{}, header...), bytes.Repeat([]byte{byte(i)}, 40)...))
+		}, []string{"000000000000000000000000000000ff", "00000000000000000000000000000101", "00000000000000000000000000000103"}},
+		// the high half of the counter, one per sample
+		{"8-byte IV", testAAC(t), unhex("00000000000000ff"), func(i int) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 20)
+		}, []string{"00000000000000ff", "0000000000000100", "0000000000000101"}},
+	}
+	block, _ := aes.NewCipher(nistKey)
+	for _, ex := range values {
+		f, err := NewTrack(ex.Codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.SetEncryption(Encryption{Scheme: fmp4io.SchemeCENC, Key: nistKey, IV: ex.IV}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			pkt := av.Packet{Data: ex.Sample(i), IsKeyFrame: true, Time: time.Duration(i) * 40 * time.Millisecond}
+			if err = f.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		frag, err := f.Fragment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var moof *fmp4io.MovieFrag
+		var mdat []byte
+		_ = forEachBox(frag.Bytes, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+			switch tag {
+			case fmp4io.MOOF:
+				moof = &fmp4io.MovieFrag{}
+				_, err = moof.Unmarshal(box, offset)
+			case fmp4io.MDAT:
+				mdat = box[8:]
+			}
+			return
+		})
+		if moof == nil || len(moof.Tracks) != 1 || moof.Tracks[0].SampleEncryption == nil {
+			t.Fatalf("%s: no senc box", ex.Name)
+		}
+		senc := moof.Tracks[0].SampleEncryption.Samples
+		if len(senc) != len(ex.Expected) {
+			t.Fatalf("%s: %d samples, want %d", ex.Name, len(senc), len(ex.Expected))
+		}
+		for i, entry := range senc {
+			if !bytes.Equal(entry.IV, unhex(ex.Expected[i])) {
+				t.Errorf("%s: sample %d IV %x, want %s", ex.Name, i, entry.IV, ex.Expected[i])
+			}
+			// the sample decrypts with its own IV
+			sample := ex.Sample(i)
+			data := append([]byte{}, mdat[:len(sample)]...)
+			mdat = mdat[len(sample):]
+			encryptCTR(block, entry.IV, data, entry.Subsamples)
+			if !bytes.Equal(data, sample) {
+				t.Errorf("%s: sample %d decrypts to %x", ex.Name, i, data)
+			}
+		}
+	}
+}
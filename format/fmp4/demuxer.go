@@ -0,0 +1,689 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/opusparser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/format/fmp4/timescale"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// Init holds the tracks declared by the moov box of a fragmented MP4, such as
+// an init segment.
+type Init struct {
+	streams []av.CodecData
+	tracks  []*demuxTrack
+}
+
+type demuxTrack struct {
+	idx       int
+	trackID   uint32
+	timeScale uint32
+	isVideo   bool
+	trex      *fmp4io.TrackExtend
+}
+
+// ParseInit reads the tracks of an init segment. Tracks of unsupported
+// codecs are left out.
+func ParseInit(b []byte) (init *Init, err error) {
+	var moov *fmp4io.Movie
+	err = forEachBox(b, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag == fmp4io.MOOV {
+			moov = &fmp4io.Movie{}
+			_, err = moov.Unmarshal(box, offset)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if moov == nil {
+		err = errors.New("fmp4: init segment without moov")
+		return
+	}
+	return newInit(moov)
+}
+
+func newInit(moov *fmp4io.Movie) (init *Init, err error) {
+	init = &Init{}
+	for _, trak := range moov.Tracks {
+		if trak.Header == nil || trak.Media == nil || trak.Media.Header == nil {
+			continue
+		}
+		var cd av.CodecData
+		if avc1 := trak.GetAVC1Conf(); avc1 != nil {
+			if cd, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(avc1.Data); err != nil {
+				return
+			}
+		} else if hvcc, ok := fmp4io.FindChildren(trak, fmp4io.HVCC).(*fmp4io.HEVCConf); ok {
+			if cd, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(hvcc.Data); err != nil {
+				return
+			}
+		} else if esds := trak.GetElemStreamDesc(); esds != nil && esds.StreamDescriptor != nil &&
+			esds.StreamDescriptor.DecoderConfig != nil {
+			if cd, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(esds.StreamDescriptor.DecoderConfig.AudioSpecific); err != nil {
+				return
+			}
+		} else if opus, ok := fmp4io.FindChildren(trak, fmp4io.OPUS).(*fmp4io.OpusSampleEntry); ok {
+			cd = opusparser.NewCodecData(int(opus.NumberOfChannels))
+		} else {
+			// not a codec we can pass on
+			continue
+		}
+
+		track := &demuxTrack{
+			idx:       len(init.streams),
+			trackID:   trak.Header.TrackID,
+			timeScale: trak.Media.Header.TimeScale,
+			isVideo:   cd.Type().IsVideo(),
+		}
+		if moov.MovieExtend != nil {
+			for _, trex := range moov.MovieExtend.Tracks {
+				if trex.TrackID == track.trackID {
+					track.trex = trex
+				}
+			}
+		}
+		if track.timeScale == 0 {
+			err = fmt.Errorf("fmp4: track %d has no timescale", track.trackID)
+			return
+		}
+		init.streams = append(init.streams, cd)
+		init.tracks = append(init.tracks, track)
+	}
+
+	if len(init.streams) == 0 {
+		err = errors.New("fmp4: no supported track")
+	}
+	return
+}
+
+func (i *Init) Streams() []av.CodecData {
+	return i.streams
+}
+
+func (i *Init) track(id uint32) *demuxTrack {
+	for _, track := range i.tracks {
+		if track.trackID == id {
+			return track
+		}
+	}
+	return nil
+}
+
+// reference returns the track that random access points are taken from,
+// the first video track or else the first track.
+func (i *Init) reference() *demuxTrack {
+	for _, track := range i.tracks {
+		if track.isVideo {
+			return track
+		}
+	}
+	return i.tracks[0]
+}
+
+// defaults returns the sample defaults of the track fragment, falling back
+// to the ones of the movie.
+func (t *demuxTrack) defaults(tfhd *fmp4io.TrackFragHeader) (duration, size uint32, flags fmp4io.SampleFlags) {
+	if t.trex != nil {
+		duration = t.trex.DefaultSampleDuration
+		size = t.trex.DefaultSampleSize
+		flags = fmp4io.SampleFlags(t.trex.DefaultSampleFlags)
+	}
+	if tfhd.Flags&fmp4io.TrackFragDefaultDuration != 0 {
+		duration = tfhd.DefaultDuration
+	}
+	if tfhd.Flags&fmp4io.TrackFragDefaultSize != 0 {
+		size = tfhd.DefaultSize
+	}
+	if tfhd.Flags&fmp4io.TrackFragDefaultFlags != 0 {
+		flags = tfhd.DefaultFlags
+	}
+	return
+}
+
+// Demuxer reads the samples of a fragmented MP4 from its moof boxes, in
+// decode order.
+type Demuxer struct {
+	r       io.ReadSeeker
+	init    *Init
+	pos     int64    // offset of the next top level box
+	nextDTS []uint64 // decode time following the last sample of each track
+	pkts    []av.Packet
+	seeking bool // drop packets until a keyframe of the reference track
+
+	sidx  []segmentIndex
+	index []accessPoint
+}
+
+// segmentIndex is a sidx box and the offset its references start from.
+type segmentIndex struct {
+	*fmp4io.SegmentIndex
+	anchor int64
+}
+
+// accessPoint is a moof starting at or containing a sync sample.
+type accessPoint struct {
+	time   time.Duration
+	offset int64
+}
+
+// fragmentSample is a sample described by a trun.
+type fragmentSample struct {
+	pkt  av.Packet
+	pos  int64
+	size int64
+}
+
+// NewDemuxer reads a fragmented MP4 file, starting with its moov box.
+func NewDemuxer(r io.ReadSeeker) *Demuxer {
+	return &Demuxer{r: r}
+}
+
+// NewDemuxer reads media segments of the tracks of i, which do not have a
+// moov box themselves.
+func (i *Init) NewDemuxer(r io.ReadSeeker) *Demuxer {
+	return &Demuxer{r: r, init: i}
+}
+
+func (d *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = d.probe(); err != nil {
+		return
+	}
+	return d.init.streams, nil
+}
+
+// probe reads the boxes up to the moov.
+func (d *Demuxer) probe() (err error) {
+	if d.nextDTS != nil {
+		return
+	}
+	for d.init == nil {
+		var tag fmp4io.Tag
+		var size int64
+		if tag, size, err = d.boxHeader(d.pos); err != nil {
+			if err == io.EOF {
+				err = errors.New("fmp4: no moov box found")
+			}
+			return
+		}
+		switch tag {
+		case fmp4io.MOOV:
+			moov := &fmp4io.Movie{}
+			if err = d.readAtom(moov, d.pos, size); err != nil {
+				return
+			}
+			if d.init, err = newInit(moov); err != nil {
+				return
+			}
+		case fmp4io.SIDX:
+			if err = d.readSegmentIndex(d.pos, size); err != nil {
+				return
+			}
+		}
+		d.pos += size
+	}
+	// the sidx boxes of on-demand files follow the moov, read them before
+	// the first seek
+	for {
+		tag, size, herr := d.boxHeader(d.pos)
+		if herr != nil || tag != fmp4io.SIDX {
+			break
+		}
+		if err = d.readSegmentIndex(d.pos, size); err != nil {
+			return
+		}
+		d.pos += size
+	}
+	d.nextDTS = make([]uint64, len(d.init.tracks))
+	return
+}
+
+// boxHeader returns the type and size of the box at offset.
+func (d *Demuxer) boxHeader(offset int64) (tag fmp4io.Tag, size int64, err error) {
+	if _, err = d.r.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	var b [16]byte
+	if _, err = io.ReadFull(d.r, b[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("fmp4: truncated box header")
+		}
+		return
+	}
+	size = int64(pio.U32BE(b[:]))
+	tag = fmp4io.Tag(pio.U32BE(b[4:]))
+	switch size {
+	case 0:
+		// up to the end of the file
+		var end int64
+		if end, err = d.r.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		size = end - offset
+	case 1:
+		if _, err = io.ReadFull(d.r, b[8:]); err != nil {
+			return
+		}
+		size = int64(pio.U64BE(b[8:]))
+	}
+	if size < 8 {
+		err = fmt.Errorf("fmp4: invalid size of box %s", tag)
+	}
+	return
+}
+
+func (d *Demuxer) readAt(offset, size int64) (b []byte, err error) {
+	if _, err = d.r.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	b = make([]byte, size)
+	_, err = io.ReadFull(d.r, b)
+	return
+}
+
+// readAtom reads and parses the box at offset.
+func (d *Demuxer) readAtom(atom fmp4io.Atom, offset, size int64) (err error) {
+	var b []byte
+	if b, err = d.readAt(offset, size); err != nil {
+		return
+	}
+	if pio.U32BE(b) == 1 {
+		return fmt.Errorf("fmp4: 64 bit size of box %s is not supported", atom.Tag())
+	}
+	_, err = atom.Unmarshal(b, int(offset))
+	return
+}
+
+func (d *Demuxer) readSegmentIndex(offset, size int64) (err error) {
+	sidx := &fmp4io.SegmentIndex{}
+	if err = d.readAtom(sidx, offset, size); err != nil {
+		return
+	}
+	d.sidx = append(d.sidx, segmentIndex{sidx, offset + size})
+	return
+}
+
+func (d *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = d.probe(); err != nil {
+		return
+	}
+	ref := d.init.reference()
+	for {
+		for len(d.pkts) == 0 {
+			if err = d.readFragment(); err != nil {
+				return
+			}
+		}
+		pkt = d.pkts[0]
+		d.pkts = d.pkts[1:]
+		if d.seeking {
+			if int(pkt.Idx) != ref.idx || !pkt.IsKeyFrame {
+				continue
+			}
+			d.seeking = false
+		}
+		return
+	}
+}
+
+// readFragment queues the samples of the next moof.
+func (d *Demuxer) readFragment() (err error) {
+	for {
+		offset := d.pos
+		var tag fmp4io.Tag
+		var size int64
+		if tag, size, err = d.boxHeader(offset); err != nil {
+			return
+		}
+		d.pos += size
+		switch tag {
+		case fmp4io.MOOF:
+			moof := &fmp4io.MovieFrag{}
+			if err = d.readAtom(moof, offset, size); err != nil {
+				return
+			}
+			var samples []fragmentSample
+			if samples, err = d.fragmentSamples(moof, offset, d.nextDTS); err != nil {
+				return
+			}
+			if len(samples) == 0 {
+				continue
+			}
+			return d.readSamples(samples)
+		case fmp4io.SIDX:
+			if d.index == nil {
+				if err = d.readSegmentIndex(offset, size); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// fragmentSamples lists the samples of the known tracks in moof, starting
+// from the decode times in nextDTS for track fragments without tfdt, and
+// updates them.
+func (d *Demuxer) fragmentSamples(moof *fmp4io.MovieFrag, offset int64, nextDTS []uint64) (samples []fragmentSample, err error) {
+	dataEnd := offset
+	for i, traf := range moof.Tracks {
+		tfhd := traf.Header
+		if tfhd == nil {
+			err = errors.New("fmp4: traf without tfhd")
+			return
+		}
+		base := offset
+		if tfhd.Flags&fmp4io.TrackFragBaseDataOffset != 0 {
+			base = int64(tfhd.BaseDataOffset)
+		} else if i > 0 && tfhd.Flags&fmp4io.TrackFragDefaultBaseIsMOOF == 0 {
+			// the data of the previous track fragment
+			base = dataEnd
+		}
+		trun := traf.Run
+		pos := base
+		if trun != nil && trun.Flags&fmp4io.TrackRunDataOffset != 0 {
+			pos += int64(int32(trun.DataOffset))
+		}
+		track := d.init.track(tfhd.TrackID)
+		if track == nil || trun == nil {
+			continue
+		}
+
+		dts := nextDTS[track.idx]
+		if traf.DecodeTime != nil {
+			dts = traf.DecodeTime.Time
+		}
+		for j, entry := range trun.Entries {
+			duration, size, flags := track.defaults(tfhd)
+			if trun.Flags&fmp4io.TrackRunSampleDuration != 0 {
+				duration = entry.Duration
+			}
+			if trun.Flags&fmp4io.TrackRunSampleSize != 0 {
+				size = entry.Size
+			}
+			if trun.Flags&fmp4io.TrackRunSampleFlags != 0 {
+				flags = entry.Flags
+			} else if j == 0 && trun.Flags&fmp4io.TrackRunFirstSampleFlags != 0 {
+				flags = trun.FirstSampleFlags
+			}
+			pkt := av.Packet{
+				Idx:        int8(track.idx),
+				IsKeyFrame: !track.isVideo || flags&fmp4io.SampleIsNonSync == 0,
+				Time:       timescale.FromScale(dts, track.timeScale),
+				Duration:   timescale.FromScale(uint64(duration), track.timeScale),
+			}
+			if trun.Flags&fmp4io.TrackRunSampleCTS != 0 && entry.CTS != 0 {
+				pkt.CompositionTime = time.Duration(entry.CTS) * time.Second / time.Duration(track.timeScale)
+			}
+			samples = append(samples, fragmentSample{pkt: pkt, pos: pos, size: int64(size)})
+			pos += int64(size)
+			dts += uint64(duration)
+		}
+		dataEnd = pos
+		nextDTS[track.idx] = dts
+	}
+	return
+}
+
+// readSamples reads the data of samples, which usually follow each other in
+// one mdat, and queues them in decode order.
+func (d *Demuxer) readSamples(samples []fragmentSample) (err error) {
+	start, end := samples[0].pos, samples[0].pos
+	for _, s := range samples {
+		if s.pos < start {
+			start = s.pos
+		}
+		if s.pos+s.size > end {
+			end = s.pos + s.size
+		}
+	}
+	if start < 0 {
+		return errors.New("fmp4: sample before the start of the file")
+	}
+	var b []byte
+	if b, err = d.readAt(start, end-start); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("fmp4: sample data beyond the end of the file")
+		}
+		return
+	}
+	pkts := make([]av.Packet, len(samples))
+	for i, s := range samples {
+		pkts[i] = s.pkt
+		pkts[i].Data = b[s.pos-start : s.pos-start+s.size]
+	}
+	sort.SliceStable(pkts, func(a, b int) bool {
+		return pkts[a].Time < pkts[b].Time
+	})
+	d.pkts = append(d.pkts, pkts...)
+	return
+}
+
+// SeekToTime moves to the last fragment with a sync sample of the reference
+// track at or before tm. The random access points come from the mfra box,
+// the sidx boxes, or else from reading all the moof boxes.
+func (d *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	if err = d.probe(); err != nil {
+		return
+	}
+	if d.index == nil {
+		if err = d.buildIndex(); err != nil {
+			return
+		}
+	}
+	if len(d.index) == 0 {
+		return errors.New("fmp4: no random access point")
+	}
+	ap := d.index[0]
+	for _, p := range d.index[1:] {
+		if p.time > tm {
+			break
+		}
+		ap = p
+	}
+	d.pos = ap.offset
+	d.pkts = nil
+	d.seeking = true
+	return
+}
+
+func (d *Demuxer) buildIndex() (err error) {
+	var index []accessPoint
+	if index, err = d.randomAccessIndex(); err != nil {
+		return
+	}
+	if len(index) == 0 {
+		index = d.segmentIndexPoints()
+	}
+	if len(index) == 0 {
+		if index, err = d.scanFragments(); err != nil {
+			return
+		}
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		return index[a].time < index[b].time
+	})
+	d.index = index
+	return
+}
+
+// randomAccessIndex reads the mfra box found through the mfro box ending
+// the file.
+func (d *Demuxer) randomAccessIndex() (index []accessPoint, err error) {
+	var end int64
+	if end, err = d.r.Seek(0, io.SeekEnd); err != nil || end < 16 {
+		return
+	}
+	var b []byte
+	if b, err = d.readAt(end-16, 16); err != nil {
+		return
+	}
+	if fmp4io.Tag(pio.U32BE(b[4:])) != fmp4io.MFRO {
+		return
+	}
+	size := int64(pio.U32BE(b[12:]))
+	if size < 16 || size > end {
+		return nil, errors.New("fmp4: invalid mfro box")
+	}
+	mfra := &fmp4io.MovieFragRandomAccess{}
+	if err = d.readAtom(mfra, end-size, size); err != nil {
+		return
+	}
+
+	ref := d.init.reference()
+	for _, tfra := range mfra.Tracks {
+		if tfra.TrackID != ref.trackID {
+			continue
+		}
+		for _, entry := range tfra.Entries {
+			index = append(index, accessPoint{
+				time:   timescale.FromScale(entry.Time, ref.timeScale),
+				offset: int64(entry.MoofOffset),
+			})
+		}
+	}
+	return
+}
+
+// segmentIndexPoints returns the subsegments of the sidx boxes read so far,
+// preferring the ones indexing the reference track.
+func (d *Demuxer) segmentIndexPoints() (index []accessPoint) {
+	if len(d.sidx) == 0 {
+		return
+	}
+	ref := d.init.reference()
+	sidx := d.sidx[0]
+	for _, s := range d.sidx {
+		if s.ReferenceID == ref.trackID {
+			sidx = s
+			break
+		}
+	}
+	if sidx.TimeScale == 0 {
+		return
+	}
+	offset := sidx.anchor + int64(sidx.FirstOffset)
+	t := sidx.EarliestPTS
+	for _, r := range sidx.References {
+		if !r.ReferencesBox {
+			index = append(index, accessPoint{
+				time:   timescale.FromScale(t, sidx.TimeScale),
+				offset: offset,
+			})
+		}
+		offset += int64(r.ReferencedSize)
+		t += uint64(r.SubsegmentDuration)
+	}
+	return
+}
+
+// scanFragments reads every moof box from the one after the moov, and
+// returns those whose first sample of the reference track is a sync sample.
+func (d *Demuxer) scanFragments() (index []accessPoint, err error) {
+	ref := d.init.reference()
+	nextDTS := make([]uint64, len(d.init.tracks))
+	var pos int64
+	for {
+		offset := pos
+		var tag fmp4io.Tag
+		var size int64
+		if tag, size, err = d.boxHeader(offset); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		pos += size
+		if tag != fmp4io.MOOF {
+			continue
+		}
+		moof := &fmp4io.MovieFrag{}
+		if err = d.readAtom(moof, offset, size); err != nil {
+			return
+		}
+		var samples []fragmentSample
+		if samples, err = d.fragmentSamples(moof, offset, nextDTS); err != nil {
+			return
+		}
+		for _, s := range samples {
+			if int(s.pkt.Idx) == ref.idx {
+				if s.pkt.IsKeyFrame {
+					index = append(index, accessPoint{time: s.pkt.Time, offset: offset})
+				}
+				break
+			}
+		}
+	}
+}
+
+// IsFragmented tells whether the MP4 file read by r from its current
+// position is fragmented, that is its moov has an mvex box or a moof comes
+// first. The read position is restored.
+func IsFragmented(r io.ReadSeeker) (fragmented bool) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	defer r.Seek(start, io.SeekStart)
+
+	d := &Demuxer{r: r}
+	pos := start
+	for {
+		tag, size, err := d.boxHeader(pos)
+		if err != nil {
+			return
+		}
+		switch tag {
+		case fmp4io.MOOF, fmp4io.STYP:
+			return true
+		case fmp4io.MOOV:
+			b, err := d.readAt(pos, size)
+			if err != nil || pio.U32BE(b) == 1 {
+				return
+			}
+			forEachBox(b[8:], func(tag fmp4io.Tag, offset int, box []byte) error {
+				fragmented = fragmented || tag == fmp4io.MVEX
+				return nil
+			})
+			return
+		}
+		pos += size
+	}
+}
+
+// forEachBox calls fn with every top level box of b.
+func forEachBox(b []byte, fn func(tag fmp4io.Tag, offset int, box []byte) error) (err error) {
+	for offset := 0; offset+8 <= len(b); {
+		size := int64(pio.U32BE(b[offset:]))
+		tag := fmp4io.Tag(pio.U32BE(b[offset+4:]))
+		switch size {
+		case 0:
+			size = int64(len(b) - offset)
+		case 1:
+			if offset+16 > len(b) {
+				return errors.New("fmp4: truncated box header")
+			}
+			size = int64(pio.U64BE(b[offset+8:]))
+		}
+		if size < 8 || size > int64(len(b)-offset) {
+			return fmt.Errorf("fmp4: invalid size of box %s", tag)
+		}
+		if err = fn(tag, offset, b[offset:offset+int(size)]); err != nil {
+			return
+		}
+		offset += int(size)
+	}
+	return
+}
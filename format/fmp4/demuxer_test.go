@@ -0,0 +1,401 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// testFile is a fragmented MP4 with 25fps video, a keyframe and a fragment
+// every second, and one audio packet per frame.
+type testFile struct {
+	init      []byte
+	fragments [][]byte
+	moofs     []int64         // offsets of the moof boxes in bytes()
+	times     []time.Duration // start of the fragments
+	written   []av.Packet     // packets that made it into a fragment
+}
+
+func newTestFile(t *testing.T, end time.Duration) *testFile {
+	f, err := NewMovie([]av.CodecData{testH264(t), testAAC(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &testFile{}
+	_, _, file.init = f.MovieHeader()
+	var pending []av.Packet
+	fragment := func() {
+		frag, err := f.Fragment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.fragments = append(file.fragments, frag.Bytes)
+		// the fragmenter holds back the last packet of each track
+		file.written = append(file.written, pending[:len(pending)-2]...)
+		pending = pending[len(pending)-2:]
+	}
+	for tm := time.Duration(0); tm < end; tm += 40 * time.Millisecond {
+		key := tm%time.Second == 0
+		video := testPacket(0, tm, key, true)
+		video.Data[10] = byte(tm / (40 * time.Millisecond))
+		if !key {
+			// B frames shift the presentation
+			video.CompositionTime = 80 * time.Millisecond
+		}
+		audio := testPacket(1, tm, false, false)
+		audio.Data[10] = byte(tm / (40 * time.Millisecond))
+		for _, pkt := range []av.Packet{video, audio} {
+			if err = f.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+			pending = append(pending, pkt)
+		}
+		if key && tm != 0 {
+			// the keyframe starts the next fragment
+			fragment()
+		}
+		if key {
+			file.times = append(file.times, tm)
+		}
+	}
+	fragment()
+
+	offset := int64(len(file.init))
+	for _, frag := range file.fragments {
+		_ = forEachBox(frag, func(tag fmp4io.Tag, o int, box []byte) error {
+			if tag == fmp4io.MOOF {
+				file.moofs = append(file.moofs, offset+int64(o))
+			}
+			return nil
+		})
+		offset += int64(len(frag))
+	}
+	return file
+}
+
+func (file *testFile) bytes() []byte {
+	b := append([]byte{}, file.init...)
+	for _, frag := range file.fragments {
+		b = append(b, frag...)
+	}
+	return b
+}
+
+// readPackets demuxes the packets until the end of the file.
+func readPackets(t *testing.T, d *Demuxer) (pkts []av.Packet) {
+	t.Helper()
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+// checkPackets compares got with want, both in decode order per track.
+func checkPackets(t *testing.T, got, want []av.Packet) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("demuxed %d packets, want %d", len(got), len(want))
+	}
+	var tracks [2][]av.Packet
+	for _, pkt := range want {
+		tracks[pkt.Idx] = append(tracks[pkt.Idx], pkt)
+	}
+	for _, pkt := range got {
+		w := tracks[pkt.Idx][0]
+		tracks[pkt.Idx] = tracks[pkt.Idx][1:]
+		if pkt.Time != w.Time || pkt.CompositionTime != w.CompositionTime || !bytes.Equal(pkt.Data, w.Data) {
+			t.Fatalf("got packet %d at %s+%s, want %s+%s", pkt.Idx, pkt.Time, pkt.CompositionTime, w.Time, w.CompositionTime)
+		}
+		if pkt.Idx == 0 && pkt.IsKeyFrame != w.IsKeyFrame {
+			t.Fatalf("packet at %s keyframe=%v", pkt.Time, pkt.IsKeyFrame)
+		}
+	}
+}
+
+func TestDemuxerRoundTrip(t *testing.T) {
+	file := newTestFile(t, 5*time.Second)
+	d := NewDemuxer(bytes.NewReader(file.bytes()))
+	streams, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 || streams[0].Type() != av.H264 || streams[1].Type() != av.AAC {
+		t.Fatalf("unexpected streams %v", streams)
+	}
+	checkPackets(t, readPackets(t, d), file.written)
+
+	// media segments read with the tracks of the init segment
+	init, err := ParseInit(file.init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []byte
+	for _, frag := range file.fragments {
+		segments = append(segments, frag...)
+	}
+	checkPackets(t, readPackets(t, init.NewDemuxer(bytes.NewReader(segments))), file.written)
+}
+
+// rewriteMoofs replaces every moof of b with the one fn returns, fixing the
+// data offsets of the track runs.
+func rewriteMoofs(t *testing.T, b []byte, fn func(moof *fmp4io.MovieFrag, offset int64)) (out []byte) {
+	t.Helper()
+	err := forEachBox(b, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag != fmp4io.MOOF {
+			out = append(out, box...)
+			return
+		}
+		moof := &fmp4io.MovieFrag{}
+		if _, err = moof.Unmarshal(box, 0); err != nil {
+			return
+		}
+		base := make([]int64, len(moof.Tracks))
+		for i, traf := range moof.Tracks {
+			base[i] = int64(traf.Run.DataOffset) - int64(len(box))
+		}
+		start := int64(len(out))
+		fn(moof, start)
+		for i, traf := range moof.Tracks {
+			traf.Run.DataOffset = uint32(base[i] + int64(moof.Len()))
+		}
+		moofb := make([]byte, moof.Len())
+		moof.Marshal(moofb)
+		out = append(out, moofb...)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDemuxerDefaults(t *testing.T) {
+	file := newTestFile(t, 5*time.Second)
+
+	// the sample durations and sizes move from the tfhd boxes to the trex
+	// boxes, data offsets become absolute and the decode times are left out
+	var moov *fmp4io.Movie
+	var init []byte
+	_ = forEachBox(file.init, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag != fmp4io.MOOV {
+			init = append(init, box...)
+			return
+		}
+		moov = &fmp4io.Movie{}
+		_, err = moov.Unmarshal(box, offset)
+		return
+	})
+	if moov == nil || moov.MovieExtend == nil {
+		t.Fatal("no mvex")
+	}
+	defaults := map[uint32]*fmp4io.TrackExtend{}
+	for _, trex := range moov.MovieExtend.Tracks {
+		defaults[trex.TrackID] = trex
+	}
+	b := rewriteMoofs(t, file.bytes(), func(moof *fmp4io.MovieFrag, offset int64) {
+		for _, traf := range moof.Tracks {
+			tfhd := traf.Header
+			trex := defaults[tfhd.TrackID]
+			if tfhd.Flags&fmp4io.TrackFragDefaultDuration == 0 || tfhd.Flags&fmp4io.TrackFragDefaultSize == 0 {
+				t.Fatalf("track %d has no default duration and size", tfhd.TrackID)
+			}
+			trex.DefaultSampleDuration = tfhd.DefaultDuration
+			trex.DefaultSampleSize = tfhd.DefaultSize
+			tfhd.Flags &^= fmp4io.TrackFragDefaultDuration | fmp4io.TrackFragDefaultSize | fmp4io.TrackFragDefaultBaseIsMOOF
+			tfhd.Flags |= fmp4io.TrackFragBaseDataOffset
+			tfhd.BaseDataOffset = uint64(offset)
+			if offset != 0 {
+				traf.DecodeTime = nil
+			}
+		}
+	})
+	moovb := make([]byte, moov.Len())
+	moov.Marshal(moovb)
+	init = append(init, moovb...)
+	// the rewritten moofs expected the init segment to keep its size
+	if len(init) != len(file.init) {
+		t.Fatalf("init segment went from %d to %d bytes", len(file.init), len(init))
+	}
+	_ = forEachBox(b, func(tag fmp4io.Tag, offset int, box []byte) error {
+		if tag == fmp4io.MOOV {
+			copy(b[offset:], moovb)
+		}
+		return nil
+	})
+
+	d := NewDemuxer(bytes.NewReader(b))
+	checkPackets(t, readPackets(t, d), file.written)
+}
+
+// withRandomAccess appends an mfra box listing the fragments of the video
+// track.
+func withRandomAccess(file *testFile, trackID uint32) []byte {
+	b := file.bytes()
+	tfra := &fmp4io.TrackFragRandomAccess{TrackID: trackID}
+	for i, offset := range file.moofs {
+		tfra.Entries = append(tfra.Entries, fmp4io.TrackFragRandomAccessEntry{
+			Time:         uint64(file.times[i] / time.Millisecond * 90),
+			MoofOffset:   uint64(offset),
+			TrafNumber:   1,
+			TrunNumber:   1,
+			SampleNumber: 1,
+		})
+	}
+	mfra := &fmp4io.MovieFragRandomAccess{
+		Tracks: []*fmp4io.TrackFragRandomAccess{tfra},
+		Offset: &fmp4io.MovieFragRandomAccessOffset{},
+	}
+	mfra.Offset.Size = uint32(mfra.Len())
+	mfrab := make([]byte, mfra.Len())
+	mfra.Marshal(mfrab)
+	return append(b, mfrab...)
+}
+
+// withSegmentIndex inserts a sidx box between the init segment and the
+// fragments.
+func withSegmentIndex(file *testFile, trackID uint32) []byte {
+	sidx := &fmp4io.SegmentIndex{
+		FullAtom:    fmp4io.FullAtom{Version: 1},
+		ReferenceID: trackID,
+		TimeScale:   90000,
+	}
+	for i, frag := range file.fragments {
+		end := 5 * time.Second
+		if i+1 < len(file.times) {
+			end = file.times[i+1]
+		}
+		sidx.References = append(sidx.References, fmp4io.SegmentReference{
+			ReferencedSize:     uint32(len(frag)),
+			SubsegmentDuration: uint32((end - file.times[i]) / time.Millisecond * 90),
+			StartsWithSAP:      true,
+			SAPType:            1,
+		})
+	}
+	sidxb := make([]byte, sidx.Len())
+	sidx.Marshal(sidxb)
+	b := append(append([]byte{}, file.init...), sidxb...)
+	for _, frag := range file.fragments {
+		b = append(b, frag...)
+	}
+	return b
+}
+
+func TestDemuxerSeek(t *testing.T) {
+	file := newTestFile(t, 5*time.Second)
+	trackID := newInitOrFatal(t, file.init).reference().trackID
+	values := []struct {
+		Name  string
+		File  []byte
+		Index func(d *Demuxer) ([]accessPoint, error)
+	}{
+		{"mfra", withRandomAccess(file, trackID), (*Demuxer).randomAccessIndex},
+		{"sidx", withSegmentIndex(file, trackID), func(d *Demuxer) ([]accessPoint, error) { return d.segmentIndexPoints(), nil }},
+		{"scan", file.bytes(), (*Demuxer).scanFragments},
+	}
+	for _, ex := range values {
+		d := NewDemuxer(bytes.NewReader(ex.File))
+		if _, err := d.Streams(); err != nil {
+			t.Fatal(err)
+		}
+		// the index comes from the intended source
+		index, err := ex.Index(d)
+		if err != nil || len(index) != len(file.times) {
+			t.Fatalf("%s: %d access points: %v", ex.Name, len(index), err)
+		}
+		for i, ap := range index {
+			if ap.time != file.times[i] {
+				t.Errorf("%s: access point %d at %s, want %s", ex.Name, i, ap.time, file.times[i])
+			}
+		}
+
+		for _, seek := range []struct{ To, Expected time.Duration }{
+			{2500 * time.Millisecond, 2 * time.Second},
+			{0, 0},
+			{3 * time.Second, 3 * time.Second},
+			{time.Hour, 4 * time.Second},
+		} {
+			if err = d.SeekToTime(seek.To); err != nil {
+				t.Fatal(err)
+			}
+			pkt, err := d.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pkt.Idx != 0 || !pkt.IsKeyFrame || pkt.Time != seek.Expected {
+				t.Errorf("%s: seek to %s read packet %d at %s", ex.Name, seek.To, pkt.Idx, pkt.Time)
+			}
+		}
+		// the rest follows the last fragment
+		if n := len(readPackets(t, d)); n < 40 {
+			t.Errorf("%s: read %d packets after the last seek", ex.Name, n)
+		}
+	}
+}
+
+func newInitOrFatal(t *testing.T, b []byte) *Init {
+	init, err := ParseInit(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return init
+}
+
+func TestIsFragmented(t *testing.T) {
+	file := newTestFile(t, 2*time.Second)
+
+	// the same moov without mvex
+	var flat []byte
+	_ = forEachBox(file.init, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag != fmp4io.MOOV {
+			flat = append(flat, box...)
+			return
+		}
+		moov := &fmp4io.Movie{}
+		if _, err = moov.Unmarshal(box, offset); err != nil {
+			return
+		}
+		moov.MovieExtend = nil
+		b := make([]byte, moov.Len())
+		moov.Marshal(b)
+		flat = append(flat, b...)
+		return
+	})
+	garbage := make([]byte, 16)
+	pio.PutU32BE(garbage, 4)
+
+	values := []struct {
+		Name     string
+		File     []byte
+		Expected bool
+	}{
+		{"file", file.bytes(), true},
+		{"init", file.init, true},
+		{"segment", file.fragments[1], true},
+		{"moov without mvex", flat, false},
+		{"invalid box", garbage, false},
+		{"empty", nil, false},
+	}
+	for _, ex := range values {
+		r := bytes.NewReader(append([]byte("xx"), ex.File...))
+		r.Seek(2, io.SeekStart)
+		if got := IsFragmented(r); got != ex.Expected {
+			t.Errorf("%s: got %v", ex.Name, got)
+		}
+		if pos, _ := r.Seek(0, io.SeekCurrent); pos != 2 {
+			t.Errorf("%s: left the read position at %d", ex.Name, pos)
+		}
+	}
+}
@@ -153,6 +153,8 @@ func ReadFileAtoms(r io.ReadSeeker) (atoms []Atom, err error) {
 			atom = &MovieFrag{}
 		case SIDX:
 			atom = &SegmentIndex{}
+		case MFRA:
+			atom = &MovieFragRandomAccess{}
 		}
 
 		if atom != nil {
@@ -0,0 +1,801 @@
+// Package fmp4io
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4io
+
+import "github.com/teocci/go-stream-av/utils/bits/pio"
+
+// Common Encryption boxes of ISO/IEC 23001-7.
+
+const (
+	ENCV = Tag(0x656e6376)
+	ENCA = Tag(0x656e6361)
+	SINF = Tag(0x73696e66)
+	FRMA = Tag(0x66726d61)
+	SCHM = Tag(0x7363686d)
+	SCHI = Tag(0x73636869)
+	TENC = Tag(0x74656e63)
+	SENC = Tag(0x73656e63)
+	SAIZ = Tag(0x7361697a)
+	SAIO = Tag(0x7361696f)
+	PSSH = Tag(0x70737368)
+)
+
+// Protection scheme types
+const (
+	SchemeCENC = Tag(0x63656e63)
+	SchemeCBCS = Tag(0x63626373)
+)
+
+// EncryptedSampleEntry is an encv or enca sample entry: the sample entry of
+// the clear format renamed, with a sinf box telling how it is protected.
+type EncryptedSampleEntry struct {
+	Tag_  Tag
+	Entry Atom
+	Sinf  *ProtectionSchemeInfo
+	AtomPos
+}
+
+func (a EncryptedSampleEntry) Tag() Tag {
+	return a.Tag_
+}
+
+func (a EncryptedSampleEntry) Marshal(b []byte) (n int) {
+	n += a.Entry.Marshal(b)
+	pio.PutU32BE(b[4:], uint32(a.Tag_))
+	if a.Sinf != nil {
+		n += a.Sinf.Marshal(b[n:])
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a EncryptedSampleEntry) Len() (n int) {
+	n += a.Entry.Len()
+	if a.Sinf != nil {
+		n += a.Sinf.Len()
+	}
+	return
+}
+
+// Unmarshal parses the entry as the original format given by the frma box,
+// without the sinf box.
+func (a *EncryptedSampleEntry) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	if len(b) < 8 {
+		err = parseErr("SampleEntry", offset, err)
+		return
+	}
+	a.Tag_ = Tag(pio.U32BE(b[4:]))
+	// size of the visual or audio sample entry fields
+	n = 8 + 28
+	if a.Tag_ == ENCV {
+		n = 8 + 78
+	}
+	if len(b) < n {
+		err = parseErr("SampleEntry", offset, err)
+		return
+	}
+	clear := append([]byte{}, b[:n]...)
+	for n+8 <= len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		if tag == SINF {
+			atom := &ProtectionSchemeInfo{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("sinf", n+offset, err)
+				return
+			}
+			a.Sinf = atom
+		} else {
+			clear = append(clear, b[n:n+size]...)
+		}
+		n += size
+	}
+	if a.Sinf == nil || a.Sinf.OriginalFormat == nil {
+		err = parseErr("frma", offset, err)
+		return
+	}
+
+	format := a.Sinf.OriginalFormat.Format
+	pio.PutU32BE(clear[0:], uint32(len(clear)))
+	pio.PutU32BE(clear[4:], uint32(format))
+	switch format {
+	case AVC1:
+		a.Entry = &AVC1Desc{}
+	case HVC1, HEV1:
+		a.Entry = &HEVCDesc{}
+	case MP4A:
+		a.Entry = &MP4ADesc{}
+	case OPUS:
+		a.Entry = &OpusSampleEntry{}
+	default:
+		a.Entry = &Dummy{Tag_: format}
+	}
+	if _, err = a.Entry.Unmarshal(clear, offset); err != nil {
+		err = parseErr(format.String(), offset, err)
+	}
+	return
+}
+
+func (a EncryptedSampleEntry) Children() (r []Atom) {
+	r = append(r, a.Entry)
+	if a.Sinf != nil {
+		r = append(r, a.Sinf)
+	}
+	return
+}
+
+// ProtectionSchemeInfo is the sinf box of a protected sample entry.
+type ProtectionSchemeInfo struct {
+	OriginalFormat *OriginalFormat
+	SchemeType     *SchemeType
+	SchemeInfo     *SchemeInfo
+	Unknowns       []Atom
+	AtomPos
+}
+
+func (a ProtectionSchemeInfo) Tag() Tag {
+	return SINF
+}
+
+func (a ProtectionSchemeInfo) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(SINF))
+	n += 8
+	for _, atom := range a.Children() {
+		n += atom.Marshal(b[n:])
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a ProtectionSchemeInfo) Len() (n int) {
+	n += 8
+	for _, atom := range a.Children() {
+		n += atom.Len()
+	}
+	return
+}
+
+func (a *ProtectionSchemeInfo) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	n += 8
+	for n+8 <= len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case FRMA:
+			atom := &OriginalFormat{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("frma", n+offset, err)
+				return
+			}
+			a.OriginalFormat = atom
+		case SCHM:
+			atom := &SchemeType{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("schm", n+offset, err)
+				return
+			}
+			a.SchemeType = atom
+		case SCHI:
+			atom := &SchemeInfo{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("schi", n+offset, err)
+				return
+			}
+			a.SchemeInfo = atom
+		default:
+			atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("", n+offset, err)
+				return
+			}
+			a.Unknowns = append(a.Unknowns, atom)
+		}
+		n += size
+	}
+	return
+}
+
+func (a ProtectionSchemeInfo) Children() (r []Atom) {
+	if a.OriginalFormat != nil {
+		r = append(r, a.OriginalFormat)
+	}
+	if a.SchemeType != nil {
+		r = append(r, a.SchemeType)
+	}
+	if a.SchemeInfo != nil {
+		r = append(r, a.SchemeInfo)
+	}
+	r = append(r, a.Unknowns...)
+	return
+}
+
+// OriginalFormat is the frma box, the type of the clear sample entry.
+type OriginalFormat struct {
+	Format Tag
+	AtomPos
+}
+
+func (a OriginalFormat) Tag() Tag {
+	return FRMA
+}
+
+func (a OriginalFormat) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[0:], 12)
+	pio.PutU32BE(b[4:], uint32(FRMA))
+	pio.PutU32BE(b[8:], uint32(a.Format))
+	return 12
+}
+
+func (a OriginalFormat) Len() int {
+	return 12
+}
+
+func (a *OriginalFormat) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	if len(b) < 12 {
+		err = parseErr("Format", offset+8, err)
+		return
+	}
+	a.Format = Tag(pio.U32BE(b[8:]))
+	return 12, nil
+}
+
+func (a OriginalFormat) Children() []Atom {
+	return nil
+}
+
+// SchemeType is the schm box, naming the protection scheme.
+type SchemeType struct {
+	FullAtom
+	Type    Tag
+	Version uint32
+}
+
+func (a SchemeType) Tag() Tag {
+	return SCHM
+}
+
+func (a SchemeType) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, SCHM)
+	pio.PutU32BE(b[n:], uint32(a.Type))
+	n += 4
+	pio.PutU32BE(b[n:], a.Version)
+	n += 4
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a SchemeType) Len() int {
+	return a.FullAtom.atomLen() + 8
+}
+
+func (a *SchemeType) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if len(b) < n+8 {
+		return 0, parseErr("Type", n+offset, nil)
+	}
+	a.Type = Tag(pio.U32BE(b[n:]))
+	n += 4
+	a.Version = pio.U32BE(b[n:])
+	n += 4
+	return
+}
+
+func (a SchemeType) Children() []Atom {
+	return nil
+}
+
+// SchemeInfo is the schi box, holding the tenc box for Common Encryption.
+type SchemeInfo struct {
+	TrackEncryption *TrackEncryption
+	Unknowns        []Atom
+	AtomPos
+}
+
+func (a SchemeInfo) Tag() Tag {
+	return SCHI
+}
+
+func (a SchemeInfo) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(SCHI))
+	n += 8
+	for _, atom := range a.Children() {
+		n += atom.Marshal(b[n:])
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a SchemeInfo) Len() (n int) {
+	n += 8
+	for _, atom := range a.Children() {
+		n += atom.Len()
+	}
+	return
+}
+
+func (a *SchemeInfo) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	n += 8
+	for n+8 <= len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		if tag == TENC {
+			atom := &TrackEncryption{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("tenc", n+offset, err)
+				return
+			}
+			a.TrackEncryption = atom
+		} else {
+			atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("", n+offset, err)
+				return
+			}
+			a.Unknowns = append(a.Unknowns, atom)
+		}
+		n += size
+	}
+	return
+}
+
+func (a SchemeInfo) Children() (r []Atom) {
+	if a.TrackEncryption != nil {
+		r = append(r, a.TrackEncryption)
+	}
+	r = append(r, a.Unknowns...)
+	return
+}
+
+// TrackEncryption is the tenc box, the default encryption parameters of a
+// track. The pattern needs version 1. ConstantIV is used when
+// PerSampleIVSize is 0.
+type TrackEncryption struct {
+	FullAtom
+	CryptByteBlock  uint8
+	SkipByteBlock   uint8
+	IsProtected     bool
+	PerSampleIVSize uint8
+	KID             [16]byte
+	ConstantIV      []byte
+}
+
+func (a TrackEncryption) Tag() Tag {
+	return TENC
+}
+
+func (a TrackEncryption) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	n += 4
+	n += 16
+	if a.IsProtected && a.PerSampleIVSize == 0 {
+		n += 1 + len(a.ConstantIV)
+	}
+	return
+}
+
+func (a TrackEncryption) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, TENC)
+	b[n] = 0
+	b[n+1] = 0
+	if a.Version != 0 {
+		b[n+1] = a.CryptByteBlock<<4 | a.SkipByteBlock&0xf
+	}
+	b[n+2] = 0
+	if a.IsProtected {
+		b[n+2] = 1
+	}
+	b[n+3] = a.PerSampleIVSize
+	n += 4
+	copy(b[n:], a.KID[:])
+	n += 16
+	if a.IsProtected && a.PerSampleIVSize == 0 {
+		b[n] = uint8(len(a.ConstantIV))
+		n++
+		copy(b[n:], a.ConstantIV)
+		n += len(a.ConstantIV)
+	}
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *TrackEncryption) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if len(b) < n+20 {
+		return 0, parseErr("KID", n+offset, nil)
+	}
+	if a.Version != 0 {
+		a.CryptByteBlock = b[n+1] >> 4
+		a.SkipByteBlock = b[n+1] & 0xf
+	}
+	a.IsProtected = b[n+2] != 0
+	a.PerSampleIVSize = b[n+3]
+	n += 4
+	copy(a.KID[:], b[n:])
+	n += 16
+	if a.IsProtected && a.PerSampleIVSize == 0 {
+		if len(b) < n+1 || len(b) < n+1+int(b[n]) {
+			return 0, parseErr("ConstantIV", n+offset, nil)
+		}
+		a.ConstantIV = append([]byte{}, b[n+1:n+1+int(b[n])]...)
+		n += 1 + len(a.ConstantIV)
+	}
+	return
+}
+
+func (a TrackEncryption) Children() []Atom {
+	return nil
+}
+
+// SampleEncryptionUseSubsamples is the senc flag for subsample encryption.
+const SampleEncryptionUseSubsamples = 0x2
+
+// SampleEncryption is the senc box of a track fragment, the IV and the
+// subsamples of every sample.
+type SampleEncryption struct {
+	FullAtom
+	Samples []SampleEncryptionEntry
+}
+
+type SampleEncryptionEntry struct {
+	IV         []byte
+	Subsamples []Subsample
+}
+
+// Subsample is a run of clear bytes followed by protected bytes.
+type Subsample struct {
+	ClearBytes     uint16
+	ProtectedBytes uint32
+}
+
+// Len returns the size of the auxiliary information of the entry, as listed
+// in saiz.
+func (e SampleEncryptionEntry) Len(subsamples bool) (n int) {
+	n = len(e.IV)
+	if subsamples {
+		n += 2 + 6*len(e.Subsamples)
+	}
+	return
+}
+
+func (a SampleEncryption) Tag() Tag {
+	return SENC
+}
+
+func (a SampleEncryption) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	n += 4
+	for _, e := range a.Samples {
+		n += e.Len(a.Flags&SampleEncryptionUseSubsamples != 0)
+	}
+	return
+}
+
+func (a SampleEncryption) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, SENC)
+	pio.PutU32BE(b[n:], uint32(len(a.Samples)))
+	n += 4
+	for _, e := range a.Samples {
+		copy(b[n:], e.IV)
+		n += len(e.IV)
+		if a.Flags&SampleEncryptionUseSubsamples != 0 {
+			pio.PutU16BE(b[n:], uint16(len(e.Subsamples)))
+			n += 2
+			for _, s := range e.Subsamples {
+				pio.PutU16BE(b[n:], s.ClearBytes)
+				pio.PutU32BE(b[n+2:], s.ProtectedBytes)
+				n += 6
+			}
+		}
+	}
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+// Unmarshal guesses the per sample IV size, which is only given by the tenc
+// box of the track, among 0, 8 and 16 bytes.
+func (a *SampleEncryption) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if len(b) < n+4 {
+		return 0, parseErr("SampleCount", n+offset, nil)
+	}
+	count := int(pio.U32BE(b[n:]))
+	n += 4
+	for _, ivSize := range []int{8, 16, 0} {
+		if samples, ok := a.parseSamples(b[n:], count, ivSize); ok {
+			a.Samples = samples
+			return len(b), nil
+		}
+	}
+	return 0, parseErr("Samples", n+offset, nil)
+}
+
+func (a *SampleEncryption) parseSamples(b []byte, count, ivSize int) (samples []SampleEncryptionEntry, ok bool) {
+	n := 0
+	for i := 0; i < count; i++ {
+		if len(b) < n+ivSize {
+			return
+		}
+		e := SampleEncryptionEntry{IV: b[n : n+ivSize]}
+		n += ivSize
+		if a.Flags&SampleEncryptionUseSubsamples != 0 {
+			if len(b) < n+2 {
+				return
+			}
+			subs := int(pio.U16BE(b[n:]))
+			n += 2
+			if len(b) < n+6*subs {
+				return
+			}
+			for j := 0; j < subs; j++ {
+				e.Subsamples = append(e.Subsamples, Subsample{
+					ClearBytes:     pio.U16BE(b[n:]),
+					ProtectedBytes: pio.U32BE(b[n+2:]),
+				})
+				n += 6
+			}
+		}
+		samples = append(samples, e)
+	}
+	return samples, n == len(b)
+}
+
+func (a SampleEncryption) Children() []Atom {
+	return nil
+}
+
+// SampleAuxInfoSizes is the saiz box, the size of the auxiliary information
+// of every sample, or DefaultSize for all of them.
+type SampleAuxInfoSizes struct {
+	FullAtom
+	DefaultSize uint8
+	SampleCount uint32
+	Sizes       []uint8
+}
+
+func (a SampleAuxInfoSizes) Tag() Tag {
+	return SAIZ
+}
+
+func (a SampleAuxInfoSizes) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	if a.Flags&1 != 0 {
+		n += 8
+	}
+	n += 5
+	if a.DefaultSize == 0 {
+		n += len(a.Sizes)
+	}
+	return
+}
+
+func (a SampleAuxInfoSizes) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, SAIZ)
+	if a.Flags&1 != 0 {
+		// aux_info_type and parameter, the protection scheme
+		n += 8
+	}
+	b[n] = a.DefaultSize
+	n++
+	pio.PutU32BE(b[n:], a.SampleCount)
+	n += 4
+	if a.DefaultSize == 0 {
+		copy(b[n:], a.Sizes)
+		n += len(a.Sizes)
+	}
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *SampleAuxInfoSizes) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if a.Flags&1 != 0 {
+		n += 8
+	}
+	if len(b) < n+5 {
+		return 0, parseErr("SampleCount", n+offset, nil)
+	}
+	a.DefaultSize = b[n]
+	a.SampleCount = pio.U32BE(b[n+1:])
+	n += 5
+	if a.DefaultSize == 0 {
+		if len(b) < n+int(a.SampleCount) {
+			return 0, parseErr("Sizes", n+offset, nil)
+		}
+		a.Sizes = b[n : n+int(a.SampleCount)]
+		n += int(a.SampleCount)
+	}
+	return
+}
+
+func (a SampleAuxInfoSizes) Children() []Atom {
+	return nil
+}
+
+// SampleAuxInfoOffsets is the saio box, where the auxiliary information
+// starts, relative to the same base as the trun data offset.
+type SampleAuxInfoOffsets struct {
+	FullAtom
+	Offsets []uint64
+}
+
+func (a SampleAuxInfoOffsets) Tag() Tag {
+	return SAIO
+}
+
+func (a SampleAuxInfoOffsets) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	if a.Flags&1 != 0 {
+		n += 8
+	}
+	n += 4
+	if a.Version == 0 {
+		n += 4 * len(a.Offsets)
+	} else {
+		n += 8 * len(a.Offsets)
+	}
+	return
+}
+
+func (a SampleAuxInfoOffsets) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, SAIO)
+	if a.Flags&1 != 0 {
+		n += 8
+	}
+	pio.PutU32BE(b[n:], uint32(len(a.Offsets)))
+	n += 4
+	for _, off := range a.Offsets {
+		if a.Version == 0 {
+			pio.PutU32BE(b[n:], uint32(off))
+			n += 4
+		} else {
+			pio.PutU64BE(b[n:], off)
+			n += 8
+		}
+	}
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *SampleAuxInfoOffsets) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if a.Flags&1 != 0 {
+		n += 8
+	}
+	if len(b) < n+4 {
+		return 0, parseErr("EntryCount", n+offset, nil)
+	}
+	count := int(pio.U32BE(b[n:]))
+	n += 4
+	size := 4
+	if a.Version != 0 {
+		size = 8
+	}
+	if len(b) < n+size*count {
+		return 0, parseErr("Offsets", n+offset, nil)
+	}
+	a.Offsets = make([]uint64, count)
+	for i := range a.Offsets {
+		if size == 4 {
+			a.Offsets[i] = uint64(pio.U32BE(b[n:]))
+		} else {
+			a.Offsets[i] = pio.U64BE(b[n:])
+		}
+		n += size
+	}
+	return
+}
+
+func (a SampleAuxInfoOffsets) Children() []Atom {
+	return nil
+}
+
+// ProtectionSystemHeader is the pssh box of a DRM system, passed through to
+// the moov box as it is.
+type ProtectionSystemHeader struct {
+	FullAtom
+	SystemID [16]byte
+	KIDs     [][16]byte
+	Data     []byte
+}
+
+func (a ProtectionSystemHeader) Tag() Tag {
+	return PSSH
+}
+
+func (a ProtectionSystemHeader) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	n += 16
+	if a.Version > 0 {
+		n += 4 + 16*len(a.KIDs)
+	}
+	n += 4 + len(a.Data)
+	return
+}
+
+func (a ProtectionSystemHeader) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, PSSH)
+	copy(b[n:], a.SystemID[:])
+	n += 16
+	if a.Version > 0 {
+		pio.PutU32BE(b[n:], uint32(len(a.KIDs)))
+		n += 4
+		for _, kid := range a.KIDs {
+			copy(b[n:], kid[:])
+			n += 16
+		}
+	}
+	pio.PutU32BE(b[n:], uint32(len(a.Data)))
+	n += 4
+	copy(b[n:], a.Data)
+	n += len(a.Data)
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *ProtectionSystemHeader) Unmarshal(b []byte, offset int) (n int, err error) {
+	if n, err = a.FullAtom.unmarshalAtom(b, offset); err != nil {
+		return
+	}
+	if len(b) < n+16 {
+		return 0, parseErr("SystemID", n+offset, nil)
+	}
+	copy(a.SystemID[:], b[n:])
+	n += 16
+	if a.Version > 0 {
+		if len(b) < n+4 {
+			return 0, parseErr("KIDCount", n+offset, nil)
+		}
+		count := int(pio.U32BE(b[n:]))
+		n += 4
+		if count < 0 || len(b) < n+16*count {
+			return 0, parseErr("KIDs", n+offset, nil)
+		}
+		a.KIDs = make([][16]byte, count)
+		for i := range a.KIDs {
+			copy(a.KIDs[i][:], b[n:])
+			n += 16
+		}
+	}
+	if len(b) < n+4 {
+		return 0, parseErr("DataSize", n+offset, nil)
+	}
+	size := int(pio.U32BE(b[n:]))
+	n += 4
+	if size < 0 || len(b) < n+size {
+		return 0, parseErr("Data", n+offset, nil)
+	}
+	a.Data = append([]byte{}, b[n:n+size]...)
+	n += size
+	return
+}
+
+func (a ProtectionSystemHeader) Children() []Atom {
+	return nil
+}
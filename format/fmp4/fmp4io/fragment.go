@@ -452,7 +452,11 @@ type TrackFrag struct {
 	Header     *TrackFragHeader
 	DecodeTime *TrackFragDecodeTime
 	Run        *TrackFragRun
-	Unknowns   []Atom
+	// auxiliary information of Common Encryption
+	AuxInfoSizes     *SampleAuxInfoSizes
+	AuxInfoOffsets   *SampleAuxInfoOffsets
+	SampleEncryption *SampleEncryption
+	Unknowns         []Atom
 	AtomPos
 }
 
@@ -473,6 +477,15 @@ func (a TrackFrag) marshal(b []byte) (n int) {
 	if a.Run != nil {
 		n += a.Run.Marshal(b[n:])
 	}
+	if a.AuxInfoSizes != nil {
+		n += a.AuxInfoSizes.Marshal(b[n:])
+	}
+	if a.AuxInfoOffsets != nil {
+		n += a.AuxInfoOffsets.Marshal(b[n:])
+	}
+	if a.SampleEncryption != nil {
+		n += a.SampleEncryption.Marshal(b[n:])
+	}
 	for _, atom := range a.Unknowns {
 		n += atom.Marshal(b[n:])
 	}
@@ -490,12 +503,45 @@ func (a TrackFrag) Len() (n int) {
 	if a.Run != nil {
 		n += a.Run.Len()
 	}
+	if a.AuxInfoSizes != nil {
+		n += a.AuxInfoSizes.Len()
+	}
+	if a.AuxInfoOffsets != nil {
+		n += a.AuxInfoOffsets.Len()
+	}
+	if a.SampleEncryption != nil {
+		n += a.SampleEncryption.Len()
+	}
 	for _, atom := range a.Unknowns {
 		n += atom.Len()
 	}
 	return
 }
 
+// SampleEncryptionOffset returns the offset of the first sample entry of the
+// senc box from the start of the traf box.
+func (a TrackFrag) SampleEncryptionOffset() (n int) {
+	n += 8
+	if a.Header != nil {
+		n += a.Header.Len()
+	}
+	if a.DecodeTime != nil {
+		n += a.DecodeTime.Len()
+	}
+	if a.Run != nil {
+		n += a.Run.Len()
+	}
+	if a.AuxInfoSizes != nil {
+		n += a.AuxInfoSizes.Len()
+	}
+	if a.AuxInfoOffsets != nil {
+		n += a.AuxInfoOffsets.Len()
+	}
+	// senc header and sample count
+	n += 16
+	return
+}
+
 func (a *TrackFrag) Unmarshal(b []byte, offset int) (n int, err error) {
 	(&a.AtomPos).setPos(offset, len(b))
 	n += 8
@@ -534,6 +580,33 @@ func (a *TrackFrag) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				a.Run = atom
 			}
+		case SAIZ:
+			{
+				atom := &SampleAuxInfoSizes{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("saiz", n+offset, err)
+					return
+				}
+				a.AuxInfoSizes = atom
+			}
+		case SAIO:
+			{
+				atom := &SampleAuxInfoOffsets{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("saio", n+offset, err)
+					return
+				}
+				a.AuxInfoOffsets = atom
+			}
+		case SENC:
+			{
+				atom := &SampleEncryption{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("senc", n+offset, err)
+					return
+				}
+				a.SampleEncryption = atom
+			}
 		default:
 			{
 				atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
@@ -559,6 +632,15 @@ func (a TrackFrag) Children() (r []Atom) {
 	if a.Run != nil {
 		r = append(r, a.Run)
 	}
+	if a.AuxInfoSizes != nil {
+		r = append(r, a.AuxInfoSizes)
+	}
+	if a.AuxInfoOffsets != nil {
+		r = append(r, a.AuxInfoOffsets)
+	}
+	if a.SampleEncryption != nil {
+		r = append(r, a.SampleEncryption)
+	}
 	r = append(r, a.Unknowns...)
 	return
 }
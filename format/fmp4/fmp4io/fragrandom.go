@@ -0,0 +1,268 @@
+// Package fmp4io
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4io
+
+import "github.com/teocci/go-stream-av/utils/bits/pio"
+
+const (
+	MFRA = Tag(0x6d667261)
+	TFRA = Tag(0x74667261)
+	MFRO = Tag(0x6d66726f)
+)
+
+// MovieFragRandomAccess is the mfra box at the end of a fragmented file,
+// listing the sync samples of each track.
+type MovieFragRandomAccess struct {
+	Tracks   []*TrackFragRandomAccess
+	Offset   *MovieFragRandomAccessOffset
+	Unknowns []Atom
+	AtomPos
+}
+
+func (a MovieFragRandomAccess) Tag() Tag {
+	return MFRA
+}
+
+func (a MovieFragRandomAccess) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(MFRA))
+	n += 8
+	for _, atom := range a.Tracks {
+		n += atom.Marshal(b[n:])
+	}
+	for _, atom := range a.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	if a.Offset != nil {
+		n += a.Offset.Marshal(b[n:])
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a MovieFragRandomAccess) Len() (n int) {
+	n += 8
+	for _, atom := range a.Tracks {
+		n += atom.Len()
+	}
+	for _, atom := range a.Unknowns {
+		n += atom.Len()
+	}
+	if a.Offset != nil {
+		n += a.Offset.Len()
+	}
+	return
+}
+
+func (a *MovieFragRandomAccess) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	n += 8
+	for n+8 <= len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case TFRA:
+			atom := &TrackFragRandomAccess{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("tfra", n+offset, err)
+				return
+			}
+			a.Tracks = append(a.Tracks, atom)
+		case MFRO:
+			atom := &MovieFragRandomAccessOffset{}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("mfro", n+offset, err)
+				return
+			}
+			a.Offset = atom
+		default:
+			atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
+			if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+				err = parseErr("", n+offset, err)
+				return
+			}
+			a.Unknowns = append(a.Unknowns, atom)
+		}
+		n += size
+	}
+	return
+}
+
+func (a MovieFragRandomAccess) Children() (r []Atom) {
+	for _, atom := range a.Tracks {
+		r = append(r, atom)
+	}
+	r = append(r, a.Unknowns...)
+	if a.Offset != nil {
+		r = append(r, a.Offset)
+	}
+	return
+}
+
+// TrackFragRandomAccess lists the sync samples of a track and the moof
+// holding each of them. Marshal always writes 4 byte traf, trun and sample
+// numbers.
+type TrackFragRandomAccess struct {
+	FullAtom
+	TrackID uint32
+	Entries []TrackFragRandomAccessEntry
+}
+
+// TrackFragRandomAccessEntry locates a sync sample. The numbers start at 1.
+type TrackFragRandomAccessEntry struct {
+	Time         uint64
+	MoofOffset   uint64
+	TrafNumber   uint32
+	TrunNumber   uint32
+	SampleNumber uint32
+}
+
+func (a TrackFragRandomAccess) Tag() Tag {
+	return TFRA
+}
+
+func (a TrackFragRandomAccess) Len() (n int) {
+	n = a.FullAtom.atomLen()
+	n += 4
+	n += 4
+	n += 4
+	entryLen := 8 + 12
+	if a.Version == 1 {
+		entryLen += 8
+	}
+	n += entryLen * len(a.Entries)
+	return
+}
+
+func (a TrackFragRandomAccess) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, TFRA)
+	pio.PutU32BE(b[n:], a.TrackID)
+	n += 4
+	pio.PutU32BE(b[n:], 0x3f) // 4 byte numbers
+	n += 4
+	pio.PutU32BE(b[n:], uint32(len(a.Entries)))
+	n += 4
+	for _, entry := range a.Entries {
+		if a.Version == 1 {
+			pio.PutU64BE(b[n:], entry.Time)
+			n += 8
+			pio.PutU64BE(b[n:], entry.MoofOffset)
+			n += 8
+		} else {
+			pio.PutU32BE(b[n:], uint32(entry.Time))
+			n += 4
+			pio.PutU32BE(b[n:], uint32(entry.MoofOffset))
+			n += 4
+		}
+		pio.PutU32BE(b[n:], entry.TrafNumber)
+		n += 4
+		pio.PutU32BE(b[n:], entry.TrunNumber)
+		n += 4
+		pio.PutU32BE(b[n:], entry.SampleNumber)
+		n += 4
+	}
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *TrackFragRandomAccess) Unmarshal(b []byte, offset int) (n int, err error) {
+	n, err = a.FullAtom.unmarshalAtom(b, offset)
+	if err != nil {
+		return
+	}
+	if len(b) < n+12 {
+		return 0, parseErr("TrackID", n+offset, nil)
+	}
+	a.TrackID = pio.U32BE(b[n:])
+	n += 4
+	sizes := pio.U32BE(b[n:])
+	n += 4
+	count := int(pio.U32BE(b[n:]))
+	n += 4
+	trafSize := int(sizes>>4&3) + 1
+	trunSize := int(sizes>>2&3) + 1
+	sampleSize := int(sizes&3) + 1
+	timeSize := 4
+	if a.Version == 1 {
+		timeSize = 8
+	}
+	entryLen := 2*timeSize + trafSize + trunSize + sampleSize
+	if count < 0 || len(b) < n+entryLen*count {
+		return 0, parseErr("Entries", n+offset, nil)
+	}
+	a.Entries = make([]TrackFragRandomAccessEntry, count)
+	for i := range a.Entries {
+		entry := &a.Entries[i]
+		if timeSize == 8 {
+			entry.Time = pio.U64BE(b[n:])
+			entry.MoofOffset = pio.U64BE(b[n+8:])
+		} else {
+			entry.Time = uint64(pio.U32BE(b[n:]))
+			entry.MoofOffset = uint64(pio.U32BE(b[n+4:]))
+		}
+		n += 2 * timeSize
+		entry.TrafNumber = getUint(b[n:], trafSize)
+		n += trafSize
+		entry.TrunNumber = getUint(b[n:], trunSize)
+		n += trunSize
+		entry.SampleNumber = getUint(b[n:], sampleSize)
+		n += sampleSize
+	}
+	return
+}
+
+func (a TrackFragRandomAccess) Children() []Atom {
+	return nil
+}
+
+// getUint reads a big endian number of size bytes.
+func getUint(b []byte, size int) (v uint32) {
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint32(b[i])
+	}
+	return
+}
+
+// MovieFragRandomAccessOffset ends an mfra box with its size, so that it can
+// be found from the end of the file.
+type MovieFragRandomAccessOffset struct {
+	FullAtom
+	Size uint32
+}
+
+func (a MovieFragRandomAccessOffset) Tag() Tag {
+	return MFRO
+}
+
+func (a MovieFragRandomAccessOffset) Len() int {
+	return a.FullAtom.atomLen() + 4
+}
+
+func (a MovieFragRandomAccessOffset) Marshal(b []byte) (n int) {
+	n = a.FullAtom.marshalAtom(b, MFRO)
+	pio.PutU32BE(b[n:], a.Size)
+	n += 4
+	pio.PutU32BE(b, uint32(n))
+	return
+}
+
+func (a *MovieFragRandomAccessOffset) Unmarshal(b []byte, offset int) (n int, err error) {
+	n, err = a.FullAtom.unmarshalAtom(b, offset)
+	if err != nil {
+		return
+	}
+	if len(b) < n+4 {
+		return 0, parseErr("Size", n+offset, nil)
+	}
+	a.Size = pio.U32BE(b[n:])
+	n += 4
+	return
+}
+
+func (a MovieFragRandomAccessOffset) Children() []Atom {
+	return nil
+}
@@ -0,0 +1,305 @@
+// Package fmp4io
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4io
+
+import "github.com/teocci/go-stream-av/utils/bits/pio"
+
+const (
+	HVC1 = Tag(0x68766331)
+	HEV1 = Tag(0x68657631)
+)
+
+// HEVCDesc is a hvc1 or hev1 visual sample entry, as given by Tag_. Parameter
+// sets of hvc1 are only in the configuration, hev1 also allows them in the
+// samples.
+type HEVCDesc struct {
+	Tag_                 Tag
+	DataRefIdx           int16
+	Version              int16
+	Revision             int16
+	Vendor               int32
+	TemporalQuality      int32
+	SpatialQuality       int32
+	Width                int16
+	Height               int16
+	HorizontalResolution float64
+	VorizontalResolution float64
+	FrameCount           int16
+	CompressorName       [32]byte
+	Depth                int16
+	ColorTableId         int16
+	Conf                 *HEVCConf
+	PixelAspect          *PixelAspect
+	Unknowns             []Atom
+	AtomPos
+}
+
+func (a HEVCDesc) Tag() Tag {
+	return a.Tag_
+}
+
+func (a HEVCDesc) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(a.Tag_))
+	n += a.marshal(b[8:]) + 8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a HEVCDesc) marshal(b []byte) (n int) {
+	n += 6
+	pio.PutI16BE(b[n:], a.DataRefIdx)
+	n += 2
+	pio.PutI16BE(b[n:], a.Version)
+	n += 2
+	pio.PutI16BE(b[n:], a.Revision)
+	n += 2
+	pio.PutI32BE(b[n:], a.Vendor)
+	n += 4
+	pio.PutI32BE(b[n:], a.TemporalQuality)
+	n += 4
+	pio.PutI32BE(b[n:], a.SpatialQuality)
+	n += 4
+	pio.PutI16BE(b[n:], a.Width)
+	n += 2
+	pio.PutI16BE(b[n:], a.Height)
+	n += 2
+	PutFixed32(b[n:], a.HorizontalResolution)
+	n += 4
+	PutFixed32(b[n:], a.VorizontalResolution)
+	n += 4
+	n += 4
+	pio.PutI16BE(b[n:], a.FrameCount)
+	n += 2
+	copy(b[n:], a.CompressorName[:])
+	n += len(a.CompressorName[:])
+	pio.PutI16BE(b[n:], a.Depth)
+	n += 2
+	pio.PutI16BE(b[n:], a.ColorTableId)
+	n += 2
+	if a.Conf != nil {
+		n += a.Conf.Marshal(b[n:])
+	}
+	if a.PixelAspect != nil {
+		n += a.PixelAspect.Marshal(b[n:])
+	}
+	for _, atom := range a.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+
+func (a HEVCDesc) Len() (n int) {
+	n += 8
+	n += 6
+	n += 2
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += len(a.CompressorName[:])
+	n += 2
+	n += 2
+	if a.Conf != nil {
+		n += a.Conf.Len()
+	}
+	if a.PixelAspect != nil {
+		n += a.PixelAspect.Len()
+	}
+	for _, atom := range a.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+
+func (a *HEVCDesc) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	a.Tag_ = Tag(pio.U32BE(b[4:]))
+	n += 8
+	n += 6
+	if len(b) < n+2 {
+		err = parseErr("DataRefIdx", n+offset, err)
+		return
+	}
+	a.DataRefIdx = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Version", n+offset, err)
+		return
+	}
+	a.Version = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Revision", n+offset, err)
+		return
+	}
+	a.Revision = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("Vendor", n+offset, err)
+		return
+	}
+	a.Vendor = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("TemporalQuality", n+offset, err)
+		return
+	}
+	a.TemporalQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("SpatialQuality", n+offset, err)
+		return
+	}
+	a.SpatialQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("Width", n+offset, err)
+		return
+	}
+	a.Width = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Height", n+offset, err)
+		return
+	}
+	a.Height = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("HorizontalResolution", n+offset, err)
+		return
+	}
+	a.HorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("VorizontalResolution", n+offset, err)
+		return
+	}
+	a.VorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("FrameCount", n+offset, err)
+		return
+	}
+	a.FrameCount = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+len(a.CompressorName) {
+		err = parseErr("CompressorName", n+offset, err)
+		return
+	}
+	copy(a.CompressorName[:], b[n:])
+	n += len(a.CompressorName)
+	if len(b) < n+2 {
+		err = parseErr("Depth", n+offset, err)
+		return
+	}
+	a.Depth = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("ColorTableId", n+offset, err)
+		return
+	}
+	a.ColorTableId = pio.I16BE(b[n:])
+	n += 2
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case HVCC:
+			{
+				atom := &HEVCConf{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hvcC", n+offset, err)
+					return
+				}
+				a.Conf = atom
+			}
+		case PASP:
+			{
+				atom := &PixelAspect{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("pasp", n+offset, err)
+					return
+				}
+				a.PixelAspect = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				a.Unknowns = append(a.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+
+func (a HEVCDesc) Children() (r []Atom) {
+	if a.Conf != nil {
+		r = append(r, a.Conf)
+	}
+	if a.PixelAspect != nil {
+		r = append(r, a.PixelAspect)
+	}
+	r = append(r, a.Unknowns...)
+	return
+}
+
+const HVCC = Tag(0x68766343)
+
+// HEVCConf holds a HEVCDecoderConfigurationRecord.
+type HEVCConf struct {
+	Data []byte
+	AtomPos
+}
+
+func (a HEVCConf) Tag() Tag {
+	return HVCC
+}
+
+func (a HEVCConf) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(HVCC))
+	n += a.marshal(b[8:]) + 8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (a HEVCConf) marshal(b []byte) (n int) {
+	copy(b[n:], a.Data[:])
+	n += len(a.Data[:])
+	return
+}
+
+func (a HEVCConf) Len() (n int) {
+	n += 8
+	n += len(a.Data[:])
+	return
+}
+
+func (a *HEVCConf) Unmarshal(b []byte, offset int) (n int, err error) {
+	a.AtomPos.setPos(offset, len(b))
+	n += 8
+	a.Data = b[n:]
+	n += len(b[n:])
+	return
+}
+
+func (a HEVCConf) Children() (r []Atom) {
+	return
+}
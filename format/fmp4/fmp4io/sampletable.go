@@ -192,11 +192,13 @@ func (a SampleTable) Tag() Tag {
 const STSD = Tag(0x73747364)
 
 type SampleDesc struct {
-	Version  uint8
-	AVC1Desc *AVC1Desc
-	MP4ADesc *MP4ADesc
-	OpusDesc *OpusSampleEntry
-	Unknowns []Atom
+	Version   uint8
+	AVC1Desc  *AVC1Desc
+	HEVCDesc  *HEVCDesc
+	MP4ADesc  *MP4ADesc
+	OpusDesc  *OpusSampleEntry
+	Encrypted *EncryptedSampleEntry
+	Unknowns  []Atom
 	AtomPos
 }
 
@@ -215,24 +217,36 @@ func (a SampleDesc) marshal(b []byte) (n int) {
 	if a.AVC1Desc != nil {
 		_childrenNR++
 	}
+	if a.HEVCDesc != nil {
+		_childrenNR++
+	}
 	if a.MP4ADesc != nil {
 		_childrenNR++
 	}
 	if a.OpusDesc != nil {
 		_childrenNR++
 	}
+	if a.Encrypted != nil {
+		_childrenNR++
+	}
 	_childrenNR += len(a.Unknowns)
 	pio.PutI32BE(b[n:], int32(_childrenNR))
 	n += 4
 	if a.AVC1Desc != nil {
 		n += a.AVC1Desc.Marshal(b[n:])
 	}
+	if a.HEVCDesc != nil {
+		n += a.HEVCDesc.Marshal(b[n:])
+	}
 	if a.MP4ADesc != nil {
 		n += a.MP4ADesc.Marshal(b[n:])
 	}
 	if a.OpusDesc != nil {
 		n += a.OpusDesc.Marshal(b[n:])
 	}
+	if a.Encrypted != nil {
+		n += a.Encrypted.Marshal(b[n:])
+	}
 	for _, atom := range a.Unknowns {
 		n += atom.Marshal(b[n:])
 	}
@@ -247,12 +261,18 @@ func (a SampleDesc) Len() (n int) {
 	if a.AVC1Desc != nil {
 		n += a.AVC1Desc.Len()
 	}
+	if a.HEVCDesc != nil {
+		n += a.HEVCDesc.Len()
+	}
 	if a.MP4ADesc != nil {
 		n += a.MP4ADesc.Len()
 	}
 	if a.OpusDesc != nil {
 		n += a.OpusDesc.Len()
 	}
+	if a.Encrypted != nil {
+		n += a.Encrypted.Len()
+	}
 	for _, atom := range a.Unknowns {
 		n += atom.Len()
 	}
@@ -287,6 +307,15 @@ func (a *SampleDesc) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				a.AVC1Desc = atom
 			}
+		case HVC1, HEV1:
+			{
+				atom := &HEVCDesc{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr(tag.String(), n+offset, err)
+					return
+				}
+				a.HEVCDesc = atom
+			}
 		case MP4A:
 			{
 				atom := &MP4ADesc{}
@@ -303,6 +332,16 @@ func (a *SampleDesc) Unmarshal(b []byte, offset int) (n int, err error) {
 					err = parseErr("OPUS", n+offset, err)
 					return
 				}
+				a.OpusDesc = atom
+			}
+		case ENCV, ENCA:
+			{
+				atom := &EncryptedSampleEntry{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr(tag.String(), n+offset, err)
+					return
+				}
+				a.Encrypted = atom
 			}
 		default:
 			{
@@ -323,12 +362,18 @@ func (a SampleDesc) Children() (r []Atom) {
 	if a.AVC1Desc != nil {
 		r = append(r, a.AVC1Desc)
 	}
+	if a.HEVCDesc != nil {
+		r = append(r, a.HEVCDesc)
+	}
 	if a.MP4ADesc != nil {
 		r = append(r, a.MP4ADesc)
 	}
 	if a.OpusDesc != nil {
 		r = append(r, a.OpusDesc)
 	}
+	if a.Encrypted != nil {
+		r = append(r, a.Encrypted)
+	}
 	r = append(r, a.Unknowns...)
 	return
 }
@@ -0,0 +1,47 @@
+// Package fmp4io
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4io
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSegmentIndexRoundTrip(t *testing.T) {
+	for _, version := range []uint8{0, 1} {
+		s := SegmentIndex{
+			FullAtom:    FullAtom{Version: version},
+			ReferenceID: 1,
+			TimeScale:   90000,
+			EarliestPTS: 1234,
+			FirstOffset: 56,
+			References: []SegmentReference{
+				{ReferencedSize: 0x7fffffff, SubsegmentDuration: 180000, StartsWithSAP: true, SAPType: 1},
+				{ReferencesBox: true, ReferencedSize: 5304, SubsegmentDuration: 90000, SAPType: 3, SAPDeltaTime: 0x0fffffff},
+				{ReferencedSize: 1, SubsegmentDuration: 1, StartsWithSAP: true, SAPType: 7, SAPDeltaTime: 42},
+			},
+		}
+		b := make([]byte, s.Len())
+		if n := s.Marshal(b); n != len(b) {
+			t.Fatalf("version %d: marshaled %d bytes, want %d", version, n, len(b))
+		}
+
+		got := SegmentIndex{}
+		n, err := got.Unmarshal(b, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(b) {
+			t.Errorf("version %d: unmarshaled %d bytes, want %d", version, n, len(b))
+		}
+		got.AtomPos = AtomPos{}
+		if !reflect.DeepEqual(got, s) {
+			t.Errorf("version %d: got %+v, want %+v", version, got, s)
+		}
+
+		if _, err = got.Unmarshal(b[:len(b)-1], 0); err == nil {
+			t.Errorf("version %d: expected an error for a truncated box", version)
+		}
+	}
+}
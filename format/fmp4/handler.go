@@ -0,0 +1,35 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/av/avutil"
+)
+
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC, av.OPUS}
+
+// Handler demuxes fragmented MP4, either .m4s files made of an init segment
+// followed by media segments, or probed ones. Fragmented .mp4 files are
+// passed on by the mp4 handler.
+func Handler(h *avutil.RegisterHandler) {
+	h.Ext = ".m4s"
+
+	h.Probe = func(b []byte) bool {
+		switch string(b[4:8]) {
+		case "styp", "moof", "sidx":
+			return true
+		}
+		return bytes.Contains(b, []byte("mvex"))
+	}
+
+	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
+		return NewDemuxer(r.(io.ReadSeeker))
+	}
+
+	h.CodecTypes = CodecTypes
+}
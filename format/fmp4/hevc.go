@@ -0,0 +1,94 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"fmt"
+
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+// SetHEVCSampleEntry selects the sample entry of a H265 track. With
+// fmp4io.HVC1, the default and the one Safari requires, the parameter sets
+// are only in the init segment and are removed from the samples. With
+// fmp4io.HEV1 they are also kept in band. It has no effect on other codecs.
+func (f *TrackFragmenter) SetHEVCSampleEntry(tag fmp4io.Tag) (err error) {
+	if tag != fmp4io.HVC1 && tag != fmp4io.HEV1 {
+		return fmt.Errorf("mp4: %v is not a HEVC sample entry", tag)
+	}
+	if _, ok := f.codecData.(h265parser.CodecData); !ok {
+		return
+	}
+	f.hevcEntry = tag
+	if f.atom, err = f.Track(); err != nil {
+		return
+	}
+	f.fhdr, err = MovieHeader([]*fmp4io.Track{f.atom}, f.pssh()...)
+	return
+}
+
+// SetHEVCSampleEntry selects the sample entry of the H265 tracks, see
+// TrackFragmenter.SetHEVCSampleEntry.
+func (f *MovieFragmenter) SetHEVCSampleEntry(tag fmp4io.Tag) (err error) {
+	atoms := make([]*fmp4io.Track, len(f.tracks))
+	for i, track := range f.tracks {
+		if err = track.SetHEVCSampleEntry(tag); err != nil {
+			return
+		}
+		atoms[i] = track.atom
+	}
+	f.fhdr, err = MovieHeader(atoms, f.tracks[0].pssh()...)
+	return
+}
+
+// hevcSampleEntry returns the sample entry for a H265 stream
+func (f *TrackFragmenter) hevcSampleEntry(cd h265parser.CodecData) (*fmp4io.HEVCDesc, error) {
+	tag := f.hevcEntry
+	if tag == 0 {
+		tag = fmp4io.HVC1
+	}
+	conf, err := cd.HEVCDecoderConfRecordBytes(tag == fmp4io.HVC1)
+	if err != nil {
+		return nil, err
+	}
+	return &fmp4io.HEVCDesc{
+		Tag_:                 tag,
+		DataRefIdx:           1,
+		HorizontalResolution: 72,
+		VorizontalResolution: 72,
+		Width:                int16(cd.Width()),
+		Height:               int16(cd.Height()),
+		FrameCount:           1,
+		Depth:                24,
+		ColorTableId:         -1,
+		Conf:                 &fmp4io.HEVCConf{Data: conf},
+	}, nil
+}
+
+// hevcSample reformats the NALUs of a H265 access unit as length prefixed,
+// dropping the parameter sets for hvc1. It also tells whether the access unit
+// is a random access point.
+func (f *TrackFragmenter) hevcSample(data []byte) (b []byte, irap bool) {
+	nalus, _ := h265parser.SplitNALUs(data)
+	b = make([]byte, 0, len(data)+3*len(nalus))
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		typ := (nalu[0] >> 1) & 0x3f
+		switch {
+		case typ >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && typ <= h265parser.NAL_UNIT_RESERVED_IRAP_VCL23:
+			irap = true
+		case typ >= h265parser.NAL_UNIT_VPS && typ <= h265parser.NAL_UNIT_PPS:
+			if f.hevcEntry != fmp4io.HEV1 {
+				continue
+			}
+		}
+		j := len(nalu)
+		b = append(b, byte(j>>24), byte(j>>16), byte(j>>8), byte(j))
+		b = append(b, nalu...)
+	}
+	return
+}
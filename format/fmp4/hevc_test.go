@@ -0,0 +1,161 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+var (
+	hevcVPS = unhex("40010c01ffff016000000300900000030000030078959809")
+	hevcSPS = unhex("420101016000000300900000030000030078a003c08010e596566a24cae010000003001000000301e080")
+	hevcPPS = unhex("4401c172b46240")
+)
+
+func testH265(t *testing.T) h265parser.CodecData {
+	cd, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(hevcVPS, hevcSPS, hevcPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd
+}
+
+// annexB joins nalus with start codes.
+func annexB(nalus ...[]byte) (b []byte) {
+	for _, nalu := range nalus {
+		b = append(append(b, 0, 0, 0, 1), nalu...)
+	}
+	return
+}
+
+// hevcSlice returns a slice NAL unit of type typ.
+func hevcSlice(typ byte) []byte {
+	return append([]byte{typ << 1, 1}, bytes.Repeat([]byte{0xaf}, 20)...)
+}
+
+// sampleEntry returns the HEVC sample entry of the init segment.
+func sampleEntry(t *testing.T, init []byte) *fmp4io.HEVCDesc {
+	t.Helper()
+	var moov *fmp4io.Movie
+	_ = forEachBox(init, func(tag fmp4io.Tag, offset int, box []byte) (err error) {
+		if tag == fmp4io.MOOV {
+			moov = &fmp4io.Movie{}
+			_, err = moov.Unmarshal(box, offset)
+		}
+		return
+	})
+	if moov == nil {
+		t.Fatal("no moov")
+	}
+	for _, tag := range []fmp4io.Tag{fmp4io.HVC1, fmp4io.HEV1} {
+		if desc, ok := fmp4io.FindChildren(moov, tag).(*fmp4io.HEVCDesc); ok {
+			return desc
+		}
+	}
+	t.Fatal("no HEVC sample entry")
+	return nil
+}
+
+func TestHEVCSampleEntry(t *testing.T) {
+	for _, tag := range []fmp4io.Tag{0, fmp4io.HVC1, fmp4io.HEV1} {
+		f, err := NewTrack(testH265(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != 0 {
+			if err = f.SetHEVCSampleEntry(tag); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, _, init := f.MovieHeader()
+		desc := sampleEntry(t, init)
+		want := tag
+		if want == 0 {
+			want = fmp4io.HVC1
+		}
+		if desc.Tag_ != want {
+			t.Errorf("%v: sample entry %v", tag, desc.Tag_)
+		}
+
+		// hvcC holds VPS, SPS and PPS, complete for hvc1 only
+		conf := desc.Conf.Data
+		if conf[0] != 1 || conf[1] != 0x01 || conf[12] != 0x78 || conf[21]&3 != 3 || conf[22] != 3 {
+			t.Errorf("%v: unexpected hvcC header %x", tag, conf[:23])
+		}
+		b := conf[23:]
+		for _, ps := range [][]byte{hevcVPS, hevcSPS, hevcPPS} {
+			typ := (ps[0] >> 1) & 0x3f
+			if b[0]&0x3f != typ || (b[0]&0x80 != 0) != (want == fmp4io.HVC1) {
+				t.Errorf("%v: array header %x for NAL unit type %d", tag, b[0], typ)
+			}
+			if n := int(b[3])<<8 | int(b[4]); b[1] != 0 || b[2] != 1 || !bytes.Equal(b[5:5+n], ps) {
+				t.Errorf("%v: unexpected array of NAL unit type %d", tag, typ)
+			}
+			b = b[5+len(ps):]
+		}
+		if len(b) != 0 {
+			t.Errorf("%v: %d trailing hvcC bytes", tag, len(b))
+		}
+		if init, err := ParseInit(init); err != nil || len(init.Streams()) != 1 {
+			t.Errorf("%v: %v", tag, err)
+		}
+	}
+
+	if err := (&TrackFragmenter{}).SetHEVCSampleEntry(fmp4io.AVC1); err == nil {
+		t.Error("expected an error for avc1")
+	}
+}
+
+func TestHEVCSample(t *testing.T) {
+	values := []struct {
+		Typ byte
+		Key bool
+	}{
+		{h265parser.NAL_UNIT_CODED_SLICE_TRAIL_R, false},
+		{h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP, true},
+		{h265parser.NAL_UNIT_CODED_SLICE_IDR_W_RADL, true},
+		{h265parser.NAL_UNIT_CODED_SLICE_IDR_N_LP, true},
+		{h265parser.NAL_UNIT_CODED_SLICE_CRA, true},
+		{h265parser.NAL_UNIT_RESERVED_IRAP_VCL23, true},
+		{h265parser.NAL_UNIT_RESERVED_VCL_N10, false},
+	}
+	for _, tag := range []fmp4io.Tag{fmp4io.HVC1, fmp4io.HEV1} {
+		f, err := NewTrack(testH265(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.SetHEVCSampleEntry(tag); err != nil {
+			t.Fatal(err)
+		}
+		for _, ex := range values {
+			slice := hevcSlice(ex.Typ)
+			// the keyframe flag of the packet is not trusted
+			pkt := av.Packet{Data: annexB(hevcVPS, hevcSPS, hevcPPS, slice), IsKeyFrame: !ex.Key}
+			if err = f.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+			got := f.pending[len(f.pending)-1]
+			if got.IsKeyFrame != ex.Key {
+				t.Errorf("%v: NAL unit type %d keyframe=%v", tag, ex.Typ, got.IsKeyFrame)
+			}
+			// length prefixed, parameter sets in band for hev1 only
+			want := []byte{0, 0, 0, byte(len(slice))}
+			want = append(want, slice...)
+			if tag == fmp4io.HEV1 {
+				want = nil
+				for _, nalu := range [][]byte{hevcVPS, hevcSPS, hevcPPS, slice} {
+					want = append(append(want, 0, 0, 0, byte(len(nalu))), nalu...)
+				}
+			}
+			if !bytes.Equal(got.Data, want) {
+				t.Errorf("%v: NAL unit type %d sample %x", tag, ex.Typ, got.Data)
+			}
+		}
+	}
+}
@@ -19,11 +19,13 @@ var (
 	shdr     []byte
 )
 
-// MovieFragmenter breaks a stream into segments each containing both tracks from the original stream
+// MovieFragmenter breaks a stream into segments each containing all tracks from the original stream.
+// Fragment durations follow the video track, or the first audio track when there is no video.
 type MovieFragmenter struct {
 	tracks []*TrackFragmenter
 	fhdr   []byte
 	vidx   int
+	didx   int // track that durations and the timescale follow
 	seqNum uint32
 	shdrw  bool
 }
@@ -33,21 +35,39 @@ func NewMovie(streams []av.CodecData) (*MovieFragmenter, error) {
 	f := &MovieFragmenter{
 		tracks: make([]*TrackFragmenter, len(streams)),
 		vidx:   -1,
+		didx:   -1,
+	}
+	if len(streams) == 0 {
+		return nil, errors.New("no track found")
 	}
 	atoms := make([]*fmp4io.Track, len(streams))
+	used := map[uint32]bool{}
+	var nextID uint32 = 3
 	var err error
 	for i, cd := range streams {
-		f.tracks[i], err = NewTrack(cd)
+		// the first audio and video tracks keep the IDs of NewTrack, the
+		// others take the next free ones
+		trackID := defaultTrackID(cd)
+		for used[trackID] {
+			trackID = nextID
+			nextID++
+		}
+		used[trackID] = true
+		f.tracks[i], err = newTrack(cd, trackID)
 		if err != nil {
 			return nil, fmt.Errorf("track %d: %w", i, err)
 		}
 		atoms[i] = f.tracks[i].atom
 		if cd.Type().IsVideo() {
 			f.vidx = i
+		} else if cd.Type().IsAudio() && f.didx < 0 {
+			f.didx = i
 		}
 	}
-	if f.vidx < 0 {
-		return nil, errors.New("no video track found")
+	if f.vidx >= 0 {
+		f.didx = f.vidx
+	} else if f.didx < 0 {
+		f.didx = 0
 	}
 	f.fhdr, err = MovieHeader(atoms)
 	if err != nil {
@@ -58,12 +78,14 @@ func NewMovie(streams []av.CodecData) (*MovieFragmenter, error) {
 
 // Fragment produces a fragment out of the currently-queued packets.
 func (f *MovieFragmenter) Fragment() (fragment.Fragment, error) {
-	dur := f.tracks[f.vidx].Duration()
+	dur := f.Duration()
 	var tracks []fragmentWithData
-	for _, track := range f.tracks {
+	hasVideo := false
+	for i, track := range f.tracks {
 		tf := track.makeFragment()
 		if tf.trackFrag != nil {
 			tracks = append(tracks, tf)
+			hasVideo = hasVideo || i == f.vidx
 		}
 	}
 	if len(tracks) == 0 {
@@ -74,6 +96,11 @@ func (f *MovieFragmenter) Fragment() (fragment.Fragment, error) {
 	f.shdrw = true
 	frag := marshalFragment(tracks, f.seqNum, initial)
 	frag.Duration = dur
+	if f.vidx >= 0 && !hasVideo {
+		// audio can be decoded on its own, but a movie with video is only
+		// independent from a video keyframe
+		frag.Independent = false
+	}
 	return frag, nil
 }
 
@@ -82,9 +109,10 @@ func (f *MovieFragmenter) WritePacket(pkt av.Packet) error {
 	return f.tracks[pkt.Idx].WritePacket(pkt)
 }
 
-// Duration calculates the elapsed duration between the first and last pending video frame
+// Duration calculates the elapsed duration between the first and last pending video frame,
+// or audio frame of the first audio track when there is no video
 func (f *MovieFragmenter) Duration() time.Duration {
-	return f.tracks[f.vidx].Duration()
+	return f.tracks[f.didx].Duration()
 }
 
 // MovieHeader marshals an init.mp4 for the fragmenter's tracks
@@ -98,6 +126,7 @@ func (f *MovieFragmenter) NewSegment() {
 	f.shdrw = false
 }
 
+// TimeScale returns the timescale of the track that the durations follow
 func (f *MovieFragmenter) TimeScale() uint32 {
-	return 90000
+	return f.tracks[f.didx].timeScale
 }
@@ -0,0 +1,120 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func testH264(t *testing.T) av.CodecData {
+	cd, err := h264parser.NewCodecDataFromSPSAndPPS(
+		unhex("6742c01ed9005005bb011000000300100000030320f162e480"), unhex("68cb8cb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd
+}
+
+func testAAC(t *testing.T) av.CodecData {
+	cd, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x11, 0x90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd
+}
+
+// testPacket returns a packet of stream idx at tm, video packets hold one
+// length prefixed NAL unit.
+func testPacket(idx int, tm time.Duration, key bool, video bool) av.Packet {
+	pkt := av.Packet{Idx: int8(idx), Time: tm, IsKeyFrame: key, Data: make([]byte, 100)}
+	if video {
+		pio.PutU32BE(pkt.Data, uint32(len(pkt.Data)-4))
+		pkt.Data[4] = 0x41
+		if key {
+			pkt.Data[4] = 0x65
+		}
+	}
+	return pkt
+}
+
+func TestMovieAudioOnly(t *testing.T) {
+	f, err := NewMovie([]av.CodecData{testAAC(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tm := time.Duration(0); tm <= time.Second; tm += 20 * time.Millisecond {
+		if err = f.WritePacket(testPacket(0, tm, false, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := f.Duration(); d != time.Second || f.TimeScale() != 48000 {
+		t.Errorf("duration %s at timescale %d", d, f.TimeScale())
+	}
+	frag, err := f.Fragment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag.Duration != time.Second || !frag.Independent {
+		t.Errorf("unexpected fragment duration %s independent %v", frag.Duration, frag.Independent)
+	}
+}
+
+func TestMovieMultiAudio(t *testing.T) {
+	f, err := NewMovie([]av.CodecData{testAAC(t), testAAC(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.tracks[0].trackID == f.tracks[1].trackID {
+		t.Fatalf("both tracks have ID %d", f.tracks[0].trackID)
+	}
+	// the second track runs twice as long
+	for tm := time.Duration(0); tm <= time.Second; tm += 20 * time.Millisecond {
+		if tm <= 500*time.Millisecond {
+			if err = f.WritePacket(testPacket(0, tm, false, false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = f.WritePacket(testPacket(1, tm, false, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// durations and the timescale keep following the first track
+	if d := f.Duration(); d != 500*time.Millisecond || f.TimeScale() != f.tracks[0].timeScale {
+		t.Errorf("duration %s at timescale %d, want the first track", d, f.TimeScale())
+	}
+	frag, err := f.Fragment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag.Duration != 500*time.Millisecond {
+		t.Errorf("fragment duration %s", frag.Duration)
+	}
+}
+
+func TestMovieVideo(t *testing.T) {
+	f, err := NewMovie([]av.CodecData{testAAC(t), testH264(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the audio runs longer, durations follow the video
+	for tm := time.Duration(0); tm <= time.Second; tm += 40 * time.Millisecond {
+		if err = f.WritePacket(testPacket(0, tm, false, false)); err != nil {
+			t.Fatal(err)
+		}
+		if tm <= 400*time.Millisecond {
+			if err = f.WritePacket(testPacket(1, tm, tm == 0, true)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if d := f.Duration(); d != 400*time.Millisecond || f.TimeScale() != 90000 {
+		t.Errorf("duration %s at timescale %d, want the video track", d, f.TimeScale())
+	}
+}
@@ -116,9 +116,13 @@ func (f *TrackFragmenter) makeFragment() fragmentWithData {
 	} else {
 		track.Run.Flags |= fmp4io.TrackRunSampleFlags
 	}
+	packets := f.pending[:entryCount]
+	if f.enc != nil {
+		packets = f.enc.encrypt(track, packets)
+	}
 	d := fragmentWithData{
 		trackFrag:   track,
-		packets:     f.pending[:entryCount],
+		packets:     packets,
 		independent: track.Run.FirstSampleFlags&fmp4io.SampleNoDependencies != 0,
 	}
 	f.pending = []av.Packet{f.pending[entryCount]}
@@ -140,6 +144,14 @@ func marshalFragment(tracks []fragmentWithData, seqNum uint32, initial bool) fra
 			independent = false
 		}
 	}
+	// auxiliary information offsets are relative to the start of the MOOF too
+	trafOffset := 8 + moof.Header.Len()
+	for _, traf := range moof.Tracks {
+		if traf.AuxInfoOffsets != nil {
+			traf.AuxInfoOffsets.Offsets = []uint64{uint64(trafOffset + traf.SampleEncryptionOffset())}
+		}
+		trafOffset += traf.Len()
+	}
 	// calculate track data offsets relative to the start of the MOOF
 	dataBase := moof.Len() + 8 // MOOF plus the MDAT header
 	dataOffset := dataBase
@@ -0,0 +1,255 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"io"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4/fragment"
+)
+
+// SegmentPolicy tells a Segmenter where to cut. Chunk limits that are zero
+// are not used. Frames and durations are counted on the video track, or on
+// all packets when there is no video.
+type SegmentPolicy struct {
+	// ChunkFrames closes a chunk once it has this many frames.
+	ChunkFrames int
+	// ChunkDuration closes a chunk once it is this long.
+	ChunkDuration time.Duration
+	// MaxChunkSize closes a chunk before its samples would exceed this many
+	// bytes, even within a GOP.
+	MaxChunkSize int
+	// SegmentDuration is the least duration of a segment. The next keyframe
+	// after it starts a new segment, every keyframe does when it is zero.
+	SegmentDuration time.Duration
+}
+
+// Chunk is a CMAF chunk, a moof and mdat pair, closed by a Segmenter.
+type Chunk struct {
+	fragment.Fragment
+	// Segment numbers the segments from 0.
+	Segment int
+	// SegmentStart is set on the first chunk of a segment, which begins
+	// with a styp box.
+	SegmentStart bool
+}
+
+// ChunkWriter receives the chunks of a Segmenter as soon as they close.
+type ChunkWriter interface {
+	WriteChunk(Chunk) error
+}
+
+// ChunkWriterFunc adapts a function to a ChunkWriter.
+type ChunkWriterFunc func(Chunk) error
+
+func (f ChunkWriterFunc) WriteChunk(c Chunk) error {
+	return f(c)
+}
+
+// StreamWriter writes every chunk to W and flushes W when it can be, as
+// http.ResponseWriter can, so that chunked transfer delivers it right away.
+type StreamWriter struct {
+	W io.Writer
+}
+
+func (s StreamWriter) WriteChunk(c Chunk) (err error) {
+	if _, err = s.W.Write(c.Bytes); err != nil {
+		return
+	}
+	if f, ok := s.W.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return
+}
+
+// Segmenter fragments a stream on its own according to a SegmentPolicy.
+// Segments only start at keyframes, chunks may close anywhere.
+//
+// Closed chunks are pushed to Writer when it is set, and otherwise returned
+// by Fragment. As with the other fragmenters, the last packet of every
+// track is held back, so a chunk closes right before the packet that
+// triggered it.
+type Segmenter struct {
+	Policy SegmentPolicy
+	Writer ChunkWriter
+
+	frag fragment.Fragmenter
+	vidx int
+
+	started      bool
+	chunkStart   time.Duration
+	frames       int
+	size         int   // bytes the open chunk would close with
+	held         []int // size of the packet held back on each track
+	last         time.Duration
+	segStart     time.Duration
+	segment      int
+	segmentStart bool // no chunk of the current segment closed yet
+	queue        []Chunk
+}
+
+// NewSegmenter creates a Segmenter for a single track, or for a movie when
+// there are several streams.
+func NewSegmenter(streams []av.CodecData, policy SegmentPolicy) (*Segmenter, error) {
+	var frag fragment.Fragmenter
+	var err error
+	if len(streams) == 1 {
+		frag, err = NewTrack(streams[0])
+	} else {
+		frag, err = NewMovie(streams)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Segmenter{
+		Policy:       policy,
+		frag:         frag,
+		vidx:         -1,
+		held:         make([]int, len(streams)),
+		segmentStart: true,
+	}
+	for i, cd := range streams {
+		if cd.Type().IsVideo() {
+			s.vidx = i
+			break
+		}
+	}
+	return s, nil
+}
+
+// WritePacket queues a packet, closing the open chunk or segment first when
+// the policy says so.
+func (s *Segmenter) WritePacket(pkt av.Packet) (err error) {
+	ref := s.vidx < 0 || int(pkt.Idx) == s.vidx
+	p := s.Policy
+	var chunk, segment bool
+	if s.started && ref {
+		segment = pkt.IsKeyFrame && pkt.Time-s.segStart >= p.SegmentDuration
+		chunk = (p.ChunkFrames > 0 && s.frames >= p.ChunkFrames) ||
+			(p.ChunkDuration > 0 && pkt.Time-s.chunkStart >= p.ChunkDuration)
+	}
+
+	// writing pkt releases the packet held back on its track into the open
+	// chunk, which closes first when that packet would not fit
+	held := s.held[pkt.Idx]
+	if p.MaxChunkSize > 0 && s.size > 0 && s.size+held > p.MaxChunkSize {
+		if err = s.cut(false); err != nil {
+			return
+		}
+		// the next chunk starts with the held back frame
+		s.frames, s.size = 1, 0
+		s.chunkStart = s.last
+	}
+	if err = s.frag.WritePacket(pkt); err != nil {
+		return
+	}
+	s.size += held
+	s.held[pkt.Idx] = len(pkt.Data)
+	if chunk || segment {
+		if err = s.cut(segment); err != nil {
+			return
+		}
+		s.frames, s.size = 0, 0
+		if ref {
+			s.chunkStart = pkt.Time
+		}
+	}
+	if segment {
+		s.segStart = pkt.Time
+	}
+	if ref {
+		if !s.started {
+			s.started = true
+			s.chunkStart, s.segStart = pkt.Time, pkt.Time
+		}
+		s.frames++
+		s.last = pkt.Time
+	}
+	return
+}
+
+// cut closes the open chunk, and the segment too when newSegment is set.
+func (s *Segmenter) cut(newSegment bool) (err error) {
+	var frag fragment.Fragment
+	if frag, err = s.frag.Fragment(); err != nil {
+		return
+	}
+	if frag.Length != 0 {
+		c := Chunk{Fragment: frag, Segment: s.segment, SegmentStart: s.segmentStart}
+		s.segmentStart = false
+		if s.Writer != nil {
+			if err = s.Writer.WriteChunk(c); err != nil {
+				return
+			}
+		} else {
+			s.queue = append(s.queue, c)
+		}
+	}
+	if newSegment && !s.segmentStart {
+		s.frag.NewSegment()
+		s.segment++
+		s.segmentStart = true
+	}
+	return
+}
+
+// Flush closes the open chunk.
+func (s *Segmenter) Flush() (err error) {
+	if err = s.cut(false); err != nil {
+		return
+	}
+	s.frames, s.size = 0, 0
+	return
+}
+
+// Fragment returns the oldest closed chunk not returned yet, or else closes
+// the open chunk. It returns an empty fragment when chunks go to Writer.
+func (s *Segmenter) Fragment() (frag fragment.Fragment, err error) {
+	if len(s.queue) == 0 {
+		if err = s.Flush(); err != nil {
+			return
+		}
+	}
+	if len(s.queue) != 0 {
+		frag = s.queue[0].Fragment
+		s.queue = s.queue[1:]
+	}
+	return
+}
+
+// NextChunk returns the oldest closed chunk not returned yet.
+func (s *Segmenter) NextChunk() (c Chunk, ok bool) {
+	if len(s.queue) == 0 {
+		return
+	}
+	c = s.queue[0]
+	s.queue = s.queue[1:]
+	return c, true
+}
+
+// Duration returns the duration of the open chunk.
+func (s *Segmenter) Duration() time.Duration {
+	return s.frag.Duration()
+}
+
+func (s *Segmenter) TimeScale() uint32 {
+	return s.frag.TimeScale()
+}
+
+func (s *Segmenter) MovieHeader() (filename, contentType string, contents []byte) {
+	return s.frag.MovieHeader()
+}
+
+// NewSegment makes the next chunk start a new segment, whatever the policy.
+func (s *Segmenter) NewSegment() {
+	if s.segmentStart {
+		return
+	}
+	s.frag.NewSegment()
+	s.segment++
+	s.segmentStart = true
+	s.segStart = s.chunkStart
+}
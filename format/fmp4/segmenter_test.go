@@ -0,0 +1,181 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// segmentChunks writes 4s of 25fps video with a keyframe every second and
+// an audio packet per frame, and returns the chunks in order. Video packets
+// grow with their frame number, so chunk sizes vary.
+func segmentChunks(t *testing.T, policy SegmentPolicy) (init *Init, chunks []Chunk) {
+	s, err := NewSegmenter([]av.CodecData{testH264(t), testAAC(t)}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Writer = ChunkWriterFunc(func(c Chunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	_, _, b := s.MovieHeader()
+	if init, err = ParseInit(b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		tm := time.Duration(i) * 40 * time.Millisecond
+		video := testPacket(0, tm, i%25 == 0, true)
+		video.Data = append(video.Data, make([]byte, 10*(i%25))...)
+		pio.PutU32BE(video.Data, uint32(len(video.Data)-4))
+		for _, pkt := range []av.Packet{video, testPacket(1, tm, false, false)} {
+			if err = s.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// chunkPackets demuxes a chunk on its own.
+func chunkPackets(t *testing.T, init *Init, c Chunk) (video, audio []av.Packet) {
+	t.Helper()
+	for _, pkt := range readPackets(t, init.NewDemuxer(bytes.NewReader(c.Bytes))) {
+		if pkt.Idx == 0 {
+			video = append(video, pkt)
+		} else {
+			audio = append(audio, pkt)
+		}
+	}
+	return
+}
+
+// checkSegments checks that segments start with styp and a keyframe, and
+// that no chunk is lost.
+func checkSegments(t *testing.T, init *Init, chunks []Chunk, segments int) {
+	t.Helper()
+	n, segment := 0, -1
+	for i, c := range chunks {
+		var first fmp4io.Tag
+		_ = forEachBox(c.Bytes, func(tag fmp4io.Tag, offset int, box []byte) error {
+			if offset == 0 {
+				first = tag
+			}
+			return nil
+		})
+		if c.SegmentStart != (first == fmp4io.STYP) {
+			t.Errorf("chunk %d: segment start %v, first box %s", i, c.SegmentStart, first)
+		}
+		if c.SegmentStart {
+			segment++
+		}
+		if c.Segment != segment {
+			t.Errorf("chunk %d in segment %d, want %d", i, c.Segment, segment)
+		}
+		video, audio := chunkPackets(t, init, c)
+		if c.SegmentStart && (len(video) == 0 || !video[0].IsKeyFrame) {
+			t.Errorf("segment %d does not start with a keyframe", c.Segment)
+		}
+		n += len(video) + len(audio)
+	}
+	if segment+1 != segments {
+		t.Errorf("%d segments, want %d", segment+1, segments)
+	}
+	// the last packet of every track is held back
+	if n != 198 {
+		t.Errorf("chunks hold %d packets, want 198", n)
+	}
+}
+
+func TestSegmenterChunkFrames(t *testing.T) {
+	init, chunks := segmentChunks(t, SegmentPolicy{ChunkFrames: 5, SegmentDuration: 2 * time.Second})
+	checkSegments(t, init, chunks, 2)
+	for i, c := range chunks[:len(chunks)-1] {
+		if video, _ := chunkPackets(t, init, c); len(video) != 5 {
+			t.Errorf("chunk %d has %d frames, want 5", i, len(video))
+		}
+	}
+}
+
+func TestSegmenterChunkDuration(t *testing.T) {
+	init, chunks := segmentChunks(t, SegmentPolicy{ChunkDuration: 300 * time.Millisecond, SegmentDuration: time.Second})
+	checkSegments(t, init, chunks, 4)
+	for i, c := range chunks[:len(chunks)-1] {
+		video, _ := chunkPackets(t, init, c)
+		// 8 frames, and the rest of the second
+		if d := video[len(video)-1].Time + 40*time.Millisecond - video[0].Time; d != 320*time.Millisecond && d != 40*time.Millisecond {
+			t.Errorf("chunk %d lasts %s", i, d)
+		}
+	}
+}
+
+func TestSegmenterMaxChunkSize(t *testing.T) {
+	const max = 1000
+	init, chunks := segmentChunks(t, SegmentPolicy{MaxChunkSize: max, SegmentDuration: 2 * time.Second})
+	checkSegments(t, init, chunks, 2)
+	for i, c := range chunks {
+		video, audio := chunkPackets(t, init, c)
+		size := 0
+		for _, pkt := range append(video, audio...) {
+			size += len(pkt.Data)
+		}
+		if size > max {
+			t.Errorf("chunk %d holds %d bytes", i, size)
+		}
+		// the first video or audio packet of the next chunk did not fit
+		if i+1 < len(chunks) && !chunks[i+1].SegmentStart {
+			video, audio = chunkPackets(t, init, chunks[i+1])
+			next := 0
+			for _, pkts := range [][]av.Packet{video, audio} {
+				if len(pkts) != 0 && len(pkts[0].Data) > next {
+					next = len(pkts[0].Data)
+				}
+			}
+			if size+next <= max {
+				t.Errorf("chunk %d closed at %d bytes", i, size)
+			}
+		}
+	}
+}
+
+func TestSegmenterKeyframeOnly(t *testing.T) {
+	// every keyframe starts a segment, chunks are whole segments
+	init, chunks := segmentChunks(t, SegmentPolicy{})
+	if len(chunks) != 4 {
+		t.Fatalf("%d chunks, want 4", len(chunks))
+	}
+	checkSegments(t, init, chunks, 4)
+
+	// a keyframe does not start a segment before SegmentDuration
+	s, err := NewSegmenter([]av.CodecData{testH264(t)}, SegmentPolicy{SegmentDuration: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err = s.WritePacket(testPacket(0, time.Duration(i)*40*time.Millisecond, i%5 == 0, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var starts int
+	for {
+		c, ok := s.NextChunk()
+		if !ok {
+			break
+		}
+		if c.SegmentStart {
+			starts++
+		}
+	}
+	if starts != 1 {
+		t.Errorf("%d segments closed, want 1", starts)
+	}
+}
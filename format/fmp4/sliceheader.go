@@ -0,0 +1,834 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxListSize bounds the counts read from parameter sets and slice headers,
+// above any a conforming stream uses.
+const maxListSize = 1024
+
+var errSliceHeader = errors.New("mp4: invalid slice header")
+
+// naluReader reads the bits of a NAL unit, skipping its emulation prevention
+// bytes. The first error sticks and makes every later read return zero.
+type naluReader struct {
+	b     []byte
+	pos   int // offset of the next byte in b
+	cur   byte
+	left  uint // bits of cur not read yet
+	zeros int  // zero bytes before pos
+	err   error
+}
+
+func (r *naluReader) bit() uint {
+	if r.err != nil {
+		return 0
+	}
+	if r.left == 0 {
+		if r.pos < len(r.b) && r.zeros >= 2 && r.b[r.pos] == 3 {
+			r.pos++
+			r.zeros = 0
+		}
+		if r.pos >= len(r.b) {
+			r.err = errSliceHeader
+			return 0
+		}
+		r.cur = r.b[r.pos]
+		r.pos++
+		if r.cur == 0 {
+			r.zeros++
+		} else {
+			r.zeros = 0
+		}
+		r.left = 8
+	}
+	r.left--
+	return uint(r.cur>>r.left) & 1
+}
+
+func (r *naluReader) u(n uint) (v uint) {
+	for i := uint(0); i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return
+}
+
+func (r *naluReader) flag() bool {
+	return r.bit() == 1
+}
+
+func (r *naluReader) ue() uint {
+	var zeros uint
+	for r.bit() == 0 {
+		if r.err != nil {
+			return 0
+		}
+		if zeros++; zeros > 31 {
+			r.err = errSliceHeader
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+func (r *naluReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// count reads an ue count, at most max.
+func (r *naluReader) count(max uint) uint {
+	v := r.ue()
+	if v > max {
+		r.err = errSliceHeader
+		return 0
+	}
+	return v
+}
+
+// skip reads n values with read.
+func (r *naluReader) skip(n uint, read func()) {
+	for i := uint(0); i < n && r.err == nil; i++ {
+		read()
+	}
+}
+
+// size returns how many bytes of the NAL unit were read, counting a partly
+// read one.
+func (r *naluReader) size() int {
+	return r.pos
+}
+
+func ceilLog2(v uint) (n uint) {
+	for 1<<n < v {
+		n++
+	}
+	return
+}
+
+// sliceHeaderParser finds where the slice data of a VCL NAL unit starts.
+type sliceHeaderParser interface {
+	// sliceHeaderSize returns the bytes of the NAL unit header and slice
+	// header of nalu.
+	sliceHeaderSize(nalu []byte) (int, error)
+}
+
+// h264Params holds the fields of the SPS and PPS that the slice header
+// syntax of H.264 7.3.3 depends on.
+type h264Params struct {
+	chromaArrayType         uint
+	separateColourPlane     bool
+	log2MaxFrameNum         uint
+	frameMbsOnly            bool
+	pocType                 uint
+	log2MaxPOCLsb           uint
+	deltaPicOrderAlwaysZero bool
+
+	ppsID             uint
+	cabac             bool
+	bottomFieldPOC    bool
+	numRefIdx         [2]uint // num_ref_idx_default_active_minus1
+	weightedPred      bool
+	weightedBipredIdc uint
+	deblockingControl bool
+	redundantPicCnt   bool
+}
+
+func newH264Params(sps, pps []byte) (p *h264Params, err error) {
+	p = &h264Params{chromaArrayType: 1}
+	r := &naluReader{b: sps}
+	r.u(8)
+	profile := r.u(8)
+	r.u(16)
+	r.ue()
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		p.chromaArrayType = r.ue()
+		if p.chromaArrayType == 3 {
+			p.separateColourPlane = r.flag()
+		}
+		r.ue()
+		r.ue()
+		r.u(1)
+		if r.flag() {
+			lists := uint(8)
+			if p.chromaArrayType == 3 {
+				lists = 12
+			}
+			for i := uint(0); i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size && r.err == nil; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+		if p.separateColourPlane {
+			p.chromaArrayType = 0
+		}
+	}
+	p.log2MaxFrameNum = r.ue() + 4
+	p.pocType = r.ue()
+	switch p.pocType {
+	case 0:
+		p.log2MaxPOCLsb = r.ue() + 4
+	case 1:
+		p.deltaPicOrderAlwaysZero = r.flag()
+		r.se()
+		r.se()
+		r.skip(r.count(255), func() { r.se() })
+	}
+	r.ue()
+	r.u(1)
+	r.ue()
+	r.ue()
+	p.frameMbsOnly = r.flag()
+	if r.err != nil {
+		return nil, fmt.Errorf("mp4: invalid SPS")
+	}
+
+	r = &naluReader{b: pps}
+	r.u(8)
+	p.ppsID = r.ue()
+	r.ue()
+	p.cabac = r.flag()
+	p.bottomFieldPOC = r.flag()
+	if r.ue() != 0 {
+		return nil, fmt.Errorf("mp4: slice groups are not supported")
+	}
+	p.numRefIdx[0] = r.ue()
+	p.numRefIdx[1] = r.ue()
+	p.weightedPred = r.flag()
+	p.weightedBipredIdc = r.u(2)
+	r.se()
+	r.se()
+	r.se()
+	p.deblockingControl = r.flag()
+	r.u(1)
+	p.redundantPicCnt = r.flag()
+	if r.err != nil {
+		return nil, fmt.Errorf("mp4: invalid PPS")
+	}
+	return
+}
+
+func (p *h264Params) sliceHeaderSize(nalu []byte) (int, error) {
+	r := &naluReader{b: nalu}
+	r.u(1)
+	refIdc := r.u(2)
+	typ := r.u(5)
+	if typ != 1 && typ != 5 {
+		return 0, fmt.Errorf("mp4: NAL unit type %d has no slice header", typ)
+	}
+	r.ue()
+	sliceType := r.ue() % 5
+	isP, isB, isI, isSP, isSI := sliceType == 0, sliceType == 1, sliceType == 2, sliceType == 3, sliceType == 4
+	if r.ue() != p.ppsID {
+		return 0, fmt.Errorf("mp4: unknown PPS")
+	}
+	if p.separateColourPlane {
+		r.u(2)
+	}
+	r.u(p.log2MaxFrameNum)
+	field := false
+	if !p.frameMbsOnly {
+		if field = r.flag(); field {
+			r.u(1)
+		}
+	}
+	if typ == 5 {
+		r.ue()
+	}
+	if p.pocType == 0 {
+		r.u(p.log2MaxPOCLsb)
+		if p.bottomFieldPOC && !field {
+			r.se()
+		}
+	}
+	if p.pocType == 1 && !p.deltaPicOrderAlwaysZero {
+		r.se()
+		if p.bottomFieldPOC && !field {
+			r.se()
+		}
+	}
+	if p.redundantPicCnt {
+		r.ue()
+	}
+	if isB {
+		r.u(1)
+	}
+	numRefIdx := p.numRefIdx
+	if isP || isSP || isB {
+		if r.flag() {
+			numRefIdx[0] = r.count(31)
+			if isB {
+				numRefIdx[1] = r.count(31)
+			}
+		}
+	}
+
+	// ref_pic_list_modification
+	lists := 0
+	if !isI && !isSI {
+		lists = 1
+	}
+	if isB {
+		lists = 2
+	}
+	for l := 0; l < lists; l++ {
+		if !r.flag() {
+			continue
+		}
+		for n := 0; r.err == nil; n++ {
+			idc := r.ue()
+			if idc == 3 {
+				break
+			}
+			if idc > 3 || n > maxListSize {
+				return 0, errSliceHeader
+			}
+			r.ue()
+		}
+	}
+
+	if (p.weightedPred && (isP || isSP)) || (p.weightedBipredIdc == 1 && isB) {
+		r.ue()
+		if p.chromaArrayType != 0 {
+			r.ue()
+		}
+		for l := 0; l < lists; l++ {
+			for n := uint(0); n <= numRefIdx[l] && r.err == nil; n++ {
+				if r.flag() {
+					r.se()
+					r.se()
+				}
+				if p.chromaArrayType != 0 && r.flag() {
+					r.skip(4, func() { r.se() })
+				}
+			}
+		}
+	}
+
+	// dec_ref_pic_marking
+	if refIdc != 0 {
+		if typ == 5 {
+			r.u(2)
+		} else if r.flag() {
+			for n := 0; r.err == nil; n++ {
+				op := r.ue()
+				if op == 0 {
+					break
+				}
+				if op > 6 || n > maxListSize {
+					return 0, errSliceHeader
+				}
+				if op == 1 || op == 3 {
+					r.ue()
+				}
+				if op == 2 {
+					r.ue()
+				}
+				if op == 3 || op == 6 {
+					r.ue()
+				}
+				if op == 4 {
+					r.ue()
+				}
+			}
+		}
+	}
+
+	if p.cabac && !isI && !isSI {
+		r.ue()
+	}
+	r.se()
+	if isSP || isSI {
+		if isSP {
+			r.u(1)
+		}
+		r.se()
+	}
+	if p.deblockingControl {
+		if r.ue() != 1 {
+			r.se()
+			r.se()
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.size(), nil
+}
+
+// hevcParams holds the fields of the SPS and PPS that the slice segment
+// header syntax of H.265 7.3.6.1 depends on.
+type hevcParams struct {
+	separateColourPlane bool
+	chromaArrayType     uint
+	log2MaxPOCLsb       uint
+	picSizeInCtbs       uint
+	shortTermRPS        []hevcRPS
+	longTermRefs        bool
+	longTermUsed        []bool // used_by_curr_pic_lt_sps_flag
+	temporalMVP         bool
+	sao                 bool
+
+	ppsID                  uint
+	dependentSlices        bool
+	outputFlag             bool
+	extraSliceHeaderBits   uint
+	cabacInit              bool
+	numRefIdx              [2]uint // num_ref_idx_default_active_minus1
+	sliceChromaQPOffsets   bool
+	weightedPred           bool
+	weightedBipred         bool
+	tiles                  bool
+	entropySync            bool
+	loopFilterAcrossSlices bool
+	deblockingOverride     bool
+	deblockingDisabled     bool
+	listsModification      bool
+	headerExtension        bool
+	chromaQPOffsetList     bool
+}
+
+// hevcRPS is a short term reference picture set, NumDeltaPocs pictures of
+// which used are used by the current picture.
+type hevcRPS struct {
+	deltas, used uint
+}
+
+func newHEVCParams(sps, pps []byte) (p *hevcParams, err error) {
+	p = &hevcParams{}
+	r := &naluReader{b: sps}
+	r.u(16)
+	r.u(4)
+	maxSubLayersMinus1 := r.u(3)
+	r.u(1)
+	hevcSkipPTL(r, maxSubLayersMinus1)
+	r.ue()
+	p.chromaArrayType = r.ue()
+	if p.chromaArrayType == 3 {
+		if p.separateColourPlane = r.flag(); p.separateColourPlane {
+			p.chromaArrayType = 0
+		}
+	}
+	width, height := r.ue(), r.ue()
+	if r.flag() {
+		r.skip(4, func() { r.ue() })
+	}
+	r.ue()
+	r.ue()
+	p.log2MaxPOCLsb = r.ue() + 4
+	first := maxSubLayersMinus1
+	if r.flag() {
+		first = 0
+	}
+	r.skip(3*(maxSubLayersMinus1-first+1), func() { r.ue() })
+	log2MinCb := r.ue() + 3
+	log2Ctb := log2MinCb + r.ue()
+	if log2Ctb > 6 {
+		return nil, fmt.Errorf("mp4: invalid SPS")
+	}
+	ctb := uint(1) << log2Ctb
+	p.picSizeInCtbs = ((width + ctb - 1) / ctb) * ((height + ctb - 1) / ctb)
+	r.skip(4, func() { r.ue() })
+	if r.flag() && r.flag() {
+		hevcSkipScalingList(r)
+	}
+	r.u(1)
+	p.sao = r.flag()
+	if r.flag() {
+		r.u(8)
+		r.ue()
+		r.ue()
+		r.u(1)
+	}
+	num := r.count(64)
+	for i := uint(0); i < num && r.err == nil; i++ {
+		p.shortTermRPS = append(p.shortTermRPS, p.readRPS(r, i, false))
+	}
+	if p.longTermRefs = r.flag(); p.longTermRefs {
+		num = r.count(32)
+		for i := uint(0); i < num && r.err == nil; i++ {
+			r.u(p.log2MaxPOCLsb)
+			p.longTermUsed = append(p.longTermUsed, r.flag())
+		}
+	}
+	p.temporalMVP = r.flag()
+	if r.err != nil {
+		return nil, fmt.Errorf("mp4: invalid SPS")
+	}
+
+	r = &naluReader{b: pps}
+	r.u(16)
+	p.ppsID = r.ue()
+	r.ue()
+	p.dependentSlices = r.flag()
+	p.outputFlag = r.flag()
+	p.extraSliceHeaderBits = r.u(3)
+	r.u(1)
+	p.cabacInit = r.flag()
+	p.numRefIdx[0] = r.ue()
+	p.numRefIdx[1] = r.ue()
+	r.se()
+	r.u(1)
+	transformSkip := r.flag()
+	if r.flag() {
+		r.ue()
+	}
+	r.se()
+	r.se()
+	p.sliceChromaQPOffsets = r.flag()
+	p.weightedPred = r.flag()
+	p.weightedBipred = r.flag()
+	r.u(1)
+	p.tiles = r.flag()
+	p.entropySync = r.flag()
+	if p.tiles {
+		cols, rows := r.count(maxListSize), r.count(maxListSize)
+		if !r.flag() {
+			r.skip(cols+rows, func() { r.ue() })
+		}
+		r.u(1)
+	}
+	p.loopFilterAcrossSlices = r.flag()
+	if r.flag() {
+		p.deblockingOverride = r.flag()
+		if p.deblockingDisabled = r.flag(); !p.deblockingDisabled {
+			r.se()
+			r.se()
+		}
+	}
+	if r.flag() {
+		hevcSkipScalingList(r)
+	}
+	p.listsModification = r.flag()
+	r.ue()
+	p.headerExtension = r.flag()
+	if r.flag() {
+		rangeExtension := r.flag()
+		r.u(2)
+		if r.flag() {
+			return nil, fmt.Errorf("mp4: HEVC screen content coding is not supported")
+		}
+		r.u(4)
+		if rangeExtension {
+			if transformSkip {
+				r.ue()
+			}
+			r.u(1)
+			if p.chromaQPOffsetList = r.flag(); p.chromaQPOffsetList {
+				r.ue()
+				r.skip(2*(r.count(5)+1), func() { r.se() })
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("mp4: invalid PPS")
+	}
+	return
+}
+
+// hevcSkipPTL reads a profile_tier_level with its general profile.
+func hevcSkipPTL(r *naluReader, maxSubLayersMinus1 uint) {
+	r.u(88)
+	r.u(8)
+	var profile, level [8]bool
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		profile[i] = r.flag()
+		level[i] = r.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.u(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profile[i] {
+			r.u(88)
+		}
+		if level[i] {
+			r.u(8)
+		}
+	}
+}
+
+func hevcSkipScalingList(r *naluReader) {
+	for size := uint(0); size < 4; size++ {
+		step := uint(1)
+		if size == 3 {
+			step = 3
+		}
+		for matrix := uint(0); matrix < 6; matrix += step {
+			if !r.flag() {
+				r.ue()
+				continue
+			}
+			coefs := uint(1) << (4 + size<<1)
+			if coefs > 64 {
+				coefs = 64
+			}
+			if size > 1 {
+				r.se()
+			}
+			r.skip(coefs, func() { r.se() })
+		}
+	}
+}
+
+// readRPS reads the st_ref_pic_set idx of the SPS, or the one of a slice
+// header, whose idx is the number of sets of the SPS.
+func (p *hevcParams) readRPS(r *naluReader, idx uint, slice bool) (rps hevcRPS) {
+	if idx != 0 && r.flag() {
+		delta := uint(1)
+		if slice {
+			delta = r.ue() + 1
+		}
+		if delta > idx {
+			r.err = errSliceHeader
+			return
+		}
+		r.u(1)
+		r.ue()
+		ref := p.shortTermRPS[idx-delta]
+		for j := uint(0); j <= ref.deltas && r.err == nil; j++ {
+			used := r.flag()
+			if used || r.flag() {
+				rps.deltas++
+			}
+			if used {
+				rps.used++
+			}
+		}
+		return
+	}
+	negative, positive := r.count(16), r.count(16)
+	rps.deltas = negative + positive
+	r.skip(rps.deltas, func() {
+		r.ue()
+		if r.flag() {
+			rps.used++
+		}
+	})
+	return
+}
+
+func (p *hevcParams) sliceHeaderSize(nalu []byte) (int, error) {
+	r := &naluReader{b: nalu}
+	r.u(1)
+	typ := r.u(6)
+	r.u(9)
+	if typ >= 32 {
+		return 0, fmt.Errorf("mp4: NAL unit type %d has no slice header", typ)
+	}
+	first := r.flag()
+	if typ >= 16 && typ <= 23 {
+		r.u(1)
+	}
+	if r.ue() != p.ppsID {
+		return 0, fmt.Errorf("mp4: unknown PPS")
+	}
+	dependent := false
+	if !first {
+		if p.dependentSlices {
+			dependent = r.flag()
+		}
+		r.u(ceilLog2(p.picSizeInCtbs))
+	}
+	if !dependent {
+		r.u(p.extraSliceHeaderBits)
+		sliceType := r.ue()
+		isB, isP := sliceType == 0, sliceType == 1
+		if p.outputFlag {
+			r.u(1)
+		}
+		if p.separateColourPlane {
+			r.u(2)
+		}
+		var numPicTotalCurr uint
+		temporalMVP := false
+		if typ != 19 && typ != 20 {
+			r.u(p.log2MaxPOCLsb)
+			if !r.flag() {
+				numPicTotalCurr = p.readRPS(r, uint(len(p.shortTermRPS)), true).used
+			} else if len(p.shortTermRPS) != 0 {
+				idx := uint(0)
+				if len(p.shortTermRPS) > 1 {
+					idx = r.u(ceilLog2(uint(len(p.shortTermRPS))))
+				}
+				if idx >= uint(len(p.shortTermRPS)) {
+					return 0, errSliceHeader
+				}
+				numPicTotalCurr = p.shortTermRPS[idx].used
+			}
+			if p.longTermRefs {
+				var fromSPS uint
+				if len(p.longTermUsed) != 0 {
+					fromSPS = r.count(uint(len(p.longTermUsed)))
+				}
+				pics := r.count(32)
+				for i := uint(0); i < fromSPS+pics && r.err == nil; i++ {
+					if i < fromSPS {
+						idx := uint(0)
+						if len(p.longTermUsed) > 1 {
+							idx = r.u(ceilLog2(uint(len(p.longTermUsed))))
+						}
+						if idx >= uint(len(p.longTermUsed)) {
+							return 0, errSliceHeader
+						}
+						if p.longTermUsed[idx] {
+							numPicTotalCurr++
+						}
+					} else {
+						r.u(p.log2MaxPOCLsb)
+						if r.flag() {
+							numPicTotalCurr++
+						}
+					}
+					if r.flag() {
+						r.ue()
+					}
+				}
+			}
+			if p.temporalMVP {
+				temporalMVP = r.flag()
+			}
+		}
+		saoLuma, saoChroma := false, false
+		if p.sao {
+			saoLuma = r.flag()
+			if p.chromaArrayType != 0 {
+				saoChroma = r.flag()
+			}
+		}
+		if isP || isB {
+			numRefIdx := p.numRefIdx
+			if r.flag() {
+				numRefIdx[0] = r.count(14)
+				if isB {
+					numRefIdx[1] = r.count(14)
+				}
+			}
+			lists := 1
+			if isB {
+				lists = 2
+			}
+			if p.listsModification && numPicTotalCurr > 1 {
+				for l := 0; l < lists; l++ {
+					if r.flag() {
+						r.u((numRefIdx[l] + 1) * ceilLog2(numPicTotalCurr))
+					}
+				}
+			}
+			if isB {
+				r.u(1)
+			}
+			if p.cabacInit {
+				r.u(1)
+			}
+			if temporalMVP {
+				fromL0 := true
+				if isB {
+					fromL0 = r.flag()
+				}
+				if (fromL0 && numRefIdx[0] > 0) || (!fromL0 && numRefIdx[1] > 0) {
+					r.ue()
+				}
+			}
+			if (p.weightedPred && isP) || (p.weightedBipred && isB) {
+				r.ue()
+				if p.chromaArrayType != 0 {
+					r.se()
+				}
+				for l := 0; l < lists; l++ {
+					n := numRefIdx[l] + 1
+					luma := make([]bool, n)
+					chroma := make([]bool, n)
+					for i := range luma {
+						luma[i] = r.flag()
+					}
+					if p.chromaArrayType != 0 {
+						for i := range chroma {
+							chroma[i] = r.flag()
+						}
+					}
+					for i := range luma {
+						if luma[i] {
+							r.se()
+							r.se()
+						}
+						if chroma[i] {
+							r.skip(4, func() { r.se() })
+						}
+					}
+				}
+			}
+			r.ue()
+		}
+		r.se()
+		if p.sliceChromaQPOffsets {
+			r.se()
+			r.se()
+		}
+		if p.chromaQPOffsetList {
+			r.u(1)
+		}
+		override := false
+		if p.deblockingOverride {
+			override = r.flag()
+		}
+		deblockingDisabled := p.deblockingDisabled
+		if override {
+			if deblockingDisabled = r.flag(); !deblockingDisabled {
+				r.se()
+				r.se()
+			}
+		}
+		if p.loopFilterAcrossSlices && (saoLuma || saoChroma || !deblockingDisabled) {
+			r.u(1)
+		}
+	}
+	if p.tiles || p.entropySync {
+		if offsets := r.count(maxListSize * maxListSize); offsets > 0 {
+			size := r.ue() + 1
+			if size > 32 {
+				return 0, errSliceHeader
+			}
+			r.skip(offsets, func() { r.u(size) })
+		}
+	}
+	if p.headerExtension {
+		r.skip(r.count(256), func() { r.u(8) })
+	}
+	// byte_alignment
+	if r.bit() != 1 {
+		return 0, errSliceHeader
+	}
+	for r.left != 0 && r.err == nil {
+		if r.bit() != 0 {
+			return 0, errSliceHeader
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.size(), nil
+}
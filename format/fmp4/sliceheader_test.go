@@ -0,0 +1,253 @@
+// Package fmp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package fmp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+)
+
+// bitWriter writes the syntax elements of a NAL unit.
+type bitWriter struct {
+	bits []byte
+}
+
+func (w *bitWriter) u(v uint, n int) *bitWriter {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>uint(i))&1)
+	}
+	return w
+}
+
+func (w *bitWriter) flag(v bool) *bitWriter {
+	if v {
+		return w.u(1, 1)
+	}
+	return w.u(0, 1)
+}
+
+func (w *bitWriter) ue(v uint) *bitWriter {
+	n := 0
+	for (v+1)>>uint(n+1) != 0 {
+		n++
+	}
+	return w.u(0, n).u(v+1, n+1)
+}
+
+func (w *bitWriter) se(v int) *bitWriter {
+	if v > 0 {
+		return w.ue(uint(2*v - 1))
+	}
+	return w.ue(uint(-2 * v))
+}
+
+// align writes a one bit and zero bits up to the next byte.
+func (w *bitWriter) align() *bitWriter {
+	w.u(1, 1)
+	for len(w.bits)%8 != 0 {
+		w.u(0, 1)
+	}
+	return w
+}
+
+// nalu returns the bits with emulation prevention bytes, the last byte
+// padded with zero bits.
+func (w *bitWriter) nalu() (b []byte) {
+	zeros := 0
+	for i := 0; i < len(w.bits); i += 8 {
+		var c byte
+		for j := 0; j < 8; j++ {
+			c <<= 1
+			if i+j < len(w.bits) {
+				c |= w.bits[i+j]
+			}
+		}
+		if zeros >= 2 && c <= 3 {
+			b = append(b, 3)
+			zeros = 0
+		}
+		b = append(b, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return
+}
+
+// sliceData follows the slice headers of the tests.
+var sliceData = bytes.Repeat([]byte{0xaa}, 40)
+
+// testHEVCParams returns a 640x352 SPS with 32x32 CTBs, two short term
+// reference picture sets, the second predicted from the first, and two long
+// term ones, and a PPS with tiles, wavefronts, weighted prediction, list
+// modification and chroma QP offset lists.
+func testHEVCParams() (sps, pps []byte) {
+	w := &bitWriter{}
+	w.u(0x4201, 16).u(0, 4).u(0, 3).u(1, 1)
+	w.u(0, 2).u(0, 1).u(1, 5).u(0x60000000, 32).u(0x9000, 16).u(0, 32).u(120, 8)
+	w.ue(0).ue(1).ue(640).ue(352).flag(false).ue(0).ue(0).ue(4)
+	w.flag(true).ue(4).ue(2).ue(0)
+	w.ue(0).ue(2).ue(0).ue(3).ue(1).ue(1)
+	w.flag(false).flag(true).flag(true).flag(false)
+	w.ue(2)
+	w.ue(1).ue(0).ue(0).flag(true)
+	w.flag(true).u(1, 1).ue(0).flag(true).flag(true)
+	w.flag(true).ue(2).u(16, 8).flag(true).u(32, 8).flag(false)
+	w.flag(true).flag(true).flag(false).flag(false)
+	sps = w.align().nalu()
+
+	w = &bitWriter{}
+	w.u(0x4401, 16).ue(0).ue(0).flag(true).flag(true).u(2, 3).flag(false).flag(true)
+	w.ue(1).ue(0).se(0).flag(false).flag(true).flag(true).ue(0).se(0).se(0)
+	w.flag(true).flag(true).flag(true).flag(false).flag(true).flag(true)
+	w.ue(1).ue(0).flag(false).ue(9).flag(true)
+	w.flag(true).flag(true).flag(true).flag(false).se(1).se(-1)
+	w.flag(false).flag(true).ue(0).flag(true)
+	w.flag(true).flag(true).u(0, 3).u(0, 4)
+	w.ue(0).flag(false).flag(true).ue(0).ue(0).se(1).se(-1).ue(0).ue(0)
+	pps = w.align().nalu()
+	return
+}
+
+func TestHEVCSliceHeader(t *testing.T) {
+	sps, pps := testHEVCParams()
+	if info, err := h265parser.ParseSPS(sps); err != nil || info.Width != 640 || info.Height != 352 {
+		t.Fatalf("SPS %+v: %v", info, err)
+	}
+	p, err := newHEVCParams(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.shortTermRPS) != 2 || p.shortTermRPS[1] != (hevcRPS{2, 2}) || len(p.longTermUsed) != 2 || p.picSizeInCtbs != 220 {
+		t.Fatalf("unexpected SPS fields %+v", p)
+	}
+
+	values := []struct {
+		Name  string
+		Slice func(w *bitWriter)
+	}{
+		{"IDR first slice", func(w *bitWriter) {
+			w.u(20<<9|1, 16).flag(true).flag(false).ue(0).u(0, 2).ue(2).flag(true)
+			w.flag(true).flag(true).se(-2).se(1).se(0).flag(false).flag(false).flag(true)
+			w.ue(0).ue(0)
+		}},
+		{"P slice", func(w *bitWriter) {
+			w.u(1<<9|1, 16).flag(false).ue(0).flag(false).u(37, 8).u(3, 2).ue(1).flag(true)
+			w.u(5, 8).flag(false)
+			// predicted from the second set of the SPS, 1 of 2 pictures used
+			w.flag(true).ue(0).flag(false).ue(0).flag(true).flag(false).flag(true).flag(false).flag(false)
+			// a long term picture of the SPS and one of the slice, both used
+			w.ue(1).ue(1).u(0, 1).flag(false).u(200, 8).flag(true).flag(true).ue(3)
+			w.flag(true)
+			w.flag(true).flag(false)
+			w.flag(true).ue(2)
+			w.flag(true).u(0, 2).u(2, 2).u(1, 2)
+			w.flag(true)
+			w.ue(1)
+			w.ue(2).se(0).flag(true).flag(false).flag(true).flag(false).flag(true).flag(false)
+			w.se(3).se(-4).se(1).se(2).se(-1).se(0).se(5).se(6)
+			w.ue(0).se(-3).se(1).se(-1).flag(true)
+			w.flag(true).flag(false).se(2).se(-2)
+			w.flag(true)
+			w.ue(2).ue(9).u(1000, 10).u(3, 10)
+			w.ue(2).u(0, 16)
+		}},
+		{"B slice", func(w *bitWriter) {
+			w.u(0<<9|1, 16).flag(false).ue(0).flag(false).u(219, 8).u(0, 2).ue(0).flag(false)
+			w.u(255, 8).flag(true).u(1, 1)
+			w.ue(0).ue(0)
+			w.flag(false).flag(false)
+			w.flag(false)
+			w.flag(false).flag(false).flag(true).u(1, 1)
+			w.flag(true).flag(false)
+			w.ue(1).se(-1).flag(false).flag(false).flag(false).flag(false).flag(true).flag(true)
+			w.se(1).se(1).se(2).se(-2).se(3).se(-3)
+			w.ue(4).se(0).se(0).se(0).flag(false).flag(false).flag(true)
+			w.ue(0).ue(0)
+		}},
+		{"dependent slice segment", func(w *bitWriter) {
+			w.u(1<<9|1, 16).flag(false).ue(0).flag(true).u(110, 8)
+			w.ue(1).ue(4).u(17, 5).ue(0)
+		}},
+	}
+	for _, ex := range values {
+		w := &bitWriter{}
+		ex.Slice(w)
+		header := w.align().nalu()
+		size, err := p.sliceHeaderSize(append(append([]byte{}, header...), sliceData...))
+		if err != nil || size != len(header) {
+			t.Errorf("%s: slice header of %d bytes, want %d: %v", ex.Name, size, len(header), err)
+		}
+	}
+
+	// the header extension of zero bytes is escaped
+	w := &bitWriter{}
+	w.u(1<<9|1, 16).flag(false).ue(0).flag(true).u(110, 8).ue(0).ue(3).u(0, 24)
+	header := w.align().nalu()
+	if !bytes.Contains(header, []byte{0, 0, 3}) {
+		t.Fatalf("no emulation prevention byte in %x", header)
+	}
+	if size, err := p.sliceHeaderSize(append(header, sliceData...)); err != nil || size != len(header) {
+		t.Errorf("escaped slice header of %d bytes, want %d: %v", size, len(header), err)
+	}
+
+	for _, nalu := range [][]byte{
+		// another PPS
+		(&bitWriter{}).u(1<<9|1, 16).flag(true).ue(1).nalu(),
+		// no byte alignment
+		(&bitWriter{}).u(1<<9|1, 16).flag(false).ue(0).flag(true).u(110, 8).ue(0).ue(0).u(0, 8).nalu(),
+		// truncated
+		(&bitWriter{}).u(1<<9|1, 16).flag(false).ue(0).flag(false).nalu(),
+		// a SEI
+		{39 << 1, 1, 5, 0},
+	} {
+		if _, err := p.sliceHeaderSize(nalu); err == nil {
+			t.Errorf("expected an error for %x", nalu)
+		}
+	}
+}
+
+func TestH264SliceHeader(t *testing.T) {
+	cd := testH264(t).(h264parser.CodecData)
+	p, err := newH264Params(cd.SPS(), cd.PPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []struct {
+		Name  string
+		Slice func(w *bitWriter)
+	}{
+		{"IDR slice", func(w *bitWriter) {
+			w.u(0x65, 8).ue(0).ue(7).ue(0).u(0, 4).ue(3)
+			w.u(0, 2).se(-4).ue(1)
+		}},
+		{"P slice", func(w *bitWriter) {
+			w.u(0x41, 8).ue(10).ue(5).ue(0).u(9, 4)
+			w.flag(true).ue(0)
+			w.flag(true).ue(0).ue(3).ue(2).ue(1).ue(3)
+			w.flag(true).ue(1).ue(0).ue(0)
+			w.se(2).ue(0).se(1).se(-1)
+		}},
+		{"non reference P slice", func(w *bitWriter) {
+			w.u(0x01, 8).ue(0).ue(0).ue(0).u(3, 4).flag(false).flag(false).se(0).ue(1)
+		}},
+	}
+	for _, ex := range values {
+		w := &bitWriter{}
+		ex.Slice(w)
+		header := w.nalu()
+		size, err := p.sliceHeaderSize(append(append([]byte{}, header...), sliceData...))
+		if err != nil || size != len(header) {
+			t.Errorf("%s: slice header of %d bytes, want %d: %v", ex.Name, size, len(header), err)
+		}
+	}
+	if _, err = p.sliceHeaderSize([]byte{0x06, 5, 1}); err == nil {
+		t.Error("expected an error for a SEI")
+	}
+}
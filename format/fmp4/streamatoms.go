@@ -9,6 +9,7 @@ import (
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/codec/aacparser"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
 	"github.com/teocci/go-stream-av/codec/opusparser"
 	"github.com/teocci/go-stream-av/format/fmp4/esio"
 	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
@@ -40,6 +41,13 @@ func (f *TrackFragmenter) Track() (*fmp4io.Track, error) {
 			ColorTableId:         -1,
 			Conf:                 &fmp4io.AVC1Conf{Data: conf},
 		}
+	case h265parser.CodecData:
+		f.timeScale = 90000
+		desc, err := f.hevcSampleEntry(cd)
+		if err != nil {
+			return nil, err
+		}
+		sample.SampleDesc.HEVCDesc = desc
 	case aacparser.CodecData:
 		f.timeScale = 48000
 		dc, err := esio.DecoderConfigFromCodecData(cd)
@@ -74,6 +82,9 @@ func (f *TrackFragmenter) Track() (*fmp4io.Track, error) {
 	default:
 		return nil, fmt.Errorf("mp4: codec type=%v is not supported", f.codecData.Type())
 	}
+	if f.enc != nil {
+		f.enc.protect(sample.SampleDesc)
+	}
 	trackAtom := &fmp4io.Track{
 		Header: &fmp4io.TrackHeader{
 			Flags:   0x0003, // Track enabled | Track in movie
@@ -120,8 +131,9 @@ func (f *TrackFragmenter) Track() (*fmp4io.Track, error) {
 	return trackAtom, nil
 }
 
-// MovieHeader marshals an init.mp4 for the given tracks
-func MovieHeader(tracks []*fmp4io.Track) ([]byte, error) {
+// MovieHeader marshals an init.mp4 for the given tracks, with extra atoms
+// such as PSSH boxes added to the MOOV
+func MovieHeader(tracks []*fmp4io.Track, extra ...fmp4io.Atom) ([]byte, error) {
 	ftyp := fmp4io.FileType{
 		MajorBrand: 0x69736f36, // iso6
 		CompatibleBrands: []uint32{
@@ -138,6 +150,7 @@ func MovieHeader(tracks []*fmp4io.Track) ([]byte, error) {
 		},
 		Tracks:      tracks,
 		MovieExtend: &fmp4io.MovieExtend{},
+		Unknowns:    extra,
 	}
 	for _, track := range tracks {
 		if track.Header.TrackID >= moov.Header.NextTrackID {
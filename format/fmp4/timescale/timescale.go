@@ -1,6 +1,7 @@
 package timescale
 
 import (
+	"math"
 	"math/bits"
 	"time"
 )
@@ -16,6 +17,20 @@ func ToScale(t time.Duration, scale uint32) uint64 {
 	return dts
 }
 
+// FromScale converts a decode time in the specified timescale to time.Duration
+func FromScale(t uint64, scale uint32) time.Duration {
+	hi, lo := bits.Mul64(t, uint64(time.Second))
+	if hi >= uint64(scale) {
+		// does not fit
+		return time.Duration(math.MaxInt64)
+	}
+	d, rem := bits.Div64(hi, lo, uint64(scale))
+	if rem >= uint64(scale/2) {
+		d++
+	}
+	return time.Duration(d)
+}
+
 // Relative converts a sub-second relative time (which may be negative) to a specified timescale
 func Relative(t time.Duration, scale uint32) int32 {
 	rel := int64(t) * int64(scale) / int64(time.Second/2)
@@ -31,6 +31,26 @@ func TestToScale(t *testing.T) {
 	}
 }
 
+func TestFromScale(t *testing.T) {
+	const scale uint32 = 90000
+	values := []struct {
+		V uint64
+		T time.Duration
+	}{
+		{0, 0},
+		{1500, time.Second/60 + 1},
+		{90000, time.Second},
+		{1, 11111},
+		{90000 * (1 << 32), time.Second * (1 << 32)},
+	}
+	for _, ex := range values {
+		d := FromScale(ex.V, scale)
+		if d != ex.T {
+			t.Errorf("%d: expected %d (%s), got %d (%s)", ex.V, ex.T, ex.T, d, d)
+		}
+	}
+}
+
 func TestRelative(t *testing.T) {
 	const scale uint32 = 90000
 	values := []struct {
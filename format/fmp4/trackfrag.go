@@ -8,6 +8,7 @@ import (
 
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
 	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
 	"github.com/teocci/go-stream-av/format/fmp4/fragment"
 )
@@ -19,6 +20,8 @@ type TrackFragmenter struct {
 	timeScale uint32
 	atom      *fmp4io.Track
 	pending   []av.Packet
+	hevcEntry fmp4io.Tag
+	enc       *trackEncryption
 
 	// for CMAF (single track) only
 	seqNum uint32
@@ -28,10 +31,18 @@ type TrackFragmenter struct {
 
 // NewTrack creates a fragmenter from the given stream codec
 func NewTrack(codecData av.CodecData) (*TrackFragmenter, error) {
-	var trackID uint32 = 1
+	return newTrack(codecData, defaultTrackID(codecData))
+}
+
+// defaultTrackID is 1 for audio and 2 for video
+func defaultTrackID(codecData av.CodecData) uint32 {
 	if codecData.Type().IsVideo() {
-		trackID = 2
+		return 2
 	}
+	return 1
+}
+
+func newTrack(codecData av.CodecData, trackID uint32) (*TrackFragmenter, error) {
 	f := &TrackFragmenter{
 		codecData: codecData,
 		trackID:   trackID,
@@ -62,6 +73,9 @@ func (f *TrackFragmenter) WritePacket(pkt av.Packet) error {
 			b = append(b, nalu...)
 		}
 		pkt.Data = b
+	case h265parser.CodecData:
+		// sync samples are the IRAP pictures
+		pkt.Data, pkt.IsKeyFrame = f.hevcSample(pkt.Data)
 	}
 	f.pending = append(f.pending, pkt)
 	return nil
@@ -75,6 +89,11 @@ func (f *TrackFragmenter) Duration() time.Duration {
 	return f.pending[len(f.pending)-1].Time - f.pending[0].Time
 }
 
+// TrackID returns the ID of the track in the movie header
+func (f *TrackFragmenter) TrackID() uint32 {
+	return f.trackID
+}
+
 // TimeScale returns the number of timestamp ticks (DTS) that elapse in 1 second for this track
 func (f *TrackFragmenter) TimeScale() uint32 {
 	return f.timeScale
@@ -7,17 +7,23 @@ import (
 	"github.com/teocci/go-stream-av/av/avutil"
 	"github.com/teocci/go-stream-av/format/aac"
 	"github.com/teocci/go-stream-av/format/flv"
+	"github.com/teocci/go-stream-av/format/fmp4"
+	"github.com/teocci/go-stream-av/format/hls"
 	"github.com/teocci/go-stream-av/format/mp4"
 	"github.com/teocci/go-stream-av/format/rtmp"
 	"github.com/teocci/go-stream-av/format/rtsp"
 	"github.com/teocci/go-stream-av/format/ts"
+	"github.com/teocci/go-stream-av/format/udp"
 )
 
 func RegisterAll() {
+	avutil.DefaultHandlers.Add(fmp4.Handler)
 	avutil.DefaultHandlers.Add(mp4.Handler)
 	avutil.DefaultHandlers.Add(ts.Handler)
 	avutil.DefaultHandlers.Add(rtmp.Handler)
 	avutil.DefaultHandlers.Add(rtsp.Handler)
 	avutil.DefaultHandlers.Add(flv.Handler)
 	avutil.DefaultHandlers.Add(aac.Handler)
+	avutil.DefaultHandlers.Add(udp.Handler)
+	avutil.DefaultHandlers.Add(hls.Handler)
 }
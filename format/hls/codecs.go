@@ -0,0 +1,107 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/opusparser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+// CodecString returns the RFC 6381 codec identifier of a stream, as used
+// by the CODECS attribute. H265 is hvc1, the default sample entry of the
+// fMP4 fragmenters.
+func CodecString(cd av.CodecData) (string, error) {
+	return SampleEntryCodecString(cd, fmp4io.HVC1)
+}
+
+// SampleEntryCodecString is CodecString for a H265 stream stored with the
+// sample entry hevc, fmp4io.HVC1 or fmp4io.HEV1.
+func SampleEntryCodecString(cd av.CodecData, hevc fmp4io.Tag) (string, error) {
+	switch cd := cd.(type) {
+	case h264parser.CodecData:
+		info := cd.RecordInfo
+		return fmt.Sprintf("avc1.%02x%02x%02x", info.AVCProfileIndication, info.ProfileCompatibility, info.AVCLevelIndication), nil
+	case h265parser.CodecData:
+		return hevcCodecString(hevc, cd.SPSInfo), nil
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", cd.Config.ObjectType), nil
+	case *opusparser.CodecData:
+		return "opus", nil
+	}
+	switch cd.Type() {
+	case av.MP3:
+		return "mp4a.40.34", nil
+	case av.AC3:
+		return "ac-3", nil
+	case av.EAC3:
+		return "ec-3", nil
+	}
+	return "", fmt.Errorf("hls: no codec string for %v", cd.Type())
+}
+
+// hevcCodecString formats the profile, tier and level of ISO/IEC 14496-15
+// E.3, such as hvc1.1.6.L93.B0, prefixed with the sample entry.
+func hevcCodecString(entry fmp4io.Tag, sps h265parser.SPSInfo) string {
+	var b strings.Builder
+	if entry == fmp4io.HEV1 {
+		b.WriteString("hev1.")
+	} else {
+		b.WriteString("hvc1.")
+	}
+	if sps.GeneralProfileSpace > 0 {
+		b.WriteByte(byte('A' + sps.GeneralProfileSpace - 1))
+	}
+	// compatibility flags in reverse bit order
+	var compat uint32
+	for i := 0; i < 32; i++ {
+		compat |= (sps.GeneralProfileCompatibilityFlags >> i & 1) << (31 - i)
+	}
+	tier := 'L'
+	if sps.GeneralTierFlag != 0 {
+		tier = 'H'
+	}
+	fmt.Fprintf(&b, "%d.%X.%c%d", sps.GeneralProfileIDC, compat, tier, sps.GeneralLevelIDC)
+	// constraint bytes without the trailing zero ones
+	constraints := make([]byte, 6)
+	for i := range constraints {
+		constraints[i] = byte(sps.GeneralConstraintIndicatorFlags >> (40 - 8*i))
+	}
+	for len(constraints) != 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// codecsAttribute joins the codec strings of the audio and video streams,
+// without duplicates. hevc is the sample entry of H265 streams.
+func codecsAttribute(streams []av.CodecData, hevc fmp4io.Tag) (string, error) {
+	var codecs []string
+	for _, cd := range streams {
+		if !cd.Type().IsAudio() && !cd.Type().IsVideo() {
+			continue
+		}
+		codec, err := SampleEntryCodecString(cd, hevc)
+		if err != nil {
+			return "", err
+		}
+		dup := false
+		for _, c := range codecs {
+			dup = dup || c == codec
+		}
+		if !dup {
+			codecs = append(codecs, codec)
+		}
+	}
+	return strings.Join(codecs, ","), nil
+}
@@ -0,0 +1,109 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+func testH265(t *testing.T) av.CodecData {
+	vps, _ := hex.DecodeString("40010c01ffff016000000300900000030000030078959809")
+	sps, _ := hex.DecodeString("420101016000000300900000030000030078a003c08010e596566a24cae010000003001000000301e080")
+	pps, _ := hex.DecodeString("4401c172b46240")
+	cd, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd
+}
+
+func TestCodecString(t *testing.T) {
+	streams := testStreams(t)
+	hevc := testH265(t)
+	values := []struct {
+		CodecData av.CodecData
+		Entry     fmp4io.Tag
+		Expected  string
+	}{
+		{streams[0], 0, "avc1.42c01e"},
+		{streams[1], 0, "mp4a.40.2"},
+		{hevc, 0, "hvc1.1.6.L120.90"},
+		{hevc, fmp4io.HVC1, "hvc1.1.6.L120.90"},
+		{hevc, fmp4io.HEV1, "hev1.1.6.L120.90"},
+	}
+	for _, ex := range values {
+		codec, err := SampleEntryCodecString(ex.CodecData, ex.Entry)
+		if err != nil || codec != ex.Expected {
+			t.Errorf("%v %v: got %q, want %q: %v", ex.CodecData.Type(), ex.Entry, codec, ex.Expected, err)
+		}
+	}
+	if codec, _ := CodecString(hevc); codec != "hvc1.1.6.L120.90" {
+		t.Errorf("CodecString is %q, want hvc1", codec)
+	}
+
+	codecs, err := codecsAttribute([]av.CodecData{hevc, streams[1], streams[1]}, fmp4io.HEV1)
+	if err != nil || codecs != "hev1.1.6.L120.90,mp4a.40.2" {
+		t.Errorf("CODECS=%q: %v", codecs, err)
+	}
+}
+
+// hevcPacket returns an access unit with the parameter sets in band.
+func hevcPacket(cd av.CodecData, tm time.Duration, key bool) av.Packet {
+	hevc := cd.(h265parser.CodecData)
+	typ := byte(h265parser.NAL_UNIT_CODED_SLICE_TRAIL_R)
+	if key {
+		typ = h265parser.NAL_UNIT_CODED_SLICE_IDR_W_RADL
+	}
+	var b []byte
+	for _, nalu := range [][]byte{hevc.VPS(), hevc.SPS(), hevc.PPS(), append([]byte{typ << 1, 1}, make([]byte, 50)...)} {
+		b = append(append(b, 0, 0, 0, 1), nalu...)
+	}
+	return av.Packet{Time: tm, IsKeyFrame: key, Data: b}
+}
+
+func TestPackagerHEVCSampleEntry(t *testing.T) {
+	storage := NewMemoryStorage()
+	p := NewPackager(storage)
+	p.Format = FormatFMP4
+	p.HEVCSampleEntry = fmp4io.HEV1
+	p.TargetDuration = time.Second
+	s := p.AddVariant("")
+	hevc := testH265(t)
+	if err := s.WriteHeader([]av.CodecData{hevc}); err != nil {
+		t.Fatal(err)
+	}
+	for tm := time.Duration(0); tm < 3*time.Second; tm += 40 * time.Millisecond {
+		if err := s.WritePacket(hevcPacket(hevc, tm, tm%time.Second == 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := storage.ReadFile(DefaultMasterName)
+	master, err := ParseMasterPlaylist(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecs := master.Variants[0].Codecs; codecs != "hev1.1.6.L120.90" {
+		t.Errorf("CODECS=%q, want hev1", codecs)
+	}
+	init, _ := storage.ReadFile("stream0_init1.mp4")
+	if !bytes.Contains(init, []byte("hev1")) || bytes.Contains(init, []byte("hvc1")) {
+		t.Error("the init section does not use hev1")
+	}
+	// hev1 keeps the parameter sets in the samples
+	segment, _ := storage.ReadFile("stream0_segment0.m4s")
+	if !bytes.Contains(segment, hevc.(h265parser.CodecData).SPS()) {
+		t.Error("no SPS in the samples")
+	}
+}
@@ -0,0 +1,478 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/av/avutil"
+	"github.com/teocci/go-stream-av/format/fmp4"
+	"github.com/teocci/go-stream-av/format/ts"
+)
+
+// HTTPClient fetches playlists, keys and segments. *http.Client implements
+// it, other clients can add authentication, retries or a cache.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// liveStartSegments is how far from the end of a live playlist playback
+// starts, as recommended by the HLS specification.
+const liveStartSegments = 3
+
+// Demuxer reads an HLS stream as one continuous stream. The URL may point to
+// a master playlist, then SelectVariant picks the variant to play, or to a
+// media playlist. TS segments go through ts.Demuxer and fMP4 segments
+// through their init section. Timestamps start at zero and keep increasing
+// across discontinuities and timestamp wraps. Live playlists are reloaded
+// until EXT-X-ENDLIST appears. Alternative renditions (EXT-X-MEDIA) are not
+// followed: the variant must carry all its streams.
+type Demuxer struct {
+	URL    string
+	Client HTTPClient
+	// SelectVariant returns the index of the variant to play, by default
+	// the one with the highest bandwidth.
+	SelectVariant func(variants []Variant) int
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	probed  bool
+	streams []av.CodecData
+
+	playlistURL *url.URL
+	playlist    *MediaPlaylist
+	loaded      time.Time
+	changed     bool
+	seqnum      uint64 // media sequence of the next segment
+
+	inits map[string]*fmp4.Init
+	keys  map[string][]byte
+
+	reader   segmentReader
+	idxmap   []int
+	rebase   bool // next packet starts a new timeline
+	segstart bool // next packet is the first of a segment
+	started  bool
+	offset   time.Duration
+	end      time.Duration
+}
+
+// segmentReader reads the packets of one segment.
+type segmentReader interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+}
+
+func NewDemuxer(uri string) *Demuxer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Demuxer{
+		URL:    uri,
+		Client: http.DefaultClient,
+		ctx:    ctx,
+		cancel: cancel,
+		inits:  map[string]*fmp4.Init{},
+		keys:   map[string][]byte{},
+	}
+}
+
+// Open loads the playlists and the first segment.
+func Open(uri string) (d *Demuxer, err error) {
+	d = NewDemuxer(uri)
+	if _, err = d.Streams(); err != nil {
+		d.Close()
+		d = nil
+	}
+	return
+}
+
+func (d *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = d.probe(); err != nil {
+		return
+	}
+	streams = d.streams
+	return
+}
+
+func (d *Demuxer) probe() (err error) {
+	if d.probed {
+		return
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(d.URL); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = d.get(u); err != nil {
+		return
+	}
+
+	if IsMasterPlaylist(b) {
+		var master *MasterPlaylist
+		if master, err = ParseMasterPlaylist(b); err != nil {
+			return
+		}
+		i := highestBandwidth(master.Variants)
+		if d.SelectVariant != nil {
+			i = d.SelectVariant(master.Variants)
+		}
+		if i < 0 || i >= len(master.Variants) {
+			err = fmt.Errorf("hls: variant %d does not exist", i)
+			return
+		}
+		if u, err = u.Parse(master.Variants[i].URI); err != nil {
+			return
+		}
+		if b, err = d.get(u); err != nil {
+			return
+		}
+	}
+
+	d.playlistURL = u
+	if d.playlist, err = ParseMediaPlaylist(b); err != nil {
+		return
+	}
+	d.loaded = time.Now()
+	d.changed = true
+
+	d.seqnum = d.playlist.MediaSequence
+	if !d.playlist.Ended {
+		n := completeSegments(d.playlist)
+		if n > liveStartSegments {
+			d.seqnum += uint64(n - liveStartSegments)
+		}
+	}
+
+	if err = d.nextSegment(); err != nil {
+		return
+	}
+	d.probed = true
+	return
+}
+
+func highestBandwidth(variants []Variant) (best int) {
+	for i, variant := range variants {
+		if variant.Bandwidth > variants[best].Bandwidth {
+			best = i
+		}
+	}
+	return
+}
+
+// completeSegments counts the segments of p that have a URI.
+func completeSegments(p *MediaPlaylist) (n int) {
+	for _, seg := range p.Segments {
+		if seg.URI != "" {
+			n++
+		}
+	}
+	return
+}
+
+func (d *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = d.probe(); err != nil {
+		return
+	}
+	for {
+		if d.reader != nil {
+			if pkt, err = d.reader.ReadPacket(); err == nil {
+				if int(pkt.Idx) >= len(d.idxmap) || d.idxmap[pkt.Idx] < 0 {
+					continue
+				}
+				pkt.Idx = int8(d.idxmap[pkt.Idx])
+				d.adjustTime(&pkt)
+				return
+			}
+			if err != io.EOF {
+				return
+			}
+			d.reader = nil
+		}
+		if err = d.nextSegment(); err != nil {
+			return
+		}
+	}
+}
+
+// adjustTime moves the packet to the output timeline. The offset is reset
+// on the first packet after a discontinuity, and on the first packet of a
+// segment whose time jumps by more than two target durations, as when the
+// 33 bit timestamps of MPEG-TS wrap around.
+func (d *Demuxer) adjustTime(pkt *av.Packet) {
+	if !d.started {
+		d.started = true
+		d.offset = -pkt.Time
+	} else if d.rebase {
+		d.offset = d.end - pkt.Time
+	} else if d.segstart {
+		jump := 2 * d.playlist.TargetDuration
+		if jump < 2*time.Second {
+			jump = 2 * time.Second
+		}
+		if t := pkt.Time + d.offset; t < d.end-jump || t > d.end+jump {
+			d.offset = d.end - pkt.Time
+		}
+	}
+	d.rebase = false
+	d.segstart = false
+
+	pkt.Time += d.offset
+	if end := pkt.Time + pkt.Duration; end > d.end {
+		d.end = end
+	}
+}
+
+func (d *Demuxer) nextSegment() (err error) {
+	for {
+		p := d.playlist
+		if d.seqnum < p.MediaSequence {
+			// fell behind a live playlist
+			d.seqnum = p.MediaSequence
+			d.rebase = true
+		}
+		if i := d.seqnum - p.MediaSequence; i < uint64(len(p.Segments)) && p.Segments[i].URI != "" {
+			seg := p.Segments[i]
+			d.seqnum++
+			return d.openSegment(seg, d.seqnum-1)
+		}
+		if p.Ended {
+			return io.EOF
+		}
+		if err = d.reload(); err != nil {
+			return
+		}
+	}
+}
+
+// reload waits a target duration, half of it when the last reload found
+// nothing new, and fetches the media playlist again.
+func (d *Demuxer) reload() (err error) {
+	wait := d.playlist.TargetDuration
+	if !d.changed {
+		wait /= 2
+	}
+	if wait = time.Until(d.loaded.Add(wait)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		}
+	}
+
+	var b []byte
+	if b, err = d.get(d.playlistURL); err != nil {
+		return
+	}
+	var p *MediaPlaylist
+	if p, err = ParseMediaPlaylist(b); err != nil {
+		return
+	}
+	last := func(p *MediaPlaylist) uint64 {
+		return p.MediaSequence + uint64(completeSegments(p))
+	}
+	d.changed = last(p) != last(d.playlist) || p.Ended != d.playlist.Ended
+	d.playlist = p
+	d.loaded = time.Now()
+	return
+}
+
+func (d *Demuxer) openSegment(seg Segment, seqnum uint64) (err error) {
+	var u *url.URL
+	if u, err = d.playlistURL.Parse(seg.URI); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = d.get(u); err != nil {
+		return
+	}
+	if seg.Key != nil {
+		if b, err = d.decrypt(b, seg.Key, seqnum); err != nil {
+			return
+		}
+	}
+
+	var r segmentReader
+	if seg.Map != "" {
+		var init *fmp4.Init
+		if init, err = d.initSection(seg.Map, seg.MapKey); err != nil {
+			return
+		}
+		r = init.NewDemuxer(bytes.NewReader(b))
+	} else {
+		r = ts.NewDemuxer(bytes.NewReader(b))
+	}
+
+	var streams []av.CodecData
+	if streams, err = r.Streams(); err != nil {
+		return
+	}
+	if d.streams == nil {
+		d.streams = streams
+	}
+	if d.idxmap, err = d.mapStreams(streams); err != nil {
+		return
+	}
+	d.reader = r
+	d.segstart = true
+	if seg.Discontinuity {
+		d.rebase = true
+	}
+	return
+}
+
+// mapStreams matches the streams of a segment to the streams of the first
+// one by codec type, in order. Streams without a match are dropped.
+func (d *Demuxer) mapStreams(streams []av.CodecData) (idxmap []int, err error) {
+	used := make([]bool, len(d.streams))
+	matched := false
+	for _, cd := range streams {
+		idx := -1
+		for i, stream := range d.streams {
+			if !used[i] && stream.Type() == cd.Type() {
+				idx = i
+				used[i] = true
+				matched = true
+				break
+			}
+		}
+		idxmap = append(idxmap, idx)
+	}
+	if !matched {
+		err = errors.New("hls: segment streams do not match the first segment")
+	}
+	return
+}
+
+// initSection returns the parsed init section at uri, decrypted with key,
+// the EXT-X-KEY in effect at its EXT-X-MAP.
+func (d *Demuxer) initSection(uri string, key *Key) (init *fmp4.Init, err error) {
+	var u *url.URL
+	if u, err = d.playlistURL.Parse(uri); err != nil {
+		return
+	}
+	if init = d.inits[u.String()]; init != nil {
+		return
+	}
+	var b []byte
+	if b, err = d.get(u); err != nil {
+		return
+	}
+	if key != nil {
+		// there is no media sequence number to derive the IV from
+		if key.IV == nil {
+			err = errors.New("hls: the EXT-X-KEY of an encrypted EXT-X-MAP has no IV")
+			return
+		}
+		if b, err = d.decrypt(b, key, 0); err != nil {
+			return
+		}
+	}
+	if init, err = fmp4.ParseInit(b); err != nil {
+		return
+	}
+	d.inits[u.String()] = init
+	return
+}
+
+// decrypt decrypts an AES-128 segment, which is AES-CBC with PKCS7 padding.
+func (d *Demuxer) decrypt(b []byte, key *Key, seqnum uint64) (out []byte, err error) {
+	if key.Method != "AES-128" {
+		err = fmt.Errorf("hls: encryption method %s is not supported", key.Method)
+		return
+	}
+
+	var u *url.URL
+	if u, err = d.playlistURL.Parse(key.URI); err != nil {
+		return
+	}
+	secret, ok := d.keys[u.String()]
+	if !ok {
+		if secret, err = d.get(u); err != nil {
+			return
+		}
+		d.keys[u.String()] = secret
+	}
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(secret); err != nil {
+		err = fmt.Errorf("hls: invalid key: %v", err)
+		return
+	}
+	iv := key.IV
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], seqnum)
+	}
+	if len(b) == 0 || len(b)%aes.BlockSize != 0 {
+		err = errors.New("hls: encrypted segment is not a multiple of the block size")
+		return
+	}
+	out = make([]byte, len(b))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, b)
+
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		err = errors.New("hls: invalid padding, wrong key?")
+		return
+	}
+	out = out[:len(out)-pad]
+	return
+}
+
+func (d *Demuxer) get(u *url.URL) (b []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(d.ctx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = d.Client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("hls: GET %s: %s", u, resp.Status)
+		return
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Close stops a pending playlist reload or download.
+func (d *Demuxer) Close() error {
+	d.cancel()
+	return nil
+}
+
+func isHLSURL(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		if !isHLSURL(uri) {
+			return
+		}
+		ok = true
+		demuxer, err = Open(uri)
+		return
+	}
+
+	h.CodecTypes = ts.CodecTypes
+}
@@ -0,0 +1,307 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/ts"
+)
+
+// fileServer serves files from memory, playlists can be replaced while
+// it runs.
+type fileServer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	gets  map[string]int
+}
+
+func startFileServer(t *testing.T) (s *fileServer, url string) {
+	s = &fileServer{files: map[string][]byte{}, gets: map[string]int{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL + "/"
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	name := path.Base(r.URL.Path)
+	b, ok := s.files[name]
+	s.gets[name]++
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(b)
+}
+
+func (s *fileServer) set(name string, b []byte) {
+	s.mu.Lock()
+	s.files[name] = b
+	s.mu.Unlock()
+}
+
+// tsSegment returns a TS segment with video starting on a keyframe and
+// audio, from start until end.
+func tsSegment(t *testing.T, streams []av.CodecData, start, end time.Duration) []byte {
+	var b bytes.Buffer
+	m := ts.NewMuxer(&b)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for tm := start; tm < end; tm += 40 * time.Millisecond {
+		for idx := range streams {
+			if err := m.WritePacket(testPacket(idx, tm, idx == 0 && tm == start)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encrypt(t *testing.T, b, key, iv []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(b)%aes.BlockSize
+	out := append(append([]byte{}, b...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+// readAll reads the packets of d and checks that the video timestamps go
+// on 40ms apart from zero.
+func readAll(t *testing.T, d *Demuxer) (pkts []av.Packet) {
+	t.Helper()
+	var next time.Duration
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Idx == 0 {
+			if pkt.Time != next {
+				t.Fatalf("video packet %d at %s, want %s", len(pkts), pkt.Time, next)
+			}
+			next += 40 * time.Millisecond
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestDemuxerVariants(t *testing.T) {
+	s, url := startFileServer(t)
+	streams := testStreams(t)
+	s.set("video.ts", tsSegment(t, streams, 0, time.Second))
+	s.set("audio.ts", tsSegment(t, streams[1:], 0, time.Second))
+	for _, name := range []string{"video", "audio"} {
+		p := &MediaPlaylist{Version: 3, TargetDuration: time.Second, Ended: true, Segments: []Segment{{URI: name + ".ts", Duration: time.Second}}}
+		s.set(name+".m3u8", p.Marshal())
+	}
+	master := &MasterPlaylist{Version: 3, Variants: []Variant{
+		{URI: "audio.m3u8", Bandwidth: 64000},
+		{URI: "video.m3u8", Bandwidth: 1000000},
+	}}
+	s.set("master.m3u8", master.Marshal())
+
+	// the highest bandwidth by default
+	d, err := Open(url + "master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams, _ := d.Streams(); len(streams) != 2 {
+		t.Errorf("default variant has %d streams, want 2", len(streams))
+	}
+	d.Close()
+
+	d = NewDemuxer(url + "master.m3u8")
+	d.SelectVariant = func(variants []Variant) int {
+		for i, v := range variants {
+			if v.Bandwidth < 100000 {
+				return i
+			}
+		}
+		return -1
+	}
+	if streams, err := d.Streams(); err != nil || len(streams) != 1 || streams[0].Type() != av.AAC {
+		t.Errorf("selected variant has streams %v: %v", streams, err)
+	}
+
+	d = NewDemuxer(url + "master.m3u8")
+	d.SelectVariant = func([]Variant) int { return 5 }
+	if _, err = d.Streams(); err == nil {
+		t.Error("expected an error for a missing variant")
+	}
+}
+
+func TestDemuxerLiveReload(t *testing.T) {
+	s, url := startFileServer(t)
+	streams := testStreams(t)
+	p := &MediaPlaylist{Version: 3, TargetDuration: time.Second, MediaSequence: 10}
+	for i := 0; i < 6; i++ {
+		uri := "segment" + string(rune('a'+i)) + ".ts"
+		start := time.Duration(i) * time.Second
+		s.set(uri, tsSegment(t, streams, start, start+time.Second))
+		p.Segments = append(p.Segments, Segment{URI: uri, Duration: time.Second})
+	}
+	s.set("index.m3u8", p.Marshal())
+
+	d, err := Open(url + "index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// live playback starts three segments from the end
+	for i := 0; i < 50; i++ {
+		if _, err = d.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.gets["segmentc.ts"] != 0 || s.gets["segmentd.ts"] != 1 {
+		t.Errorf("unexpected downloads %v", s.gets)
+	}
+
+	// the next playlist slides and ends
+	p.MediaSequence++
+	p.Segments = p.Segments[1:]
+	s.set("segmentg.ts", tsSegment(t, streams, 6*time.Second, 7*time.Second))
+	p.Segments = append(p.Segments, Segment{URI: "segmentg.ts", Duration: time.Second})
+	p.Ended = true
+	s.set("index.m3u8", p.Marshal())
+
+	n := 50
+	for {
+		if _, err = d.ReadPacket(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 4*50 || s.gets["index.m3u8"] != 2 || s.gets["segmentg.ts"] != 1 {
+		t.Errorf("read %d packets, downloads %v", n, s.gets)
+	}
+}
+
+func TestDemuxerDiscontinuity(t *testing.T) {
+	s, url := startFileServer(t)
+	streams := testStreams(t)
+	// the second segment restarts at zero after a discontinuity, the third
+	// jumps as if the timestamps wrapped
+	s.set("a.ts", tsSegment(t, streams, 10*time.Second, 11*time.Second))
+	s.set("b.ts", tsSegment(t, streams, 0, time.Second))
+	s.set("c.ts", tsSegment(t, streams, 50*time.Second, 51*time.Second))
+	p := &MediaPlaylist{Version: 3, TargetDuration: time.Second, Ended: true, Segments: []Segment{
+		{URI: "a.ts", Duration: time.Second},
+		{URI: "b.ts", Duration: time.Second, Discontinuity: true},
+		{URI: "c.ts", Duration: time.Second},
+	}}
+	s.set("index.m3u8", p.Marshal())
+
+	d, err := Open(url + "index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkts := readAll(t, d); len(pkts) != 150 {
+		t.Errorf("read %d packets, want 150", len(pkts))
+	}
+}
+
+func TestDemuxerAES128(t *testing.T) {
+	s, url := startFileServer(t)
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	s.set("key", key)
+	streams := testStreams(t)
+
+	// TS with the IV from the media sequence number, then with an IV
+	seqiv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(seqiv[8:], 7)
+	s.set("a.ts", encrypt(t, tsSegment(t, streams, 0, time.Second), key, seqiv))
+	s.set("b.ts", encrypt(t, tsSegment(t, streams, time.Second, 2*time.Second), key, iv))
+	p := &MediaPlaylist{Version: 3, TargetDuration: time.Second, MediaSequence: 7, Ended: true, Segments: []Segment{
+		{URI: "a.ts", Duration: time.Second, Key: &Key{Method: "AES-128", URI: "key"}},
+		{URI: "b.ts", Duration: time.Second, Key: &Key{Method: "AES-128", URI: "key", IV: iv}},
+	}}
+	s.set("ts.m3u8", p.Marshal())
+
+	d, err := Open(url + "ts.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkts := readAll(t, d); len(pkts) != 100 || s.gets["key"] != 1 {
+		t.Errorf("read %d packets, fetched the key %d times", len(pkts), s.gets["key"])
+	}
+
+	// fMP4 with the init section encrypted by the key before EXT-X-MAP
+	storage := NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Format = FormatFMP4
+	m.Type = VOD
+	m.TargetDuration = time.Second
+	if err = m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 3*time.Second, every(time.Second, 0, 3*time.Second)...)
+	if err = m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	fp := m.Playlist()
+	mapkey := &Key{Method: "AES-128", URI: "key", IV: iv}
+	segkey := &Key{Method: "AES-128", URI: "key"}
+	init, _ := storage.ReadFile("init1.mp4")
+	s.set("init1.mp4", encrypt(t, init, key, iv))
+	for i := range fp.Segments {
+		seg := &fp.Segments[i]
+		b, _ := storage.ReadFile(seg.URI)
+		ivseq := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(ivseq[8:], uint64(i))
+		s.set(seg.URI, encrypt(t, b, key, ivseq))
+		seg.MapKey, seg.Key = mapkey, segkey
+	}
+	s.set("fmp4.m3u8", fp.Marshal())
+
+	parsed, err := ParseMediaPlaylist(fp.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg := parsed.Segments[0]; seg.MapKey == nil || !bytes.Equal(seg.MapKey.IV, iv) || seg.Key == nil || seg.Key.IV != nil {
+		t.Fatalf("keys do not round trip: map %+v segment %+v", seg.MapKey, seg.Key)
+	}
+
+	d, err = Open(url + "fmp4.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fragmenter holds back the last packet of each track
+	if pkts := readAll(t, d); len(pkts) != 148 {
+		t.Errorf("read %d packets, want 148", len(pkts))
+	}
+
+	// without an IV the init section can not be decrypted
+	mapkey.IV = nil
+	s.set("fmp4.m3u8", fp.Marshal())
+	if _, err = Open(url + "fmp4.m3u8"); err == nil {
+		t.Error("expected an error for an encrypted EXT-X-MAP without IV")
+	}
+}
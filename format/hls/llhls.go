@@ -0,0 +1,480 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/format/fmp4/fragment"
+)
+
+// Low-Latency HLS, RFC 8216bis. The LLMuxer keeps a live fMP4 playlist in
+// memory and serves it, with blocking playlist reloads and delta updates,
+// as an http.Handler.
+
+const (
+	DefaultLLTargetDuration = 2 * time.Second
+	DefaultPartTarget       = 500 * time.Millisecond
+	DefaultLLWindowSize     = 10
+)
+
+type llPart struct {
+	Part
+	data []byte
+}
+
+type llSegment struct {
+	seq           uint64
+	parts         []llPart
+	duration      time.Duration
+	discontinuity bool
+	mapuri        string
+	data          []byte // set once the segment is complete
+}
+
+type LLMuxer struct {
+	TargetDuration time.Duration
+	PartTarget     time.Duration
+	WindowSize     int
+	PlaylistName   string
+	SegmentPrefix  string
+	// HEVCSampleEntry is the sample entry of H265 streams, fmp4io.HVC1
+	// when zero.
+	HEVCSampleEntry fmp4io.Tag
+
+	mu     sync.Mutex
+	notify chan struct{} // closed and replaced on every new part
+
+	frag     fragment.Fragmenter
+	vidx     int
+	framedur time.Duration
+	lastvid  time.Duration
+
+	inits         map[string][]byte
+	initnum       int
+	mapuri        string
+	discontinuity bool
+
+	segments []*llSegment  // complete segments in the window
+	target   time.Duration // EXT-X-TARGETDURATION, fits every segment so far
+	cur      *llSegment
+	seqnum   uint64
+	discseq  uint64
+	ended    bool
+}
+
+func NewLLMuxer() *LLMuxer {
+	return &LLMuxer{
+		TargetDuration: DefaultLLTargetDuration,
+		PartTarget:     DefaultPartTarget,
+		WindowSize:     DefaultLLWindowSize,
+		PlaylistName:   DefaultPlaylistName,
+		SegmentPrefix:  DefaultSegmentPrefix,
+		notify:         make(chan struct{}),
+		inits:          map[string][]byte{},
+	}
+}
+
+func (m *LLMuxer) WriteHeader(streams []av.CodecData) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.frag != nil {
+		// codec change: the pending packets end the segment
+		if err = m.cutPart(); err != nil {
+			return
+		}
+		if err = m.finishSegment(); err != nil {
+			return
+		}
+		m.discontinuity = true
+	}
+
+	m.vidx = -1
+	for i, cd := range streams {
+		if cd.Type().IsVideo() {
+			m.vidx = i
+			break
+		}
+	}
+	m.framedur = 0
+	m.lastvid = 0
+
+	if m.frag, err = newFragmenter(streams, m.HEVCSampleEntry); err != nil {
+		return
+	}
+	m.initnum++
+	m.mapuri = fmt.Sprintf("init%d.mp4", m.initnum)
+	_, _, m.inits[m.mapuri] = m.frag.MovieHeader()
+	return
+}
+
+func (m *LLMuxer) WritePacket(pkt av.Packet) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.frag == nil {
+		return errors.New("hls: WriteHeader not called")
+	}
+	if err = m.frag.WritePacket(pkt); err != nil {
+		return
+	}
+
+	keyframe := m.vidx < 0
+	if int(pkt.Idx) == m.vidx {
+		keyframe = pkt.IsKeyFrame
+		if m.lastvid != 0 && pkt.Time > m.lastvid {
+			m.framedur = pkt.Time - m.lastvid
+		}
+		m.lastvid = pkt.Time
+	}
+
+	// the fragmenter holds pkt back, so cutting now ends the part right
+	// before it and the pending duration is the duration of that part
+	partdur := m.frag.Duration()
+	segdur := partdur
+	if m.cur != nil {
+		segdur += m.cur.duration
+	}
+	switch {
+	case keyframe && segdur >= m.TargetDuration:
+		if err = m.cutPart(); err != nil {
+			return
+		}
+		err = m.finishSegment()
+	case partdur+m.framedur > m.PartTarget:
+		// the next frame would make the part longer than PART-TARGET
+		err = m.cutPart()
+	}
+	return
+}
+
+func (m *LLMuxer) cutPart() (err error) {
+	var frag fragment.Fragment
+	if frag, err = m.frag.Fragment(); err != nil {
+		return
+	}
+	if frag.Length == 0 {
+		return
+	}
+	if m.cur == nil {
+		m.cur = &llSegment{
+			seq:           m.seqnum,
+			discontinuity: m.discontinuity,
+			mapuri:        m.mapuri,
+		}
+		m.seqnum++
+		m.discontinuity = false
+	}
+	m.cur.parts = append(m.cur.parts, llPart{
+		Part: Part{
+			URI:         m.partURI(m.cur.seq, len(m.cur.parts)),
+			Duration:    frag.Duration,
+			Independent: frag.Independent,
+		},
+		data: frag.Bytes,
+	})
+	m.cur.duration += frag.Duration
+	m.update()
+	return
+}
+
+func (m *LLMuxer) finishSegment() (err error) {
+	cur := m.cur
+	if cur == nil {
+		return
+	}
+	m.cur = nil
+	m.frag.NewSegment()
+
+	n := 0
+	for _, part := range cur.parts {
+		n += len(part.data)
+	}
+	cur.data = make([]byte, 0, n)
+	for _, part := range cur.parts {
+		cur.data = append(cur.data, part.data...)
+	}
+	m.target = FitTarget(m.target, cur.duration)
+	m.segments = append(m.segments, cur)
+	if len(m.segments) > m.WindowSize {
+		if m.segments[0].discontinuity {
+			m.discseq++
+		}
+		m.segments = m.segments[1:]
+	}
+	m.update()
+	return
+}
+
+// WriteTrailer completes the last segment and ends the playlist.
+func (m *LLMuxer) WriteTrailer() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.frag == nil {
+		return
+	}
+	if err = m.cutPart(); err != nil {
+		return
+	}
+	if err = m.finishSegment(); err != nil {
+		return
+	}
+	m.ended = true
+	m.update()
+	return
+}
+
+func (m *LLMuxer) update() {
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+func (m *LLMuxer) segmentURI(seq uint64) string {
+	return fmt.Sprintf("%s%d.m4s", m.SegmentPrefix, seq)
+}
+
+func (m *LLMuxer) partURI(seq uint64, part int) string {
+	return fmt.Sprintf("%s%d.%d.m4s", m.SegmentPrefix, seq, part)
+}
+
+// nextPart returns the segment and part number that the next part will
+// have.
+func (m *LLMuxer) nextPart() (seq uint64, part int) {
+	if m.cur != nil {
+		return m.cur.seq, len(m.cur.parts)
+	}
+	return m.seqnum, 0
+}
+
+// hasPart reports whether part of segment seq is in the playlist, or with
+// part -1 whether the whole segment is.
+func (m *LLMuxer) hasPart(seq uint64, part int) bool {
+	next, nextpart := m.nextPart()
+	if part < 0 {
+		return seq < next
+	}
+	return seq < next || (seq == next && part < nextpart)
+}
+
+// Playlist builds the current media playlist. With skip, segments older
+// than CAN-SKIP-UNTIL are replaced by EXT-X-SKIP.
+func (m *LLMuxer) Playlist(skip bool) MediaPlaylist {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.playlist(skip)
+}
+
+func (m *LLMuxer) playlist(skip bool) MediaPlaylist {
+	p := MediaPlaylist{
+		Version:               9,
+		TargetDuration:        FitTarget(m.TargetDuration, m.target),
+		IndependentSegments:   m.vidx >= 0,
+		PartTarget:            m.PartTarget,
+		Ended:                 m.ended,
+		DiscontinuitySequence: m.discseq,
+		ServerControl: &ServerControl{
+			CanBlockReload: true,
+			PartHoldBack:   3 * m.PartTarget,
+			CanSkipUntil:   6 * m.TargetDuration,
+		},
+	}
+	p.MediaSequence, _ = m.nextPart()
+	if len(m.segments) > 0 {
+		p.MediaSequence = m.segments[0].seq
+	}
+
+	// parts are listed for the segments within three target durations of
+	// the live edge
+	var total, fromEnd time.Duration
+	for _, seg := range m.segments {
+		total += seg.duration
+	}
+	for _, seg := range m.segments {
+		s := Segment{
+			URI:           m.segmentURI(seg.seq),
+			Duration:      seg.duration,
+			Discontinuity: seg.discontinuity,
+			Map:           seg.mapuri,
+		}
+		fromEnd = total
+		total -= seg.duration
+		if skip && fromEnd > p.ServerControl.CanSkipUntil && !seg.discontinuity {
+			p.SkippedSegments++
+			continue
+		}
+		skip = false
+		if fromEnd <= 3*m.TargetDuration {
+			for _, part := range seg.parts {
+				s.Parts = append(s.Parts, part.Part)
+			}
+		}
+		p.Segments = append(p.Segments, s)
+	}
+
+	if m.cur != nil {
+		s := Segment{
+			Discontinuity: m.cur.discontinuity,
+			Map:           m.cur.mapuri,
+		}
+		for _, part := range m.cur.parts {
+			s.Parts = append(s.Parts, part.Part)
+		}
+		p.Segments = append(p.Segments, s)
+	}
+	if !m.ended {
+		seq, part := m.nextPart()
+		p.PreloadHint = m.partURI(seq, part)
+	}
+	return p
+}
+
+// wait blocks until cond holds or timeout passes. It is called and
+// returns with m.mu held.
+func (m *LLMuxer) wait(cond func() bool, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !cond() {
+		if m.ended {
+			return false
+		}
+		notify := m.notify
+		m.mu.Unlock()
+		select {
+		case <-notify:
+			m.mu.Lock()
+		case <-timer.C:
+			m.mu.Lock()
+			return cond()
+		}
+	}
+	return true
+}
+
+func (m *LLMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	switch {
+	case name == m.PlaylistName:
+		m.servePlaylist(w, r)
+	case path.Ext(name) == ".mp4":
+		m.mu.Lock()
+		b, ok := m.inits[name]
+		m.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		serveData(w, "video/mp4", b)
+	case path.Ext(name) == ".m4s":
+		m.serveMedia(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *LLMuxer) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	b, status, msg := m.blockingPlaylist(r.URL.Query())
+	if status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	serveData(w, "application/vnd.apple.mpegurl", b)
+}
+
+// blockingPlaylist waits for the segment or part a blocking playlist
+// reload asks for and marshals the playlist, or returns why it can not.
+// The client is written to after m.mu is released.
+func (m *LLMuxer) blockingPlaylist(q url.Values) (b []byte, status int, msg string) {
+	skip := q.Get("_HLS_skip") == "YES" || q.Get("_HLS_skip") == "v2"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s := q.Get("_HLS_msn"); s != "" {
+		msn, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, "invalid _HLS_msn"
+		}
+		part := -1
+		if s := q.Get("_HLS_part"); s != "" {
+			if part, err = strconv.Atoi(s); err != nil || part < 0 {
+				return nil, http.StatusBadRequest, "invalid _HLS_part"
+			}
+		}
+		// requests more than two segments ahead are rejected
+		if next, _ := m.nextPart(); msn > next+2 {
+			return nil, http.StatusBadRequest, "_HLS_msn too far ahead"
+		}
+		if !m.wait(func() bool { return m.hasPart(msn, part) }, 3*m.TargetDuration) && !m.ended {
+			return nil, http.StatusServiceUnavailable, "playlist update timed out"
+		}
+	}
+
+	p := m.playlist(skip)
+	return p.Marshal(), http.StatusOK, ""
+}
+
+func (m *LLMuxer) serveMedia(w http.ResponseWriter, r *http.Request, name string) {
+	var seq uint64
+	var part int
+	isPart := false
+	prefix := m.SegmentPrefix
+	if _, err := fmt.Sscanf(name, prefix+"%d.%d.m4s", &seq, &part); err == nil {
+		isPart = true
+	} else if _, err := fmt.Sscanf(name, prefix+"%d.m4s", &seq); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	if isPart {
+		// the preload hinted part is held until it is complete
+		if next, nextpart := m.nextPart(); seq == next && part == nextpart {
+			m.wait(func() bool { return m.hasPart(seq, part) }, 3*m.TargetDuration)
+		}
+	}
+	// parts and segments are not modified once listed
+	b, ok := m.findMedia(seq, part, isPart)
+	m.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	serveData(w, "video/mp4", b)
+}
+
+func (m *LLMuxer) findMedia(seq uint64, part int, isPart bool) ([]byte, bool) {
+	segs := m.segments
+	if m.cur != nil {
+		segs = append(segs[:len(segs):len(segs)], m.cur)
+	}
+	for _, seg := range segs {
+		if seg.seq != seq {
+			continue
+		}
+		if !isPart {
+			return seg.data, seg.data != nil
+		}
+		if part < len(seg.parts) {
+			return seg.parts[part].data, true
+		}
+	}
+	return nil, false
+}
+
+func serveData(w http.ResponseWriter, contentType string, b []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,213 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (status int, body []byte) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body
+}
+
+func getPlaylist(t *testing.T, url string) *MediaPlaylist {
+	t.Helper()
+	status, body := get(t, url)
+	if status != http.StatusOK {
+		t.Fatalf("%s: status %d %s", url, status, body)
+	}
+	p, err := ParseMediaPlaylist(body)
+	if err != nil {
+		t.Fatalf("%s: %v", url, err)
+	}
+	return p
+}
+
+// startLLMuxer serves a muxer that got keyframes every second until end.
+func startLLMuxer(t *testing.T, end time.Duration) (m *LLMuxer, url string) {
+	m = NewLLMuxer()
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, end, every(time.Second, 0, end)...)
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	return m, srv.URL + "/"
+}
+
+func TestLLMuxerPlaylist(t *testing.T) {
+	m, url := startLLMuxer(t, 5*time.Second)
+
+	p := getPlaylist(t, url+"index.m3u8")
+	if p.Version != 9 || p.PartTarget != DefaultPartTarget || p.ServerControl == nil || !p.ServerControl.CanBlockReload {
+		t.Errorf("unexpected playlist header %+v", p)
+	}
+	// two 2s segments and the one in progress
+	if len(p.Segments) != 3 || p.Segments[2].URI != "" {
+		t.Fatalf("unexpected segments %+v", p.Segments)
+	}
+	for _, seg := range p.Segments[:2] {
+		if seg.Duration != 2*time.Second || len(seg.Parts) == 0 || !seg.Parts[0].Independent {
+			t.Errorf("unexpected segment %+v", seg)
+		}
+		var total time.Duration
+		var data []byte
+		for _, part := range seg.Parts {
+			if part.Duration > DefaultPartTarget {
+				t.Errorf("part %s is longer than PART-TARGET", part.URI)
+			}
+			total += part.Duration
+			status, body := get(t, url+part.URI)
+			if status != http.StatusOK {
+				t.Fatalf("%s: status %d", part.URI, status)
+			}
+			data = append(data, body...)
+		}
+		if total != seg.Duration {
+			t.Errorf("%s: parts last %s", seg.URI, total)
+		}
+		// a segment is its parts
+		if status, body := get(t, url+seg.URI); status != http.StatusOK || !bytes.Equal(body, data) {
+			t.Errorf("%s: status %d, %d bytes, want %d", seg.URI, status, len(body), len(data))
+		}
+	}
+
+	seq, part := m.nextPart()
+	if want := fmt.Sprintf("segment%d.%d.m4s", seq, part); p.PreloadHint != want {
+		t.Errorf("preload hint %q, want %q", p.PreloadHint, want)
+	}
+	if status, body := get(t, url+"init1.mp4"); status != http.StatusOK || !bytes.Contains(body, []byte("moov")) {
+		t.Errorf("init section: status %d", status)
+	}
+	for _, name := range []string{"segment9.m4s", "segment0.9.m4s", "init2.mp4", "other.txt"} {
+		if status, _ := get(t, url+name); status != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", name, status)
+		}
+	}
+}
+
+func TestLLMuxerBlockingReload(t *testing.T) {
+	m, url := startLLMuxer(t, 3*time.Second)
+
+	for _, q := range []string{"_HLS_msn=x", "_HLS_msn=1&_HLS_part=-1", "_HLS_msn=9"} {
+		if status, _ := get(t, url+"index.m3u8?"+q); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, status)
+		}
+	}
+
+	m.mu.Lock()
+	seq, part := m.nextPart()
+	m.mu.Unlock()
+	reloaded := make(chan *MediaPlaylist)
+	go func() {
+		reloaded <- getPlaylist(t, fmt.Sprintf("%sindex.m3u8?_HLS_msn=%d&_HLS_part=%d", url, seq, part))
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("the reload did not wait for the part")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	writeTestPackets(t, m, 3*time.Second, 4*time.Second, 3*time.Second)
+	select {
+	case p := <-reloaded:
+		last := p.Segments[len(p.Segments)-1]
+		if want := fmt.Sprintf("segment%d.%d.m4s", seq, part); len(last.Parts) <= part || last.Parts[part].URI != want {
+			t.Errorf("reloaded playlist misses %s: %+v", want, last)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reload did not return")
+	}
+}
+
+func TestLLMuxerPreloadHint(t *testing.T) {
+	m, url := startLLMuxer(t, 3*time.Second)
+
+	hint := getPlaylist(t, url+"index.m3u8").PreloadHint
+	fetched := make(chan []byte)
+	go func() {
+		status, body := get(t, url+hint)
+		if status != http.StatusOK {
+			t.Errorf("%s: status %d", hint, status)
+		}
+		fetched <- body
+	}()
+	select {
+	case <-fetched:
+		t.Fatal("the hinted part was served before it was complete")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	writeTestPackets(t, m, 3*time.Second, 4*time.Second, 3*time.Second)
+	select {
+	case body := <-fetched:
+		if _, again := get(t, url+hint); len(body) == 0 || !bytes.Equal(body, again) {
+			t.Errorf("%s: got %d bytes, then %d", hint, len(body), len(again))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hinted part was not served")
+	}
+}
+
+func TestLLMuxerDeltaUpdate(t *testing.T) {
+	_, url := startLLMuxer(t, 24*time.Second)
+
+	full := getPlaylist(t, url+"index.m3u8")
+	delta := getPlaylist(t, url+"index.m3u8?_HLS_skip=YES")
+	// segments older than six target durations are skipped
+	if delta.SkippedSegments != 4 || delta.MediaSequence != full.MediaSequence {
+		t.Fatalf("skipped %d of %d segments", delta.SkippedSegments, len(full.Segments))
+	}
+	if len(delta.Segments)+delta.SkippedSegments != len(full.Segments) {
+		t.Errorf("delta update lists %d segments, want %d", len(delta.Segments), len(full.Segments)-delta.SkippedSegments)
+	}
+	for i, seg := range delta.Segments {
+		if want := full.Segments[i+delta.SkippedSegments]; seg.URI != want.URI || len(seg.Parts) != len(want.Parts) {
+			t.Errorf("segment %d is %+v, want %+v", i, seg, want)
+		}
+	}
+}
+
+func TestLLMuxerCodecChange(t *testing.T) {
+	m := NewLLMuxer()
+	streams := testStreams(t)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 1300*time.Millisecond, 0, time.Second)
+	// the packets since the last part end the segment
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, time.Second, 0)
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := m.Playlist(false)
+	if len(p.Segments) != 2 || !p.Segments[1].Discontinuity || !p.Ended {
+		t.Fatalf("unexpected playlist %+v", p)
+	}
+	if d := p.Segments[0].Duration; d < 1260*time.Millisecond {
+		t.Errorf("segment before the codec change lasts %s, want 1.3s", d)
+	}
+	if p.Segments[0].Map != "init1.mp4" || p.Segments[1].Map != "init2.mp4" {
+		t.Errorf("unexpected init sections %q %q", p.Segments[0].Map, p.Segments[1].Map)
+	}
+}
@@ -2,3 +2,351 @@
 // Created by RTT.
 // Author: teocci@yandex.com on 2021-Oct-27
 package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+	"github.com/teocci/go-stream-av/format/fmp4/fragment"
+	"github.com/teocci/go-stream-av/format/ts"
+)
+
+// SegmentFormat selects the container of the media segments.
+type SegmentFormat int
+
+const (
+	FormatTS SegmentFormat = iota
+	FormatFMP4
+)
+
+const (
+	DefaultTargetDuration = 6 * time.Second
+	DefaultWindowSize     = 6
+	DefaultPlaylistName   = "index.m3u8"
+	DefaultSegmentPrefix  = "segment"
+	DefaultInitPrefix     = "init"
+)
+
+// Muxer writes a media playlist and its segments to a Storage. Segments are
+// cut on video keyframes once TargetDuration is reached, or on any packet
+// for audio only streams. Calling WriteHeader again starts a new segment
+// after an EXT-X-DISCONTINUITY, as needed when the codecs change.
+type Muxer struct {
+	Storage        Storage
+	Format         SegmentFormat
+	Type           PlaylistType
+	TargetDuration time.Duration
+	WindowSize     int // segments listed by a Live playlist
+	PlaylistName   string
+	SegmentPrefix  string
+	InitPrefix     string
+	// HEVCSampleEntry is the sample entry of H265 streams in fMP4
+	// segments, fmp4io.HVC1 when zero. See fmp4.TrackFragmenter.
+	HEVCSampleEntry fmp4io.Tag
+
+	// align replaces the duration rule for cutting a segment before an
+	// eligible packet, to follow the boundaries of another muxer
+	align func(t time.Duration) bool
+
+	seg      segmenter
+	vidx     int
+	started  bool
+	segstart time.Duration
+	lastTime time.Duration
+
+	playlist      MediaPlaylist
+	seqnum        uint64 // number of the next segment
+	initnum       int
+	mapuri        string
+	discontinuity bool
+	expired       []string // segments out of the window, removed later
+	peak          int      // highest segment bit rate
+}
+
+func NewMuxer(storage Storage) *Muxer {
+	return &Muxer{
+		Storage:        storage,
+		TargetDuration: DefaultTargetDuration,
+		WindowSize:     DefaultWindowSize,
+		PlaylistName:   DefaultPlaylistName,
+		SegmentPrefix:  DefaultSegmentPrefix,
+		InitPrefix:     DefaultInitPrefix,
+	}
+}
+
+// segmenter writes packets in one segment format and returns the bytes of
+// a segment when it is cut before pkt.
+type segmenter interface {
+	writePacket(pkt av.Packet, cut bool) (segment []byte, err error)
+	flush() (segment []byte, err error)
+}
+
+type tsSegmenter struct {
+	muxer *ts.Muxer
+	buf   bytes.Buffer
+}
+
+func newTSSegmenter(streams []av.CodecData) (*tsSegmenter, error) {
+	s := &tsSegmenter{}
+	s.muxer = ts.NewMuxer(&s.buf)
+	if err := s.muxer.WriteHeader(streams); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *tsSegmenter) writePacket(pkt av.Packet, cut bool) (segment []byte, err error) {
+	if cut {
+		segment = s.take()
+		// every segment starts with the tables
+		if err = s.muxer.WritePATPMT(); err != nil {
+			return
+		}
+	}
+	err = s.muxer.WritePacket(pkt)
+	return
+}
+
+func (s *tsSegmenter) flush() (segment []byte, err error) {
+	return s.take(), nil
+}
+
+func (s *tsSegmenter) take() []byte {
+	b := make([]byte, s.buf.Len())
+	copy(b, s.buf.Bytes())
+	s.buf.Reset()
+	return b
+}
+
+type fmp4Segmenter struct {
+	frag fragment.Fragmenter
+}
+
+func newFMP4Segmenter(streams []av.CodecData, hevc fmp4io.Tag) (*fmp4Segmenter, error) {
+	frag, err := newFragmenter(streams, hevc)
+	if err != nil {
+		return nil, err
+	}
+	return &fmp4Segmenter{frag: frag}, nil
+}
+
+// newFragmenter returns a track fragmenter for a single stream, a movie
+// fragmenter otherwise, storing H265 with the sample entry hevc.
+func newFragmenter(streams []av.CodecData, hevc fmp4io.Tag) (frag fragment.Fragmenter, err error) {
+	if len(streams) == 1 {
+		var f *fmp4.TrackFragmenter
+		if f, err = fmp4.NewTrack(streams[0]); err != nil {
+			return
+		}
+		if hevc != 0 {
+			err = f.SetHEVCSampleEntry(hevc)
+		}
+		return f, err
+	}
+	var f *fmp4.MovieFragmenter
+	if f, err = fmp4.NewMovie(streams); err != nil {
+		return
+	}
+	if hevc != 0 {
+		err = f.SetHEVCSampleEntry(hevc)
+	}
+	return f, err
+}
+
+// writePacket queues pkt before fragmenting because the fragmenter holds
+// back the last packet of every track, so the cut lands right before it.
+func (s *fmp4Segmenter) writePacket(pkt av.Packet, cut bool) (segment []byte, err error) {
+	if err = s.frag.WritePacket(pkt); err != nil {
+		return
+	}
+	if cut {
+		segment, err = s.flush()
+	}
+	return
+}
+
+func (s *fmp4Segmenter) flush() (segment []byte, err error) {
+	var frag fragment.Fragment
+	if frag, err = s.frag.Fragment(); err != nil {
+		return
+	}
+	s.frag.NewSegment()
+	segment = frag.Bytes
+	return
+}
+
+func (s *fmp4Segmenter) initSection() []byte {
+	_, _, blob := s.frag.MovieHeader()
+	return blob
+}
+
+func (m *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	if m.seg != nil {
+		// a new header is a codec change: close the segment and mark the
+		// next one as a discontinuity
+		if err = m.finishSegment(m.lastTime); err != nil {
+			return
+		}
+		m.discontinuity = true
+	}
+
+	m.vidx = -1
+	for i, cd := range streams {
+		if cd.Type().IsVideo() {
+			m.vidx = i
+			break
+		}
+	}
+	m.started = false
+	m.lastTime = 0
+
+	switch m.Format {
+	case FormatTS:
+		m.seg, err = newTSSegmenter(streams)
+		m.mapuri = ""
+	case FormatFMP4:
+		var seg *fmp4Segmenter
+		if seg, err = newFMP4Segmenter(streams, m.HEVCSampleEntry); err != nil {
+			return
+		}
+		m.seg = seg
+		m.initnum++
+		m.mapuri = fmt.Sprintf("%s%d.mp4", m.InitPrefix, m.initnum)
+		err = m.Storage.WriteFile(m.mapuri, seg.initSection())
+	default:
+		err = fmt.Errorf("hls: unknown segment format %d", m.Format)
+	}
+	return
+}
+
+func (m *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if m.seg == nil {
+		return errors.New("hls: WriteHeader not called")
+	}
+	if !m.started {
+		m.started = true
+		m.segstart = pkt.Time
+	}
+
+	// segments start on a video keyframe, or anywhere without video
+	cut := m.vidx < 0 || (int(pkt.Idx) == m.vidx && pkt.IsKeyFrame)
+	if m.align != nil {
+		cut = cut && pkt.Time != m.segstart && m.align(pkt.Time)
+	} else {
+		cut = cut && pkt.Time-m.segstart >= m.TargetDuration
+	}
+
+	var segment []byte
+	if segment, err = m.seg.writePacket(pkt, cut); err != nil {
+		return
+	}
+	if cut {
+		if err = m.addSegment(segment, pkt.Time-m.segstart); err != nil {
+			return
+		}
+		m.segstart = pkt.Time
+	}
+	if pkt.Time > m.lastTime {
+		m.lastTime = pkt.Time
+	}
+	return
+}
+
+func (m *Muxer) finishSegment(end time.Duration) (err error) {
+	var segment []byte
+	if segment, err = m.seg.flush(); err != nil {
+		return
+	}
+	if len(segment) == 0 || !m.started {
+		return
+	}
+	return m.addSegment(segment, end-m.segstart)
+}
+
+func (m *Muxer) segmentExt() string {
+	if m.Format == FormatFMP4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+func (m *Muxer) addSegment(segment []byte, dur time.Duration) (err error) {
+	uri := fmt.Sprintf("%s%d%s", m.SegmentPrefix, m.seqnum, m.segmentExt())
+	m.seqnum++
+	if err = m.Storage.WriteFile(uri, segment); err != nil {
+		return
+	}
+	if dur > 0 {
+		if bw := int(float64(len(segment)*8) / dur.Seconds()); bw > m.peak {
+			m.peak = bw
+		}
+	}
+	m.playlist.TargetDuration = FitTarget(m.playlist.TargetDuration, dur)
+	m.playlist.Segments = append(m.playlist.Segments, Segment{
+		URI:           uri,
+		Duration:      dur,
+		Discontinuity: m.discontinuity,
+		Map:           m.mapuri,
+	})
+	m.discontinuity = false
+
+	if m.Type == Live && m.WindowSize > 0 {
+		for len(m.playlist.Segments) > m.WindowSize {
+			old := m.playlist.Segments[0]
+			m.playlist.Segments = m.playlist.Segments[1:]
+			m.playlist.MediaSequence++
+			if old.Discontinuity {
+				m.playlist.DiscontinuitySequence++
+			}
+			m.expired = append(m.expired, old.URI)
+		}
+		// clients may still fetch what they saw in the previous playlists
+		for len(m.expired) > m.WindowSize {
+			if err = m.Storage.Remove(m.expired[0]); err != nil {
+				return
+			}
+			m.expired = m.expired[1:]
+		}
+	}
+
+	if m.Type == VOD {
+		return
+	}
+	return m.writePlaylist()
+}
+
+func (m *Muxer) writePlaylist() error {
+	m.playlist.Type = m.Type
+	if m.TargetDuration > m.playlist.TargetDuration {
+		m.playlist.TargetDuration = m.TargetDuration
+	}
+	m.playlist.IndependentSegments = m.vidx >= 0
+	m.playlist.Version = 3
+	if m.Format == FormatFMP4 {
+		m.playlist.Version = 7
+	}
+	return m.Storage.WriteFile(m.PlaylistName, m.playlist.Marshal())
+}
+
+// WriteTrailer writes the last segment and ends the playlist.
+func (m *Muxer) WriteTrailer() (err error) {
+	if m.seg == nil {
+		return
+	}
+	if err = m.finishSegment(m.lastTime); err != nil {
+		return
+	}
+	m.seg = nil
+	m.playlist.Ended = true
+	return m.writePlaylist()
+}
+
+// Playlist returns the current media playlist.
+func (m *Muxer) Playlist() MediaPlaylist {
+	return m.playlist
+}
@@ -0,0 +1,247 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// testPacket returns a packet of stream idx at tm, video packets hold one
+// length prefixed NAL unit.
+func testPacket(idx int, tm time.Duration, key bool) av.Packet {
+	pkt := av.Packet{Idx: int8(idx), Time: tm, IsKeyFrame: key, Data: make([]byte, 100)}
+	if idx == 0 {
+		pio.PutU32BE(pkt.Data, uint32(len(pkt.Data)-4))
+		pkt.Data[4] = 0x41
+		if key {
+			pkt.Data[4] = 0x65
+		}
+	}
+	return pkt
+}
+
+// writeTestPackets writes 25fps video with a keyframe at every time in
+// keys, and one audio packet per frame, from start until end.
+func writeTestPackets(t *testing.T, m av.PacketWriter, start, end time.Duration, keys ...time.Duration) {
+	t.Helper()
+	for tm := start; tm < end; tm += 40 * time.Millisecond {
+		key := false
+		for _, k := range keys {
+			key = key || k == tm
+		}
+		for idx := 0; idx < 2; idx++ {
+			if err := m.WritePacket(testPacket(idx, tm, key && idx == 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// every returns the multiples of d from start until end.
+func every(d, start, end time.Duration) (times []time.Duration) {
+	for tm := start; tm < end; tm += d {
+		times = append(times, tm)
+	}
+	return
+}
+
+func readPlaylist(t *testing.T, storage *MemoryStorage, name string) *MediaPlaylist {
+	t.Helper()
+	b, ok := storage.ReadFile(name)
+	if !ok {
+		t.Fatalf("%s not written", name)
+	}
+	p, err := ParseMediaPlaylist(b)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return p
+}
+
+func TestMuxerLive(t *testing.T) {
+	storage := NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.TargetDuration = 2 * time.Second
+	m.WindowSize = 3
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 20*time.Second, every(time.Second, 0, 20*time.Second)...)
+
+	// nine 2s segments are complete, the window keeps the last three
+	p := readPlaylist(t, storage, "index.m3u8")
+	if p.MediaSequence != 6 || len(p.Segments) != 3 || p.Ended || p.Type != Live {
+		t.Fatalf("unexpected playlist %+v", p)
+	}
+	for i, seg := range p.Segments {
+		if seg.URI != fmt.Sprintf("segment%d.ts", 6+i) || seg.Duration != 2*time.Second {
+			t.Errorf("unexpected segment %d %+v", i, seg)
+		}
+	}
+	if p.TargetDuration != 2*time.Second || !p.IndependentSegments || p.Version != 3 {
+		t.Errorf("unexpected playlist header %+v", p)
+	}
+	// segments that left the window are removed one window later
+	for i, name := range []string{"segment2.ts", "segment3.ts", "segment8.ts"} {
+		if _, ok := storage.ReadFile(name); ok != (i > 0) {
+			t.Errorf("%s stored=%v", name, ok)
+		}
+	}
+
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	p = readPlaylist(t, storage, "index.m3u8")
+	if !p.Ended || len(p.Segments) != 3 || p.Segments[2].URI != "segment9.ts" {
+		t.Errorf("unexpected final playlist %+v", p)
+	}
+}
+
+func TestMuxerTargetDuration(t *testing.T) {
+	storage := NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.TargetDuration = 2 * time.Second
+	m.WindowSize = 2
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	// a 5s GOP first, then 2s ones
+	writeTestPackets(t, m, 0, 15*time.Second, append([]time.Duration{0}, every(2*time.Second, 5*time.Second, 15*time.Second)...)...)
+
+	p := readPlaylist(t, storage, "index.m3u8")
+	if p.MediaSequence == 0 {
+		t.Fatalf("the long segment is still in the window %+v", p)
+	}
+	if p.TargetDuration != 5*time.Second {
+		t.Errorf("EXT-X-TARGETDURATION went from 5 to %v", p.TargetDuration.Seconds())
+	}
+}
+
+func TestMuxerDiscontinuity(t *testing.T) {
+	storage := NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Format = FormatFMP4
+	m.Type = Event
+	m.TargetDuration = time.Second
+	streams := testStreams(t)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 3*time.Second, every(time.Second, 0, 3*time.Second)...)
+	// a codec change
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, m, 0, 3*time.Second, every(time.Second, 0, 3*time.Second)...)
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := readPlaylist(t, storage, "index.m3u8")
+	if len(p.Segments) != 6 || p.Type != Event || !p.Ended || p.Version != 7 {
+		t.Fatalf("unexpected playlist %+v", p)
+	}
+	for i, seg := range p.Segments {
+		wantMap := "init1.mp4"
+		if i >= 3 {
+			wantMap = "init2.mp4"
+		}
+		if seg.Discontinuity != (i == 3) || seg.Map != wantMap || !strings.HasSuffix(seg.URI, ".m4s") {
+			t.Errorf("unexpected segment %d %+v", i, seg)
+		}
+		if _, ok := storage.ReadFile(seg.URI); !ok {
+			t.Errorf("%s not stored", seg.URI)
+		}
+	}
+	for _, name := range []string{"init1.mp4", "init2.mp4"} {
+		if b, ok := storage.ReadFile(name); !ok || !strings.Contains(string(b), "moov") {
+			t.Errorf("%s is not an init section", name)
+		}
+	}
+}
+
+func TestMuxerVOD(t *testing.T) {
+	storage := NewMemoryStorage()
+	m := NewMuxer(storage)
+	m.Type = VOD
+	m.TargetDuration = time.Second
+	m.WindowSize = 1
+	if err := m.WriteHeader(testStreams(t)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	for tm := time.Duration(0); tm < 5*time.Second; tm += 40 * time.Millisecond {
+		if err := m.WritePacket(testPacket(0, tm, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := storage.ReadFile("index.m3u8"); ok {
+		t.Error("a VOD playlist is written by WriteTrailer only")
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// audio only segments are cut on any packet, the window does not apply
+	p := readPlaylist(t, storage, "index.m3u8")
+	if len(p.Segments) != 5 || p.Type != VOD || !p.Ended || p.IndependentSegments {
+		t.Errorf("unexpected playlist %+v", p)
+	}
+	b, _ := storage.ReadFile("index.m3u8")
+	if !strings.Contains(string(b), "#EXT-X-PLAYLIST-TYPE:VOD\n") || !strings.HasSuffix(string(b), "#EXT-X-ENDLIST\n") {
+		t.Errorf("unexpected playlist\n%s", b)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hls")
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.WriteFile("a.ts", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "a.ts")); err != nil || string(b) != "abc" {
+		t.Errorf("read %q: %v", b, err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(names) != 0 {
+		t.Errorf("temporary files left %v", names)
+	}
+	if err = s.Remove("a.ts"); err != nil {
+		t.Fatal(err)
+	}
+	// removing twice is fine
+	if err = s.Remove("a.ts"); err != nil {
+		t.Error(err)
+	}
+}
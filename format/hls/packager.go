@@ -0,0 +1,347 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/fmp4/fmp4io"
+)
+
+const DefaultMasterName = "master.m3u8"
+
+// alignTolerance is how far before a boundary of the reference variant the
+// keyframe of another input may be and still start the same segment.
+const alignTolerance = 100 * time.Millisecond
+
+// Packager writes several synchronized renditions of the same content, such
+// as the main and sub streams of a camera, and the master playlist listing
+// them. Every input is written through its own StreamMuxer, possibly from
+// its own goroutine.
+//
+// The first variant added is the reference: the other inputs cut their
+// segments at the boundaries it chose, so their keyframes must be aligned
+// and all inputs must share a timeline. Packets of the other inputs are
+// held until the reference has reached their time. BANDWIDTH is the highest
+// segment bit rate seen so far; the master playlist is written once every
+// input has a segment, and rewritten when an attribute changes.
+type Packager struct {
+	Storage        Storage
+	Format         SegmentFormat
+	Type           PlaylistType
+	TargetDuration time.Duration
+	WindowSize     int
+	MasterName     string
+	// HEVCSampleEntry is the sample entry of H265 streams in fMP4
+	// segments, fmp4io.HVC1 when zero. CODECS follows it.
+	HEVCSampleEntry fmp4io.Tag
+
+	mu         sync.Mutex
+	inputs     []*StreamMuxer
+	boundaries []time.Duration // segment starts of the reference
+	reftime    time.Duration
+	refended   bool
+	master     []byte
+}
+
+func NewPackager(storage Storage) *Packager {
+	return &Packager{
+		Storage:        storage,
+		TargetDuration: DefaultTargetDuration,
+		WindowSize:     DefaultWindowSize,
+		MasterName:     DefaultMasterName,
+	}
+}
+
+// StreamMuxer is one input of a Packager, a variant stream or an alternate
+// audio rendition.
+type StreamMuxer struct {
+	p         *Packager
+	name      string
+	rendition *Rendition // nil for a variant
+	audio     string     // audio group of a variant
+	muxer     *Muxer
+	streams   []av.CodecData // of the last header written to muxer
+	held      []heldPacket
+	next      int // next boundary to cut at
+	ended     bool
+	closed    bool
+}
+
+// heldPacket is a packet, or a new header when streams is set.
+type heldPacket struct {
+	pkt     av.Packet
+	streams []av.CodecData
+}
+
+// AddVariant adds a variant stream. audioGroup is the GROUP-ID of its
+// alternate audio renditions, empty when it has none.
+func (p *Packager) AddVariant(audioGroup string) *StreamMuxer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &StreamMuxer{
+		p:     p,
+		name:  fmt.Sprintf("stream%d", len(p.inputs)),
+		audio: audioGroup,
+	}
+	p.inputs = append(p.inputs, s)
+	return s
+}
+
+// AddAudio adds an audio only alternate rendition to group.
+func (p *Packager) AddAudio(group, name, language string, isDefault bool) *StreamMuxer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &StreamMuxer{
+		p:    p,
+		name: fmt.Sprintf("audio%d", len(p.inputs)),
+		rendition: &Rendition{
+			Type:       "AUDIO",
+			GroupID:    group,
+			Name:       name,
+			Language:   language,
+			Default:    isDefault,
+			AutoSelect: true,
+		},
+	}
+	p.inputs = append(p.inputs, s)
+	return s
+}
+
+// reference returns the first variant.
+func (p *Packager) reference() *StreamMuxer {
+	for _, s := range p.inputs {
+		if s.rendition == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *StreamMuxer) isReference() bool {
+	return s.p.reference() == s
+}
+
+func (s *StreamMuxer) WriteHeader(streams []av.CodecData) (err error) {
+	p := s.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.muxer == nil {
+		m := NewMuxer(p.Storage)
+		m.Format = p.Format
+		m.Type = p.Type
+		m.TargetDuration = p.TargetDuration
+		m.WindowSize = p.WindowSize
+		m.HEVCSampleEntry = p.HEVCSampleEntry
+		m.PlaylistName = s.name + ".m3u8"
+		m.SegmentPrefix = s.name + "_segment"
+		m.InitPrefix = s.name + "_init"
+		if !s.isReference() {
+			m.align = s.align
+		}
+		s.muxer = m
+	}
+
+	if s.isReference() {
+		if err = s.muxer.WriteHeader(streams); err != nil {
+			return
+		}
+		s.streams = streams
+	} else {
+		s.held = append(s.held, heldPacket{streams: streams})
+		if err = s.drain(); err != nil {
+			return
+		}
+	}
+	return p.writeMaster()
+}
+
+func (s *StreamMuxer) WritePacket(pkt av.Packet) (err error) {
+	p := s.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.muxer == nil {
+		return errors.New("hls: WriteHeader not called")
+	}
+	if !s.isReference() {
+		s.held = append(s.held, heldPacket{pkt: pkt})
+		if err = s.drain(); err != nil {
+			return
+		}
+		return p.writeMaster()
+	}
+
+	seqnum := s.muxer.seqnum
+	if err = s.muxer.WritePacket(pkt); err != nil {
+		return
+	}
+	if s.muxer.seqnum != seqnum {
+		p.boundaries = append(p.boundaries, pkt.Time)
+	}
+	if pkt.Time > p.reftime {
+		p.reftime = pkt.Time
+	}
+	if err = p.drainAll(); err != nil {
+		return
+	}
+	return p.writeMaster()
+}
+
+func (s *StreamMuxer) WriteTrailer() (err error) {
+	p := s.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.muxer == nil {
+		return
+	}
+	s.ended = true
+	if s.isReference() {
+		if err = s.muxer.WriteTrailer(); err != nil {
+			return
+		}
+		s.closed = true
+		p.refended = true
+		err = p.drainAll()
+	} else {
+		err = s.drain()
+	}
+	if err != nil {
+		return
+	}
+	return p.writeMaster()
+}
+
+// drain writes the held packets that the reference has caught up with, and
+// the trailer once all packets of an ended input are written.
+func (s *StreamMuxer) drain() (err error) {
+	p := s.p
+	for len(s.held) != 0 {
+		h := s.held[0]
+		if h.streams != nil {
+			if err = s.muxer.WriteHeader(h.streams); err == nil {
+				// CODECS and RESOLUTION follow the streams being written
+				s.streams = h.streams
+			}
+		} else {
+			if !p.refended && h.pkt.Time+alignTolerance > p.reftime {
+				break
+			}
+			err = s.muxer.WritePacket(h.pkt)
+		}
+		if err != nil {
+			return
+		}
+		s.held = s.held[1:]
+	}
+	if len(s.held) == 0 && s.ended && !s.closed {
+		s.closed = true
+		err = s.muxer.WriteTrailer()
+	}
+	return
+}
+
+func (p *Packager) drainAll() (err error) {
+	for _, s := range p.inputs {
+		if s.muxer == nil || s.isReference() {
+			continue
+		}
+		if err = s.drain(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// align cuts at the first eligible packet past the next boundary, or close
+// to it for video keyframes. Boundaries passed within a longer GOP are
+// skipped.
+func (s *StreamMuxer) align(t time.Duration) bool {
+	tolerance := alignTolerance
+	if s.muxer.vidx < 0 {
+		tolerance = 0
+	}
+	b := s.p.boundaries
+	if s.next >= len(b) || t < b[s.next]-tolerance {
+		return false
+	}
+	for s.next < len(b) && b[s.next]-tolerance <= t {
+		s.next++
+	}
+	return true
+}
+
+// hevcEntry returns the sample entry H265 is stored with, TS segments have
+// none and are listed as hvc1.
+func (p *Packager) hevcEntry() fmp4io.Tag {
+	if p.Format == FormatFMP4 {
+		return p.HEVCSampleEntry
+	}
+	return 0
+}
+
+func (p *Packager) writeMaster() (err error) {
+	pl := MasterPlaylist{
+		Version:             3,
+		IndependentSegments: true,
+	}
+	if p.Format == FormatFMP4 {
+		pl.Version = 7
+	}
+
+	audioPeak := map[string]int{}
+	audioStreams := map[string][]av.CodecData{}
+	for _, s := range p.inputs {
+		if s.muxer == nil || s.muxer.peak == 0 {
+			// not known yet
+			return
+		}
+		if s.rendition == nil {
+			continue
+		}
+		media := *s.rendition
+		media.URI = s.muxer.PlaylistName
+		pl.Media = append(pl.Media, media)
+		if s.muxer.peak > audioPeak[media.GroupID] {
+			audioPeak[media.GroupID] = s.muxer.peak
+		}
+		audioStreams[media.GroupID] = append(audioStreams[media.GroupID], s.streams...)
+	}
+
+	for _, s := range p.inputs {
+		if s.rendition != nil {
+			continue
+		}
+		variant := Variant{
+			URI:       s.muxer.PlaylistName,
+			Bandwidth: s.muxer.peak + audioPeak[s.audio],
+			Audio:     s.audio,
+		}
+		streams := append(append([]av.CodecData{}, s.streams...), audioStreams[s.audio]...)
+		if variant.Codecs, err = codecsAttribute(streams, p.hevcEntry()); err != nil {
+			return
+		}
+		for _, cd := range s.streams {
+			if vcd, ok := cd.(av.VideoCodecData); ok {
+				variant.Width, variant.Height = vcd.Width(), vcd.Height()
+				break
+			}
+		}
+		pl.Variants = append(pl.Variants, variant)
+	}
+
+	b := pl.Marshal()
+	if bytes.Equal(b, p.master) {
+		return
+	}
+	p.master = b
+	return p.Storage.WriteFile(p.MasterName, b)
+}
@@ -0,0 +1,182 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+)
+
+// testSubStreams returns a 640x352 video stream and the audio of
+// testStreams.
+func testSubStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01e5680a02d90")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, testStreams(t)[1]}
+}
+
+// testPackager has a reference variant with keyframes every second, a
+// second variant with keyframes every 500ms shifted by 40ms, and an audio
+// rendition.
+type testPackager struct {
+	*Packager
+	storage *MemoryStorage
+	main    *StreamMuxer
+	sub     *StreamMuxer
+	audio   *StreamMuxer
+}
+
+func newTestPackager(t *testing.T) *testPackager {
+	storage := NewMemoryStorage()
+	p := &testPackager{Packager: NewPackager(storage), storage: storage}
+	p.Type = Event
+	p.TargetDuration = 2 * time.Second
+	p.main = p.AddVariant("aud")
+	p.sub = p.AddVariant("aud")
+	p.audio = p.AddAudio("aud", "English", "en", true)
+	if err := p.main.WriteHeader(testStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.sub.WriteHeader(testSubStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.audio.WriteHeader(testStreams(t)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func (p *testPackager) write(t *testing.T, start, end time.Duration) {
+	t.Helper()
+	for tm := start; tm < end; tm += 40 * time.Millisecond {
+		if err := p.main.WritePacket(testPacket(0, tm, tm%time.Second == 0)); err != nil {
+			t.Fatal(err)
+		}
+		sub := tm + 40*time.Millisecond
+		if err := p.sub.WritePacket(testPacket(0, sub, sub%(500*time.Millisecond) == 40*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		pkt := testPacket(1, tm, false)
+		pkt.Idx = 0
+		if err := p.audio.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (p *testPackager) close(t *testing.T) {
+	for _, s := range []*StreamMuxer{p.main, p.sub, p.audio} {
+		if err := s.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (p *testPackager) master(t *testing.T) *MasterPlaylist {
+	t.Helper()
+	b, ok := p.storage.ReadFile(DefaultMasterName)
+	if !ok {
+		t.Fatal("master playlist not written")
+	}
+	pl, err := ParseMasterPlaylist(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl
+}
+
+func TestPackagerAlignment(t *testing.T) {
+	p := newTestPackager(t)
+	p.write(t, 0, 10*time.Second)
+	p.close(t)
+
+	ref := readPlaylist(t, p.storage, "stream0.m3u8")
+	if len(ref.Segments) != 5 {
+		t.Fatalf("reference has %d segments, want 5", len(ref.Segments))
+	}
+	for _, name := range []string{"stream1.m3u8", "audio2.m3u8"} {
+		pl := readPlaylist(t, p.storage, name)
+		if len(pl.Segments) != len(ref.Segments) || !pl.Ended {
+			t.Errorf("%s has %d segments, want %d", name, len(pl.Segments), len(ref.Segments))
+			continue
+		}
+		// the last segment of the sub stream is one frame short
+		for i, seg := range pl.Segments[:len(pl.Segments)-1] {
+			if d := seg.Duration - ref.Segments[i].Duration; d < -alignTolerance || d > alignTolerance {
+				t.Errorf("%s: segment %d lasts %s, reference %s", name, i, seg.Duration, ref.Segments[i].Duration)
+			}
+		}
+	}
+}
+
+func TestPackagerMaster(t *testing.T) {
+	p := newTestPackager(t)
+	p.write(t, 0, time.Second)
+	if _, ok := p.storage.ReadFile(DefaultMasterName); ok {
+		t.Fatal("the master playlist was written before every input had a segment")
+	}
+	p.write(t, time.Second, 5*time.Second)
+
+	pl := p.master(t)
+	if len(pl.Media) != 1 || len(pl.Variants) != 2 || !pl.IndependentSegments || pl.Version != 3 {
+		t.Fatalf("unexpected master playlist %+v", pl)
+	}
+	media := pl.Media[0]
+	want := Rendition{Type: "AUDIO", GroupID: "aud", Name: "English", Language: "en", Default: true, AutoSelect: true, URI: "audio2.m3u8"}
+	if media != want {
+		t.Errorf("rendition %+v, want %+v", media, want)
+	}
+	for i, v := range pl.Variants {
+		if v.URI != []string{"stream0.m3u8", "stream1.m3u8"}[i] || v.Audio != "aud" {
+			t.Errorf("unexpected variant %+v", v)
+		}
+		if v.Codecs != "avc1.42c01e,mp4a.40.2" {
+			t.Errorf("%s: CODECS=%q", v.URI, v.Codecs)
+		}
+		// the audio rendition is included in BANDWIDTH
+		if v.Bandwidth <= p.audio.muxer.peak {
+			t.Errorf("%s: BANDWIDTH=%d, audio %d", v.URI, v.Bandwidth, p.audio.muxer.peak)
+		}
+	}
+	if v := pl.Variants[1]; v.Width != 640 || v.Height != 352 {
+		t.Errorf("sub stream RESOLUTION=%dx%d", v.Width, v.Height)
+	}
+}
+
+func TestPackagerCodecChange(t *testing.T) {
+	p := newTestPackager(t)
+	p.write(t, 0, 5*time.Second)
+	if v := p.master(t).Variants[0]; v.Width == 640 {
+		t.Fatalf("unexpected RESOLUTION %dx%d", v.Width, v.Height)
+	}
+
+	// both variants switch resolution
+	if err := p.main.WriteHeader(testSubStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.sub.WriteHeader(testStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	p.write(t, 5*time.Second, 10*time.Second)
+	p.close(t)
+
+	pl := p.master(t)
+	main, sub := pl.Variants[0], pl.Variants[1]
+	if main.Width != 640 || main.Height != 352 || sub.Width == 640 {
+		t.Errorf("RESOLUTION not updated: %dx%d and %dx%d", main.Width, main.Height, sub.Width, sub.Height)
+	}
+	b, _ := p.storage.ReadFile("stream1.m3u8")
+	if !strings.Contains(string(b), "#EXT-X-DISCONTINUITY") {
+		t.Errorf("no discontinuity in\n%s", b)
+	}
+}
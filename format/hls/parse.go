@@ -0,0 +1,273 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsMasterPlaylist tells whether b lists variant streams rather than
+// segments.
+func IsMasterPlaylist(b []byte) bool {
+	return bytes.Contains(b, []byte("#EXT-X-STREAM-INF:"))
+}
+
+func ParseMasterPlaylist(b []byte) (p *MasterPlaylist, err error) {
+	var lines []string
+	if lines, err = playlistLines(b); err != nil {
+		return
+	}
+
+	p = &MasterPlaylist{}
+	var variant *Variant
+	for _, line := range lines {
+		tag, value := splitTag(line)
+		switch tag {
+		case "":
+			if variant != nil {
+				variant.URI = line
+				p.Variants = append(p.Variants, *variant)
+				variant = nil
+			}
+		case "#EXT-X-VERSION":
+			p.Version, err = strconv.Atoi(value)
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case "#EXT-X-MEDIA":
+			attrs := parseAttributes(value)
+			p.Media = append(p.Media, Rendition{
+				Type:       attrs["TYPE"],
+				GroupID:    attrs["GROUP-ID"],
+				Name:       attrs["NAME"],
+				Language:   attrs["LANGUAGE"],
+				Default:    attrs["DEFAULT"] == "YES",
+				AutoSelect: attrs["AUTOSELECT"] == "YES",
+				URI:        attrs["URI"],
+			})
+		case "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			variant = &Variant{Codecs: attrs["CODECS"], Audio: attrs["AUDIO"]}
+			if variant.Bandwidth, err = strconv.Atoi(attrs["BANDWIDTH"]); err != nil {
+				break
+			}
+			if res, ok := attrs["RESOLUTION"]; ok {
+				_, err = fmt.Sscanf(res, "%dx%d", &variant.Width, &variant.Height)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("hls: invalid %s: %v", tag, err)
+			return
+		}
+	}
+
+	if len(p.Variants) == 0 {
+		err = errors.New("hls: no variant in master playlist")
+	}
+	return
+}
+
+func ParseMediaPlaylist(b []byte) (p *MediaPlaylist, err error) {
+	var lines []string
+	if lines, err = playlistLines(b); err != nil {
+		return
+	}
+
+	p = &MediaPlaylist{}
+	var seg Segment
+	var mapuri string
+	var key, mapkey *Key
+	for _, line := range lines {
+		tag, value := splitTag(line)
+		switch tag {
+		case "":
+			seg.URI = line
+			seg.Map = mapuri
+			seg.MapKey = mapkey
+			seg.Key = key
+			p.Segments = append(p.Segments, seg)
+			seg = Segment{}
+		case "#EXT-X-VERSION":
+			p.Version, err = strconv.Atoi(value)
+		case "#EXT-X-TARGETDURATION":
+			var target int
+			target, err = strconv.Atoi(value)
+			p.TargetDuration = time.Duration(target) * time.Second
+		case "#EXT-X-MEDIA-SEQUENCE":
+			p.MediaSequence, err = strconv.ParseUint(value, 10, 64)
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			p.DiscontinuitySequence, err = strconv.ParseUint(value, 10, 64)
+		case "#EXT-X-PLAYLIST-TYPE":
+			p.Type = PlaylistType(value)
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case "#EXT-X-ENDLIST":
+			p.Ended = true
+		case "#EXTINF":
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[:i]
+			}
+			seg.Duration, err = parseSeconds(value)
+		case "#EXT-X-DISCONTINUITY":
+			seg.Discontinuity = true
+		case "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			if _, ok := attrs["BYTERANGE"]; ok {
+				err = errors.New("byte ranges are not supported")
+			}
+			mapuri = attrs["URI"]
+			mapkey = key
+		case "#EXT-X-BYTERANGE":
+			err = errors.New("byte ranges are not supported")
+		case "#EXT-X-KEY":
+			key, err = parseKey(parseAttributes(value))
+		case "#EXT-X-SERVER-CONTROL":
+			attrs := parseAttributes(value)
+			sc := &ServerControl{CanBlockReload: attrs["CAN-BLOCK-RELOAD"] == "YES"}
+			if v, ok := attrs["PART-HOLD-BACK"]; ok {
+				if sc.PartHoldBack, err = parseSeconds(v); err != nil {
+					break
+				}
+			}
+			if v, ok := attrs["CAN-SKIP-UNTIL"]; ok {
+				sc.CanSkipUntil, err = parseSeconds(v)
+			}
+			p.ServerControl = sc
+		case "#EXT-X-PART-INF":
+			p.PartTarget, err = parseSeconds(parseAttributes(value)["PART-TARGET"])
+		case "#EXT-X-PART":
+			attrs := parseAttributes(value)
+			part := Part{URI: attrs["URI"], Independent: attrs["INDEPENDENT"] == "YES"}
+			part.Duration, err = parseSeconds(attrs["DURATION"])
+			seg.Parts = append(seg.Parts, part)
+		case "#EXT-X-SKIP":
+			p.SkippedSegments, err = strconv.Atoi(parseAttributes(value)["SKIPPED-SEGMENTS"])
+		case "#EXT-X-PRELOAD-HINT":
+			if attrs := parseAttributes(value); attrs["TYPE"] == "PART" {
+				p.PreloadHint = attrs["URI"]
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("hls: invalid %s: %v", tag, err)
+			return
+		}
+	}
+
+	// parts of the segment in progress
+	if len(seg.Parts) != 0 {
+		seg.Map = mapuri
+		seg.MapKey = mapkey
+		seg.Key = key
+		p.Segments = append(p.Segments, seg)
+	}
+	return
+}
+
+// playlistLines returns the non blank lines of a playlist, without the
+// comments.
+func playlistLines(b []byte) (lines []string, err error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 1<<20)
+	first := true
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if first {
+			if line != "#EXTM3U" {
+				err = errors.New("hls: missing #EXTM3U header")
+				return
+			}
+			first = false
+			continue
+		}
+		if line == "" || (strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#EXT")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+	if first {
+		err = errors.New("hls: empty playlist")
+	}
+	return
+}
+
+// splitTag splits a tag line at the colon. The tag of a URI line is empty.
+func splitTag(line string) (tag string, value string) {
+	if !strings.HasPrefix(line, "#") {
+		return
+	}
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+// parseAttributes parses an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.64001f,mp4a.40.2".
+func parseAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[name] = value
+		s = strings.TrimPrefix(s, ",")
+	}
+	return attrs
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Round(f * float64(time.Second))), nil
+}
+
+func parseKey(attrs map[string]string) (key *Key, err error) {
+	method := attrs["METHOD"]
+	if method == "NONE" {
+		return
+	}
+	key = &Key{Method: method, URI: attrs["URI"]}
+	if iv, ok := attrs["IV"]; ok {
+		iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+		if key.IV, err = hex.DecodeString(iv); err != nil {
+			return
+		}
+		if len(key.IV) > 16 {
+			err = fmt.Errorf("IV has %d bytes", len(key.IV))
+			return
+		}
+		// left pad to 128 bits
+		key.IV = append(make([]byte, 16-len(key.IV)), key.IV...)
+	}
+	return
+}
@@ -0,0 +1,258 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// PlaylistType is the EXT-X-PLAYLIST-TYPE of a media playlist. Live
+// playlists have none and slide over the most recent segments.
+type PlaylistType string
+
+const (
+	Live  PlaylistType = ""
+	Event PlaylistType = "EVENT"
+	VOD   PlaylistType = "VOD"
+)
+
+type Segment struct {
+	URI           string
+	Duration      time.Duration
+	Discontinuity bool
+	Map           string // URI of the fMP4 init section, empty for TS
+	MapKey        *Key   // encryption of the init section, the EXT-X-KEY before EXT-X-MAP
+	Key           *Key   // encryption of the segment, nil when clear
+	Parts         []Part // partial segments of a low latency playlist
+}
+
+// A Segment without URI is the segment in progress of a low latency
+// playlist, only its parts are listed.
+
+// Key is EXT-X-KEY. Without IV the media sequence number of the segment is
+// used as initialization vector.
+type Key struct {
+	Method string // AES-128 or SAMPLE-AES
+	URI    string
+	IV     []byte
+}
+
+// Part is an EXT-X-PART partial segment.
+type Part struct {
+	URI         string
+	Duration    time.Duration
+	Independent bool
+}
+
+// ServerControl is EXT-X-SERVER-CONTROL.
+type ServerControl struct {
+	CanBlockReload bool
+	PartHoldBack   time.Duration
+	CanSkipUntil   time.Duration
+}
+
+type MediaPlaylist struct {
+	Version               int
+	Type                  PlaylistType
+	TargetDuration        time.Duration
+	MediaSequence         uint64
+	DiscontinuitySequence uint64
+	IndependentSegments   bool
+	Segments              []Segment
+	Ended                 bool
+
+	// low latency extensions
+	ServerControl   *ServerControl
+	PartTarget      time.Duration
+	SkippedSegments int    // segments replaced by EXT-X-SKIP in a delta update
+	PreloadHint     string // URI of the next part
+}
+
+// Variant is an EXT-X-STREAM-INF entry of a master playlist.
+type Variant struct {
+	URI       string
+	Bandwidth int // peak bit rate, including the audio rendition
+	Codecs    string
+	Width     int
+	Height    int
+	Audio     string // GROUP-ID of the alternate audio renditions
+}
+
+// Rendition is an EXT-X-MEDIA alternate rendition.
+type Rendition struct {
+	Type       string // AUDIO, VIDEO or SUBTITLES
+	GroupID    string
+	Name       string
+	Language   string
+	Default    bool
+	AutoSelect bool
+	URI        string
+}
+
+type MasterPlaylist struct {
+	Version             int
+	IndependentSegments bool
+	Media               []Rendition
+	Variants            []Variant
+}
+
+func (p *MasterPlaylist) Marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+
+	for _, media := range p.Media {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=%s,GROUP-ID=%q,NAME=%q", media.Type, media.GroupID, media.Name)
+		if media.Language != "" {
+			fmt.Fprintf(&b, ",LANGUAGE=%q", media.Language)
+		}
+		if media.Default {
+			b.WriteString(",DEFAULT=YES")
+		}
+		if media.AutoSelect {
+			b.WriteString(",AUTOSELECT=YES")
+		}
+		if media.URI != "" {
+			fmt.Fprintf(&b, ",URI=%q", media.URI)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, variant := range p.Variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", variant.Bandwidth)
+		if variant.Width != 0 && variant.Height != 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", variant.Width, variant.Height)
+		}
+		if variant.Codecs != "" {
+			fmt.Fprintf(&b, ",CODECS=%q", variant.Codecs)
+		}
+		if variant.Audio != "" {
+			fmt.Fprintf(&b, ",AUDIO=%q", variant.Audio)
+		}
+		b.WriteString("\n")
+		b.WriteString(variant.URI)
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// targetDuration is EXT-X-TARGETDURATION in whole seconds.
+func (p *MediaPlaylist) targetDuration() int {
+	return int(math.Ceil(p.TargetDuration.Seconds()))
+}
+
+// FitTarget returns target raised so that no segment duration rounded to
+// the nearest second exceeds it. Muxers keep the result as playlist state:
+// EXT-X-TARGETDURATION must not go down when a long segment leaves the
+// window.
+func FitTarget(target, d time.Duration) time.Duration {
+	if r := time.Duration(math.Round(d.Seconds())) * time.Second; r > target {
+		return r
+	}
+	return target
+}
+
+func (p *MediaPlaylist) Marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.targetDuration())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.DiscontinuitySequence != 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence)
+	}
+	if p.Type != Live {
+		fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:%s\n", p.Type)
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if sc := p.ServerControl; sc != nil {
+		b.WriteString("#EXT-X-SERVER-CONTROL:")
+		sep := ""
+		if sc.CanBlockReload {
+			b.WriteString("CAN-BLOCK-RELOAD=YES")
+			sep = ","
+		}
+		if sc.PartHoldBack != 0 {
+			fmt.Fprintf(&b, "%sPART-HOLD-BACK=%.3f", sep, sc.PartHoldBack.Seconds())
+			sep = ","
+		}
+		if sc.CanSkipUntil != 0 {
+			fmt.Fprintf(&b, "%sCAN-SKIP-UNTIL=%.3f", sep, sc.CanSkipUntil.Seconds())
+		}
+		b.WriteString("\n")
+	}
+	if p.PartTarget != 0 {
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", p.PartTarget.Seconds())
+	}
+	if p.SkippedSegments != 0 {
+		fmt.Fprintf(&b, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", p.SkippedSegments)
+	}
+
+	mapuri := ""
+	var key *Key
+	for _, seg := range p.Segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.Map != mapuri {
+			// the init section is encrypted with the key before it
+			if seg.MapKey != key {
+				writeKey(&b, seg.MapKey)
+				key = seg.MapKey
+			}
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", seg.Map)
+			mapuri = seg.Map
+		}
+		if seg.Key != key {
+			writeKey(&b, seg.Key)
+			key = seg.Key
+		}
+		writeParts(&b, seg.Parts)
+		if seg.URI == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.Duration.Seconds())
+		b.WriteString(seg.URI)
+		b.WriteString("\n")
+	}
+
+	if p.PreloadHint != "" {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=%q\n", p.PreloadHint)
+	}
+
+	if p.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+func writeKey(b *bytes.Buffer, key *Key) {
+	if key == nil {
+		b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		return
+	}
+	fmt.Fprintf(b, "#EXT-X-KEY:METHOD=%s,URI=%q", key.Method, key.URI)
+	if key.IV != nil {
+		fmt.Fprintf(b, ",IV=0x%x", key.IV)
+	}
+	b.WriteString("\n")
+}
+
+func writeParts(b *bytes.Buffer, parts []Part) {
+	for _, part := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=%q", part.Duration.Seconds(), part.URI)
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
@@ -0,0 +1,94 @@
+// Package hls
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package hls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Storage receives the playlists, init sections and segments of a muxer.
+type Storage interface {
+	WriteFile(name string, data []byte) error
+	Remove(name string) error
+}
+
+// FileStorage writes to a directory. Files are replaced through a rename so
+// that readers never see a partial playlist.
+type FileStorage struct {
+	Dir string
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{Dir: dir}, nil
+}
+
+func (s *FileStorage) WriteFile(name string, data []byte) error {
+	path := filepath.Join(s.Dir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStorage) Remove(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemoryStorage keeps the files in memory, for serving them directly.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: map[string][]byte{}}
+}
+
+func (s *MemoryStorage) WriteFile(name string, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	s.mu.Lock()
+	s.files[name] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStorage) Remove(name string) error {
+	s.mu.Lock()
+	delete(s.files, name)
+	s.mu.Unlock()
+	return nil
+}
+
+// ReadFile returns the contents of a file. The slice must not be modified.
+func (s *MemoryStorage) ReadFile(name string) ([]byte, bool) {
+	s.mu.RLock()
+	b, ok := s.files[name]
+	s.mu.RUnlock()
+	return b, ok
+}
+
+// Files lists the stored file names in order.
+func (s *MemoryStorage) Files() []string {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
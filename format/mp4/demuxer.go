@@ -10,15 +10,35 @@ import (
 	"time"
 
 	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec"
 	"github.com/teocci/go-stream-av/codec/aacparser"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/opusparser"
 	"github.com/teocci/go-stream-av/format/mp4/mp4io"
 )
 
 type Demuxer struct {
-	r         io.ReadSeeker
-	streams   []*Stream
-	movieAtom *mp4io.Movie
+	r           io.ReadSeeker
+	streams     []*Stream
+	unsupported []*UnsupportedTrackError
+	movieAtom   *mp4io.Movie
+}
+
+// UnsupportedTrackError tells why a track of the file is left out of the
+// streams.
+type UnsupportedTrackError struct {
+	TrackId int32
+	// Format is the sample entry of the track, 0 if it has none
+	Format mp4io.Tag
+	Reason string
+}
+
+func (e *UnsupportedTrackError) Error() string {
+	if e.Format == 0 {
+		return fmt.Sprintf("mp4: track %d: %s", e.TrackId, e.Reason)
+	}
+	return fmt.Sprintf("mp4: track %d: %s: %s", e.TrackId, e.Format, e.Reason)
 }
 
 func NewDemuxer(r io.ReadSeeker) *Demuxer {
@@ -37,6 +57,12 @@ func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
 	return
 }
 
+// UnsupportedTracks returns the tracks that Streams left out, as their codecs
+// cannot be passed on.
+func (self *Demuxer) UnsupportedTracks() []*UnsupportedTrackError {
+	return self.unsupported
+}
+
 func (self *Demuxer) readat(pos int64, b []byte) (err error) {
 	if _, err = self.r.Seek(pos, 0); err != nil {
 		return
@@ -74,11 +100,12 @@ func (self *Demuxer) probe() (err error) {
 	}
 
 	self.streams = []*Stream{}
-	for i, atrack := range moov.Tracks {
+	self.unsupported = nil
+	for _, atrack := range moov.Tracks {
 		stream := &Stream{
 			trackAtom: atrack,
 			demuxer:   self,
-			idx:       i,
+			idx:       len(self.streams),
 		}
 		if atrack.Media != nil && atrack.Media.Info != nil && atrack.Media.Info.Sample != nil {
 			stream.sample = atrack.Media.Info.Sample
@@ -88,23 +115,129 @@ func (self *Demuxer) probe() (err error) {
 			return
 		}
 
-		if avc1 := atrack.GetAVC1Conf(); avc1 != nil {
-			if stream.CodecData, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(avc1.Data); err != nil {
-				return
-			}
-			self.streams = append(self.streams, stream)
-		} else if esds := atrack.GetElemStreamDesc(); esds != nil {
-			if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(esds.DecConfig); err != nil {
-				return
+		if stream.CodecData, err = codecData(atrack); err != nil {
+			if unsupported, ok := err.(*UnsupportedTrackError); ok {
+				self.unsupported = append(self.unsupported, unsupported)
+				err = nil
+				continue
 			}
-			self.streams = append(self.streams, stream)
+			return
 		}
+		self.streams = append(self.streams, stream)
+	}
+	if len(self.streams) == 0 && len(self.unsupported) != 0 {
+		err = fmt.Errorf("mp4: no supported track: %w", self.unsupported[0])
+		return
 	}
 
 	self.movieAtom = moov
 	return
 }
 
+// codecData returns the codec of a track from its sample entry, or an
+// *UnsupportedTrackError.
+func codecData(atrack *mp4io.Track) (cd av.CodecData, err error) {
+	var trackId int32
+	if atrack.Header != nil {
+		trackId = atrack.Header.TrackId
+	}
+	desc := atrack.Media.Info.Sample.SampleDesc
+	unsupported := func(format mp4io.Tag, reason string, args ...interface{}) error {
+		return &UnsupportedTrackError{TrackId: trackId, Format: format, Reason: fmt.Sprintf(reason, args...)}
+	}
+	switch {
+	case desc == nil:
+		err = unsupported(0, "no sample description")
+	case desc.AVC1Desc != nil:
+		conf := desc.AVC1Desc.Conf
+		if conf == nil {
+			err = unsupported(mp4io.AVC1, "no avcC")
+			return
+		}
+		cd, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(conf.Data)
+	case desc.HV1Desc != nil:
+		conf := desc.HV1Desc.Conf
+		if conf == nil {
+			err = unsupported(desc.HV1Desc.Tag(), "no hvcC")
+			return
+		}
+		cd, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(conf.Data)
+	case desc.MP4ADesc != nil:
+		conf := desc.MP4ADesc.Conf
+		if conf == nil {
+			err = unsupported(mp4io.MP4A, "no esds")
+			return
+		}
+		cd, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(conf.DecConfig)
+	case desc.AudioDesc != nil:
+		cd, err = audioCodecData(desc.AudioDesc, unsupported)
+	case len(desc.Unknowns) != 0:
+		err = unsupported(desc.Unknowns[0].Tag(), "unsupported codec")
+	default:
+		err = unsupported(0, "no sample entry")
+	}
+	return
+}
+
+func audioCodecData(desc *mp4io.AudioDesc, unsupported func(mp4io.Tag, string, ...interface{}) error) (cd av.CodecData, err error) {
+	format := desc.Tag()
+	channels := int(desc.NumberOfChannels)
+	if format == mp4io.OPUS && desc.OpusConf != nil {
+		channels = int(desc.OpusConf.OutputChannelCount)
+	}
+	var layout av.ChannelLayout
+	switch channels {
+	case 1:
+		layout = av.CH_MONO
+	case 2:
+		layout = av.CH_STEREO
+	default:
+		err = unsupported(format, "%d channels", channels)
+		return
+	}
+	sampleRate := int(desc.SampleRate)
+
+	switch format {
+	case mp4io.OPUS:
+		cd = opusparser.NewCodecData(channels)
+	case mp4io.ALAW, mp4io.ULAW:
+		typ := av.PCM_ALAW
+		if format == mp4io.ULAW {
+			typ = av.PCM_MULAW
+		}
+		switch {
+		case sampleRate == 8000 && layout == av.CH_MONO && typ == av.PCM_ALAW:
+			cd = codec.NewPCMAlawCodecData()
+		case sampleRate == 8000 && layout == av.CH_MONO:
+			cd = codec.NewPCMMulawCodecData()
+		default:
+			cd = codec.NewPCMCodecDataWithFormat(typ, sampleRate, layout, av.S16)
+		}
+	case mp4io.IPCM:
+		conf := desc.PCMConf
+		if conf == nil {
+			err = unsupported(format, "no pcmC")
+			return
+		}
+		if conf.FormatFlags&mp4io.PCMConfLittleEndian == 0 {
+			err = unsupported(format, "big endian samples")
+			return
+		}
+		var sampleFormat av.SampleFormat
+		switch conf.SampleSize {
+		case 16:
+			sampleFormat = av.S16
+		case 32:
+			sampleFormat = av.S32
+		default:
+			err = unsupported(format, "%d bit samples", conf.SampleSize)
+			return
+		}
+		cd = codec.NewPCMCodecDataWithFormat(av.PCM, sampleRate, layout, sampleFormat)
+	}
+	return
+}
+
 func (s *Stream) setSampleIndex(index int) (err error) {
 	found := false
 	start := 0
@@ -418,7 +551,7 @@ func (s *Stream) timeToSampleIndex(tm time.Duration) int {
 	endIndex := 0
 	found := false
 	for _, entry := range s.sample.TimeToSample.Entries {
-		endTs = startTs + int64(entry.Count*entry.Duration)
+		endTs = startTs + int64(entry.Count)*int64(entry.Duration)
 		endIndex = startIndex + int(entry.Count)
 		if targetTs >= startTs && targetTs < endTs {
 			targetIndex = startIndex + int((targetTs-startTs)/int64(entry.Duration))
@@ -0,0 +1,185 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/opusparser"
+	"github.com/teocci/go-stream-av/format/mp4/mp4io"
+)
+
+var (
+	hevcVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0x95, 0x98, 0x09}
+	hevcSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0x96, 0x56, 0x6a, 0x24, 0xca, 0xe0, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x01, 0xe0, 0x80}
+	hevcPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	hevc, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(hevcVPS, hevcSPS, hevcPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []av.CodecData{
+		hevc,
+		opusparser.NewCodecData(2),
+		codec.NewPCMAlawCodecData(),
+		codec.NewPCMCodecDataWithFormat(av.PCM_MULAW, 16000, av.CH_STEREO, av.S16),
+		codec.NewPCMCodecDataWithFormat(av.PCM, 48000, av.CH_STEREO, av.S32),
+	}
+	f := &sparseFile{}
+	m := NewMuxer(f)
+	if err = m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		for idx := range streams {
+			pkt := av.Packet{Idx: int8(idx), IsKeyFrame: true, Time: time.Duration(i) * 20 * time.Millisecond, Data: []byte{byte(idx), byte(i)}}
+			if err = m.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDemuxer(f)
+	got, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(streams) || len(d.UnsupportedTracks()) != 0 {
+		t.Fatalf("expected %d streams, got %d and %v", len(streams), len(got), d.UnsupportedTracks())
+	}
+	if cd, ok := got[0].(h265parser.CodecData); !ok || !bytes.Equal(cd.SPS(), hevcSPS) || cd.Width() != hevc.Width() {
+		t.Errorf("unexpected H265 stream %#v", got[0])
+	}
+	for i, cd := range got[1:] {
+		expected, actual := streams[i+1].(av.AudioCodecData), cd.(av.AudioCodecData)
+		if actual.Type() != expected.Type() || actual.SampleRate() != expected.SampleRate() ||
+			actual.ChannelLayout() != expected.ChannelLayout() || actual.SampleFormat() != expected.SampleFormat() {
+			t.Errorf("stream %d: expected %v %dHz %v %v, got %v %dHz %v %v", i+1,
+				expected.Type(), expected.SampleRate(), expected.ChannelLayout(), expected.SampleFormat(),
+				actual.Type(), actual.SampleRate(), actual.ChannelLayout(), actual.SampleFormat())
+		}
+	}
+	pkt, err := d.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Idx != 0 || !bytes.Equal(pkt.Data, []byte{0, 0}) {
+		t.Errorf("unexpected first packet %d %x", pkt.Idx, pkt.Data)
+	}
+}
+
+func TestHEVCSampleEntry(t *testing.T) {
+	if mp4io.HVC1.String() != "hvc1" || mp4io.HEV1.String() != "hev1" {
+		t.Fatalf("HVC1 is %s, HEV1 is %s", mp4io.HVC1, mp4io.HEV1)
+	}
+	if tag := (mp4io.HV1Desc{}).Tag(); tag != mp4io.HVC1 {
+		t.Errorf("expected hvc1, got %s", tag)
+	}
+	if tag := (mp4io.HV1Desc{InBand: true}).Tag(); tag != mp4io.HEV1 {
+		t.Errorf("expected hev1, got %s", tag)
+	}
+
+	hevc, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(hevcVPS, hevcSPS, hevcPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &sparseFile{}
+	m := NewMuxer(f)
+	if err = m.WriteHeader([]av.CodecData{hevc}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.WritePacket(av.Packet{IsKeyFrame: true, Data: []byte{0, 0, 0, 2, 0x26, 0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.LastIndex(b, []byte("hvc1"))
+	if i < 0 || bytes.Contains(b, []byte("hev1")) {
+		t.Fatal("expected an hvc1 sample entry")
+	}
+
+	// the same track as hev1
+	copy(b[i:], "hev1")
+	streams, err := NewDemuxer(bytes.NewReader(b)).Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cd, ok := streams[0].(h265parser.CodecData); !ok || !bytes.Equal(cd.SPS(), hevcSPS) {
+		t.Errorf("unexpected hev1 stream %#v", streams[0])
+	}
+}
+
+func TestUnsupportedTrack(t *testing.T) {
+	f := &sparseFile{}
+	m := NewMuxer(f)
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for idx := 0; idx < 2; idx++ {
+			if err := m.WritePacket(av.Packet{Idx: int8(idx), Time: time.Duration(i) * time.Second, Data: []byte{byte(idx)}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make the video track an mp4v one
+	i := bytes.LastIndex(b, []byte("avc1"))
+	copy(b[i:], "mp4v")
+
+	d := NewDemuxer(bytes.NewReader(b))
+	streams, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].Type() != av.AAC {
+		t.Fatalf("expected the aac stream only, got %v", streams)
+	}
+	unsupported := d.UnsupportedTracks()
+	if len(unsupported) != 1 || unsupported[0].TrackId != 1 || unsupported[0].Format.String() != "mp4v" {
+		t.Fatalf("expected track 1 to be reported, got %v", unsupported)
+	}
+	pkt, err := d.ReadPacket()
+	if err != nil || pkt.Idx != 0 || !bytes.Equal(pkt.Data, []byte{1}) {
+		t.Errorf("unexpected packet %d %x: %v", pkt.Idx, pkt.Data, err)
+	}
+
+	// and the audio one an ac-3 one
+	i = bytes.LastIndex(b, []byte("mp4a"))
+	copy(b[i:], "ac-3")
+	d = NewDemuxer(bytes.NewReader(b))
+	var unsupportedErr *UnsupportedTrackError
+	if _, err = d.Streams(); !errors.As(err, &unsupportedErr) {
+		t.Errorf("expected an error for a file without supported tracks, got %v", err)
+	}
+}
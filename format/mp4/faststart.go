@@ -0,0 +1,211 @@
+// Package mp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/teocci/go-stream-av/format/mp4/mp4io"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+type topBox struct {
+	tag    mp4io.Tag
+	offset int64
+	size   int64
+}
+
+// Faststart copies the MP4 file read from r to w with its moov box moved in
+// front of the first mdat box, so that playback can start before the whole
+// file is downloaded. The chunk offsets are updated to match. A file whose
+// moov is already first is copied as it is.
+func Faststart(r io.ReadSeeker, w io.Writer) (err error) {
+	var boxes []topBox
+	if boxes, err = readTopBoxes(r); err != nil {
+		return
+	}
+	moovIdx, mdatIdx := -1, -1
+	for i, box := range boxes {
+		switch box.tag {
+		case mp4io.MOOV:
+			if moovIdx < 0 {
+				moovIdx = i
+			}
+		case mp4io.MDAT:
+			if mdatIdx < 0 {
+				mdatIdx = i
+			}
+		}
+	}
+	if moovIdx < 0 {
+		err = errors.New("mp4: no moov box found")
+		return
+	}
+	if mdatIdx < 0 || moovIdx < mdatIdx {
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		_, err = io.Copy(w, r)
+		return
+	}
+
+	moovBox := boxes[moovIdx]
+	moov := make([]byte, moovBox.size)
+	if _, err = r.Seek(moovBox.offset, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, moov); err != nil {
+		return
+	}
+	// only the data between the first mdat and the moov moves
+	start, end := boxes[mdatIdx].offset, moovBox.offset
+	err = shiftChunkOffsets(moov, func(offset int64) int64 {
+		if offset >= start && offset < end {
+			return offset + moovBox.size
+		}
+		return offset
+	})
+	if err != nil {
+		return
+	}
+
+	copyBox := func(box topBox) (err error) {
+		if _, err = r.Seek(box.offset, io.SeekStart); err != nil {
+			return
+		}
+		_, err = io.CopyN(w, r, box.size)
+		return
+	}
+	for i, box := range boxes {
+		if i == mdatIdx {
+			if _, err = w.Write(moov); err != nil {
+				return
+			}
+		}
+		if i == moovIdx {
+			continue
+		}
+		if err = copyBox(box); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readTopBoxes lists the top level boxes of a file.
+func readTopBoxes(r io.ReadSeeker) (boxes []topBox, err error) {
+	var end int64
+	if end, err = r.Seek(0, io.SeekEnd); err != nil {
+		return
+	}
+	hdr := make([]byte, 16)
+	for offset := int64(0); offset < end; {
+		if offset+8 > end {
+			err = fmt.Errorf("mp4: %d trailing bytes at %d", end-offset, offset)
+			return
+		}
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(r, hdr[:8]); err != nil {
+			return
+		}
+		box := topBox{
+			tag:    mp4io.Tag(pio.U32BE(hdr[4:])),
+			offset: offset,
+			size:   int64(pio.U32BE(hdr)),
+		}
+		switch box.size {
+		case 0:
+			// up to the end of the file
+			box.size = end - offset
+		case 1:
+			if _, err = io.ReadFull(r, hdr[8:]); err != nil {
+				return
+			}
+			box.size = int64(pio.U64BE(hdr[8:]))
+		}
+		if box.size < 8 || offset+box.size > end {
+			err = fmt.Errorf("mp4: invalid size of box %v at %d", box.tag, offset)
+			return
+		}
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	return
+}
+
+// shiftChunkOffsets rewrites in place the stco and co64 tables of a
+// marshaled moov box.
+func shiftChunkOffsets(b []byte, shift func(int64) int64) (err error) {
+	for n := 8; n+8 <= len(b); {
+		size := int(pio.U32BE(b[n:]))
+		tag := mp4io.Tag(pio.U32BE(b[n+4:]))
+		if size < 8 || n+size > len(b) {
+			return fmt.Errorf("mp4: invalid size of box %v", tag)
+		}
+		box := b[n : n+size]
+		switch tag {
+		case mp4io.TRAK, mp4io.MDIA, mp4io.MINF, mp4io.STBL:
+			if err = shiftChunkOffsets(box, shift); err != nil {
+				return
+			}
+		case mp4io.STCO, mp4io.CO64:
+			if len(box) < 16 {
+				return fmt.Errorf("mp4: invalid %v box", tag)
+			}
+			count := int(pio.U32BE(box[12:]))
+			entrySize := 4
+			if tag == mp4io.CO64 {
+				entrySize = 8
+			}
+			if count < 0 || 16+count*entrySize > len(box) {
+				return fmt.Errorf("mp4: invalid %v box", tag)
+			}
+			for i := 0; i < count; i++ {
+				p := box[16+i*entrySize:]
+				if entrySize == 8 {
+					pio.PutU64BE(p, uint64(shift(int64(pio.U64BE(p)))))
+					continue
+				}
+				offset := shift(int64(pio.U32BE(p)))
+				if offset > math.MaxUint32 {
+					return errors.New("mp4: chunk offset does not fit in stco after moving the moov")
+				}
+				pio.PutU32BE(p, uint32(offset))
+			}
+		}
+		n += size
+	}
+	return
+}
+
+// moveData moves the bytes between start and end of rw forward by delta,
+// from the last ones so that they do not overwrite each other.
+func moveData(rw io.ReadWriteSeeker, start, end, delta int64) (err error) {
+	buf := make([]byte, pio.RecommendBufioSize)
+	for pos := end; pos > start; {
+		n := int64(len(buf))
+		if pos-start < n {
+			n = pos - start
+		}
+		pos -= n
+		if _, err = rw.Seek(pos, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(rw, buf[:n]); err != nil {
+			return
+		}
+		if _, err = rw.Seek(pos+delta, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = rw.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,178 @@
+// Package mp4
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/mp4/mp4io"
+)
+
+// writeSeeker hides the Read method of the file it wraps.
+type writeSeeker struct {
+	io.WriteSeeker
+}
+
+// muxTestFile writes 2s of video and audio packets, each with its own data,
+// and returns the file and the packets.
+func muxTestFile(t *testing.T, faststart bool) (b []byte, pkts []av.Packet) {
+	t.Helper()
+	f := &sparseFile{}
+	m := NewMuxer(f)
+	m.Faststart = faststart
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		tm := time.Duration(i) * 40 * time.Millisecond
+		pkts = append(pkts,
+			av.Packet{Idx: 0, Time: tm, IsKeyFrame: i%25 == 0, Data: bytes.Repeat([]byte{byte(i)}, 200+i*3)},
+			av.Packet{Idx: 1, Time: tm, Data: []byte{0xa0, byte(i), byte(i * 7)}},
+		)
+	}
+	for _, pkt := range pkts {
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// topTags lists the top level boxes of a file.
+func topTags(t *testing.T, b []byte) (tags []mp4io.Tag) {
+	t.Helper()
+	boxes, err := readTopBoxes(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, box := range boxes {
+		tags = append(tags, box.tag)
+	}
+	return
+}
+
+// checkDemux reads a file back and compares its packets with the ones
+// written.
+func checkDemux(t *testing.T, b []byte, pkts []av.Packet) {
+	t.Helper()
+	d := NewDemuxer(bytes.NewReader(b))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	var got []av.Packet
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pkt)
+	}
+	// reading stops at the end of the first stream to finish
+	if len(got) < len(pkts)-1 {
+		t.Fatalf("expected %d packets, got %d", len(pkts), len(got))
+	}
+	for i, pkt := range got {
+		expected := pkts[i]
+		if pkt.Idx != expected.Idx || pkt.Time != expected.Time || pkt.IsKeyFrame != expected.IsKeyFrame || !bytes.Equal(pkt.Data, expected.Data) {
+			t.Errorf("packet %d: expected %d at %s %x, got %d at %s %x", i,
+				expected.Idx, expected.Time, expected.Data, pkt.Idx, pkt.Time, pkt.Data)
+		}
+	}
+}
+
+func checkTags(t *testing.T, b []byte, expected ...mp4io.Tag) {
+	t.Helper()
+	tags := topTags(t, b)
+	if len(tags) != len(expected) {
+		t.Fatalf("expected boxes %v, got %v", expected, tags)
+	}
+	for i := range tags {
+		if tags[i] != expected[i] {
+			t.Fatalf("expected boxes %v, got %v", expected, tags)
+		}
+	}
+}
+
+func TestFaststart(t *testing.T) {
+	b, pkts := muxTestFile(t, false)
+	checkTags(t, b, mp4io.FREE, mp4io.MDAT, mp4io.MOOV)
+	// a box after the moov stays where it is
+	b = append(b, 0, 0, 0, 8, 'f', 'r', 'e', 'e')
+
+	out := &bytes.Buffer{}
+	if err := Faststart(bytes.NewReader(b), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != len(b) {
+		t.Errorf("expected %d bytes, got %d", len(b), out.Len())
+	}
+	checkTags(t, out.Bytes(), mp4io.FREE, mp4io.MOOV, mp4io.MDAT, mp4io.FREE)
+	checkDemux(t, out.Bytes(), pkts)
+
+	// a file whose moov is first is copied as it is
+	again := &bytes.Buffer{}
+	if err := Faststart(bytes.NewReader(out.Bytes()), again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), out.Bytes()) {
+		t.Error("file with the moov first was changed")
+	}
+
+	boxes, err := readTopBoxes(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Faststart(bytes.NewReader(b[:boxes[2].offset]), io.Discard); err == nil {
+		t.Error("expected an error for a file without moov")
+	}
+	for _, n := range []int{4, 12} {
+		if err = Faststart(bytes.NewReader(b[:len(b)-n]), io.Discard); err == nil {
+			t.Errorf("expected an error for a file cut by %d bytes", n)
+		}
+	}
+}
+
+func TestMuxerFaststart(t *testing.T) {
+	b, pkts := muxTestFile(t, true)
+	checkTags(t, b, mp4io.FREE, mp4io.MOOV, mp4io.MDAT)
+	checkDemux(t, b, pkts)
+
+	// the same file as moving the moov afterwards
+	plain, _ := muxTestFile(t, false)
+	out := &bytes.Buffer{}
+	if err := Faststart(bytes.NewReader(plain), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Error("Muxer.Faststart and Faststart wrote different files")
+	}
+
+	m := NewMuxer(writeSeeker{&sparseFile{}})
+	m.Faststart = true
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WritePacket(pkts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteTrailer(); err == nil {
+		t.Error("expected an error for a writer that cannot be read back")
+	}
+}
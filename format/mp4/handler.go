@@ -8,9 +8,10 @@ import (
 
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/av/avutil"
+	"github.com/teocci/go-stream-av/format/fmp4"
 )
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC, av.OPUS, av.PCM_ALAW, av.PCM_MULAW, av.PCM}
 
 func Handler(h *avutil.RegisterHandler) {
 	h.Ext = ".mp4"
@@ -24,7 +25,11 @@ func Handler(h *avutil.RegisterHandler) {
 	}
 
 	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
-		return NewDemuxer(r.(io.ReadSeeker))
+		rs := r.(io.ReadSeeker)
+		if fmp4.IsFragmented(rs) {
+			return fmp4.NewDemuxer(rs)
+		}
+		return NewDemuxer(rs)
 	}
 
 	h.WriterMuxer = func(w io.Writer) av.Muxer {
@@ -4,6 +4,7 @@
 package mp4io
 
 import (
+	"math"
 	"time"
 
 	"github.com/teocci/go-stream-av/utils/bits/pio"
@@ -27,17 +28,25 @@ func (avc1 AVC1Desc) Tag() Tag {
 	return AVC1
 }
 
-//0x31766568
-const HEV1 = Tag(0x68766331)
+// HVC1 is the hvc1 sample entry, whose parameter sets are only in the hvcC.
+const HVC1 = Tag(0x68766331)
+
+// HEV1 is the hev1 sample entry, whose parameter sets may also be in the
+// samples. It is read into an HV1Desc with InBand set.
+const HEV1 = Tag(0x68657631)
+
+// HEV1InBand is the hev1 sample entry.
+//
+// Deprecated: use HEV1.
+const HEV1InBand = HEV1
 
 func (hv1 HV1Desc) Tag() Tag {
-	return HEV1
+	if hv1.InBand {
+		return HEV1
+	}
+	return HVC1
 }
 
-//const HVC1 = Tag(0x68766331)
-//func (self HVC1Desc) Tag() Tag {
-//	return HVC1
-//}
 const URL = Tag(0x75726c20)
 
 func (dru DataReferUrl) Tag() Tag {
@@ -124,7 +133,13 @@ func (co CompositionOffset) Tag() Tag {
 
 const STCO = Tag(0x7374636f)
 
+// CO64 is the 64-bit variant of the STCO chunk offset table
+const CO64 = Tag(0x636f3634)
+
 func (co ChunkOffset) Tag() Tag {
+	if co.Is64() {
+		return CO64
+	}
 	return STCO
 }
 
@@ -226,6 +241,8 @@ func (self SoundMediaInfo) Tag() Tag {
 
 const MDAT = Tag(0x6d646174)
 
+const FREE = Tag(0x66726565)
+
 type Movie struct {
 	Header      *MovieHeader
 	MovieExtend *MovieExtend
@@ -343,7 +360,7 @@ type MovieHeader struct {
 	CreateTime        time.Time
 	ModifyTime        time.Time
 	TimeScale         int32
-	Duration          int32
+	Duration          int64
 	PreferredRate     float64
 	PreferredVolume   float64
 	Matrix            [9]int32
@@ -368,14 +385,25 @@ func (mh MovieHeader) marshal(b []byte) (n int) {
 	n += 1
 	pio.PutU24BE(b[n:], mh.Flags)
 	n += 3
-	PutTime32(b[n:], mh.CreateTime)
-	n += 4
-	PutTime32(b[n:], mh.ModifyTime)
-	n += 4
-	pio.PutI32BE(b[n:], mh.TimeScale)
-	n += 4
-	pio.PutI32BE(b[n:], mh.Duration)
-	n += 4
+	if mh.Version == 1 {
+		PutTime64(b[n:], mh.CreateTime)
+		n += 8
+		PutTime64(b[n:], mh.ModifyTime)
+		n += 8
+		pio.PutI32BE(b[n:], mh.TimeScale)
+		n += 4
+		pio.PutI64BE(b[n:], mh.Duration)
+		n += 8
+	} else {
+		PutTime32(b[n:], mh.CreateTime)
+		n += 4
+		PutTime32(b[n:], mh.ModifyTime)
+		n += 4
+		pio.PutI32BE(b[n:], mh.TimeScale)
+		n += 4
+		pio.PutU32BE(b[n:], uint32(mh.Duration))
+		n += 4
+	}
 	PutFixed32(b[n:], mh.PreferredRate)
 	n += 4
 	PutFixed16(b[n:], mh.PreferredVolume)
@@ -405,6 +433,10 @@ func (mh MovieHeader) Len() (n int) {
 	n += 8
 	n += 1
 	n += 3
+	if mh.Version == 1 {
+		// 64-bit times and duration
+		n += 12
+	}
 	n += 4
 	n += 4
 	n += 4
@@ -437,30 +469,46 @@ func (mh *MovieHeader) Unmarshal(b []byte, offset int) (n int, err error) {
 	}
 	mh.Flags = pio.U24BE(b[n:])
 	n += 3
-	if len(b) < n+4 {
+	timeSize := 4
+	if mh.Version == 1 {
+		timeSize = 8
+	}
+	if len(b) < n+timeSize {
 		err = parseErr("CreateTime", n+offset, err)
 		return
 	}
-	mh.CreateTime = GetTime32(b[n:])
-	n += 4
-	if len(b) < n+4 {
+	if mh.Version == 1 {
+		mh.CreateTime = GetTime64(b[n:])
+	} else {
+		mh.CreateTime = GetTime32(b[n:])
+	}
+	n += timeSize
+	if len(b) < n+timeSize {
 		err = parseErr("ModifyTime", n+offset, err)
 		return
 	}
-	mh.ModifyTime = GetTime32(b[n:])
-	n += 4
+	if mh.Version == 1 {
+		mh.ModifyTime = GetTime64(b[n:])
+	} else {
+		mh.ModifyTime = GetTime32(b[n:])
+	}
+	n += timeSize
 	if len(b) < n+4 {
 		err = parseErr("TimeScale", n+offset, err)
 		return
 	}
 	mh.TimeScale = pio.I32BE(b[n:])
 	n += 4
-	if len(b) < n+4 {
+	if len(b) < n+timeSize {
 		err = parseErr("Duration", n+offset, err)
 		return
 	}
-	mh.Duration = pio.I32BE(b[n:])
-	n += 4
+	if mh.Version == 1 {
+		mh.Duration = pio.I64BE(b[n:])
+	} else {
+		mh.Duration = int64(pio.U32BE(b[n:]))
+	}
+	n += timeSize
 	if len(b) < n+4 {
 		err = parseErr("PreferredRate", n+offset, err)
 		return
@@ -628,7 +676,7 @@ type TrackHeader struct {
 	CreateTime     time.Time
 	ModifyTime     time.Time
 	TrackId        int32
-	Duration       int32
+	Duration       int64
 	Layer          int16
 	AlternateGroup int16
 	Volume         float64
@@ -649,15 +697,27 @@ func (self TrackHeader) marshal(b []byte) (n int) {
 	n += 1
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
-	PutTime32(b[n:], self.CreateTime)
-	n += 4
-	PutTime32(b[n:], self.ModifyTime)
-	n += 4
-	pio.PutI32BE(b[n:], self.TrackId)
-	n += 4
-	n += 4
-	pio.PutI32BE(b[n:], self.Duration)
-	n += 4
+	if self.Version == 1 {
+		PutTime64(b[n:], self.CreateTime)
+		n += 8
+		PutTime64(b[n:], self.ModifyTime)
+		n += 8
+		pio.PutI32BE(b[n:], self.TrackId)
+		n += 4
+		n += 4
+		pio.PutI64BE(b[n:], self.Duration)
+		n += 8
+	} else {
+		PutTime32(b[n:], self.CreateTime)
+		n += 4
+		PutTime32(b[n:], self.ModifyTime)
+		n += 4
+		pio.PutI32BE(b[n:], self.TrackId)
+		n += 4
+		n += 4
+		pio.PutU32BE(b[n:], uint32(self.Duration))
+		n += 4
+	}
 	n += 8
 	pio.PutI16BE(b[n:], self.Layer)
 	n += 2
@@ -680,6 +740,10 @@ func (self TrackHeader) Len() (n int) {
 	n += 8
 	n += 1
 	n += 3
+	if self.Version == 1 {
+		// 64-bit times and duration
+		n += 12
+	}
 	n += 4
 	n += 4
 	n += 4
@@ -710,18 +774,30 @@ func (self *TrackHeader) Unmarshal(b []byte, offset int) (n int, err error) {
 	}
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
-	if len(b) < n+4 {
+	timeSize := 4
+	if self.Version == 1 {
+		timeSize = 8
+	}
+	if len(b) < n+timeSize {
 		err = parseErr("CreateTime", n+offset, err)
 		return
 	}
-	self.CreateTime = GetTime32(b[n:])
-	n += 4
-	if len(b) < n+4 {
+	if self.Version == 1 {
+		self.CreateTime = GetTime64(b[n:])
+	} else {
+		self.CreateTime = GetTime32(b[n:])
+	}
+	n += timeSize
+	if len(b) < n+timeSize {
 		err = parseErr("ModifyTime", n+offset, err)
 		return
 	}
-	self.ModifyTime = GetTime32(b[n:])
-	n += 4
+	if self.Version == 1 {
+		self.ModifyTime = GetTime64(b[n:])
+	} else {
+		self.ModifyTime = GetTime32(b[n:])
+	}
+	n += timeSize
 	if len(b) < n+4 {
 		err = parseErr("TrackId", n+offset, err)
 		return
@@ -729,12 +805,16 @@ func (self *TrackHeader) Unmarshal(b []byte, offset int) (n int, err error) {
 	self.TrackId = pio.I32BE(b[n:])
 	n += 4
 	n += 4
-	if len(b) < n+4 {
+	if len(b) < n+timeSize {
 		err = parseErr("Duration", n+offset, err)
 		return
 	}
-	self.Duration = pio.I32BE(b[n:])
-	n += 4
+	if self.Version == 1 {
+		self.Duration = pio.I64BE(b[n:])
+	} else {
+		self.Duration = int64(pio.U32BE(b[n:]))
+	}
+	n += timeSize
 	n += 8
 	if len(b) < n+2 {
 		err = parseErr("Layer", n+offset, err)
@@ -970,7 +1050,7 @@ type MediaHeader struct {
 	CreateTime time.Time
 	ModifyTime time.Time
 	TimeScale  int32
-	Duration   int32
+	Duration   int64
 	Language   int16
 	Quality    int16
 	AtomPos
@@ -987,14 +1067,25 @@ func (self MediaHeader) marshal(b []byte) (n int) {
 	n += 1
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
-	PutTime32(b[n:], self.CreateTime)
-	n += 4
-	PutTime32(b[n:], self.ModifyTime)
-	n += 4
-	pio.PutI32BE(b[n:], self.TimeScale)
-	n += 4
-	pio.PutI32BE(b[n:], self.Duration)
-	n += 4
+	if self.Version == 1 {
+		PutTime64(b[n:], self.CreateTime)
+		n += 8
+		PutTime64(b[n:], self.ModifyTime)
+		n += 8
+		pio.PutI32BE(b[n:], self.TimeScale)
+		n += 4
+		pio.PutI64BE(b[n:], self.Duration)
+		n += 8
+	} else {
+		PutTime32(b[n:], self.CreateTime)
+		n += 4
+		PutTime32(b[n:], self.ModifyTime)
+		n += 4
+		pio.PutI32BE(b[n:], self.TimeScale)
+		n += 4
+		pio.PutU32BE(b[n:], uint32(self.Duration))
+		n += 4
+	}
 	pio.PutI16BE(b[n:], self.Language)
 	n += 2
 	pio.PutI16BE(b[n:], self.Quality)
@@ -1005,6 +1096,10 @@ func (self MediaHeader) Len() (n int) {
 	n += 8
 	n += 1
 	n += 3
+	if self.Version == 1 {
+		// 64-bit times and duration
+		n += 12
+	}
 	n += 4
 	n += 4
 	n += 4
@@ -1028,30 +1123,46 @@ func (self *MediaHeader) Unmarshal(b []byte, offset int) (n int, err error) {
 	}
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
-	if len(b) < n+4 {
+	timeSize := 4
+	if self.Version == 1 {
+		timeSize = 8
+	}
+	if len(b) < n+timeSize {
 		err = parseErr("CreateTime", n+offset, err)
 		return
 	}
-	self.CreateTime = GetTime32(b[n:])
-	n += 4
-	if len(b) < n+4 {
+	if self.Version == 1 {
+		self.CreateTime = GetTime64(b[n:])
+	} else {
+		self.CreateTime = GetTime32(b[n:])
+	}
+	n += timeSize
+	if len(b) < n+timeSize {
 		err = parseErr("ModifyTime", n+offset, err)
 		return
 	}
-	self.ModifyTime = GetTime32(b[n:])
-	n += 4
+	if self.Version == 1 {
+		self.ModifyTime = GetTime64(b[n:])
+	} else {
+		self.ModifyTime = GetTime32(b[n:])
+	}
+	n += timeSize
 	if len(b) < n+4 {
 		err = parseErr("TimeScale", n+offset, err)
 		return
 	}
 	self.TimeScale = pio.I32BE(b[n:])
 	n += 4
-	if len(b) < n+4 {
+	if len(b) < n+timeSize {
 		err = parseErr("Duration", n+offset, err)
 		return
 	}
-	self.Duration = pio.I32BE(b[n:])
-	n += 4
+	if self.Version == 1 {
+		self.Duration = pio.I64BE(b[n:])
+	} else {
+		self.Duration = int64(pio.U32BE(b[n:]))
+	}
+	n += timeSize
 	if len(b) < n+2 {
 		err = parseErr("Language", n+offset, err)
 		return
@@ -1654,11 +1765,11 @@ func (self *SampleTable) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				self.SyncSample = atom
 			}
-		case STCO:
+		case STCO, CO64:
 			{
 				atom := &ChunkOffset{}
 				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
-					err = parseErr("stco", n+offset, err)
+					err = parseErr(tag.String(), n+offset, err)
 					return
 				}
 				self.ChunkOffset = atom
@@ -1707,7 +1818,9 @@ type SampleDesc struct {
 	AVC1Desc *AVC1Desc
 	HV1Desc  *HV1Desc
 	MP4ADesc *MP4ADesc
-	Unknowns []Atom
+	// AudioDesc is an Opus, alaw, ulaw or ipcm sample entry
+	AudioDesc *AudioDesc
+	Unknowns  []Atom
 	AtomPos
 }
 
@@ -1731,6 +1844,9 @@ func (self SampleDesc) marshal(b []byte) (n int) {
 	if self.MP4ADesc != nil {
 		_childrenNR++
 	}
+	if self.AudioDesc != nil {
+		_childrenNR++
+	}
 	_childrenNR += len(self.Unknowns)
 	pio.PutI32BE(b[n:], int32(_childrenNR))
 	n += 4
@@ -1743,6 +1859,9 @@ func (self SampleDesc) marshal(b []byte) (n int) {
 	if self.MP4ADesc != nil {
 		n += self.MP4ADesc.Marshal(b[n:])
 	}
+	if self.AudioDesc != nil {
+		n += self.AudioDesc.Marshal(b[n:])
+	}
 	for _, atom := range self.Unknowns {
 		n += atom.Marshal(b[n:])
 	}
@@ -1762,6 +1881,9 @@ func (self SampleDesc) Len() (n int) {
 	if self.MP4ADesc != nil {
 		n += self.MP4ADesc.Len()
 	}
+	if self.AudioDesc != nil {
+		n += self.AudioDesc.Len()
+	}
 	for _, atom := range self.Unknowns {
 		n += atom.Len()
 	}
@@ -1795,15 +1917,24 @@ func (self *SampleDesc) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				self.AVC1Desc = atom
 			}
-		case HEV1:
+		case HVC1, HEV1:
 			{
-				atom := &HV1Desc{}
+				atom := &HV1Desc{InBand: tag == HEV1}
 				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
 					err = parseErr("hec1", n+offset, err)
 					return
 				}
 				self.HV1Desc = atom
 			}
+		case OPUS, ALAW, ULAW, IPCM:
+			{
+				atom := &AudioDesc{Tag_: tag}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr(tag.String(), n+offset, err)
+					return
+				}
+				self.AudioDesc = atom
+			}
 		case MP4A:
 			{
 				atom := &MP4ADesc{}
@@ -1837,6 +1968,9 @@ func (self SampleDesc) Children() (r []Atom) {
 	if self.MP4ADesc != nil {
 		r = append(r, self.MP4ADesc)
 	}
+	if self.AudioDesc != nil {
+		r = append(r, self.AudioDesc)
+	}
 	r = append(r, self.Unknowns...)
 	return
 }
@@ -2016,6 +2150,7 @@ type HV1Desc struct {
 	Depth                int16
 	ColorTableId         int16
 	Conf                 *HV1Conf
+	InBand               bool
 	Unknowns             []Atom
 	AtomPos
 }
@@ -2046,7 +2181,7 @@ func (avc1 AVC1Desc) Marshal(b []byte) (n int) {
 	return
 }
 func (hv1 HV1Desc) Marshal(b []byte) (n int) {
-	pio.PutU32BE(b[4:], uint32(HEV1))
+	pio.PutU32BE(b[4:], uint32(hv1.Tag()))
 	n += hv1.marshal(b[8:]) + 8
 	pio.PutU32BE(b[0:], uint32(n))
 	return
@@ -2825,20 +2960,32 @@ func (ss SyncSample) Children() (r []Atom) {
 	return
 }
 
+// ChunkOffset is marshaled as a co64 box when an offset needs 64 bits, and
+// as a stco box otherwise
 type ChunkOffset struct {
 	Version uint8
 	Flags   uint32
-	Entries []uint32
+	Entries []uint64
 	AtomPos
 }
 
+// Is64 tells whether the offsets need a co64 box
+func (co ChunkOffset) Is64() bool {
+	for _, entry := range co.Entries {
+		if entry > math.MaxUint32 {
+			return true
+		}
+	}
+	return false
+}
+
 func (co ChunkOffset) Marshal(b []byte) (n int) {
-	pio.PutU32BE(b[4:], uint32(STCO))
-	n += co.marshal(b[8:]) + 8
+	pio.PutU32BE(b[4:], uint32(co.Tag()))
+	n += co.marshal(b[8:], co.Is64()) + 8
 	pio.PutU32BE(b[0:], uint32(n))
 	return
 }
-func (co ChunkOffset) marshal(b []byte) (n int) {
+func (co ChunkOffset) marshal(b []byte, is64 bool) (n int) {
 	pio.PutU8(b[n:], co.Version)
 	n += 1
 	pio.PutU24BE(b[n:], co.Flags)
@@ -2846,8 +2993,13 @@ func (co ChunkOffset) marshal(b []byte) (n int) {
 	pio.PutU32BE(b[n:], uint32(len(co.Entries)))
 	n += 4
 	for _, entry := range co.Entries {
-		pio.PutU32BE(b[n:], entry)
-		n += 4
+		if is64 {
+			pio.PutU64BE(b[n:], entry)
+			n += 8
+		} else {
+			pio.PutU32BE(b[n:], uint32(entry))
+			n += 4
+		}
 	}
 	return
 }
@@ -2856,7 +3008,11 @@ func (co ChunkOffset) Len() (n int) {
 	n += 1
 	n += 3
 	n += 4
-	n += 4 * len(co.Entries)
+	if co.Is64() {
+		n += 8 * len(co.Entries)
+	} else {
+		n += 4 * len(co.Entries)
+	}
 	return
 }
 func (co *ChunkOffset) Unmarshal(b []byte, offset int) (n int, err error) {
@@ -2874,17 +3030,29 @@ func (co *ChunkOffset) Unmarshal(b []byte, offset int) (n int, err error) {
 	}
 	co.Flags = pio.U24BE(b[n:])
 	n += 3
+	if len(b) < n+4 {
+		err = parseErr("Entries", n+offset, err)
+		return
+	}
 	var _len_Entries uint32
 	_len_Entries = pio.U32BE(b[n:])
 	n += 4
-	co.Entries = make([]uint32, _len_Entries)
-	if len(b) < n+4*len(co.Entries) {
-		err = parseErr("uint32", n+offset, err)
+	entrySize := 4
+	if Tag(pio.U32BE(b[4:])) == CO64 {
+		entrySize = 8
+	}
+	if uint64(len(b)) < uint64(n)+uint64(entrySize)*uint64(_len_Entries) {
+		err = parseErr("Entries", n+offset, err)
 		return
 	}
+	co.Entries = make([]uint64, _len_Entries)
 	for i := range co.Entries {
-		co.Entries[i] = pio.U32BE(b[n:])
-		n += 4
+		if entrySize == 8 {
+			co.Entries[i] = pio.U64BE(b[n:])
+		} else {
+			co.Entries[i] = uint64(pio.U32BE(b[n:]))
+		}
+		n += entrySize
 	}
 	return
 }
@@ -0,0 +1,308 @@
+// Package mp4io
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package mp4io
+
+import (
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+const (
+	OPUS = Tag(0x4f707573)
+	DOPS = Tag(0x644f7073)
+	ALAW = Tag(0x616c6177)
+	ULAW = Tag(0x756c6177)
+	IPCM = Tag(0x6970636d)
+	PCMC = Tag(0x70636d43)
+)
+
+// AudioDesc is a sound sample entry with no esds: Opus, alaw, ulaw or ipcm.
+type AudioDesc struct {
+	Tag_             Tag
+	DataRefIdx       int16
+	Version          int16
+	RevisionLevel    int16
+	Vendor           int32
+	NumberOfChannels int16
+	SampleSize       int16
+	CompressionId    int16
+	SampleRate       float64
+	OpusConf         *OpusSpecificConf
+	PCMConf          *PCMConf
+	Unknowns         []Atom
+	AtomPos
+}
+
+func (self AudioDesc) Tag() Tag {
+	return self.Tag_
+}
+
+func (self AudioDesc) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(self.Tag_))
+	n += self.marshal(b[8:]) + 8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self AudioDesc) marshal(b []byte) (n int) {
+	n += 6
+	pio.PutI16BE(b[n:], self.DataRefIdx)
+	n += 2
+	pio.PutI16BE(b[n:], self.Version)
+	n += 2
+	pio.PutI16BE(b[n:], self.RevisionLevel)
+	n += 2
+	pio.PutI32BE(b[n:], self.Vendor)
+	n += 4
+	pio.PutI16BE(b[n:], self.NumberOfChannels)
+	n += 2
+	pio.PutI16BE(b[n:], self.SampleSize)
+	n += 2
+	pio.PutI16BE(b[n:], self.CompressionId)
+	n += 2
+	n += 2
+	PutFixed32(b[n:], self.SampleRate)
+	n += 4
+	if self.OpusConf != nil {
+		n += self.OpusConf.Marshal(b[n:])
+	}
+	if self.PCMConf != nil {
+		n += self.PCMConf.Marshal(b[n:])
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+
+func (self AudioDesc) Len() (n int) {
+	n += 8
+	n += 28
+	if self.OpusConf != nil {
+		n += self.OpusConf.Len()
+	}
+	if self.PCMConf != nil {
+		n += self.PCMConf.Len()
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+
+func (self *AudioDesc) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	if len(b) < n+28 {
+		err = parseErr("AudioDesc", n+offset, err)
+		return
+	}
+	n += 6
+	self.DataRefIdx = pio.I16BE(b[n:])
+	n += 2
+	self.Version = pio.I16BE(b[n:])
+	n += 2
+	self.RevisionLevel = pio.I16BE(b[n:])
+	n += 2
+	self.Vendor = pio.I32BE(b[n:])
+	n += 4
+	self.NumberOfChannels = pio.I16BE(b[n:])
+	n += 2
+	self.SampleSize = pio.I16BE(b[n:])
+	n += 2
+	self.CompressionId = pio.I16BE(b[n:])
+	n += 2
+	n += 2
+	self.SampleRate = GetFixed32(b[n:])
+	n += 4
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case DOPS:
+			{
+				atom := &OpusSpecificConf{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("dOps", n+offset, err)
+					return
+				}
+				self.OpusConf = atom
+			}
+		case PCMC:
+			{
+				atom := &PCMConf{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("pcmC", n+offset, err)
+					return
+				}
+				self.PCMConf = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n : n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				self.Unknowns = append(self.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+
+func (self AudioDesc) Children() (r []Atom) {
+	if self.OpusConf != nil {
+		r = append(r, self.OpusConf)
+	}
+	if self.PCMConf != nil {
+		r = append(r, self.PCMConf)
+	}
+	r = append(r, self.Unknowns...)
+	return
+}
+
+// OpusSpecificConf is the dOps box of an Opus sample entry. ChannelMapping
+// holds the channel mapping table when ChannelMappingFamily is not 0.
+type OpusSpecificConf struct {
+	Version              uint8
+	OutputChannelCount   uint8
+	PreSkip              uint16
+	InputSampleRate      uint32
+	OutputGain           int16
+	ChannelMappingFamily uint8
+	ChannelMapping       []byte
+	AtomPos
+}
+
+func (self OpusSpecificConf) Tag() Tag {
+	return DOPS
+}
+
+func (self OpusSpecificConf) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(DOPS))
+	n += self.marshal(b[8:]) + 8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self OpusSpecificConf) marshal(b []byte) (n int) {
+	pio.PutU8(b[n:], self.Version)
+	n += 1
+	pio.PutU8(b[n:], self.OutputChannelCount)
+	n += 1
+	pio.PutU16BE(b[n:], self.PreSkip)
+	n += 2
+	pio.PutU32BE(b[n:], self.InputSampleRate)
+	n += 4
+	pio.PutI16BE(b[n:], self.OutputGain)
+	n += 2
+	pio.PutU8(b[n:], self.ChannelMappingFamily)
+	n += 1
+	copy(b[n:], self.ChannelMapping)
+	n += len(self.ChannelMapping)
+	return
+}
+
+func (self OpusSpecificConf) Len() (n int) {
+	n += 8
+	n += 11
+	n += len(self.ChannelMapping)
+	return
+}
+
+func (self *OpusSpecificConf) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	if len(b) < n+11 {
+		err = parseErr("OpusSpecificConf", n+offset, err)
+		return
+	}
+	self.Version = pio.U8(b[n:])
+	n += 1
+	self.OutputChannelCount = pio.U8(b[n:])
+	n += 1
+	self.PreSkip = pio.U16BE(b[n:])
+	n += 2
+	self.InputSampleRate = pio.U32BE(b[n:])
+	n += 4
+	self.OutputGain = pio.I16BE(b[n:])
+	n += 2
+	self.ChannelMappingFamily = pio.U8(b[n:])
+	n += 1
+	self.ChannelMapping = b[n:]
+	n += len(self.ChannelMapping)
+	return
+}
+
+func (self OpusSpecificConf) Children() (r []Atom) {
+	return
+}
+
+// PCMConfLittleEndian is set in the FormatFlags of little endian samples
+const PCMConfLittleEndian = 0x01
+
+// PCMConf is the pcmC box of an ipcm sample entry (ISO/IEC 23003-5).
+type PCMConf struct {
+	Version     uint8
+	Flags       uint32
+	FormatFlags uint8
+	SampleSize  uint8
+	AtomPos
+}
+
+func (self PCMConf) Tag() Tag {
+	return PCMC
+}
+
+func (self PCMConf) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(PCMC))
+	n += self.marshal(b[8:]) + 8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self PCMConf) marshal(b []byte) (n int) {
+	pio.PutU8(b[n:], self.Version)
+	n += 1
+	pio.PutU24BE(b[n:], self.Flags)
+	n += 3
+	pio.PutU8(b[n:], self.FormatFlags)
+	n += 1
+	pio.PutU8(b[n:], self.SampleSize)
+	n += 1
+	return
+}
+
+func (self PCMConf) Len() (n int) {
+	n += 8
+	n += 6
+	return
+}
+
+func (self *PCMConf) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	if len(b) < n+6 {
+		err = parseErr("PCMConf", n+offset, err)
+		return
+	}
+	self.Version = pio.U8(b[n:])
+	n += 1
+	self.Flags = pio.U24BE(b[n:])
+	n += 3
+	self.FormatFlags = pio.U8(b[n:])
+	n += 1
+	self.SampleSize = pio.U8(b[n:])
+	n += 1
+	return
+}
+
+func (self PCMConf) Children() (r []Atom) {
+	return
+}
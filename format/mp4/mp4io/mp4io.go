@@ -389,8 +389,32 @@ func ReadFileAtoms(r io.ReadSeeker) (atoms []Atom, err error) {
 			}
 			return
 		}
-		size := pio.U32BE(taghdr[0:])
+		size := int64(pio.U32BE(taghdr[0:]))
 		tag := Tag(pio.U32BE(taghdr[4:]))
+		hdrsize := int64(8)
+		switch size {
+		case 0:
+			// up to the end of the file
+			var end int64
+			if end, err = r.Seek(0, 2); err != nil {
+				return
+			}
+			size = end - offset
+			if _, err = r.Seek(offset+8, 0); err != nil {
+				return
+			}
+		case 1:
+			// 64-bit size
+			if _, err = io.ReadFull(r, taghdr[:8]); err != nil {
+				return
+			}
+			size = int64(pio.U64BE(taghdr))
+			hdrsize = 16
+		}
+		if size < hdrsize {
+			err = parseErr("TagSizeInvalid", int(offset), nil)
+			return
+		}
 
 		var atom Atom
 		switch tag {
@@ -401,6 +425,10 @@ func ReadFileAtoms(r io.ReadSeeker) (atoms []Atom, err error) {
 		}
 
 		if atom != nil {
+			if hdrsize != 8 {
+				err = parseErr("TagSizeInvalid", int(offset), nil)
+				return
+			}
 			b := make([]byte, int(size))
 			if _, err = io.ReadFull(r, b[8:]); err != nil {
 				return
@@ -413,13 +441,12 @@ func ReadFileAtoms(r io.ReadSeeker) (atoms []Atom, err error) {
 		} else {
 			dummy := &Dummy{Tag_: tag}
 			dummy.setPos(int(offset), int(size))
-			if _, err = r.Seek(int64(size)-8, 1); err != nil {
+			if _, err = r.Seek(size-hdrsize, 1); err != nil {
 				return
 			}
 			atoms = append(atoms, dummy)
 		}
 	}
-	return
 }
 
 func printatom(out io.Writer, root Atom, depth int) {
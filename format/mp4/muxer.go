@@ -5,18 +5,26 @@ package mp4
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"time"
 
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/codec/aacparser"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
 	"github.com/teocci/go-stream-av/format/mp4/mp4io"
 	"github.com/teocci/go-stream-av/utils/bits/pio"
 )
 
 type Muxer struct {
+	// Faststart makes WriteTrailer move the samples behind the moov, so that
+	// playback can start before the whole file is downloaded. The writer
+	// must then also be readable, as an os.File is.
+	Faststart bool
+
 	w       io.WriteSeeker
 	bufw    *bufio.Writer
 	wpos    int64
@@ -32,7 +40,7 @@ func NewMuxer(w io.WriteSeeker) *Muxer {
 
 func (m *Muxer) newStream(codec av.CodecData) (err error) {
 	switch codec.Type() {
-	case av.H264, av.H265, av.AAC:
+	case av.H264, av.H265, av.AAC, av.OPUS, av.PCM_ALAW, av.PCM_MULAW, av.PCM:
 
 	default:
 		err = fmt.Errorf("mp4: codec type=%v is not supported", codec.Type())
@@ -98,7 +106,10 @@ func (m *Muxer) newStream(codec av.CodecData) (err error) {
 
 func (s *Stream) fillTrackAtom() (err error) {
 	s.trackAtom.Media.Header.TimeScale = int32(s.timeScale)
-	s.trackAtom.Media.Header.Duration = int32(s.duration)
+	s.trackAtom.Media.Header.Duration = s.duration
+	if s.duration > math.MaxUint32 {
+		s.trackAtom.Media.Header.Version = 1
+	}
 	if s.Type() == av.H264 {
 		codec := s.CodecData.(h264parser.CodecData)
 		width, height := codec.Width(), codec.Height()
@@ -123,8 +134,12 @@ func (s *Stream) fillTrackAtom() (err error) {
 		s.trackAtom.Header.TrackWidth = float64(width)
 		s.trackAtom.Header.TrackHeight = float64(height)
 	} else if s.Type() == av.H265 {
-		codec := s.CodecData.(h264parser.CodecData)
+		codec := s.CodecData.(h265parser.CodecData)
 		width, height := codec.Width(), codec.Height()
+		var conf []byte
+		if conf, err = codec.HEVCDecoderConfRecordBytes(true); err != nil {
+			return
+		}
 		s.sample.SampleDesc.HV1Desc = &mp4io.HV1Desc{
 			DataRefIdx:           1,
 			HorizontalResolution: 72,
@@ -134,7 +149,7 @@ func (s *Stream) fillTrackAtom() (err error) {
 			FrameCount:           1,
 			Depth:                24,
 			ColorTableId:         -1,
-			Conf:                 &mp4io.HV1Conf{Data: codec.AVCDecoderConfRecordBytes()},
+			Conf:                 &mp4io.HV1Conf{Data: conf},
 		}
 		s.trackAtom.Media.Handler = &mp4io.HandlerRefer{
 			SubType: [4]byte{'v', 'i', 'd', 'e'},
@@ -164,6 +179,18 @@ func (s *Stream) fillTrackAtom() (err error) {
 		}
 		s.trackAtom.Media.Info.Sound = &mp4io.SoundMediaInfo{}
 
+	} else if codec, ok := s.CodecData.(av.AudioCodecData); ok {
+		if s.sample.SampleDesc.AudioDesc, err = audioDesc(codec); err != nil {
+			return
+		}
+		s.trackAtom.Header.Volume = 1
+		s.trackAtom.Header.AlternateGroup = 1
+		s.trackAtom.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'s', 'o', 'u', 'n'},
+			Name:    []byte("Sound Handler"),
+		}
+		s.trackAtom.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+
 	} else {
 		err = fmt.Errorf("mp4: codec type=%d invalid", s.Type())
 	}
@@ -171,6 +198,43 @@ func (s *Stream) fillTrackAtom() (err error) {
 	return
 }
 
+// audioDesc returns the sample entry of an Opus, G.711 or PCM stream
+func audioDesc(codec av.AudioCodecData) (desc *mp4io.AudioDesc, err error) {
+	desc = &mp4io.AudioDesc{
+		DataRefIdx:       1,
+		NumberOfChannels: int16(codec.ChannelLayout().Count()),
+		SampleSize:       16,
+		SampleRate:       float64(codec.SampleRate()),
+	}
+	switch codec.Type() {
+	case av.OPUS:
+		desc.Tag_ = mp4io.OPUS
+		desc.SampleRate = 48000
+		desc.OpusConf = &mp4io.OpusSpecificConf{
+			OutputChannelCount: uint8(desc.NumberOfChannels),
+			InputSampleRate:    48000,
+		}
+	case av.PCM_ALAW:
+		desc.Tag_ = mp4io.ALAW
+	case av.PCM_MULAW:
+		desc.Tag_ = mp4io.ULAW
+	case av.PCM:
+		switch codec.SampleFormat() {
+		case av.S16, av.S32:
+		default:
+			err = fmt.Errorf("mp4: pcm sample format=%v is not supported", codec.SampleFormat())
+			return
+		}
+		desc.Tag_ = mp4io.IPCM
+		desc.SampleSize = int16(codec.SampleFormat().BytesPerSample() * 8)
+		desc.PCMConf = &mp4io.PCMConf{
+			FormatFlags: mp4io.PCMConfLittleEndian,
+			SampleSize:  uint8(desc.SampleSize),
+		}
+	}
+	return
+}
+
 func (m *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	m.streams = []*Stream{}
 	for _, stream := range streams {
@@ -179,12 +243,15 @@ func (m *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 		}
 	}
 
-	taghdr := make([]byte, 8)
-	pio.PutU32BE(taghdr[4:], uint32(mp4io.MDAT))
+	// a free box the mdat header grows over when it needs a 64-bit size
+	taghdr := make([]byte, 16)
+	pio.PutU32BE(taghdr, 8)
+	pio.PutU32BE(taghdr[4:], uint32(mp4io.FREE))
+	pio.PutU32BE(taghdr[12:], uint32(mp4io.MDAT))
 	if _, err = m.w.Write(taghdr); err != nil {
 		return
 	}
-	m.wpos += 8
+	m.wpos += 16
 
 	for _, stream := range m.streams {
 		if stream.Type().IsVideo() {
@@ -239,7 +306,7 @@ func (s *Stream) writePacket(pkt av.Packet, rawdur time.Duration) (err error) {
 
 	s.duration += int64(duration)
 	s.sampleIndex++
-	s.sample.ChunkOffset.Entries = append(s.sample.ChunkOffset.Entries, uint32(s.muxer.wpos))
+	s.sample.ChunkOffset.Entries = append(s.sample.ChunkOffset.Entries, uint64(s.muxer.wpos))
 	s.sample.SampleSize.Entries = append(s.sample.SampleSize.Entries, uint32(len(pkt.Data)))
 
 	s.muxer.wpos += int64(len(pkt.Data))
@@ -271,32 +338,55 @@ func (m *Muxer) WriteTrailer() (err error) {
 			return
 		}
 		dur := stream.tsToTime(stream.duration)
-		stream.trackAtom.Header.Duration = int32(timeToTs(dur, timeScale))
+		stream.trackAtom.Header.Duration = timeToTs(dur, timeScale)
+		if stream.trackAtom.Header.Duration > math.MaxUint32 {
+			stream.trackAtom.Header.Version = 1
+		}
 		if dur > maxDur {
 			maxDur = dur
 		}
 		moov.Tracks = append(moov.Tracks, stream.trackAtom)
 	}
 	moov.Header.TimeScale = int32(timeScale)
-	moov.Header.Duration = int32(timeToTs(maxDur, timeScale))
+	moov.Header.Duration = timeToTs(maxDur, timeScale)
+	if moov.Header.Duration > math.MaxUint32 {
+		moov.Header.Version = 1
+	}
 
 	if err = m.bufw.Flush(); err != nil {
 		return
 	}
 
-	var mdatsize int64
-	if mdatsize, err = m.w.Seek(0, 1); err != nil {
+	var end int64
+	if end, err = m.w.Seek(0, 1); err != nil {
 		return
 	}
-	if _, err = m.w.Seek(0, 0); err != nil {
+	var taghdr []byte
+	mdatpos := int64(8)
+	if end-8 > math.MaxUint32 {
+		mdatpos = 0
+		// the mdat takes the place of the free box, with a 64-bit size
+		taghdr = make([]byte, 16)
+		pio.PutU32BE(taghdr, 1)
+		pio.PutU32BE(taghdr[4:], uint32(mp4io.MDAT))
+		pio.PutU64BE(taghdr[8:], uint64(end))
+		_, err = m.w.Seek(0, 0)
+	} else {
+		taghdr = make([]byte, 4)
+		pio.PutU32BE(taghdr, uint32(end-8))
+		_, err = m.w.Seek(8, 0)
+	}
+	if err != nil {
 		return
 	}
-	taghdr := make([]byte, 4)
-	pio.PutU32BE(taghdr, uint32(mdatsize))
 	if _, err = m.w.Write(taghdr); err != nil {
 		return
 	}
 
+	if m.Faststart {
+		return m.writeMovieFirst(moov, mdatpos, end)
+	}
+
 	if _, err = m.w.Seek(0, 2); err != nil {
 		return
 	}
@@ -308,3 +398,42 @@ func (m *Muxer) WriteTrailer() (err error) {
 
 	return
 }
+
+// writeMovieFirst moves the mdat forward by the size of the moov and writes
+// the moov in front of it.
+func (m *Muxer) writeMovieFirst(moov *mp4io.Movie, mdatpos, end int64) (err error) {
+	rw, ok := m.w.(io.ReadWriteSeeker)
+	if !ok {
+		err = errors.New("mp4: faststart needs a writer that can be read back")
+		return
+	}
+	shift := func(delta int64) {
+		for _, stream := range m.streams {
+			entries := stream.sample.ChunkOffset.Entries
+			for i := range entries {
+				entries[i] += uint64(delta)
+			}
+		}
+	}
+	delta := int64(moov.Len())
+	shift(delta)
+	if n := int64(moov.Len()); n != delta {
+		// the offsets moved into co64, which is larger
+		shift(n - delta)
+		delta = n
+	}
+	b := make([]byte, delta)
+	moov.Marshal(b)
+
+	if err = moveData(rw, mdatpos, end, delta); err != nil {
+		return
+	}
+	if _, err = rw.Seek(mdatpos, 0); err != nil {
+		return
+	}
+	if _, err = rw.Write(b); err != nil {
+		return
+	}
+	_, err = rw.Seek(0, 2)
+	return
+}
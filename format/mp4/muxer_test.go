@@ -0,0 +1,214 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/format/mp4/mp4io"
+)
+
+// sparseFile is an in-memory file that only keeps what was written, reading
+// zeros elsewhere, so that tests can write past 4GB.
+type sparseFile struct {
+	extents []extent
+	pos     int64
+	size    int64
+}
+
+type extent struct {
+	offset int64
+	data   []byte
+}
+
+func (f *sparseFile) Write(b []byte) (int, error) {
+	f.extents = append(f.extents, extent{f.pos, append([]byte{}, b...)})
+	f.pos += int64(len(b))
+	if f.pos > f.size {
+		f.size = f.pos
+	}
+	return len(b), nil
+}
+
+func (f *sparseFile) Read(b []byte) (n int, err error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	n = len(b)
+	if int64(n) > f.size-f.pos {
+		n = int(f.size - f.pos)
+	}
+	b = b[:n]
+	for i := range b {
+		b[i] = 0
+	}
+	// later writes win
+	for _, e := range f.extents {
+		start, end := e.offset, e.offset+int64(len(e.data))
+		if end <= f.pos || start >= f.pos+int64(n) {
+			continue
+		}
+		src := e.data
+		dst := b
+		if start < f.pos {
+			src = src[f.pos-start:]
+		} else {
+			dst = dst[start-f.pos:]
+		}
+		copy(dst, src)
+	}
+	f.pos += int64(n)
+	return
+}
+
+func (f *sparseFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	h264, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aac, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRateIndex: 3, ChannelConfig: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{h264, aac}
+}
+
+func TestLargeFile(t *testing.T) {
+	const hole = 5 << 30
+	const step = 10 * time.Minute
+	const count = 900 // 150 hours
+	f := &sparseFile{}
+	m := NewMuxer(f)
+	if err := m.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	var pkts []av.Packet
+	for i := 0; i < count; i++ {
+		tm := time.Duration(i) * step
+		pkts = append(pkts,
+			av.Packet{Idx: 0, Time: tm, IsKeyFrame: i%3 == 0, Data: bytes.Repeat([]byte{byte(i)}, 100+i%7)},
+			av.Packet{Idx: 1, Time: tm, Data: []byte{1, 2, byte(i)}},
+		)
+	}
+	for i, pkt := range pkts {
+		if i == count {
+			// skip ahead past 4GB instead of writing it
+			if err := m.bufw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Seek(hole, io.SeekCurrent); err != nil {
+				t.Fatal(err)
+			}
+			m.wpos += hole
+		}
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	atoms, err := mp4io.ReadFileAtoms(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atoms) != 2 || atoms[0].Tag() != mp4io.MDAT || atoms[1].Tag() != mp4io.MOOV {
+		t.Fatalf("unexpected atoms %v", atoms)
+	}
+	_, mdatSize := atoms[0].Pos()
+	_, moovSize := atoms[1].Pos()
+	if int64(mdatSize+moovSize) != f.size {
+		t.Errorf("unexpected mdat size %d", mdatSize)
+	}
+	moov := atoms[1].(*mp4io.Movie)
+	if moov.Header.Version != 1 || time.Duration(moov.Header.Duration)*time.Second/10000 < (count-1)*step {
+		t.Errorf("unexpected mvhd version %d duration %d", moov.Header.Version, moov.Header.Duration)
+	}
+	for _, track := range moov.Tracks {
+		if track.Header.Version != 1 || track.Media.Header.Version != 1 {
+			t.Errorf("track %d: expected version 1 tkhd and mdhd", track.Header.TrackId)
+		}
+		if !track.Media.Info.Sample.ChunkOffset.Is64() {
+			t.Errorf("track %d: expected co64", track.Header.TrackId)
+		}
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDemuxer(f)
+	if _, err = d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	var got []av.Packet
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pkt)
+	}
+	// reading stops at the end of the first stream to finish
+	if len(got) < len(pkts)-1 {
+		t.Fatalf("expected %d packets, got %d", len(pkts), len(got))
+	}
+	for _, pkt := range got {
+		var expected *av.Packet
+		for i := range pkts {
+			if pkts[i].Idx == pkt.Idx && pkts[i].Time == pkt.Time {
+				expected = &pkts[i]
+			}
+		}
+		if expected == nil {
+			t.Errorf("unexpected packet %d at %s", pkt.Idx, pkt.Time)
+		} else if !bytes.Equal(pkt.Data, expected.Data) {
+			t.Errorf("packet %d at %s: expected %x, got %x", pkt.Idx, pkt.Time, expected.Data, pkt.Data)
+		}
+	}
+}
+
+func TestDurationVersion(t *testing.T) {
+	for _, duration := range []int64{1 << 31, 1 << 33} {
+		mdhd := mp4io.MediaHeader{TimeScale: 90000, Duration: duration}
+		if duration > 1<<32 {
+			mdhd.Version = 1
+		}
+		b := make([]byte, mdhd.Len())
+		mdhd.Marshal(b)
+		var got mp4io.MediaHeader
+		if _, err := got.Unmarshal(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got.Duration != duration || got.TimeScale != 90000 {
+			t.Errorf("version %d: expected %d, got %d", mdhd.Version, duration, got.Duration)
+		}
+	}
+}
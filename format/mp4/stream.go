@@ -44,18 +44,22 @@ type Stream struct {
 	cttsEntry *mp4io.CompositionOffsetEntry
 }
 
+// timeToTs and tsToTime convert whole seconds apart, so that long durations
+// do not overflow
 func timeToTs(tm time.Duration, timeScale int64) int64 {
-	return int64(tm * time.Duration(timeScale) / time.Second)
+	sec := tm / time.Second
+	return int64(sec)*timeScale + int64((tm-sec*time.Second)*time.Duration(timeScale)/time.Second)
 }
 
 func tsToTime(ts int64, timeScale int64) time.Duration {
-	return time.Duration(ts) * time.Second / time.Duration(timeScale)
+	sec := ts / timeScale
+	return time.Duration(sec)*time.Second + time.Duration(ts-sec*timeScale)*time.Second/time.Duration(timeScale)
 }
 
 func (s *Stream) timeToTs(tm time.Duration) int64 {
-	return int64(tm * time.Duration(s.timeScale) / time.Second)
+	return timeToTs(tm, s.timeScale)
 }
 
 func (s *Stream) tsToTime(ts int64) time.Duration {
-	return time.Duration(ts) * time.Second / time.Duration(s.timeScale)
+	return tsToTime(ts, s.timeScale)
 }
@@ -155,7 +155,7 @@ func (self *Stream) buildEdts() *FDummy {
 
 func (self *Stream) fillTrackAtom() (err error) {
 	self.trackAtom.Media.Header.TimeScale = int32(self.timeScale)
-	self.trackAtom.Media.Header.Duration = int32(self.duration)
+	self.trackAtom.Media.Header.Duration = self.duration
 
 	if self.Type() == av.H264 {
 		codec := self.CodecData.(h264parser.CodecData)
@@ -96,7 +96,7 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 
 func (self *Stream) fillTrackAtom() (err error) {
 	self.trackAtom.Media.Header.TimeScale = int32(self.timeScale)
-	self.trackAtom.Media.Header.Duration = int32(self.duration)
+	self.trackAtom.Media.Header.Duration = self.duration
 
 	if self.Type() == av.H264 {
 		codec := self.CodecData.(h264parser.CodecData)
@@ -215,7 +215,7 @@ func (self *Stream) writePacket(pkt av.Packet, rawdur time.Duration) (err error)
 
 	self.duration += int64(duration)
 	self.sampleIndex++
-	self.sample.ChunkOffset.Entries = append(self.sample.ChunkOffset.Entries, uint32(self.muxer.wpos))
+	self.sample.ChunkOffset.Entries = append(self.sample.ChunkOffset.Entries, uint64(self.muxer.wpos))
 	self.sample.SampleSize.Entries = append(self.sample.SampleSize.Entries, uint32(len(pkt.Data)))
 
 	self.muxer.wpos += int64(len(pkt.Data))
@@ -247,14 +247,14 @@ func (self *Muxer) WriteTrailer() (err error) {
 			return
 		}
 		dur := stream.tsToTime(stream.duration)
-		stream.trackAtom.Header.Duration = int32(timeToTs(dur, timeScale))
+		stream.trackAtom.Header.Duration = timeToTs(dur, timeScale)
 		if dur > maxDur {
 			maxDur = dur
 		}
 		moov.Tracks = append(moov.Tracks, stream.trackAtom)
 	}
 	moov.Header.TimeScale = int32(timeScale)
-	moov.Header.Duration = int32(timeToTs(maxDur, timeScale))
+	moov.Header.Duration = timeToTs(maxDur, timeScale)
 
 	if err = self.bufw.Flush(); err != nil {
 		return
@@ -0,0 +1,460 @@
+// Package rtmp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/flv/flvio"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// PlayEventType identifies a NetStream command sent by a playing client.
+type PlayEventType int
+
+const (
+	PlayEventSeek = PlayEventType(iota + 1)
+	PlayEventPause
+	PlayEventReceiveAudio
+	PlayEventReceiveVideo
+	PlayEventBufferLength
+)
+
+func (t PlayEventType) String() string {
+	switch t {
+	case PlayEventSeek:
+		return "seek"
+	case PlayEventPause:
+		return "pause"
+	case PlayEventReceiveAudio:
+		return "receiveAudio"
+	case PlayEventReceiveVideo:
+		return "receiveVideo"
+	case PlayEventBufferLength:
+		return "setBufferLength"
+	}
+	return "?"
+}
+
+// PlayEvent is a NetStream command or buffer control received from a player.
+//
+// Time is the seek/pause position or the client buffer length. Flag is the
+// pause state for PlayEventPause and the enable state for receiveAudio/receiveVideo.
+type PlayEvent struct {
+	Type PlayEventType
+	Time time.Duration
+	Flag bool
+}
+
+// SeekDemuxer is a Demuxer that can reposition itself, like mp4.Demuxer.
+type SeekDemuxer interface {
+	av.Demuxer
+	SeekToTime(time.Duration) error
+}
+
+func durationToMs(tm time.Duration) float64 {
+	return float64(tm / time.Millisecond)
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (c *Conn) checkPlayClient() (err error) {
+	if c.isserver || !c.playing {
+		err = fmt.Errorf("rtmp: NetStream command needs a playing client connection")
+	}
+	return
+}
+
+func (c *Conn) writeNetStreamCommand(args ...interface{}) (err error) {
+	if err = c.prepare(stageCommandDone, prepareReading); err != nil {
+		return
+	}
+	if err = c.checkPlayClient(); err != nil {
+		return
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if Debug {
+		fmt.Printf("rtmp: > %s%v\n", args[0], args[1:])
+	}
+	if err = c.writeCommandMsg(8, c.avmsgsid, args...); err != nil {
+		return
+	}
+	return c.flushWrite()
+}
+
+// Seek asks the server to continue playback from the given position.
+func (c *Conn) Seek(tm time.Duration) (err error) {
+	return c.writeNetStreamCommand("seek", 0, nil, durationToMs(tm))
+}
+
+// Pause pauses or resumes playback; tm is the position where the stream
+// was paused or should be resumed.
+func (c *Conn) Pause(pause bool, tm time.Duration) (err error) {
+	return c.writeNetStreamCommand("pause", 0, nil, pause, durationToMs(tm))
+}
+
+// ReceiveAudio tells the server whether to send audio to this client.
+func (c *Conn) ReceiveAudio(enable bool) (err error) {
+	return c.writeNetStreamCommand("receiveAudio", 0, nil, enable)
+}
+
+// ReceiveVideo tells the server whether to send video to this client.
+func (c *Conn) ReceiveVideo(enable bool) (err error) {
+	return c.writeNetStreamCommand("receiveVideo", 0, nil, enable)
+}
+
+// SetBufferLength informs the server about the client buffer size.
+func (c *Conn) SetBufferLength(tm time.Duration) (err error) {
+	if err = c.prepare(stageCommandDone, prepareReading); err != nil {
+		return
+	}
+	if err = c.checkPlayClient(); err != nil {
+		return
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if err = c.writeSetBufferLength(c.avmsgsid, uint32(tm/time.Millisecond)); err != nil {
+		return
+	}
+	return c.flushWrite()
+}
+
+func (c *Conn) dropPacket(pkt av.Packet, stream av.CodecData) bool {
+	if stream.Type().IsAudio() {
+		return c.dropaudio
+	}
+	if c.dropvideo {
+		return true
+	}
+	if c.waitkeyframe {
+		if !pkt.IsKeyFrame {
+			return true
+		}
+		c.waitkeyframe = false
+	}
+	return false
+}
+
+// ReadPlayEvent reads commands from a playing client until one of seek, pause,
+// receiveAudio, receiveVideo or a buffer length update arrives.
+//
+// receiveAudio and receiveVideo are applied to WritePacket right away, other
+// events are left to the caller, which should answer them with RespondPlayEvent.
+// ReadPlayEvent may run in its own goroutine while another one writes packets.
+func (c *Conn) ReadPlayEvent() (ev PlayEvent, err error) {
+	if !c.isserver || !c.playing {
+		err = fmt.Errorf("rtmp: ReadPlayEvent needs a playing server connection")
+		return
+	}
+	c.setBackgroundReading()
+
+	for {
+		if err = c.pollMsg(); err != nil {
+			c.setReadError(err)
+			return
+		}
+
+		if c.gotcommand {
+			switch c.commandname {
+			case "seek":
+				if len(c.commandparams) < 1 {
+					err = fmt.Errorf("rtmp: command seek params invalid")
+					return
+				}
+				ms, _ := c.commandparams[0].(float64)
+				ev = PlayEvent{Type: PlayEventSeek, Time: msToDuration(ms)}
+
+			case "pause":
+				if len(c.commandparams) < 1 {
+					err = fmt.Errorf("rtmp: command pause params invalid")
+					return
+				}
+				ev = PlayEvent{Type: PlayEventPause}
+				ev.Flag, _ = c.commandparams[0].(bool)
+				if len(c.commandparams) > 1 {
+					ms, _ := c.commandparams[1].(float64)
+					ev.Time = msToDuration(ms)
+				}
+
+			case "receiveAudio", "receiveVideo":
+				if len(c.commandparams) < 1 {
+					err = fmt.Errorf("rtmp: command %s params invalid", c.commandname)
+					return
+				}
+				enable, _ := c.commandparams[0].(bool)
+				c.wlock.Lock()
+				if c.commandname == "receiveAudio" {
+					ev = PlayEvent{Type: PlayEventReceiveAudio, Flag: enable}
+					c.dropaudio = !enable
+				} else {
+					ev = PlayEvent{Type: PlayEventReceiveVideo, Flag: enable}
+					if enable && c.dropvideo {
+						c.waitkeyframe = true
+					}
+					c.dropvideo = !enable
+				}
+				c.wlock.Unlock()
+
+			default:
+				continue
+			}
+
+			if Debug {
+				fmt.Printf("rtmp: < %s %v %v\n", ev.Type, ev.Flag, ev.Time)
+			}
+			return
+		}
+
+		if c.msgtypeid == msgtypeidUserControl && c.eventtype == eventtypeSetBufferLength {
+			if len(c.msgdata) < 10 {
+				err = fmt.Errorf("rtmp: short packet of SetBufferLength")
+				return
+			}
+			ms := pio.U32BE(c.msgdata[6:10])
+			ev = PlayEvent{Type: PlayEventBufferLength, Time: time.Duration(ms) * time.Millisecond}
+			return
+		}
+	}
+}
+
+func (c *Conn) writeStatus(level, code, description string) (err error) {
+	return c.writeCommandMsg(5, c.avmsgsid,
+		"onStatus", 0, nil,
+		flvio.AMFMap{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		},
+	)
+}
+
+// RespondPlayEvent sends the status messages a player expects once the server
+// has applied a seek or pause. After a seek the codec headers are sent again
+// so that decoders restart cleanly.
+func (c *Conn) RespondPlayEvent(ev PlayEvent) (err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	switch ev.Type {
+	case PlayEventSeek:
+		if err = c.writeStreamBegin(c.avmsgsid); err != nil {
+			return
+		}
+		if err = c.writeStatus("status", "NetStream.Seek.Notify", "Seeking"); err != nil {
+			return
+		}
+		if err = c.writeStatus("status", "NetStream.Play.Start", "Start video on demand"); err != nil {
+			return
+		}
+		if err = c.writeCodecDataTags(c.streams, int32(ev.Time/time.Millisecond)); err != nil {
+			return
+		}
+
+	case PlayEventPause:
+		if ev.Flag {
+			if err = c.writeStreamEvent(eventtypeStreamEOF, c.avmsgsid); err != nil {
+				return
+			}
+			if err = c.writeStatus("status", "NetStream.Pause.Notify", "Paused"); err != nil {
+				return
+			}
+		} else {
+			if err = c.writeStreamBegin(c.avmsgsid); err != nil {
+				return
+			}
+			if err = c.writeStatus("status", "NetStream.Unpause.Notify", "Unpaused"); err != nil {
+				return
+			}
+		}
+
+	default:
+		return
+	}
+
+	return c.flushWrite()
+}
+
+// WriteStreamEOF tells the player that playback reached the end of the stream.
+func (c *Conn) WriteStreamEOF() (err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if err = c.writeDataMsg(5, c.avmsgsid,
+		"onPlayStatus",
+		flvio.AMFMap{
+			"level": "status",
+			"code":  "NetStream.Play.Complete",
+		},
+	); err != nil {
+		return
+	}
+	if err = c.writeStreamEvent(eventtypeStreamEOF, c.avmsgsid); err != nil {
+		return
+	}
+	if err = c.writeStatus("status", "NetStream.Play.Stop", "Stopped playing"); err != nil {
+		return
+	}
+	return c.flushWrite()
+}
+
+// WriteStreamDry tells the player that no data is available for the moment.
+func (c *Conn) WriteStreamDry() (err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if err = c.writeStreamEvent(eventtypeStreamDry, c.avmsgsid); err != nil {
+		return
+	}
+	return c.flushWrite()
+}
+
+// ServeDemuxer plays demuxer to the client at real-time speed, honoring seek,
+// pause and receiveAudio/receiveVideo commands. At the end of the demuxer
+// StreamEOF is sent and the connection stays open so the player can seek back.
+// It returns when the client goes away.
+func (c *Conn) ServeDemuxer(demuxer SeekDemuxer) (err error) {
+	var streams []av.CodecData
+	if streams, err = demuxer.Streams(); err != nil {
+		return
+	}
+	if err = c.WriteHeader(streams); err != nil {
+		return
+	}
+	if err = c.WriteTrailer(); err != nil {
+		return
+	}
+
+	events := make(chan PlayEvent)
+	readerr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			ev, err := c.ReadPlayEvent()
+			if err != nil {
+				readerr <- err
+				return
+			}
+			select {
+			case events <- ev:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var pending *av.Packet
+	var paused, eof, started bool
+	var start time.Time
+	var base, buflen time.Duration
+
+	handle := func(ev PlayEvent) (err error) {
+		switch ev.Type {
+		case PlayEventSeek:
+			if err = demuxer.SeekToTime(ev.Time); err != nil {
+				c.wlock.Lock()
+				err = c.writeStatus("error", "NetStream.Seek.Failed", err.Error())
+				if err == nil {
+					err = c.flushWrite()
+				}
+				c.wlock.Unlock()
+				return
+			}
+			pending, eof, started = nil, false, false
+
+		case PlayEventPause:
+			if !ev.Flag && paused {
+				if err = demuxer.SeekToTime(ev.Time); err != nil {
+					return
+				}
+				pending, eof, started = nil, false, false
+			}
+			paused = ev.Flag
+
+		case PlayEventBufferLength:
+			buflen = ev.Time
+			return
+		}
+		return c.RespondPlayEvent(ev)
+	}
+
+	for {
+		select {
+		case ev := <-events:
+			if err = handle(ev); err != nil {
+				return
+			}
+			continue
+		case err = <-readerr:
+			return
+		default:
+		}
+
+		if paused || eof {
+			select {
+			case ev := <-events:
+				if err = handle(ev); err != nil {
+					return
+				}
+			case err = <-readerr:
+				return
+			}
+			continue
+		}
+
+		if pending == nil {
+			pkt, rerr := demuxer.ReadPacket()
+			if rerr == io.EOF {
+				if err = c.WriteStreamEOF(); err != nil {
+					return
+				}
+				eof = true
+				continue
+			}
+			if rerr != nil {
+				err = rerr
+				return
+			}
+			pending = &pkt
+		}
+
+		if !started {
+			start, base, started = time.Now(), pending.Time, true
+		}
+		if wait := pending.Time - base - buflen - time.Since(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case ev := <-events:
+				timer.Stop()
+				if err = handle(ev); err != nil {
+					return
+				}
+			case err = <-readerr:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		if err = c.WritePacket(*pending); err != nil {
+			return
+		}
+		pending = nil
+		if err = c.WriteTrailer(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package rtmp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/flv"
+)
+
+// sliceDemuxer plays a fixed list of packets, waiting delay before each
+// one, and seeks to the first packet at or after the asked time.
+type sliceDemuxer struct {
+	streams []av.CodecData
+	pkts    []av.Packet
+	pos     int
+	delay   time.Duration
+}
+
+func (d *sliceDemuxer) Streams() ([]av.CodecData, error) {
+	return d.streams, nil
+}
+
+func (d *sliceDemuxer) ReadPacket() (pkt av.Packet, err error) {
+	if d.pos >= len(d.pkts) {
+		err = io.EOF
+		return
+	}
+	time.Sleep(d.delay)
+	pkt = d.pkts[d.pos]
+	d.pos++
+	return
+}
+
+func (d *sliceDemuxer) SeekToTime(tm time.Duration) error {
+	d.pos = len(d.pkts)
+	for i, pkt := range d.pkts {
+		if pkt.Time >= tm {
+			d.pos = i
+			break
+		}
+	}
+	return nil
+}
+
+func TestPlayEvents(t *testing.T) {
+	// the codec header is enough to probe the streams
+	defer func(n int) { flv.MaxProbePacketCount = n }(flv.MaxProbePacketCount)
+	flv.MaxProbePacketCount = 1
+
+	expected := []PlayEvent{
+		{Type: PlayEventPause, Flag: true, Time: 3 * time.Second},
+		{Type: PlayEventSeek, Time: 2 * time.Second},
+		{Type: PlayEventReceiveAudio, Flag: false},
+		{Type: PlayEventReceiveAudio, Flag: true},
+		{Type: PlayEventBufferLength, Time: 500 * time.Millisecond},
+	}
+
+	events := make(chan PlayEvent, len(expected))
+	next := make(chan struct{})
+	uri := startServer(t, &Server{
+		HandlePlay: func(conn *Conn) {
+			if err := conn.WriteHeader(testStreams(t)); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := conn.WriteTrailer(); err != nil {
+				t.Error(err)
+				return
+			}
+			for i := range expected {
+				ev, err := conn.ReadPlayEvent()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err = conn.RespondPlayEvent(ev); err != nil {
+					t.Error(err)
+					return
+				}
+				events <- ev
+				switch ev.Type {
+				case PlayEventReceiveAudio:
+					// dropped while audio is off
+					err = conn.WritePacket(testPacket(i, 10))
+				case PlayEventBufferLength:
+					err = conn.WriteStreamEOF()
+				default:
+					err = conn.WritePacket(testPacket(i, 10))
+				}
+				if err == nil {
+					err = conn.WriteTrailer()
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				<-next
+			}
+		},
+	})
+
+	conn, err := Dial(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Streams(); err != nil {
+		t.Fatal(err)
+	}
+
+	readPacket := func(i int) {
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if want := testPacket(i, 10); !bytes.Equal(pkt.Data, want.Data) {
+			t.Fatalf("event %d: got packet %x, want %x", i, pkt.Data, want.Data)
+		}
+	}
+
+	// a paused stream must not end
+	if err = conn.Pause(true, 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	readPacket(0)
+	next <- struct{}{}
+
+	if err = conn.Seek(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	readPacket(1)
+	next <- struct{}{}
+
+	if err = conn.ReceiveAudio(false); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the audio packet to be dropped
+	<-events
+	<-events
+	<-events
+	next <- struct{}{}
+	if err = conn.ReceiveAudio(true); err != nil {
+		t.Fatal(err)
+	}
+	readPacket(3)
+	next <- struct{}{}
+
+	if err = conn.SetBufferLength(500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.ReadPacket(); err != io.EOF {
+		t.Errorf("expected io.EOF after StreamEOF, got %v", err)
+	}
+	next <- struct{}{}
+
+	got := []PlayEvent{}
+	close(events)
+	for ev := range events {
+		got = append(got, ev)
+	}
+	if len(got) != 2 || got[0] != expected[3] || got[1] != expected[4] {
+		t.Errorf("unexpected last events %v", got)
+	}
+}
+
+func TestServeDemuxer(t *testing.T) {
+	const count = 50
+	demuxer := &sliceDemuxer{streams: testStreams(t)}
+	for i := 0; i < count; i++ {
+		demuxer.pkts = append(demuxer.pkts, testPacket(i, 10))
+	}
+	last := demuxer.pkts[count-1].Time
+
+	served := make(chan error, 1)
+	uri := startServer(t, &Server{
+		HandlePlay: func(conn *Conn) {
+			served <- conn.ServeDemuxer(demuxer)
+		},
+	})
+
+	conn, err := Dial(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readPackets(conn, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// packets sent before the seek may still be on their way
+	seek := 600 * time.Millisecond
+	if err = conn.Seek(seek); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Time == seek {
+			break
+		} else if pkt.Time > seek {
+			t.Fatalf("packet at %s after seeking to %s", pkt.Time, seek)
+		}
+	}
+
+	// pausing and resuming goes on to the end of the stream
+	if err = conn.Pause(true, 700*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = conn.Pause(false, 800*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	var tm time.Duration
+	for {
+		pkt, err := conn.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		tm = pkt.Time
+	}
+	if tm != last {
+		t.Errorf("stream ended at %s, want %s", tm, last)
+	}
+
+	conn.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeDemuxer did not return after the client left")
+	}
+}
@@ -0,0 +1,346 @@
+// Package rtmp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+)
+
+const (
+	DefaultRelayQueueSize    = 1024
+	DefaultRelayDialTimeout  = 10 * time.Second
+	DefaultRelayWriteTimeout = 10 * time.Second
+	DefaultRelayMinBackoff   = time.Second
+	DefaultRelayMaxBackoff   = 30 * time.Second
+)
+
+// RelayStats describes the state of one relay destination.
+type RelayStats struct {
+	URL        string
+	Connected  bool
+	Reconnects int
+	TxBytes    uint64        // bytes written over all connections
+	Packets    int           // packets written
+	Dropped    int           // packets dropped because the queue was full or the destination was down
+	Latency    time.Duration // delay between reading a packet from the source and writing it out
+	LastError  error
+}
+
+// Relay pushes one source to several RTMP destinations.
+//
+// Every destination owns a bounded packet queue and a goroutine that dials,
+// writes and reconnects with exponential backoff, so a slow or unreachable
+// destination only drops its own packets. After every (re)connect the
+// destination starts at a video keyframe with timestamps rebased to zero.
+type Relay struct {
+	QueueSize    int
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+
+	dests   []*relayDest
+	closing chan struct{}
+	once    sync.Once
+}
+
+type relayPacket struct {
+	pkt  av.Packet
+	read time.Time
+}
+
+type relayDest struct {
+	relay   *Relay
+	url     string
+	queue   chan relayPacket
+	needkey bool
+
+	lock      sync.Mutex
+	conn      *Conn
+	connected bool
+	txbytes   uint64
+	stats     RelayStats
+}
+
+func NewRelay(urls ...string) *Relay {
+	r := &Relay{
+		QueueSize:    DefaultRelayQueueSize,
+		DialTimeout:  DefaultRelayDialTimeout,
+		WriteTimeout: DefaultRelayWriteTimeout,
+		MinBackoff:   DefaultRelayMinBackoff,
+		MaxBackoff:   DefaultRelayMaxBackoff,
+		closing:      make(chan struct{}),
+	}
+	for _, uri := range urls {
+		r.dests = append(r.dests, &relayDest{
+			relay: r,
+			url:   uri,
+			stats: RelayStats{URL: uri},
+		})
+	}
+	return r
+}
+
+// Stats returns a snapshot of every destination in the order given to NewRelay.
+func (r *Relay) Stats() (stats []RelayStats) {
+	for _, d := range r.dests {
+		d.lock.Lock()
+		st := d.stats
+		st.TxBytes = d.txbytes
+		if d.conn != nil {
+			st.TxBytes += d.conn.TxBytes()
+		}
+		d.lock.Unlock()
+		stats = append(stats, st)
+	}
+	return
+}
+
+// Close stops all destinations without waiting for their queues to drain.
+// Run returns after the next packet read from the source.
+func (r *Relay) Close() (err error) {
+	r.once.Do(func() {
+		close(r.closing)
+		for _, d := range r.dests {
+			d.lock.Lock()
+			if d.conn != nil {
+				d.conn.Close()
+			}
+			d.lock.Unlock()
+		}
+	})
+	return
+}
+
+// Run reads src until it ends and fans every packet out to the destinations.
+// When src reaches io.EOF the queued packets are flushed and Run returns nil.
+// pubsub.QueueCursor can be used directly as src.
+func (r *Relay) Run(src av.Demuxer) (err error) {
+	if len(r.dests) == 0 {
+		err = fmt.Errorf("rtmp: relay has no destinations")
+		return
+	}
+
+	var streams []av.CodecData
+	if streams, err = src.Streams(); err != nil {
+		return
+	}
+	videoidx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoidx = i
+			break
+		}
+	}
+
+	size := r.QueueSize
+	if size <= 0 {
+		size = DefaultRelayQueueSize
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range r.dests {
+		d.queue = make(chan relayPacket, size)
+		d.needkey = videoidx >= 0
+		wg.Add(1)
+		go func(d *relayDest) {
+			defer wg.Done()
+			d.run(streams, videoidx)
+		}(d)
+	}
+
+	for !r.closed() {
+		var pkt av.Packet
+		if pkt, err = src.ReadPacket(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		iskey := int(pkt.Idx) == videoidx && pkt.IsKeyFrame
+
+		item := relayPacket{pkt: pkt, read: time.Now()}
+		for _, d := range r.dests {
+			if d.needkey && !iskey {
+				d.drop()
+				continue
+			}
+			select {
+			case d.queue <- item:
+				d.needkey = false
+			default:
+				// queue is full, skip to the next keyframe so the
+				// destination does not see a broken GOP
+				d.drop()
+				d.needkey = videoidx >= 0
+			}
+		}
+	}
+
+	for _, d := range r.dests {
+		close(d.queue)
+	}
+	wg.Wait()
+	return
+}
+
+func (r *Relay) closed() bool {
+	select {
+	case <-r.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *relayDest) drop() {
+	d.lock.Lock()
+	d.stats.Dropped++
+	d.lock.Unlock()
+}
+
+func (d *relayDest) setError(err error) {
+	d.lock.Lock()
+	d.stats.LastError = err
+	d.lock.Unlock()
+	if Debug {
+		fmt.Println("rtmp: relay:", d.url, err)
+	}
+}
+
+// closeConn closes a connection of the destination and keeps the bytes it
+// sent in the stats.
+func (d *relayDest) closeConn(conn *Conn) {
+	d.lock.Lock()
+	d.stats.Connected = false
+	d.txbytes += conn.TxBytes()
+	if d.conn == conn {
+		d.conn = nil
+	}
+	d.lock.Unlock()
+	conn.Close()
+}
+
+func (d *relayDest) connect(streams []av.CodecData) (conn *Conn, err error) {
+	if conn, err = DialTimeout(d.url, d.relay.DialTimeout); err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	closed := d.relay.closed()
+	if !closed {
+		d.conn = conn
+	}
+	d.lock.Unlock()
+	if closed {
+		err = io.ErrClosedPipe
+	} else if err = d.setDeadline(conn); err == nil {
+		err = conn.WriteHeader(streams)
+	}
+	if err != nil {
+		d.closeConn(conn)
+		conn = nil
+		return
+	}
+
+	d.lock.Lock()
+	if d.connected {
+		d.stats.Reconnects++
+	}
+	d.connected = true
+	d.stats.Connected = true
+	d.lock.Unlock()
+	return
+}
+
+func (d *relayDest) setDeadline(conn *Conn) (err error) {
+	if d.relay.WriteTimeout > 0 {
+		err = conn.NetConn().SetWriteDeadline(time.Now().Add(d.relay.WriteTimeout))
+	}
+	return
+}
+
+func (d *relayDest) run(streams []av.CodecData, videoidx int) {
+	var conn *Conn
+	var err error
+	var base time.Duration
+	var started bool
+
+	minbackoff, maxbackoff := d.relay.MinBackoff, d.relay.MaxBackoff
+	if minbackoff <= 0 {
+		minbackoff = DefaultRelayMinBackoff
+	}
+	if maxbackoff < minbackoff {
+		maxbackoff = minbackoff
+	}
+	backoff := minbackoff
+	retryat := time.Time{}
+
+	for item := range d.queue {
+		if conn == nil {
+			if time.Now().Before(retryat) {
+				d.drop()
+				continue
+			}
+			// only a keyframe can start a new connection
+			if videoidx >= 0 && !(int(item.pkt.Idx) == videoidx && item.pkt.IsKeyFrame) {
+				d.drop()
+				continue
+			}
+			if conn, err = d.connect(streams); err != nil {
+				d.setError(err)
+				retryat = time.Now().Add(backoff)
+				if backoff *= 2; backoff > maxbackoff {
+					backoff = maxbackoff
+				}
+				d.drop()
+				continue
+			}
+			started = false
+		}
+
+		pkt := item.pkt
+		if !started {
+			base = pkt.Time
+			started = true
+		}
+		// RTMP timestamps can not go below the first packet
+		if pkt.Time < base {
+			d.drop()
+			continue
+		}
+		pkt.Time -= base
+
+		if err = d.setDeadline(conn); err == nil {
+			if err = conn.WritePacket(pkt); err == nil {
+				err = conn.WriteTrailer()
+			}
+		}
+		if err != nil {
+			d.closeConn(conn)
+			d.setError(err)
+			conn = nil
+			retryat = time.Now().Add(backoff)
+			if backoff *= 2; backoff > maxbackoff {
+				backoff = maxbackoff
+			}
+			continue
+		}
+		backoff = minbackoff
+
+		d.lock.Lock()
+		d.stats.Packets++
+		d.stats.Latency = time.Since(item.read)
+		d.lock.Unlock()
+	}
+
+	if conn != nil {
+		d.closeConn(conn)
+	}
+}
@@ -0,0 +1,231 @@
+// Package rtmp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package rtmp
+
+import (
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/format/flv"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func relayStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]av.CodecData{video}, testStreams(t)...)
+}
+
+// relaySource returns count video packets, a keyframe every gop, each
+// followed by an audio packet. Packet data holds the packet number.
+func relaySource(t *testing.T, count, gop, size int, delay time.Duration) *sliceDemuxer {
+	d := &sliceDemuxer{streams: relayStreams(t), delay: delay}
+	for i := 0; i < count; i++ {
+		for idx := 0; idx < 2; idx++ {
+			data := make([]byte, size)
+			pio.PutU32BE(data, uint32(len(d.pkts)))
+			d.pkts = append(d.pkts, av.Packet{
+				Idx:        int8(idx),
+				IsKeyFrame: idx == 0 && i%gop == 0,
+				Time:       time.Duration(i) * 40 * time.Millisecond,
+				Data:       data,
+			})
+		}
+	}
+	return d
+}
+
+// relayServer collects the packets published to it, one slice per
+// connection, once each connection ends. A stalling server reads nothing
+// for a while first.
+func relayServer(t *testing.T, stall time.Duration) (uri string, published chan []av.Packet) {
+	published = make(chan []av.Packet, 16)
+	uri = startServer(t, &Server{
+		HandlePublish: func(conn *Conn) {
+			time.Sleep(stall)
+			var pkts []av.Packet
+			for {
+				pkt, err := conn.ReadPacket()
+				if err != nil {
+					break
+				}
+				pkts = append(pkts, pkt)
+			}
+			published <- pkts
+		},
+	})
+	return
+}
+
+func setProbeCount(t *testing.T, n int) {
+	old := flv.MaxProbePacketCount
+	flv.MaxProbePacketCount = n
+	t.Cleanup(func() { flv.MaxProbePacketCount = old })
+}
+
+func TestRelayKeyframeStart(t *testing.T) {
+	setProbeCount(t, 2)
+	uri, published := relayServer(t, 0)
+
+	// the source starts in the middle of a GOP
+	src := relaySource(t, 20, 5, 10, 0)
+	src.pkts = src.pkts[4:]
+	r := NewRelay(uri)
+	if err := r.Run(src); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := <-published
+	if len(pkts) == 0 {
+		t.Fatal("nothing relayed")
+	}
+	first := pkts[0]
+	if first.Idx != 0 || !first.IsKeyFrame || first.Time != 0 {
+		t.Errorf("relay started with packet %d key=%v at %s, want a keyframe at 0", first.Idx, first.IsKeyFrame, first.Time)
+	}
+	// packets 0-5 of the trimmed source come before the keyframe
+	if n := pio.U32BE(first.Data); n != 10 {
+		t.Errorf("relay started with packet %d, want 10", n)
+	}
+	if len(pkts) != len(src.pkts)-6 {
+		t.Errorf("relayed %d packets, want %d", len(pkts), len(src.pkts)-6)
+	}
+	stats := r.Stats()[0]
+	if stats.Packets != len(pkts) || stats.Dropped != 6 || stats.TxBytes == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRelayEarlyAudio(t *testing.T) {
+	setProbeCount(t, 2)
+	uri, published := relayServer(t, 0)
+
+	// the audio packet after the starting keyframe is stamped before it
+	src := relaySource(t, 20, 5, 10, 0)
+	src.pkts = src.pkts[4:]
+	src.pkts[7].Time -= 20 * time.Millisecond
+	r := NewRelay(uri)
+	if err := r.Run(src); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := <-published
+	for _, pkt := range pkts {
+		if n := pio.U32BE(pkt.Data); n == 11 || pkt.Time < 0 || pkt.Time > time.Second {
+			t.Errorf("relayed packet %d at %s", n, pkt.Time)
+		}
+	}
+	stats := r.Stats()[0]
+	if len(pkts) != len(src.pkts)-7 || stats.Dropped != 7 {
+		t.Errorf("relayed %d packets, want %d, stats %+v", len(pkts), len(src.pkts)-7, stats)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	setProbeCount(t, 2)
+	good, published := relayServer(t, 0)
+
+	// a destination that hangs up right away
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var attempts int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&attempts, 1)
+			conn.Close()
+		}
+	}()
+	bad := "rtmp://" + listener.Addr().String() + "/live/test"
+
+	// a keyframe every 20ms for a second
+	src := relaySource(t, 25, 1, 10, 20*time.Millisecond)
+	r := NewRelay(bad, good)
+	r.MinBackoff = 100 * time.Millisecond
+	r.MaxBackoff = 400 * time.Millisecond
+	if err = r.Run(src); err != nil {
+		t.Fatal(err)
+	}
+
+	// retries at about 0, 100, 300, 700 and 1100ms
+	if n := atomic.LoadInt32(&attempts); n < 3 || n > 6 {
+		t.Errorf("%d connection attempts, want about 4", n)
+	}
+	stats := r.Stats()
+	if stats[0].Connected || stats[0].Packets != 0 || stats[0].Dropped != len(src.pkts) || stats[0].LastError == nil {
+		t.Errorf("unexpected stats of the failing destination %+v", stats[0])
+	}
+	// the other destination does not suffer from it
+	if pkts := <-published; len(pkts) != len(src.pkts) || stats[1].Packets != len(src.pkts) || stats[1].Dropped != 0 {
+		t.Errorf("good destination got %d packets, stats %+v", len(pkts), stats[1])
+	}
+}
+
+func TestRelayQueueFull(t *testing.T) {
+	setProbeCount(t, 2)
+	fast, fastPublished := relayServer(t, 0)
+	slow, slowPublished := relayServer(t, 500*time.Millisecond)
+
+	// far more than the socket buffers hold while the slow server sleeps,
+	// then some more once it reads again. The packets share one big buffer
+	// and are told apart by their time.
+	src := relaySource(t, 150, 10, 4, 5*time.Millisecond)
+	data := make([]byte, 512*1024)
+	for i := range src.pkts {
+		src.pkts[i].Data = data
+	}
+	number := func(pkt av.Packet) int {
+		return int(pkt.Time/(40*time.Millisecond))*2 + int(pkt.Idx)
+	}
+	r := NewRelay(fast, slow)
+	r.QueueSize = 4
+	if err := r.Run(src); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := r.Stats()
+	if stats[1].Dropped == 0 {
+		t.Fatalf("slow destination dropped nothing, stats %+v", stats[1])
+	}
+	if stats[0].Packets+stats[0].Dropped != len(src.pkts) {
+		t.Errorf("fast destination wrote %d packets and dropped %d of %d", stats[0].Packets, stats[0].Dropped, len(src.pkts))
+	}
+	<-fastPublished
+
+	// after a gap the slow destination goes on at a keyframe
+	pkts := <-slowPublished
+	last, gaps := -1, 0
+	for _, pkt := range pkts {
+		n := number(pkt)
+		if n != last+1 {
+			gaps++
+		}
+		if n != last+1 && pkt.Idx == 0 && !pkt.IsKeyFrame {
+			t.Fatalf("slow destination resumed at packet %d after %d without a keyframe", n, last)
+		}
+		if n != last+1 && pkt.Idx == 1 {
+			// the audio packet right before the keyframe is dropped as well
+			t.Fatalf("slow destination resumed at audio packet %d after %d", n, last)
+		}
+		last = n
+	}
+	if gaps == 0 {
+		t.Errorf("slow destination got %d packets without a gap", len(pkts))
+	}
+}
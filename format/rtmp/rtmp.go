@@ -15,6 +15,8 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teocci/go-stream-av/av"
@@ -105,6 +107,11 @@ func (s *Server) ListenAndServe() (err error) {
 		fmt.Println("rtmp: server: listening on", addr)
 	}
 
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until it is closed.
+func (s *Server) Serve(listener net.Listener) (err error) {
 	for {
 		var netconn net.Conn
 		if netconn, err = listener.Accept(); err != nil {
@@ -137,7 +144,26 @@ const (
 	prepareWriting
 )
 
+const (
+	PeerBandwidthHard    = 0
+	PeerBandwidthSoft    = 1
+	PeerBandwidthDynamic = 2
+)
+
+const (
+	DefaultChunkSize     = 65536
+	DefaultWindowAckSize = 2500000
+	DefaultPeerBandwidth = 10000000
+)
+
 type Conn struct {
+	// Settings announced to the peer before connect/_result. ChunkSize is
+	// the outbound chunk size, between 128 and 0xffffff.
+	ChunkSize          int
+	WindowAckSize      uint32
+	PeerBandwidth      uint32
+	PeerBandwidthLimit uint8
+
 	chunkHeaderBuf      []byte
 	chunkHeaderBufExt   []byte
 	URL                 *url.URL
@@ -149,6 +175,7 @@ type Conn struct {
 	bufr                *bufio.Reader
 	bufw                *bufio.Writer
 	ackn                uint32
+	acklast             uint32
 	writebuf            []byte
 	readbuf             []byte
 	netconn             net.Conn
@@ -156,6 +183,7 @@ type Conn struct {
 	writeMaxChunkSize   int
 	readMaxChunkSize    int
 	readAckSize         uint32
+	writeAckSize        uint32
 	readcsmap           map[uint32]*chunkStream
 	isserver            bool
 	publishing, playing bool
@@ -174,6 +202,20 @@ type Conn struct {
 	datamsgvals         []interface{}
 	avtag               flvio.Tag
 	eventtype           uint16
+	wlock               sync.Mutex
+	dropaudio           bool
+	dropvideo           bool
+	waitkeyframe        bool
+	playstopped         bool
+	streameof           bool
+	acklock             sync.Mutex
+	ackcond             *sync.Cond
+	txbase              uint64
+	peerack             uint32
+	sendwindow          uint32
+	sendlimit           uint8
+	bgread              bool
+	readerr             error
 }
 
 type txrxcount struct {
@@ -184,13 +226,13 @@ type txrxcount struct {
 
 func (trc *txrxcount) Read(p []byte) (int, error) {
 	n, err := trc.ReadWriter.Read(p)
-	trc.rxbytes += uint64(n)
+	atomic.AddUint64(&trc.rxbytes, uint64(n))
 	return n, err
 }
 
 func (trc *txrxcount) Write(p []byte) (int, error) {
 	n, err := trc.ReadWriter.Write(p)
-	trc.txbytes += uint64(n)
+	atomic.AddUint64(&trc.txbytes, uint64(n))
 	return n, err
 }
 
@@ -201,9 +243,14 @@ func NewConn(netconn net.Conn) *Conn {
 	conn.readcsmap = make(map[uint32]*chunkStream)
 	conn.readMaxChunkSize = 128
 	conn.writeMaxChunkSize = 128
-	conn.bufr = bufio.NewReaderSize(netconn, pio.RecommendBufioSize)
-	conn.bufw = bufio.NewWriterSize(netconn, pio.RecommendBufioSize)
+	conn.ChunkSize = DefaultChunkSize
+	conn.WindowAckSize = DefaultWindowAckSize
+	conn.PeerBandwidth = DefaultPeerBandwidth
+	conn.PeerBandwidthLimit = PeerBandwidthDynamic
+	conn.ackcond = sync.NewCond(&conn.acklock)
 	conn.txrxcount = &txrxcount{ReadWriter: netconn}
+	conn.bufr = bufio.NewReaderSize(conn.txrxcount, pio.RecommendBufioSize)
+	conn.bufw = bufio.NewWriterSize(conn.txrxcount, pio.RecommendBufioSize)
 	conn.writebuf = make([]byte, 4096)
 	conn.readbuf = make([]byte, 4096)
 	conn.chunkHeaderBuf = make([]byte, 265)
@@ -230,6 +277,7 @@ func (cs *chunkStream) Start() {
 
 const (
 	msgtypeidUserControl      = 4
+	msgtypeidAbort            = 2
 	msgtypeidAck              = 3
 	msgtypeidWindowAckSize    = 5
 	msgtypeidSetPeerBandwidth = 6
@@ -244,8 +292,12 @@ const (
 
 const (
 	eventtypeStreamBegin      = 0
+	eventtypeStreamEOF        = 1
+	eventtypeStreamDry        = 2
 	eventtypeSetBufferLength  = 3
 	eventtypeStreamIsRecorded = 4
+	eventtypePingRequest      = 6
+	eventtypePingResponse     = 7
 )
 
 func (c *Conn) NetConn() net.Conn {
@@ -253,11 +305,11 @@ func (c *Conn) NetConn() net.Conn {
 }
 
 func (c *Conn) TxBytes() uint64 {
-	return c.txrxcount.txbytes
+	return atomic.LoadUint64(&c.txrxcount.txbytes)
 }
 
 func (c *Conn) RxBytes() uint64 {
-	return c.txrxcount.rxbytes
+	return atomic.LoadUint64(&c.txrxcount.rxbytes)
 }
 
 func (c *Conn) Close() (err error) {
@@ -284,10 +336,56 @@ func (c *Conn) pollAVTag() (tag flvio.Tag, err error) {
 		case msgtypeidVideoMsg, msgtypeidAudioMsg:
 			tag = c.avtag
 			return
+
+		case msgtypeidCommandMsgAMF0, msgtypeidCommandMsgAMF3, msgtypeidDataMsgAMF0:
+			if c.playing && !c.isserver && c.isPlayStop() {
+				c.playstopped = true
+			}
+
+		case msgtypeidUserControl:
+			if c.playing && !c.isserver {
+				switch c.eventtype {
+				case eventtypeStreamBegin:
+					c.playstopped, c.streameof = false, false
+				case eventtypeStreamEOF:
+					c.streameof = true
+				}
+			}
+		}
+
+		// a StreamEOF alone may only be a pause, the stream ends once the
+		// server also said that playback stopped
+		if c.playstopped && c.streameof {
+			err = io.EOF
+			return
 		}
 	}
 }
 
+// isPlayStop tells whether the last message is an onStatus NetStream.Play.Stop
+// or an onPlayStatus NetStream.Play.Complete.
+func (c *Conn) isPlayStop() bool {
+	var name string
+	var info flvio.AMFMap
+	if c.gotcommand {
+		name = c.commandname
+		if len(c.commandparams) > 0 {
+			info, _ = c.commandparams[0].(flvio.AMFMap)
+		}
+	} else if len(c.datamsgvals) > 1 {
+		name, _ = c.datamsgvals[0].(string)
+		info, _ = c.datamsgvals[1].(flvio.AMFMap)
+	}
+	code, _ := info["code"].(string)
+	switch {
+	case name == "onStatus" && code == "NetStream.Play.Stop":
+		return true
+	case name == "onPlayStatus" && code == "NetStream.Play.Complete":
+		return true
+	}
+	return false
+}
+
 func (c *Conn) pollMsg() (err error) {
 	c.gotmsg = false
 	c.gotcommand = false
@@ -348,13 +446,13 @@ func createURL(tcurl, app, play string) (u *url.URL) {
 var CodecTypes = flv.CodecTypes
 
 func (c *Conn) writeBasicConf() (err error) {
-	if err = c.writeSetChunkSize(65536); err != nil {
+	if err = c.writeSetChunkSize(c.ChunkSize); err != nil {
 		return
 	}
-	if err = c.writeWindowAckSize(2500000); err != nil {
+	if err = c.writeWindowAckSize(c.WindowAckSize); err != nil {
 		return
 	}
-	if err = c.writeSetPeerBandwidth(10000000, 2); err != nil {
+	if err = c.writeSetPeerBandwidth(c.PeerBandwidth, c.PeerBandwidthLimit); err != nil {
 		return
 	}
 	return
@@ -622,9 +720,6 @@ func (c *Conn) writeConnect(path string) (err error) {
 			}
 		} else {
 			if c.msgtypeid == msgtypeidWindowAckSize {
-				if len(c.msgdata) == 4 {
-					c.readAckSize = pio.U32BE(c.msgdata)
-				}
 				if err = c.writeWindowAckSize(0xffffffff); err != nil {
 					return
 				}
@@ -687,6 +782,18 @@ func (c *Conn) connectPublish() (err error) {
 	c.writing = true
 	c.publishing = true
 	c.stage++
+
+	// a publisher never reads again, keep consuming acknowledgements,
+	// pings and status messages so the peer does not stall
+	c.setBackgroundReading()
+	go func() {
+		for {
+			if err := c.pollMsg(); err != nil {
+				c.setReadError(err)
+				return
+			}
+		}
+	}()
 	return
 }
 
@@ -786,6 +893,7 @@ func (c *Conn) prepare(stage int, flags int) (err error) {
 					return
 				}
 			}
+			c.txbase = c.TxBytes() + uint64(c.bufw.Buffered())
 
 		case stageHandshakeDone:
 			if c.isserver {
@@ -830,8 +938,17 @@ func (c *Conn) WritePacket(pkt av.Packet) (err error) {
 	if err = c.prepare(stageCodecDataDone, prepareWriting); err != nil {
 		return
 	}
+	if err = c.waitAckWindow(); err != nil {
+		return
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
 
 	stream := c.streams[pkt.Idx]
+	if c.dropPacket(pkt, stream) {
+		return
+	}
 	tag, timestamp := flv.PacketToTag(pkt, stream)
 
 	if Debug {
@@ -841,10 +958,19 @@ func (c *Conn) WritePacket(pkt av.Packet) (err error) {
 	if err = c.writeAVTag(tag, int32(timestamp)); err != nil {
 		return
 	}
+	if c.ackWindowActive() {
+		// unacked bytes are counted on the socket, do not let them hide in bufw
+		if err = c.flushWrite(); err != nil {
+			return
+		}
+	}
 	return
 }
 
 func (c *Conn) WriteTrailer() (err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
 	if err = c.flushWrite(); err != nil {
 		return
 	}
@@ -856,6 +982,9 @@ func (c *Conn) WriteHeader(streams []av.CodecData) (err error) {
 		return
 	}
 
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
 	var metadata flvio.AMFMap
 	if metadata, err = flv.NewMetadataByStreams(streams); err != nil {
 		return
@@ -865,6 +994,16 @@ func (c *Conn) WriteHeader(streams []av.CodecData) (err error) {
 		return
 	}
 
+	if err = c.writeCodecDataTags(streams, 0); err != nil {
+		return
+	}
+
+	c.streams = streams
+	c.stage++
+	return
+}
+
+func (c *Conn) writeCodecDataTags(streams []av.CodecData, ts int32) (err error) {
 	for _, stream := range streams {
 		var ok bool
 		var tag flvio.Tag
@@ -872,14 +1011,11 @@ func (c *Conn) WriteHeader(streams []av.CodecData) (err error) {
 			return
 		}
 		if ok {
-			if err = c.writeAVTag(tag, 0); err != nil {
+			if err = c.writeAVTag(tag, ts); err != nil {
 				return
 			}
 		}
 	}
-
-	c.streams = streams
-	c.stage++
 	return
 }
 
@@ -891,6 +1027,10 @@ func (c *Conn) tmpwbuf(n int) []byte {
 }
 
 func (c *Conn) writeSetChunkSize(size int) (err error) {
+	if size < 128 || size > 0xffffff {
+		err = fmt.Errorf("rtmp: chunk size=%d invalid", size)
+		return
+	}
 	c.writeMaxChunkSize = size
 	b := c.tmpwbuf(chunkHeaderLength + 4)
 	n := c.fillChunkHeader(b, 2, 0, msgtypeidSetChunkSize, 0, 4)
@@ -910,6 +1050,7 @@ func (c *Conn) writeAck(seqnum uint32) (err error) {
 }
 
 func (c *Conn) writeWindowAckSize(size uint32) (err error) {
+	c.writeAckSize = size
 	b := c.tmpwbuf(chunkHeaderLength + 4)
 	n := c.fillChunkHeader(b, 2, 0, msgtypeidWindowAckSize, 0, 4)
 	pio.PutU32BE(b[n:], size)
@@ -943,14 +1084,13 @@ func (c *Conn) writeAMF0Msg(msgtypeid uint8, csid, msgsid uint32, args ...interf
 		size += flvio.LenAMF0Val(arg)
 	}
 
-	b := c.tmpwbuf(chunkHeaderLength + size)
-	n := c.fillChunkHeader(b, csid, 0, msgtypeid, msgsid, size)
+	b := c.tmpwbuf(size)
+	n := 0
 	for _, arg := range args {
 		n += flvio.FillAMF0Val(b[n:], arg)
 	}
 
-	_, err = c.bufw.Write(b[:n])
-	return
+	return c.writeChunks(csid, 0, msgtypeid, msgsid, b[:n])
 }
 func (c *Conn) fillChunk3Header(b []byte, csid uint32, timestamp uint32) (n int) {
 	b[n] = (byte(csid) & 0x3f) | 0xC0
@@ -1001,42 +1141,26 @@ func (c *Conn) fillChunk0Header(b []byte, csid uint32, timestamp uint32, msgtype
 
 	return
 }
-func (c *Conn) weiteAVTagtoChunk(csid uint32, timestamp uint32, msgtypeid uint8, msgsid uint32, msgdatalen int, tag flvio.Tag) (n int, err error) {
-	pos := 0
-	sn := 0
-	last := c.writeMaxChunkSize
-	hdrlen := tag.FillHeader(c.chunkHeaderBufExt)
-	tag.Data = append(c.chunkHeaderBufExt[:hdrlen], tag.Data...)
-	msgdatalen = len(tag.Data)
-	end := msgdatalen
-	for msgdatalen+hdrlen > 0 {
-		if pos == 0 {
-			n = c.fillChunk0Header(c.chunkHeaderBuf, csid, timestamp, msgtypeid, msgsid, msgdatalen)
-			n, err = c.bufw.Write(c.chunkHeaderBuf[:n])
-			if err != nil {
-				return
-			}
-		} else {
-			n := c.fillChunk3Header(c.chunkHeaderBuf, csid, timestamp)
-			_, err = c.bufw.Write(c.chunkHeaderBuf[:n])
+
+// writeChunks splits one message into chunks of writeMaxChunkSize bytes.
+func (c *Conn) writeChunks(csid uint32, timestamp uint32, msgtypeid uint8, msgsid uint32, data []byte) (err error) {
+	n := c.fillChunk0Header(c.chunkHeaderBuf, csid, timestamp, msgtypeid, msgsid, len(data))
+	for {
+		if _, err = c.bufw.Write(c.chunkHeaderBuf[:n]); err != nil {
+			return
 		}
-		if msgdatalen > c.writeMaxChunkSize {
-			if sn, err = c.bufw.Write(tag.Data[pos:last]); err != nil {
-				return
-			}
-			pos += sn
-			last += sn
-			msgdatalen -= sn
-			continue
+		size := len(data)
+		if size > c.writeMaxChunkSize {
+			size = c.writeMaxChunkSize
 		}
-		if sn, err = c.bufw.Write(tag.Data[pos:end]); err != nil {
+		if _, err = c.bufw.Write(data[:size]); err != nil {
 			return
 		}
-		pos += sn
-		msgdatalen -= sn
-		return
+		if data = data[size:]; len(data) == 0 {
+			return
+		}
+		n = c.fillChunk3Header(c.chunkHeaderBuf, csid, timestamp)
 	}
-	return
 }
 
 func (c *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
@@ -1055,14 +1179,19 @@ func (c *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
 		csid = 7
 		data = tag.Data
 	}
-	_, err = c.weiteAVTagtoChunk(csid, uint32(ts), msgtypeid, c.avmsgsid, len(data), tag)
-	return err
+	hdrlen := tag.FillHeader(c.chunkHeaderBufExt)
+	data = append(c.chunkHeaderBufExt[:hdrlen:hdrlen], data...)
+	return c.writeChunks(csid, uint32(ts), msgtypeid, c.avmsgsid, data)
 }
 
 func (c *Conn) writeStreamBegin(msgsid uint32) (err error) {
+	return c.writeStreamEvent(eventtypeStreamBegin, msgsid)
+}
+
+func (c *Conn) writeStreamEvent(eventtype uint16, msgsid uint32) (err error) {
 	b := c.tmpwbuf(chunkHeaderLength + 6)
 	n := c.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 6)
-	pio.PutU16BE(b[n:], eventtypeStreamBegin)
+	pio.PutU16BE(b[n:], eventtype)
 	n += 2
 	pio.PutU32BE(b[n:], msgsid)
 	n += 4
@@ -1070,6 +1199,17 @@ func (c *Conn) writeStreamBegin(msgsid uint32) (err error) {
 	return
 }
 
+func (c *Conn) writePingResponse(timestamp uint32) (err error) {
+	b := c.tmpwbuf(chunkHeaderLength + 6)
+	n := c.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 6)
+	pio.PutU16BE(b[n:], eventtypePingResponse)
+	n += 2
+	pio.PutU32BE(b[n:], timestamp)
+	n += 4
+	_, err = c.bufw.Write(b[:n])
+	return
+}
+
 func (c *Conn) writeSetBufferLength(msgsid uint32, timestamp uint32) (err error) {
 	b := c.tmpwbuf(chunkHeaderLength + 10)
 	n := c.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 10)
@@ -1341,12 +1481,18 @@ func (c *Conn) readChunk() (err error) {
 		}
 	}
 
+	// the sequence number is the total number of bytes received so far
 	c.ackn += uint32(n)
-	if c.readAckSize != 0 && c.ackn > c.readAckSize {
-		if err = c.writeAck(c.ackn); err != nil {
+	if c.readAckSize != 0 && c.ackn-c.acklast >= c.readAckSize {
+		c.wlock.Lock()
+		if err = c.writeAck(c.ackn); err == nil {
+			err = c.flushWrite()
+		}
+		c.wlock.Unlock()
+		if err != nil {
 			return
 		}
-		c.ackn = 0
+		c.acklast = c.ackn
 	}
 
 	return
@@ -1421,6 +1567,16 @@ func (c *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, msgda
 			return
 		}
 		c.eventtype = pio.U16BE(msgdata)
+		if c.eventtype == eventtypePingRequest && len(msgdata) >= 6 {
+			c.wlock.Lock()
+			if err = c.writePingResponse(pio.U32BE(msgdata[2:])); err == nil {
+				err = c.flushWrite()
+			}
+			c.wlock.Unlock()
+			if err != nil {
+				return
+			}
+		}
 
 	case msgtypeidDataMsgAMF0:
 		b := msgdata
@@ -1471,14 +1627,142 @@ func (c *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, msgda
 			err = fmt.Errorf("rtmp: short packet of SetChunkSize")
 			return
 		}
-		c.readMaxChunkSize = int(pio.U32BE(msgdata))
+		size := pio.U32BE(msgdata) & 0x7fffffff
+		if size == 0 {
+			err = fmt.Errorf("rtmp: SetChunkSize size=0 invalid")
+			return
+		}
+		c.readMaxChunkSize = int(size)
 		return
+
+	case msgtypeidAbort:
+		if len(msgdata) < 4 {
+			err = fmt.Errorf("rtmp: short packet of Abort")
+			return
+		}
+		if cs := c.readcsmap[pio.U32BE(msgdata)]; cs != nil {
+			cs.msgdataleft = 0
+			cs.msgdata = nil
+		}
+		return
+
+	case msgtypeidAck:
+		if len(msgdata) < 4 {
+			err = fmt.Errorf("rtmp: short packet of Ack")
+			return
+		}
+		c.acklock.Lock()
+		c.peerack = pio.U32BE(msgdata)
+		c.ackcond.Broadcast()
+		c.acklock.Unlock()
+
+	case msgtypeidWindowAckSize:
+		if len(msgdata) < 4 {
+			err = fmt.Errorf("rtmp: short packet of WindowAckSize")
+			return
+		}
+		c.readAckSize = pio.U32BE(msgdata)
+
+	case msgtypeidSetPeerBandwidth:
+		if len(msgdata) < 5 {
+			err = fmt.Errorf("rtmp: short packet of SetPeerBandwidth")
+			return
+		}
+		if err = c.setPeerBandwidth(pio.U32BE(msgdata), msgdata[4]); err != nil {
+			return
+		}
 	}
 
 	c.gotmsg = true
 	return
 }
 
+// setPeerBandwidth applies a SetPeerBandwidth message to the send window.
+func (c *Conn) setPeerBandwidth(size uint32, limittype uint8) (err error) {
+	c.acklock.Lock()
+	switch limittype {
+	case PeerBandwidthHard:
+	case PeerBandwidthSoft:
+		if c.sendwindow != 0 && c.sendwindow < size {
+			size = c.sendwindow
+		}
+	case PeerBandwidthDynamic:
+		// only meaningful after a hard limit
+		if c.sendwindow == 0 || c.sendlimit != PeerBandwidthHard {
+			c.acklock.Unlock()
+			return
+		}
+		limittype = PeerBandwidthHard
+	default:
+		c.acklock.Unlock()
+		return
+	}
+	c.sendwindow = size
+	c.sendlimit = limittype
+	c.ackcond.Broadcast()
+	c.acklock.Unlock()
+
+	if Debug {
+		fmt.Printf("rtmp: send window=%d limittype=%d\n", size, limittype)
+	}
+
+	if size != c.writeAckSize {
+		c.wlock.Lock()
+		if err = c.writeWindowAckSize(size); err == nil {
+			err = c.flushWrite()
+		}
+		c.wlock.Unlock()
+	}
+	return
+}
+
+// setBackgroundReading marks that acknowledgements are read by another
+// goroutine, so writers may wait for them.
+func (c *Conn) setBackgroundReading() {
+	c.acklock.Lock()
+	c.bgread = true
+	c.acklock.Unlock()
+}
+
+func (c *Conn) setReadError(err error) {
+	c.acklock.Lock()
+	c.readerr = err
+	c.ackcond.Broadcast()
+	c.acklock.Unlock()
+}
+
+// unacked returns the bytes sent since the handshake that the peer has not
+// acknowledged yet. Peers that count the handshake may ack more than we
+// counted, which is treated as nothing outstanding.
+func (c *Conn) unacked() uint32 {
+	sent := uint32(c.TxBytes() - c.txbase)
+	if d := int32(sent - c.peerack); d > 0 {
+		return uint32(d)
+	}
+	return 0
+}
+
+func (c *Conn) ackWindowActive() bool {
+	c.acklock.Lock()
+	defer c.acklock.Unlock()
+	return c.bgread && c.sendwindow != 0
+}
+
+// waitAckWindow blocks while more than the peer bandwidth is unacknowledged.
+func (c *Conn) waitAckWindow() (err error) {
+	c.acklock.Lock()
+	defer c.acklock.Unlock()
+
+	for c.bgread && c.sendwindow != 0 && c.unacked() > c.sendwindow {
+		if c.readerr != nil {
+			err = c.readerr
+			return
+		}
+		c.ackcond.Wait()
+	}
+	return
+}
+
 var (
 	hsClientFullKey = []byte{
 		'G', 'e', 'n', 'u', 'i', 'n', 'e', ' ', 'A', 'd', 'o', 'b', 'e', ' ',
@@ -0,0 +1,253 @@
+// Package rtmp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func startServer(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return "rtmp://" + listener.Addr().String() + "/live/test"
+}
+
+func testStreams(t *testing.T) []av.CodecData {
+	stream, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{stream}
+}
+
+func testPacket(i int, size int) av.Packet {
+	data := make([]byte, size)
+	for j := range data {
+		data[j] = byte(i + j)
+	}
+	return av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: data}
+}
+
+func publish(t *testing.T, conn *Conn, count, size int) {
+	if err := conn.WriteHeader(testStreams(t)); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < count; i++ {
+		if err := conn.WritePacket(testPacket(i, size)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err := conn.WriteTrailer(); err != nil {
+		t.Error(err)
+	}
+}
+
+func readPackets(conn *Conn, count int) (pkts []av.Packet, err error) {
+	for len(pkts) < count {
+		var pkt av.Packet
+		if pkt, err = conn.ReadPacket(); err != nil {
+			return
+		}
+		pkts = append(pkts, pkt)
+	}
+	return
+}
+
+func TestChunkSizeNegotiation(t *testing.T) {
+	const count, size = 40, 10000
+
+	result := make(chan []av.Packet, 1)
+	uri := startServer(t, &Server{
+		HandleConn: func(conn *Conn) {
+			conn.ChunkSize = 4096
+			pkts, err := readPackets(conn, count)
+			if err != nil {
+				t.Error(err)
+			}
+			result <- pkts
+		},
+	})
+
+	conn, err := Dial(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.ChunkSize = 128
+
+	publish(t, conn, count, size)
+
+	pkts := <-result
+	if len(pkts) != count {
+		t.Fatalf("got %d packets, want %d", len(pkts), count)
+	}
+	for i, pkt := range pkts {
+		want := testPacket(i, size)
+		if !bytes.Equal(pkt.Data, want.Data) || pkt.Time != want.Time {
+			t.Fatalf("packet %d mismatch", i)
+		}
+	}
+	if conn.readMaxChunkSize != 4096 {
+		t.Errorf("client read chunk size=%d, want 4096", conn.readMaxChunkSize)
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	conn := NewConn(nil)
+	if err := conn.writeSetChunkSize(64); err == nil {
+		t.Error("chunk size 64 accepted")
+	}
+	if err := conn.writeSetChunkSize(0x1000000); err == nil {
+		t.Error("chunk size 0x1000000 accepted")
+	}
+}
+
+func TestAckWindow(t *testing.T) {
+	const count, size = 200, 4000
+	const window = 32 * 1024
+
+	stalled := make(chan *Conn, 1)
+	release := make(chan struct{})
+	result := make(chan []av.Packet, 1)
+	uri := startServer(t, &Server{
+		HandleConn: func(conn *Conn) {
+			conn.PeerBandwidth = window
+			conn.PeerBandwidthLimit = PeerBandwidthHard
+			if err := conn.Prepare(); err != nil {
+				t.Error(err)
+				return
+			}
+			stalled <- conn
+			<-release
+			pkts, err := readPackets(conn, count)
+			if err != nil {
+				t.Error(err)
+			}
+			result <- pkts
+		},
+	})
+
+	conn, err := Dial(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go publish(t, conn, count, size)
+
+	<-stalled
+	time.Sleep(200 * time.Millisecond)
+	conn.acklock.Lock()
+	unacked, sendwindow := conn.unacked(), conn.sendwindow
+	conn.acklock.Unlock()
+	if sendwindow != window {
+		t.Fatalf("send window=%d, want %d", sendwindow, window)
+	}
+	// one message may be in flight on top of the window
+	if unacked > window+size+64 {
+		t.Fatalf("unacked=%d exceeds window=%d while the server is not reading", unacked, window)
+	}
+	close(release)
+
+	select {
+	case pkts := <-result:
+		if len(pkts) != count {
+			t.Fatalf("got %d packets, want %d", len(pkts), count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher stalled")
+	}
+}
+
+func TestSetPeerBandwidthLimitType(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := NewConn(client)
+	conn.writeAckSize = 1 << 20
+
+	steps := []struct {
+		size      uint32
+		limittype uint8
+		want      uint32
+	}{
+		{5000, PeerBandwidthDynamic, 0},
+		{5000, PeerBandwidthHard, 5000},
+		{8000, PeerBandwidthSoft, 5000},
+		{3000, PeerBandwidthSoft, 3000},
+		{9000, PeerBandwidthDynamic, 3000},
+		{4000, PeerBandwidthHard, 4000},
+		{9000, PeerBandwidthDynamic, 9000},
+	}
+	for i, step := range steps {
+		if err := conn.setPeerBandwidth(step.size, step.limittype); err != nil {
+			t.Fatal(err)
+		}
+		if conn.sendwindow != step.want {
+			t.Errorf("step %d: send window=%d, want %d", i, conn.sendwindow, step.want)
+		}
+	}
+	if conn.writeAckSize != 9000 {
+		t.Errorf("window ack size=%d, want 9000", conn.writeAckSize)
+	}
+}
+
+func TestAbortMessage(t *testing.T) {
+	var b bytes.Buffer
+	chunk := make([]byte, chunkHeaderLength)
+
+	// first chunk of a 300 byte message on csid 4, never completed
+	n := (&Conn{}).fillChunkHeader(chunk, 4, 0, msgtypeidDataMsgAMF0, 1, 300)
+	b.Write(chunk[:n])
+	b.Write(make([]byte, 128))
+
+	// abort csid 4
+	n = (&Conn{}).fillChunkHeader(chunk, 2, 0, msgtypeidAbort, 0, 4)
+	b.Write(chunk[:n])
+	pio.PutU32BE(chunk, 4)
+	b.Write(chunk[:4])
+
+	// a new message on csid 4 must start cleanly
+	n = (&Conn{}).fillChunkHeader(chunk, 4, 0, msgtypeidSetChunkSize, 0, 4)
+	b.Write(chunk[:n])
+	pio.PutU32BE(chunk, 1000)
+	b.Write(chunk[:4])
+
+	conn := NewConn(nil)
+	conn.bufr = bufio.NewReader(&b)
+	for i := 0; i < 3; i++ {
+		if err := conn.readChunk(); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	if conn.readMaxChunkSize != 1000 {
+		t.Errorf("read chunk size=%d, want 1000", conn.readMaxChunkSize)
+	}
+}
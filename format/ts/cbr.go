@@ -0,0 +1,393 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/teocci/go-stream-av/format/ts/tsio"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// Constant bitrate output. Every transport packet occupies 188*8/MuxRate
+// seconds on the wire, PCRs are stamped from the position of the packet in
+// that timeline and the gaps are filled with null packets.
+
+const (
+	DefaultMuxDelay    = 500 * time.Millisecond
+	DefaultPCRInterval = 30 * time.Millisecond
+	DefaultPSIInterval = 100 * time.Millisecond
+
+	// MaxPCRInterval is the PCR repetition limit of ISO/IEC 13818-1 and
+	// ETSI TR 101 290.
+	MaxPCRInterval = 40 * time.Millisecond
+
+	// MaxPCRJitter is the PCR accuracy limit of ISO/IEC 13818-1.
+	MaxPCRJitter = 500 * time.Nanosecond
+)
+
+const tsPacketSize = 188
+
+// pcrOffset is the offset in the packet of the byte that holds the last bit
+// of program_clock_reference_base, the byte a PCR value refers to.
+const pcrOffset = 10
+
+type cbrWriter struct {
+	muxer *Muxer
+	w     io.Writer
+
+	pkt []byte
+	n   int
+
+	bytes   int64 // bytes written
+	started bool
+	origin  time.Duration // clock of the first byte
+	lastpcr time.Duration
+	lastpsi time.Duration
+
+	psi    []byte // PAT and PMT packets repeated every PSIInterval
+	pcrpkt []byte
+	null   []byte
+}
+
+func newCBRWriter(muxer *Muxer, w io.Writer) *cbrWriter {
+	null := make([]byte, tsPacketSize)
+	null[0] = syncByte
+	pio.PutU16BE(null[1:3], nullPID)
+	null[3] = 0x10
+	for i := 4; i < tsPacketSize; i++ {
+		null[i] = 0xff
+	}
+
+	pcrpkt := make([]byte, tsPacketSize)
+	pcrpkt[0] = syncByte
+	pcrpkt[3] = 0x20 // adaptation field only
+	pcrpkt[4] = tsPacketSize - 5
+	pcrpkt[5] = 0x10 // PCR flag
+	for i := 12; i < tsPacketSize; i++ {
+		pcrpkt[i] = 0xff
+	}
+
+	return &cbrWriter{
+		muxer:  muxer,
+		w:      w,
+		pkt:    make([]byte, tsPacketSize),
+		pcrpkt: pcrpkt,
+		null:   null,
+	}
+}
+
+// clock returns the time on the wire of the byte at offset pos.
+func (self *cbrWriter) clock(pos int64) time.Duration {
+	return self.origin + self.elapsed(pos)
+}
+
+func (self *cbrWriter) elapsed(pos int64) time.Duration {
+	rate := self.muxer.MuxRate
+	return time.Duration(pos/rate)*8*time.Second +
+		time.Duration(pos%rate*8*int64(time.Second)/rate)
+}
+
+// Write collects whole transport packets and passes them on in CBR order.
+func (self *cbrWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(self.pkt[self.n:], p)
+		self.n += c
+		n += c
+		p = p[c:]
+		if self.n == tsPacketSize {
+			self.n = 0
+			if err = self.writePacket(self.pkt); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *cbrWriter) writePacket(pkt []byte) (err error) {
+	if self.started {
+		if err = self.writeDue(); err != nil {
+			return
+		}
+		if pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x10 != 0 {
+			// restamp the PCR with the wire clock
+			clk := self.clock(self.bytes + pcrOffset)
+			pio.PutU48BE(pkt[6:12], tsio.TimeToPCR(clk))
+			if pio.U16BE(pkt[1:3])&0x1fff == self.muxer.pcrPID() {
+				self.lastpcr = clk
+			}
+		}
+	}
+	return self.write(pkt)
+}
+
+func (self *cbrWriter) write(pkt []byte) (err error) {
+	if _, err = self.w.Write(pkt); err != nil {
+		return
+	}
+	self.bytes += tsPacketSize
+	return
+}
+
+// writeDue inserts a PCR packet and the PAT/PMT when they are due at the
+// current position.
+func (self *cbrWriter) writeDue() (err error) {
+	clk := self.clock(self.bytes)
+	if clk-self.lastpsi >= self.muxer.PSIInterval {
+		for i := 0; i+tsPacketSize <= len(self.psi); i += tsPacketSize {
+			pkt := self.psi[i : i+tsPacketSize]
+			tsw := self.muxer.tswpmt
+			if pio.U16BE(pkt[1:3])&0x1fff == tsio.PAT_PID {
+				tsw = self.muxer.tswpat
+			}
+			pkt[3] = pkt[3]&0xf0 | byte(tsw.ContinuityCounter)&0xf
+			tsw.ContinuityCounter++
+			if err = self.write(pkt); err != nil {
+				return
+			}
+		}
+		self.lastpsi = clk
+		clk = self.clock(self.bytes)
+	}
+	if clk-self.lastpcr >= self.muxer.PCRInterval {
+		if err = self.writePCR(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *cbrWriter) writePCR() (err error) {
+	pid := self.muxer.pcrPID()
+	pio.PutU16BE(self.pcrpkt[1:3], pid)
+	// the counter does not advance on packets without payload
+	cc := byte(0)
+	for _, stream := range self.muxer.streams {
+		if stream.pid == pid {
+			cc = byte(stream.tsw.ContinuityCounter-1) & 0xf
+		}
+	}
+	self.pcrpkt[3] = 0x20 | cc
+	clk := self.clock(self.bytes + pcrOffset)
+	pio.PutU48BE(self.pcrpkt[6:12], tsio.TimeToPCR(clk))
+	self.lastpcr = clk
+	return self.write(self.pcrpkt)
+}
+
+// fill pads the output with null packets until the wire clock is MuxDelay
+// ahead of dts. The first call anchors the clock. It fails when the wire
+// clock is already past dts, the payload does not fit in MuxRate.
+func (self *cbrWriter) fill(dts time.Duration) (err error) {
+	if !self.started {
+		self.started = true
+		self.origin = dts - self.muxer.MuxDelay - self.elapsed(self.bytes)
+		self.lastpsi = self.clock(self.bytes)
+		if err = self.writePCR(); err != nil {
+			return
+		}
+	}
+	if late := self.clock(self.bytes) - dts; late > 0 {
+		err = fmt.Errorf("ts: payload exceeds mux rate=%d, packet %v late", self.muxer.MuxRate, late)
+		return
+	}
+	for self.clock(self.bytes) < dts-self.muxer.MuxDelay {
+		if err = self.writeDue(); err != nil {
+			return
+		}
+		if err = self.write(self.null); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// setPSI keeps the PAT/PMT packets written by WritePATPMT for repetition.
+func (self *cbrWriter) setPSI(b []byte) {
+	self.psi = append(self.psi[:0], b...)
+}
+
+func (self *Muxer) startCBR() (err error) {
+	if self.MuxRate < 8*tsPacketSize {
+		err = fmt.Errorf("ts: mux rate=%d too low", self.MuxRate)
+		return
+	}
+	if self.MuxDelay == 0 {
+		self.MuxDelay = DefaultMuxDelay
+	}
+	if self.PCRInterval == 0 {
+		self.PCRInterval = DefaultPCRInterval
+	}
+	if self.PSIInterval == 0 {
+		self.PSIInterval = DefaultPSIInterval
+	}
+	self.cbr = newCBRWriter(self, self.w)
+	self.w = self.cbr
+	return
+}
+
+// Validator measures the PCR accuracy and the rate of a transport stream
+// written to it. It locks on to the first PID that carries a PCR.
+type Validator struct {
+	pkt []byte
+	n   int
+
+	bytes       int64
+	packets     int
+	nullpackets int
+
+	pcrpid int
+	pcrs   []pcrSample
+}
+
+type pcrSample struct {
+	pos int64
+	pcr uint64
+}
+
+// ValidatorReport holds the measurements of a Validator.
+type ValidatorReport struct {
+	Packets        int
+	NullPackets    int
+	PCRs           int
+	Rate           int64         // average rate between the first and last PCR in bits per second
+	MinRate        int64         // lowest rate between two PCRs
+	MaxRate        int64         // highest rate between two PCRs
+	MaxPCRInterval time.Duration // longest gap between two PCRs
+	MaxPCRJitter   time.Duration // largest PCR offset from a constant Rate timeline
+}
+
+func NewValidator() *Validator {
+	return &Validator{
+		pkt:    make([]byte, tsPacketSize),
+		pcrpid: -1,
+	}
+}
+
+func (self *Validator) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(self.pkt[self.n:], p)
+		self.n += c
+		n += c
+		p = p[c:]
+		if self.n == tsPacketSize {
+			self.n = 0
+			if err = self.handlePacket(self.pkt); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *Validator) handlePacket(pkt []byte) (err error) {
+	var hdr tsio.TSHeader
+	if hdr, _, err = tsio.ParseTSPacketHeader(pkt); err != nil {
+		err = fmt.Errorf("ts: validator lost sync at byte %d", self.bytes)
+		return
+	}
+	self.packets++
+	if hdr.PID == nullPID {
+		self.nullpackets++
+	}
+	if hdr.HasPCR && (self.pcrpid == -1 || int(hdr.PID) == self.pcrpid) {
+		self.pcrpid = int(hdr.PID)
+		self.pcrs = append(self.pcrs, pcrSample{pos: self.bytes + pcrOffset, pcr: hdr.PCR})
+	}
+	self.bytes += tsPacketSize
+	return
+}
+
+const pcrWrap = (1 << 33) * 300
+
+func pcrDiff(a, b uint64) uint64 {
+	return (a + pcrWrap - b) % pcrWrap
+}
+
+func pcrTicksToTime(ticks uint64) time.Duration {
+	return time.Duration(ticks * 1000 / (tsio.PCR_HZ / 1000000))
+}
+
+// Report measures the PCRs seen so far. The jitter is taken against the
+// constant rate timeline through the first and last PCR.
+func (self *Validator) Report() (report ValidatorReport) {
+	report.Packets = self.packets
+	report.NullPackets = self.nullpackets
+	report.PCRs = len(self.pcrs)
+	if len(self.pcrs) < 2 {
+		return
+	}
+
+	for i := 1; i < len(self.pcrs); i++ {
+		prev, cur := self.pcrs[i-1], self.pcrs[i]
+		interval := pcrTicksToTime(pcrDiff(cur.pcr, prev.pcr))
+		if interval > report.MaxPCRInterval {
+			report.MaxPCRInterval = interval
+		}
+		if interval == 0 {
+			continue
+		}
+		rate := (cur.pos - prev.pos) * 8 * int64(time.Second) / int64(interval)
+		if report.MinRate == 0 || rate < report.MinRate {
+			report.MinRate = rate
+		}
+		if rate > report.MaxRate {
+			report.MaxRate = rate
+		}
+	}
+
+	first, last := self.pcrs[0], self.pcrs[len(self.pcrs)-1]
+	ticks := float64(pcrDiff(last.pcr, first.pcr))
+	bytes := float64(last.pos - first.pos)
+	if ticks == 0 {
+		return
+	}
+	report.Rate = int64(bytes * 8 * tsio.PCR_HZ / ticks)
+	for _, s := range self.pcrs {
+		expected := float64(s.pos-first.pos) * ticks / bytes
+		offset := math.Abs(float64(pcrDiff(s.pcr, first.pcr)) - expected)
+		if jitter := time.Duration(offset * 1e9 / tsio.PCR_HZ); jitter > report.MaxPCRJitter {
+			report.MaxPCRJitter = jitter
+		}
+	}
+	return
+}
+
+// Check reports the first way the stream fails CBR compliance at rate bits
+// per second. Measured rates may differ by tolerance parts per million.
+func (self ValidatorReport) Check(rate int64, tolerance int64) (err error) {
+	if self.PCRs < 2 {
+		err = fmt.Errorf("ts: %d PCRs found", self.PCRs)
+		return
+	}
+	if self.MaxPCRInterval > MaxPCRInterval {
+		err = fmt.Errorf("ts: PCR interval=%v exceeds %v", self.MaxPCRInterval, MaxPCRInterval)
+		return
+	}
+	if self.MaxPCRJitter > MaxPCRJitter {
+		err = fmt.Errorf("ts: PCR jitter=%v exceeds %v", self.MaxPCRJitter, MaxPCRJitter)
+		return
+	}
+	maxdiff := rate * tolerance / 1000000
+	for _, r := range []int64{self.Rate, self.MinRate, self.MaxRate} {
+		if r < rate-maxdiff || r > rate+maxdiff {
+			err = fmt.Errorf("ts: rate=%d differs from %d", r, rate)
+			return
+		}
+	}
+	return
+}
+
+// Validate reads a whole transport stream of 188 byte packets from r.
+func Validate(r io.Reader) (report ValidatorReport, err error) {
+	v := NewValidator()
+	if _, err = io.Copy(v, r); err != nil {
+		return
+	}
+	report = v.Report()
+	return
+}
@@ -0,0 +1,74 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCBR(t *testing.T) {
+	const rate = 2000000
+	streams := testStreams(t)
+
+	v := NewValidator()
+	m := NewMuxer(v)
+	m.MuxRate = rate
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	// about 500kbps of video and 80kbps of audio for 5s
+	for i := 0; i < 125; i++ {
+		size := 2000
+		if i%25 == 0 {
+			size = 10000
+		}
+		for idx := range streams {
+			if err := m.WritePacket(testPacket(idx, i, size/(idx*4+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := v.Report()
+	if err := report.Check(rate, 10); err != nil {
+		t.Errorf("%v, report %+v", err, report)
+	}
+	if report.NullPackets == 0 || report.PCRs < 100 {
+		t.Errorf("expected stuffing and a PCR every 30ms, report %+v", report)
+	}
+}
+
+func TestCBRTooLow(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMuxer(&b)
+	m.MuxRate = 500000
+	streams := testStreams(t)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	// 800kbps of video
+	for i := 0; i < 125; i++ {
+		if err := m.WritePacket(testPacket(0, i, 4000)); err != nil {
+			return
+		}
+	}
+	t.Error("expected an error for a payload above the mux rate")
+}
+
+func TestValidatorCheck(t *testing.T) {
+	// a VBR stream fails the check
+	var b bytes.Buffer
+	muxTestStream(t, &b, testStreams(t), 125)
+	report, err := Validate(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = report.Check(2000000, 10); err == nil {
+		t.Errorf("expected a VBR stream to fail, report %+v", report)
+	}
+}
@@ -5,13 +5,20 @@ package ts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec"
 	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/ac3parser"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/klvparser"
+	"github.com/teocci/go-stream-av/codec/mp3parser"
+	"github.com/teocci/go-stream-av/codec/opusparser"
 	"github.com/teocci/go-stream-av/format/ts/tsio"
 	"github.com/teocci/go-stream-av/utils/bits/pio"
 )
@@ -27,15 +34,69 @@ type Demuxer struct {
 	tsHDR   []byte
 
 	stage int
+
+	// ProgramNumber selects the program of a multi-program transport
+	// stream. Zero selects the first program listed in the PAT.
+	ProgramNumber uint16
+
+	program    uint16
+	pmtpid     uint16
+	patversion int
+	pmtversion int
+	psi        map[uint16][]byte
+
+	pktsize   int
+	synclosts int
+	pids      map[uint16]*pidState
+
+	pcr    time.Duration
+	haspcr bool
+
+	// HandleSpliceInfo is called with every SCTE-35 splice_info_section
+	// found on a PID the PMT announces with stream type 0x86.
+	// SpliceInfo.PTS is in the time base of the packets.
+	HandleSpliceInfo func(info tsio.SpliceInfo)
+
+	// DataStreams makes Streams include timed metadata streams such as
+	// KLV. They are left out by default, most muxers only take audio and
+	// video.
+	DataStreams bool
+
+	scte35pids []uint16
 }
 
 func NewDemuxer(r io.Reader) *Demuxer {
 	return &Demuxer{
-		tsHDR: make([]byte, 188),
-		r:     bufio.NewReaderSize(r, pio.RecommendBufioSize),
+		tsHDR:      make([]byte, 188),
+		r:          bufio.NewReaderSize(r, pio.RecommendBufioSize),
+		patversion: -1,
+		pmtversion: -1,
+		psi:        map[uint16][]byte{},
+		pids:       map[uint16]*pidState{},
 	}
 }
 
+// Programs returns the program numbers listed in the PAT.
+func (d *Demuxer) Programs() (programs []uint16, err error) {
+	for d.pat == nil {
+		if err = d.poll(); err != nil {
+			return
+		}
+	}
+	for _, entry := range d.pat.Entries {
+		if entry.ProgramNumber != 0 {
+			programs = append(programs, entry.ProgramNumber)
+		}
+	}
+	return
+}
+
+// PCR returns the last program clock reference seen on the PCR PID of
+// the selected program. ok is false until the first PCR arrives.
+func (d *Demuxer) PCR() (pcr time.Duration, ok bool) {
+	return d.pcr, d.haspcr
+}
+
 func (d *Demuxer) Streams() (streams []av.CodecData, err error) {
 	if err = d.probe(); err != nil {
 		return
@@ -98,39 +159,152 @@ func (d *Demuxer) poll() (err error) {
 	return
 }
 
-func (d *Demuxer) initPMT(payload []byte) (err error) {
-	var psiHDRLen int
-	var dataLen int
-	if _, _, psiHDRLen, dataLen, err = tsio.ParsePSI(payload); err != nil {
-		return
-	}
-	d.pmt = &tsio.PMT{}
-	if _, err = d.pmt.Unmarshal(payload[psiHDRLen : psiHDRLen+dataLen]); err != nil {
+func (d *Demuxer) initPMT(section []byte, hdrlen int, datalen int) (err error) {
+	pmt := &tsio.PMT{}
+	if _, err = pmt.Unmarshal(section[hdrlen : hdrlen+datalen]); err != nil {
 		return
 	}
+	d.pmt = pmt
 
-	d.streams = []*Stream{}
-	for i, info := range d.pmt.ElementaryStreamInfos {
+	var streams []*Stream
+	d.scte35pids = nil
+	for _, info := range d.pmt.ElementaryStreamInfos {
 		stream := &Stream{}
-		stream.idx = i
+		stream.idx = len(streams)
 		stream.demuxer = d
 		stream.pid = info.ElementaryPID
 		stream.streamType = info.StreamType
 		switch info.StreamType {
 		case tsio.ElementaryStreamTypeH264:
-			d.streams = append(d.streams, stream)
+			streams = append(streams, stream)
+		case tsio.ElementaryStreamTypeH265:
+			streams = append(streams, stream)
 		case tsio.ElementaryStreamTypeAdtsAAC:
-			d.streams = append(d.streams, stream)
+			streams = append(streams, stream)
+		case tsio.ElementaryStreamTypeMPEG1Audio, tsio.ElementaryStreamTypeMPEG2Audio:
+			streams = append(streams, stream)
+		case tsio.ElementaryStreamTypeAC3, tsio.ElementaryStreamTypeEAC3:
+			streams = append(streams, stream)
+		case tsio.ElementaryStreamTypePrivatePES:
+			if initPrivateStream(stream, info.Descriptors) && d.wantStream(stream) {
+				streams = append(streams, stream)
+			}
+		case tsio.ElementaryStreamTypeMetadata:
+			// synchronous metadata, KLV unless the descriptor says otherwise
+			if format := tsio.MetadataFormat(info.Descriptors); format == nil || bytes.Equal(format, tsio.RegistrationKLV) {
+				stream.CodecData = klvparser.NewCodecData()
+				if d.wantStream(stream) {
+					streams = append(streams, stream)
+				}
+			}
+		case tsio.ElementaryStreamTypeSCTE35:
+			d.scte35pids = append(d.scte35pids, info.ElementaryPID)
+		}
+	}
+
+	if d.stage == 0 {
+		d.streams = streams
+		return
+	}
+
+	// Streams() has been returned already: keep the index and codec data of
+	// every stream that survives the update and detach the ones that are
+	// gone. New streams are not added, their indexes would be out of range
+	// for the caller, so their packets are dropped.
+	keep := map[*Stream]bool{}
+	for _, stream := range streams {
+		for _, old := range d.streams {
+			if old.pid == stream.pid && old.streamType == stream.streamType {
+				keep[old] = true
+				break
+			}
+		}
+	}
+	for _, old := range d.streams {
+		if !keep[old] {
+			old.pid = nullPID
+			old.data = nil
 		}
 	}
 	return
 }
 
+// wantStream leaves out data streams unless DataStreams is set.
+func (d *Demuxer) wantStream(stream *Stream) bool {
+	return d.DataStreams || stream.CodecData == nil || !stream.CodecData.Type().IsData()
+}
+
+// initPrivateStream identifies a private PES stream by its descriptors.
+// AC-3 and E-AC-3 are mapped to their ATSC stream types, Opus, G.711 and
+// asynchronous KLV keep ElementaryStreamTypePrivatePES.
+func initPrivateStream(stream *Stream, descs []tsio.Descriptor) bool {
+	switch string(tsio.RegistrationFormat(descs)) {
+	case string(tsio.RegistrationOpus):
+		channels := 2
+		if desc, ok := tsio.FindDescriptor(descs, tsio.DescriptorTagExtension); ok {
+			if len(desc.Data) >= 2 && desc.Data[0] == tsio.ExtensionDescriptorTagOpus && desc.Data[1] == 1 {
+				channels = 1
+			}
+		}
+		layout := av.CH_STEREO
+		if channels == 1 {
+			layout = av.CH_MONO
+		}
+		stream.CodecData = codec.NewOpusCodecData(48000, layout)
+		return true
+	case string(tsio.RegistrationALAW), string(tsio.RegistrationULAW):
+		typ := av.PCM_ALAW
+		if bytes.Equal(tsio.RegistrationFormat(descs), tsio.RegistrationULAW) {
+			typ = av.PCM_MULAW
+		}
+		sampleRate, channels := tsio.ParseG711Registration(descs)
+		var layout av.ChannelLayout
+		switch channels {
+		case 1:
+			layout = av.CH_MONO
+		case 2:
+			layout = av.CH_STEREO
+		default:
+			return false
+		}
+		switch {
+		case sampleRate == 8000 && layout == av.CH_MONO && typ == av.PCM_ALAW:
+			stream.CodecData = codec.NewPCMAlawCodecData()
+		case sampleRate == 8000 && layout == av.CH_MONO:
+			stream.CodecData = codec.NewPCMMulawCodecData()
+		default:
+			stream.CodecData = codec.NewPCMCodecDataWithFormat(typ, sampleRate, layout, av.S16)
+		}
+		return true
+	case string(tsio.RegistrationKLV):
+		stream.CodecData = klvparser.NewCodecData()
+		return true
+	case string(tsio.RegistrationAC3):
+		stream.streamType = tsio.ElementaryStreamTypeAC3
+		return true
+	case string(tsio.RegistrationEAC3):
+		stream.streamType = tsio.ElementaryStreamTypeEAC3
+		return true
+	}
+
+	// DVB signals Dolby audio with descriptors only
+	if _, ok := tsio.FindDescriptor(descs, tsio.DescriptorTagAC3); ok {
+		stream.streamType = tsio.ElementaryStreamTypeAC3
+		return true
+	}
+	if _, ok := tsio.FindDescriptor(descs, tsio.DescriptorTagEAC3); ok {
+		stream.streamType = tsio.ElementaryStreamTypeEAC3
+		return true
+	}
+	return false
+}
+
 func (d *Demuxer) payloadEnd() (n int, err error) {
 	for _, stream := range d.streams {
-		var i int
-		if i, err = stream.payloadEnd(); err != nil {
-			return
+		i, perr := stream.payloadEnd()
+		if perr != nil {
+			d.pidState(stream.pid).errs.Payload++
+			stream.data = nil
 		}
 		n += i
 	}
@@ -138,49 +312,80 @@ func (d *Demuxer) payloadEnd() (n int, err error) {
 }
 
 func (d *Demuxer) readTSPacket() (err error) {
-	var HDRLen int
-	var pid uint16
-	var start bool
-	var isKeyFrame bool
-
+	if err = d.sync(); err != nil {
+		return
+	}
 	if _, err = io.ReadFull(d.r, d.tsHDR); err != nil {
 		return
 	}
+	if d.pktsize > len(d.tsHDR) {
+		// M2TS timestamp of the next packet or Reed-Solomon parity
+		if _, err = d.r.Discard(d.pktsize - len(d.tsHDR)); err == io.EOF {
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
 
-	if pid, start, isKeyFrame, HDRLen, err = tsio.ParseTSHeader(d.tsHDR); err != nil {
+	hdr, hdrLen, perr := tsio.ParseTSPacketHeader(d.tsHDR)
+	if perr != nil {
+		d.synclosts++
+		return
+	}
+	pid := uint16(hdr.PID)
+	if pid == nullPID {
 		return
 	}
-	payload := d.tsHDR[HDRLen:]
 
-	if d.pat == nil {
-		if pid == 0 {
-			var psiHDRLen int
-			var dataLen int
-			if _, _, psiHDRLen, dataLen, err = tsio.ParsePSI(payload); err != nil {
-				return
-			}
-			d.pat = &tsio.PAT{}
-			if _, err = d.pat.Unmarshal(payload[psiHDRLen : psiHDRLen+dataLen]); err != nil {
+	ps := d.pidState(pid)
+	if hdr.TransportError {
+		ps.errs.Transport++
+		return
+	}
+	dup, discontinuity := ps.checkContinuity(hdr)
+	if dup {
+		return
+	}
+	if hdr.HasPCR && d.pmt != nil && pid == d.pmt.PCRPID {
+		d.pcr = tsio.PCRToTime(tsio.PCRToUInt(hdr.PCR))
+		d.haspcr = true
+	}
+	if !hdr.HasPayload {
+		return
+	}
+	payload := d.tsHDR[hdrLen:]
+
+	switch {
+	case pid == tsio.PAT_PID:
+		if section, ok := d.assemblePSI(pid, hdr.PayloadUnitStart, discontinuity, payload); ok {
+			if err = d.handlePAT(section); err != nil {
 				return
 			}
 		}
-	} else if d.pmt == nil {
-		for _, entry := range d.pat.Entries {
-			if entry.ProgramMapPID == pid {
-				if err = d.initPMT(payload); err != nil {
-					return
-				}
-				break
-			}
+
+	case d.pmtpid != 0 && pid == d.pmtpid:
+		if section, ok := d.assemblePSI(pid, hdr.PayloadUnitStart, discontinuity, payload); ok {
+			d.handlePMT(section)
 		}
-	} else {
+
+	case d.isSCTE35(pid):
+		if section, ok := d.assemblePSI(pid, hdr.PayloadUnitStart, discontinuity, payload); ok {
+			d.handleSCTE35(pid, section)
+		}
+
+	case d.pmt != nil:
 		for _, stream := range d.streams {
 			if pid == stream.pid {
-				if stream.streamType == tsio.ElementaryStreamTypeAdtsAAC {
+				if discontinuity {
+					// the PES in progress lost data, do not emit it
+					stream.data = nil
+				}
+				isKeyFrame := hdr.RandomAccessIndicator
+				if !stream.isVideo() {
 					isKeyFrame = false
 				}
-				if err = stream.handleTSPacket(start, isKeyFrame, payload); err != nil {
-					return
+				if perr = stream.handleTSPacket(hdr.PayloadUnitStart, isKeyFrame, payload); perr != nil {
+					ps.errs.Payload++
 				}
 				break
 			}
@@ -190,6 +395,107 @@ func (d *Demuxer) readTSPacket() (err error) {
 	return
 }
 
+func (d *Demuxer) handlePAT(section []byte) (err error) {
+	hdr, hdrlen, datalen, perr := tsio.ParsePSIHeader(section)
+	if perr != nil || hdr.TableId != tsio.TableIdPAT || !tsio.VerifyPSI(section, hdrlen, datalen) {
+		d.pidState(tsio.PAT_PID).errs.Payload++
+		return
+	}
+	if !hdr.CurrentNext || int(hdr.Version) == d.patversion {
+		return
+	}
+
+	pat := &tsio.PAT{}
+	if _, perr = pat.Unmarshal(section[hdrlen : hdrlen+datalen]); perr != nil {
+		d.pidState(tsio.PAT_PID).errs.Payload++
+		return
+	}
+	d.pat = pat
+	d.patversion = int(hdr.Version)
+
+	var program, pmtpid uint16
+	for _, entry := range pat.Entries {
+		if entry.ProgramNumber == 0 {
+			continue
+		}
+		if d.ProgramNumber == 0 || entry.ProgramNumber == d.ProgramNumber {
+			program, pmtpid = entry.ProgramNumber, entry.ProgramMapPID
+			break
+		}
+	}
+	if pmtpid == 0 {
+		err = fmt.Errorf("ts: program %d not found in PAT", d.ProgramNumber)
+		return
+	}
+	if program != d.program || pmtpid != d.pmtpid {
+		d.program, d.pmtpid = program, pmtpid
+		d.pmtversion = -1
+	}
+	return
+}
+
+func (d *Demuxer) handlePMT(section []byte) {
+	hdr, hdrlen, datalen, err := tsio.ParsePSIHeader(section)
+	if err != nil || hdr.TableId != tsio.TableIdPMT || !tsio.VerifyPSI(section, hdrlen, datalen) {
+		d.pidState(d.pmtpid).errs.Payload++
+		return
+	}
+	// several programs may share one PMT PID
+	if hdr.TableExt != d.program {
+		return
+	}
+	if !hdr.CurrentNext || int(hdr.Version) == d.pmtversion {
+		return
+	}
+	if err = d.initPMT(section, hdrlen, datalen); err != nil {
+		d.pidState(d.pmtpid).errs.Payload++
+		return
+	}
+	d.pmtversion = int(hdr.Version)
+}
+
+func (d *Demuxer) isSCTE35(pid uint16) bool {
+	for _, p := range d.scte35pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Demuxer) handleSCTE35(pid uint16, section []byte) {
+	// skip pointer_field
+	info, err := tsio.ParseSpliceInfoSection(section[1+int(section[0]):])
+	if err != nil {
+		d.pidState(pid).errs.Payload++
+		return
+	}
+	if d.HandleSpliceInfo != nil {
+		d.HandleSpliceInfo(info)
+	}
+}
+
+// assemblePSI collects a PSI section that may span several TS packets.
+func (d *Demuxer) assemblePSI(pid uint16, start bool, discontinuity bool, payload []byte) (section []byte, ok bool) {
+	buf := d.psi[pid]
+	if start {
+		buf = append(buf[:0], payload...)
+	} else if buf != nil && !discontinuity {
+		buf = append(buf, payload...)
+	} else {
+		d.psi[pid] = nil
+		return
+	}
+
+	n, known := tsio.PSISectionLength(buf)
+	if known && len(buf) >= n {
+		section, ok = buf[:n], true
+		buf = nil
+	}
+	d.psi[pid] = buf
+	return
+}
+
 func (s *Stream) addPacket(payload []byte, timedelta time.Duration) {
 	dts := s.dts
 	pts := s.pts
@@ -252,6 +558,101 @@ func (s *Stream) payloadEnd() (n int, err error) {
 			payload = payload[framelen:]
 		}
 
+	case tsio.ElementaryStreamTypeMPEG1Audio, tsio.ElementaryStreamTypeMPEG2Audio:
+		delta := time.Duration(0)
+		for len(payload) >= mp3parser.HeaderLength {
+			var header mp3parser.FrameHeader
+			var framelen, samples int
+			if header, framelen, samples, err = mp3parser.ParseFrameHeader(payload); err != nil {
+				return
+			}
+			if framelen > len(payload) {
+				err = fmt.Errorf("ts: mp3 frame size=%d exceeds payload=%d", framelen, len(payload))
+				return
+			}
+			if s.CodecData == nil {
+				s.CodecData = mp3parser.CodecData{Header: header}
+			}
+			s.addPacket(payload[:framelen], delta)
+			n++
+			delta += time.Duration(samples) * time.Second / time.Duration(header.SampleRate)
+			payload = payload[framelen:]
+		}
+
+	case tsio.ElementaryStreamTypeAC3, tsio.ElementaryStreamTypeEAC3:
+		delta := time.Duration(0)
+		for len(payload) >= ac3parser.HeaderLength {
+			var header ac3parser.SyncFrameHeader
+			if header, err = ac3parser.ParseSyncFrameHeader(payload); err != nil {
+				return
+			}
+			// dependent E-AC-3 substreams belong to the preceding independent frame
+			size := header.FrameLength
+			for header.IsEAC3() && size+ac3parser.HeaderLength <= len(payload) {
+				next, perr := ac3parser.ParseSyncFrameHeader(payload[size:])
+				if perr != nil || next.StreamType != ac3parser.StreamTypeDependent {
+					break
+				}
+				size += next.FrameLength
+			}
+			if size > len(payload) {
+				err = fmt.Errorf("ts: ac3 frame size=%d exceeds payload=%d", size, len(payload))
+				return
+			}
+			if s.CodecData == nil {
+				s.CodecData = ac3parser.CodecData{Header: header}
+			}
+			s.addPacket(payload[:size], delta)
+			n++
+			delta += time.Duration(header.Samples) * time.Second / time.Duration(header.SampleRate)
+			payload = payload[size:]
+		}
+
+	case tsio.ElementaryStreamTypeMetadata:
+		var au []byte
+		for len(payload) > 0 {
+			var fragment uint8
+			var hdrlen, datalen int
+			if fragment, hdrlen, datalen, err = tsio.ParseMetadataAUCell(payload); err != nil {
+				return
+			}
+			// cell_fragment_indication: 11 complete, 10 first, 00 middle, 01 last
+			au = append(au, payload[hdrlen:hdrlen+datalen]...)
+			if fragment&0x1 != 0 {
+				s.addPacket(au, time.Duration(0))
+				n++
+				au = nil
+			}
+			payload = payload[hdrlen+datalen:]
+		}
+
+	case tsio.ElementaryStreamTypePrivatePES:
+		if typ := s.Type(); typ == av.KLV || typ == av.PCM_ALAW || typ == av.PCM_MULAW {
+			// one packet per PES
+			s.addPacket(payload, time.Duration(0))
+			n++
+			break
+		}
+
+		// Opus, see initPrivateStream
+		delta := time.Duration(0)
+		for len(payload) > 0 {
+			var hdrlen, size int
+			if hdrlen, size, err = tsio.ParseOpusControlHeader(payload); err != nil {
+				return
+			}
+			if hdrlen+size > len(payload) {
+				err = fmt.Errorf("ts: opus packet size=%d exceeds payload=%d", size, len(payload)-hdrlen)
+				return
+			}
+			data := payload[hdrlen : hdrlen+size]
+			s.addPacket(data, delta)
+			n++
+			dur, _ := opusparser.PacketDuration(data)
+			delta += dur
+			payload = payload[hdrlen+size:]
+		}
+
 	case tsio.ElementaryStreamTypeH264:
 		nalus, _ := h264parser.SplitNALUs(payload)
 		var sps, pps []byte
@@ -279,6 +680,46 @@ func (s *Stream) payloadEnd() (n int, err error) {
 				return
 			}
 		}
+
+	case tsio.ElementaryStreamTypeH265:
+		// one PES carries one access unit, which becomes one packet
+		nalus, _ := h265parser.SplitNALUs(payload)
+		var vps, sps, pps []byte
+		var b []byte
+		for _, nalu := range nalus {
+			if len(nalu) < 2 {
+				continue
+			}
+			switch typ := h265NALUType(nalu); {
+			case typ == h265parser.NAL_UNIT_VPS:
+				vps = nalu
+			case typ == h265parser.NAL_UNIT_SPS:
+				sps = nalu
+			case typ == h265parser.NAL_UNIT_PPS:
+				pps = nalu
+			case typ == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER:
+			default:
+				if typ >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && typ <= h265parser.NAL_UNIT_RESERVED_IRAP_VCL23 {
+					s.isKeyFrame = true
+				}
+				// raw nalu to avcc
+				hdr := make([]byte, 4)
+				pio.PutU32BE(hdr, uint32(len(nalu)))
+				b = append(b, hdr...)
+				b = append(b, nalu...)
+			}
+		}
+
+		if s.CodecData == nil && len(vps) > 0 && len(sps) > 0 && len(pps) > 0 {
+			if s.CodecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps); err != nil {
+				return
+			}
+		}
+
+		if len(b) > 0 {
+			s.addPacket(b, time.Duration(0))
+			n++
+		}
 	}
 
 	return
@@ -286,11 +727,14 @@ func (s *Stream) payloadEnd() (n int, err error) {
 
 func (s *Stream) handleTSPacket(start bool, isKeyFrame bool, payload []byte) (err error) {
 	if start {
+		// a broken PES must not stop the next one from being read
 		if _, err = s.payloadEnd(); err != nil {
-			return
+			s.data = nil
 		}
 		var hdrLen int
-		if hdrLen, _, s.dataLen, s.pts, s.dts, err = tsio.ParsePESHeader(payload); err != nil {
+		var perr error
+		if hdrLen, _, s.dataLen, s.pts, s.dts, perr = tsio.ParsePESHeader(payload); perr != nil {
+			err = perr
 			return
 		}
 		s.isKeyFrame = isKeyFrame
@@ -300,7 +744,7 @@ func (s *Stream) handleTSPacket(start bool, isKeyFrame bool, payload []byte) (er
 			s.data = make([]byte, 0, s.dataLen)
 		}
 		s.data = append(s.data, payload[hdrLen:]...)
-	} else {
+	} else if s.data != nil {
 		s.data = append(s.data, payload...)
 	}
 	return
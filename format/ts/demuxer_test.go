@@ -0,0 +1,349 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec/aacparser"
+	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/klvparser"
+	"github.com/teocci/go-stream-av/format/ts/tsio"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps, _ := hex.DecodeString("6742c01ed9005005bb011000000300100000030320f162e480")
+	pps, _ := hex.DecodeString("68cb8cb2")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// testPacket returns packet i of stream idx, a keyframe every 25 frames.
+func testPacket(idx, i int, size int) av.Packet {
+	pkt := av.Packet{
+		Idx:  int8(idx),
+		Time: time.Duration(i) * 40 * time.Millisecond,
+		Data: make([]byte, size),
+	}
+	for j := range pkt.Data {
+		pkt.Data[j] = byte(i + j)
+	}
+	if idx == 0 {
+		// one length prefixed NAL unit
+		pio.PutU32BE(pkt.Data, uint32(size-4))
+		pkt.Data[4] = 0x41
+		if i%25 == 0 {
+			pkt.IsKeyFrame = true
+			pkt.Data[4] = 0x65
+		}
+	}
+	return pkt
+}
+
+func muxTestStream(t *testing.T, w io.Writer, streams []av.CodecData, count int) {
+	m := NewMuxer(w)
+	if err := m.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		for idx := range streams {
+			if err := m.WritePacket(testPacket(idx, i, 200)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataStreams(t *testing.T) {
+	streams := append(testStreams(t), klvparser.NewCodecData())
+	var b bytes.Buffer
+	muxTestStream(t, &b, streams, 10)
+
+	for _, data := range []bool{false, true} {
+		d := NewDemuxer(bytes.NewReader(b.Bytes()))
+		d.DataStreams = data
+		got, err := d.Streams()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 2
+		if data {
+			want = 3
+		}
+		if len(got) != want {
+			t.Fatalf("DataStreams=%v: got %d streams, want %d", data, len(got), want)
+		}
+		if data && got[2].Type() != av.KLV {
+			t.Errorf("DataStreams=%v: stream 2 is %v, want KLV", data, got[2].Type())
+		}
+
+		n := make([]int, 3)
+		for {
+			pkt, err := d.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if int(pkt.Idx) >= len(got) {
+				t.Fatalf("DataStreams=%v: packet of stream %d", data, pkt.Idx)
+			}
+			n[pkt.Idx]++
+		}
+		if n[0] != 10 || n[1] != 10 || (data && n[2] != 10) {
+			t.Errorf("DataStreams=%v: got %v packets per stream", data, n)
+		}
+	}
+}
+
+// psiPacket returns a TS packet holding a PSI section of the given version.
+func psiPacket(pid uint16, tableid uint8, tableext uint16, version uint8, data []byte) []byte {
+	section := make([]byte, tsio.PSIHeaderLength+len(data)+4)
+	copy(section[tsio.PSIHeaderLength:], data)
+	n := tsio.FillPSI(section, tableid, tableext, len(data))
+	section[6] = 0x3<<6 | version<<1 | 1
+	// CRC-32/MPEG-2 of table_id up to the data
+	crc := uint32(0xffffffff)
+	for _, c := range section[1 : n-4] {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	pio.PutU32BE(section[n-4:], crc)
+	var b bytes.Buffer
+	_ = tsio.NewTSWriter(pid).WritePackets(&b, [][]byte{section[:n]}, 0, false, true)
+	return b.Bytes()
+}
+
+func patPacket(version uint8, entries ...tsio.PATEntry) []byte {
+	pat := tsio.PAT{Entries: entries}
+	data := make([]byte, pat.Len())
+	pat.Marshal(data)
+	return psiPacket(tsio.PAT_PID, tsio.TableIdPAT, tsio.TableExtPAT, version, data)
+}
+
+func pmtPacket(pid, program uint16, version uint8, pmt tsio.PMT) []byte {
+	data := make([]byte, pmt.Len())
+	pmt.Marshal(data)
+	return psiPacket(pid, tsio.TableIdPMT, program, version, data)
+}
+
+func TestPSIVersions(t *testing.T) {
+	var b bytes.Buffer
+	muxTestStream(t, &b, testStreams(t), 20)
+	pkts := tsPackets(b.Bytes())
+	video := tsio.ElementaryStreamInfo{StreamType: tsio.ElementaryStreamTypeH264, ElementaryPID: 0x100}
+	program := tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID}
+
+	values := []struct {
+		Name   string
+		Tables [][]byte
+		Audio  bool // audio packets go on after the tables
+	}{
+		{"same PMT version", [][]byte{
+			pmtPacket(tsio.PMT_PID, 1, 0, tsio.PMT{PCRPID: 0x100, ElementaryStreamInfos: []tsio.ElementaryStreamInfo{video}}),
+		}, true},
+		{"new PMT version", [][]byte{
+			pmtPacket(tsio.PMT_PID, 1, 1, tsio.PMT{PCRPID: 0x100, ElementaryStreamInfos: []tsio.ElementaryStreamInfo{video}}),
+		}, false},
+		{"PMT of another program", [][]byte{
+			pmtPacket(tsio.PMT_PID, 2, 1, tsio.PMT{PCRPID: 0x100, ElementaryStreamInfos: []tsio.ElementaryStreamInfo{video}}),
+		}, true},
+		{"same PAT version", [][]byte{
+			patPacket(0, tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1001}),
+			pmtPacket(0x1001, 1, 0, tsio.PMT{PCRPID: 0x100, ElementaryStreamInfos: []tsio.ElementaryStreamInfo{video}}),
+		}, true},
+		// the PMT version starts over on the new PID
+		{"new PAT version", [][]byte{
+			patPacket(1, tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1001}),
+			pmtPacket(0x1001, 1, 0, tsio.PMT{PCRPID: 0x100, ElementaryStreamInfos: []tsio.ElementaryStreamInfo{video}}),
+		}, false},
+		{"new PAT version, same program", [][]byte{
+			patPacket(1, program),
+		}, true},
+	}
+	for _, ex := range values {
+		// the tables go on from the continuity counters of their PIDs
+		var stream []byte
+		cc := map[uint16]byte{}
+		for i, pkt := range pkts {
+			if i == len(pkts)/2 {
+				for _, table := range ex.Tables {
+					table = append([]byte{}, table...)
+					pid := pio.U16BE(table[1:]) & 0x1fff
+					table[3] = table[3]&0xf0 | cc[pid]
+					cc[pid] = (cc[pid] + 1) & 0xf
+					stream = append(stream, table...)
+				}
+			}
+			pid := pio.U16BE(pkt[1:]) & 0x1fff
+			cc[pid] = (pkt[3] + 1) & 0xf
+			stream = append(stream, pkt...)
+		}
+		d, got := demuxAll(t, stream, nil)
+		var video, audioBefore, audioAfter int
+		for _, pkt := range got {
+			switch {
+			case pkt.Idx == 0:
+				video++
+			case video < 10:
+				audioBefore++
+			default:
+				audioAfter++
+			}
+		}
+		if video != 20 || audioBefore == 0 || (audioAfter != 0) != ex.Audio {
+			t.Errorf("%s: %d video packets, %d audio packets before the middle and %d after", ex.Name, video, audioBefore, audioAfter)
+		}
+		for pid, errs := range d.Errors() {
+			if errs != (PIDErrors{}) {
+				t.Errorf("%s: PID %#x: %+v", ex.Name, pid, errs)
+			}
+		}
+	}
+}
+
+// multiProgramStream carries the test streams as program 1 and an audio
+// stream 100s later as program 2, on PID 0x200 with its own PMT PID.
+func multiProgramStream(t *testing.T) (b []byte, audio []av.Packet) {
+	var one, two bytes.Buffer
+	muxTestStream(t, &one, testStreams(t), 20)
+	m := NewMuxer(&two)
+	if err := m.WriteHeader(testStreams(t)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		pkt := testPacket(1, i, 50)
+		pkt.Idx = 0
+		pkt.Time += 100 * time.Second
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		audio = append(audio, pkt)
+	}
+	if err := m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = patPacket(0,
+		tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID},
+		tsio.PATEntry{ProgramNumber: 2, ProgramMapPID: 0x1001},
+	)
+	b = append(b, pmtPacket(0x1001, 2, 0, tsio.PMT{
+		PCRPID: 0x200,
+		ElementaryStreamInfos: []tsio.ElementaryStreamInfo{
+			{StreamType: tsio.ElementaryStreamTypeAdtsAAC, ElementaryPID: 0x200},
+		},
+	})...)
+	var es [][]byte
+	for _, pkt := range tsPackets(two.Bytes()) {
+		if pio.U16BE(pkt[1:])&0x1fff == 0x100 {
+			pkt[1] = pkt[1]&0xe0 | 0x02
+			es = append(es, pkt)
+		}
+	}
+	for _, pkt := range tsPackets(one.Bytes()) {
+		if pio.U16BE(pkt[1:])&0x1fff == tsio.PAT_PID {
+			continue
+		}
+		b = append(b, pkt...)
+		if len(es) != 0 {
+			b = append(b, es[0]...)
+			es = es[1:]
+		}
+	}
+	for _, pkt := range es {
+		b = append(b, pkt...)
+	}
+	return
+}
+
+func TestProgramSelection(t *testing.T) {
+	b, audio := multiProgramStream(t)
+
+	d := NewDemuxer(bytes.NewReader(b))
+	programs, err := d.Programs()
+	if err != nil || len(programs) != 2 || programs[0] != 1 || programs[1] != 2 {
+		t.Fatalf("programs %v: %v", programs, err)
+	}
+
+	values := []struct {
+		Program uint16
+		Streams int
+		Packets int
+		PCRMin  time.Duration
+	}{
+		{0, 2, 40, 0},
+		{1, 2, 40, 0},
+		{2, 1, 20, 100 * time.Second},
+	}
+	for _, ex := range values {
+		d := NewDemuxer(bytes.NewReader(b))
+		d.ProgramNumber = ex.Program
+		if _, ok := d.PCR(); ok {
+			t.Errorf("program %d: PCR before the first packet", ex.Program)
+		}
+		streams, err := d.Streams()
+		if err != nil || len(streams) != ex.Streams {
+			t.Fatalf("program %d: %d streams: %v", ex.Program, len(streams), err)
+		}
+		var got []av.Packet
+		for {
+			pkt, err := d.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, pkt)
+			// the PCR is read from the PCR PID of the program only
+			if pcr, ok := d.PCR(); !ok || pcr < ex.PCRMin || pcr > ex.PCRMin+10*time.Second {
+				t.Fatalf("program %d: PCR %s %v", ex.Program, pcr, ok)
+			}
+		}
+		if len(got) != ex.Packets {
+			t.Errorf("program %d: got %d packets, want %d", ex.Program, len(got), ex.Packets)
+		}
+		if ex.Program == 2 {
+			// the muxer delays timestamps by a second
+			for i := range got {
+				got[i].Time -= time.Second
+			}
+			if !samePackets(got, audio) {
+				t.Errorf("program 2: unexpected packets")
+			}
+		}
+	}
+
+	d = NewDemuxer(bytes.NewReader(b))
+	d.ProgramNumber = 3
+	if _, err = d.Streams(); err == nil {
+		t.Error("expected an error for a program that is not in the PAT")
+	}
+}
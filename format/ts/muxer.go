@@ -4,17 +4,24 @@
 package ts
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"time"
 
 	"github.com/teocci/go-stream-av/av"
 	"github.com/teocci/go-stream-av/codec/aacparser"
 	"github.com/teocci/go-stream-av/codec/h264parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
 	"github.com/teocci/go-stream-av/format/ts/tsio"
 )
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC}
+var CodecTypes = []av.CodecType{
+	av.H264, av.H265,
+	av.AAC, av.OPUS, av.MP3, av.AC3, av.EAC3, av.PCM_ALAW, av.PCM_MULAW,
+	av.KLV,
+}
 
 type Muxer struct {
 	w       io.Writer
@@ -22,14 +29,31 @@ type Muxer struct {
 
 	PaddingToMakeCounterCont bool
 
+	// SCTE35PID enables WriteSpliceInfo. It must be set before WriteHeader
+	// so that the PMT announces the cue stream.
+	SCTE35PID uint16
+
+	// MuxRate enables constant bitrate output in bits per second: PCRs at
+	// most PCRInterval apart, PAT/PMT every PSIInterval and null packet
+	// stuffing. Packets leave MuxDelay ahead of their DTS, WritePacket
+	// fails when one can not leave before its DTS. These must be set
+	// before WriteHeader, zero intervals and delay take the defaults.
+	MuxRate     int64
+	MuxDelay    time.Duration
+	PCRInterval time.Duration
+	PSIInterval time.Duration
+	cbr         *cbrWriter
+
 	psidata []byte
 	peshdr  []byte
 	tshdr   []byte
 	adtshdr []byte
+	opushdr []byte
 	datav   [][]byte
 	nalus   [][]byte
 
 	tswpat, tswpmt *tsio.TSWriter
+	tswscte35      *tsio.TSWriter
 }
 
 func NewMuxer(w io.Writer) *Muxer {
@@ -39,6 +63,7 @@ func NewMuxer(w io.Writer) *Muxer {
 		peshdr:  make([]byte, tsio.MaxPESHeaderLength),
 		tshdr:   make([]byte, tsio.MaxTSHeaderLength),
 		adtshdr: make([]byte, aacparser.ADTSHeaderLength),
+		opushdr: make([]byte, tsio.MaxOpusControlHeaderLength),
 		nalus:   make([][]byte, 16),
 		datav:   make([][]byte, 16),
 		tswpmt:  tsio.NewTSWriter(tsio.PMT_PID),
@@ -91,25 +116,49 @@ func (self *Muxer) WriteTrailer() (err error) {
 }
 
 func (self *Muxer) SetWriter(w io.Writer) {
+	if self.cbr != nil {
+		self.cbr.w = w
+		return
+	}
 	self.w = w
 	return
 }
 
+func (self *Muxer) pcrPID() uint16 {
+	return 0x100
+}
+
 func (self *Muxer) WritePATPMT() (err error) {
 	pat := tsio.PAT{
 		Entries: []tsio.PATEntry{
 			{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID},
 		},
 	}
+	// in CBR mode the tables are kept to be repeated
+	w := self.w
+	var psibuf *bytes.Buffer
+	if self.cbr != nil {
+		psibuf = &bytes.Buffer{}
+		w = psibuf
+	}
+
 	patlen := pat.Marshal(self.psidata[tsio.PSIHeaderLength:])
 	n := tsio.FillPSI(self.psidata, tsio.TableIdPAT, tsio.TableExtPAT, patlen)
 	self.datav[0] = self.psidata[:n]
-	if err = self.tswpat.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
+	if err = self.tswpat.WritePackets(w, self.datav[:1], 0, false, true); err != nil {
 		return
 	}
 
+	// keep the PMT in stream order so that a demuxer assigns the same indexes
+	idxs := make([]int, 0, len(self.streams))
+	for idx := range self.streams {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
 	var elemStreams []tsio.ElementaryStreamInfo
-	for _, stream := range self.streams {
+	for _, idx := range idxs {
+		stream := self.streams[idx]
 		switch stream.Type() {
 		case av.AAC:
 			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
@@ -121,13 +170,85 @@ func (self *Muxer) WritePATPMT() (err error) {
 				StreamType:    tsio.ElementaryStreamTypeH264,
 				ElementaryPID: stream.pid,
 			})
+		case av.H265:
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypeH265,
+				ElementaryPID: stream.pid,
+			})
+		case av.OPUS:
+			channels := stream.CodecData.(av.AudioCodecData).ChannelLayout().Count()
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypePrivatePES,
+				ElementaryPID: stream.pid,
+				Descriptors: []tsio.Descriptor{
+					{Tag: tsio.DescriptorTagRegistration, Data: tsio.RegistrationOpus},
+					{Tag: tsio.DescriptorTagExtension, Data: []byte{tsio.ExtensionDescriptorTagOpus, uint8(channels)}},
+				},
+			})
+		case av.MP3:
+			streamType := uint8(tsio.ElementaryStreamTypeMPEG1Audio)
+			if stream.CodecData.(av.AudioCodecData).SampleRate() < 32000 {
+				streamType = tsio.ElementaryStreamTypeMPEG2Audio
+			}
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    streamType,
+				ElementaryPID: stream.pid,
+			})
+		case av.AC3:
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypeAC3,
+				ElementaryPID: stream.pid,
+				Descriptors: []tsio.Descriptor{
+					{Tag: tsio.DescriptorTagRegistration, Data: tsio.RegistrationAC3},
+				},
+			})
+		case av.EAC3:
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypeEAC3,
+				ElementaryPID: stream.pid,
+				Descriptors: []tsio.Descriptor{
+					{Tag: tsio.DescriptorTagRegistration, Data: tsio.RegistrationEAC3},
+				},
+			})
+		case av.PCM_ALAW, av.PCM_MULAW:
+			format := tsio.RegistrationALAW
+			if stream.Type() == av.PCM_MULAW {
+				format = tsio.RegistrationULAW
+			}
+			acd := stream.CodecData.(av.AudioCodecData)
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypePrivatePES,
+				ElementaryPID: stream.pid,
+				Descriptors: []tsio.Descriptor{
+					{Tag: tsio.DescriptorTagRegistration, Data: tsio.G711Registration(format, acd.SampleRate(), acd.ChannelLayout().Count())},
+				},
+			})
+		case av.KLV:
+			// asynchronous KLV, SMPTE RP 217 / MISB ST 1402
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypePrivatePES,
+				ElementaryPID: stream.pid,
+				Descriptors: []tsio.Descriptor{
+					{Tag: tsio.DescriptorTagRegistration, Data: tsio.RegistrationKLV},
+				},
+			})
 		}
 	}
 
 	pmt := tsio.PMT{
-		PCRPID:                0x100,
+		PCRPID:                self.pcrPID(),
 		ElementaryStreamInfos: elemStreams,
 	}
+	if self.tswscte35 != nil {
+		pmt.ProgramDescriptors = append(pmt.ProgramDescriptors, tsio.Descriptor{
+			Tag:  tsio.DescriptorTagRegistration,
+			Data: tsio.RegistrationSCTE35,
+		})
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    tsio.ElementaryStreamTypeSCTE35,
+			ElementaryPID: self.SCTE35PID,
+		})
+	}
 	pmtlen := pmt.Len()
 	if pmtlen+tsio.PSIHeaderLength > len(self.psidata) {
 		err = fmt.Errorf("ts: pmt too large")
@@ -136,15 +257,30 @@ func (self *Muxer) WritePATPMT() (err error) {
 	pmt.Marshal(self.psidata[tsio.PSIHeaderLength:])
 	n = tsio.FillPSI(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, pmtlen)
 	self.datav[0] = self.psidata[:n]
-	if err = self.tswpmt.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
+	if err = self.tswpmt.WritePackets(w, self.datav[:1], 0, false, true); err != nil {
 		return
 	}
 
+	if psibuf != nil {
+		self.cbr.setPSI(psibuf.Bytes())
+		if _, err = self.w.Write(psibuf.Bytes()); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	self.streams = map[int]*Stream{}
+	if self.SCTE35PID != 0 {
+		self.tswscte35 = tsio.NewTSWriter(self.SCTE35PID)
+	}
+	if self.MuxRate != 0 && self.cbr == nil {
+		if err = self.startCBR(); err != nil {
+			return
+		}
+	}
 
 	for idx, stream := range streams {
 		if err = self.newStream(idx, stream); err != nil {
@@ -158,6 +294,26 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	return
 }
 
+// WriteSpliceInfo writes an SCTE-35 cue on SCTE35PID. Splice times are in
+// the time base of the packets given to WritePacket.
+func (self *Muxer) WriteSpliceInfo(info tsio.SpliceInfo) (err error) {
+	if self.tswscte35 == nil {
+		err = fmt.Errorf("ts: SCTE35PID is not set")
+		return
+	}
+	// same offset WritePacket applies to timestamps
+	info.PTSAdjustment += time.Second
+
+	b := make([]byte, 1+info.Len())
+	b[0] = 0 // pointer_field
+	info.Marshal(b[1:])
+	self.datav[0] = b
+	if err = self.tswscte35.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
+		return
+	}
+	return
+}
+
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 	var stream *Stream = nil
 
@@ -169,6 +325,12 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 
 	pkt.Time += time.Second
 
+	if self.cbr != nil {
+		if err = self.cbr.fill(pkt.Time); err != nil {
+			return
+		}
+	}
+
 	switch stream.Type() {
 	case av.AAC:
 		codec := stream.CodecData.(aacparser.CodecData)
@@ -182,6 +344,41 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 			return
 		}
 
+	case av.OPUS:
+		hdrlen := tsio.FillOpusControlHeader(self.opushdr, len(pkt.Data))
+		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdPrivateData1, hdrlen+len(pkt.Data), pkt.Time, 0)
+		self.datav[0] = self.peshdr[:n]
+		self.datav[1] = self.opushdr[:hdrlen]
+		self.datav[2] = pkt.Data
+
+		if err = stream.tsw.WritePackets(self.w, self.datav[:3], pkt.Time, true, false); err != nil {
+			return
+		}
+
+	case av.MP3, av.AC3, av.EAC3, av.PCM_ALAW, av.PCM_MULAW:
+		// frames are carried as they are, one or more per PES
+		streamid := uint8(tsio.StreamIdMP3)
+		switch stream.Type() {
+		case av.AC3, av.EAC3, av.PCM_ALAW, av.PCM_MULAW:
+			streamid = tsio.StreamIdPrivateData1
+		}
+		n := tsio.FillPESHeader(self.peshdr, streamid, len(pkt.Data), pkt.Time, 0)
+		self.datav[0] = self.peshdr[:n]
+		self.datav[1] = pkt.Data
+
+		if err = stream.tsw.WritePackets(self.w, self.datav[:2], pkt.Time, true, false); err != nil {
+			return
+		}
+
+	case av.KLV:
+		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdPrivateData1, len(pkt.Data), pkt.Time, 0)
+		self.datav[0] = self.peshdr[:n]
+		self.datav[1] = pkt.Data
+
+		if err = stream.tsw.WritePackets(self.w, self.datav[:2], 0, false, false); err != nil {
+			return
+		}
+
 	case av.H264:
 		codec := stream.CodecData.(h264parser.CodecData)
 
@@ -211,7 +408,62 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 		if err = stream.tsw.WritePackets(self.w, datav, pkt.Time, pkt.IsKeyFrame, false); err != nil {
 			return
 		}
+
+	case av.H265:
+		codec := stream.CodecData.(h265parser.CodecData)
+
+		pktnalus, _ := h265parser.SplitNALUs(pkt.Data)
+		irap := pkt.IsKeyFrame
+		hasps := false
+		for _, nalu := range pktnalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch typ := h265NALUType(nalu); {
+			case typ >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && typ <= h265parser.NAL_UNIT_RESERVED_IRAP_VCL23:
+				irap = true
+			case typ == h265parser.NAL_UNIT_VPS:
+				hasps = true
+			}
+		}
+
+		// every IRAP access unit carries its parameter sets so that a
+		// decoder can join the stream at any random access point
+		nalus := self.nalus[:0]
+		if irap && !hasps {
+			nalus = append(nalus, codec.VPS())
+			nalus = append(nalus, codec.SPS())
+			nalus = append(nalus, codec.PPS())
+		}
+		for _, nalu := range pktnalus {
+			if len(nalu) == 0 || h265NALUType(nalu) == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER {
+				continue
+			}
+			nalus = append(nalus, nalu)
+		}
+
+		datav := self.datav[:1]
+		datav = append(datav, h265AUDBytes)
+		for _, nalu := range nalus {
+			datav = append(datav, h265parser.StartCodeBytes)
+			datav = append(datav, nalu)
+		}
+
+		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH265, -1, pkt.Time+pkt.CompositionTime, pkt.Time)
+		datav[0] = self.peshdr[:n]
+
+		if err = stream.tsw.WritePackets(self.w, datav, pkt.Time, irap, false); err != nil {
+			return
+		}
 	}
 
 	return
 }
+
+// h265AUDBytes is an HEVC access unit delimiter (nal_unit_type 35,
+// pic_type 2) prefixed with a start code.
+var h265AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50}
+
+func h265NALUType(nalu []byte) int {
+	return int(nalu[0]>>1) & 0x3f
+}
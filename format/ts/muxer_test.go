@@ -0,0 +1,312 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/codec"
+	"github.com/teocci/go-stream-av/codec/ac3parser"
+	"github.com/teocci/go-stream-av/codec/h265parser"
+	"github.com/teocci/go-stream-av/codec/mp3parser"
+	"github.com/teocci/go-stream-av/format/ts/tsio"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+var (
+	hevcVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0x95, 0x98, 0x09}
+	hevcSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0x96, 0x56, 0x6a, 0x24, 0xca, 0xe0, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x01, 0xe0, 0x80}
+	hevcPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+// hevcNALU returns a NAL unit of type typ with data that holds no start code.
+func hevcNALU(typ int, size int, seed byte) []byte {
+	nalu := []byte{byte(typ << 1), 1}
+	for i := 0; i < size; i++ {
+		nalu = append(nalu, seed+byte(i)|0x80)
+	}
+	return nalu
+}
+
+// avcc length prefixes NAL units.
+func avcc(nalus ...[]byte) (b []byte) {
+	for _, nalu := range nalus {
+		b = append(b, 0, 0, 0, 0)
+		pio.PutU32BE(b[len(b)-4:], uint32(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return
+}
+
+// pesPayloads collects the elementary stream data of the PES packets on pid.
+func pesPayloads(t *testing.T, b []byte, pid uint16) (es [][]byte) {
+	t.Helper()
+	var pes []byte
+	flush := func() {
+		if pes == nil {
+			return
+		}
+		hdrlen, _, _, _, _, err := tsio.ParsePESHeader(pes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, pes[hdrlen:])
+	}
+	for _, pkt := range tsPackets(b) {
+		hdr, hdrlen, err := tsio.ParseTSPacketHeader(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint16(hdr.PID) != pid || !hdr.HasPayload {
+			continue
+		}
+		if hdr.PayloadUnitStart {
+			flush()
+			pes = nil
+		}
+		pes = append(pes, pkt[hdrlen:]...)
+	}
+	flush()
+	return
+}
+
+func TestH265RoundTrip(t *testing.T) {
+	cd, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(hevcVPS, hevcSPS, hevcPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		trail = h265parser.NAL_UNIT_CODED_SLICE_TRAIL_R
+		idr   = h265parser.NAL_UNIT_CODED_SLICE_IDR_W_RADL
+		cra   = h265parser.NAL_UNIT_CODED_SLICE_CRA
+		aud   = h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER
+		sei   = h265parser.NAL_UNIT_PREFIX_SEI
+	)
+	values := []struct {
+		Key    bool
+		NALUs  [][]byte
+		Slices [][]byte // what the demuxer returns
+		IRAP   bool
+	}{
+		{true, [][]byte{hevcNALU(idr, 300, 1)}, nil, true},
+		{false, [][]byte{hevcNALU(trail, 50, 2)}, nil, false},
+		// an access unit delimiter of the packet is not repeated
+		{false, [][]byte{{aud << 1, 1, 0x50}, hevcNALU(trail, 50, 3)}, [][]byte{hevcNALU(trail, 50, 3)}, false},
+		{false, [][]byte{hevcNALU(sei, 10, 4), hevcNALU(trail, 50, 5), hevcNALU(trail, 50, 6)}, nil, false},
+		// a CRA picture not flagged as a keyframe is still a random access point
+		{false, [][]byte{hevcNALU(cra, 200, 7)}, nil, true},
+		// parameter sets already in the packet are not added again
+		{true, [][]byte{hevcVPS, hevcSPS, hevcPPS, hevcNALU(idr, 200, 8)}, [][]byte{hevcNALU(idr, 200, 8)}, true},
+	}
+
+	var b bytes.Buffer
+	m := NewMuxer(&b)
+	if err = m.WriteHeader([]av.CodecData{cd}); err != nil {
+		t.Fatal(err)
+	}
+	for i, ex := range values {
+		pkt := av.Packet{IsKeyFrame: ex.Key, Time: time.Duration(i) * 40 * time.Millisecond, Data: avcc(ex.NALUs...)}
+		if err = m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	es := pesPayloads(t, b.Bytes(), 0x100)
+	if len(es) != len(values) {
+		t.Fatalf("%d PES packets, want %d", len(es), len(values))
+	}
+	for i, ex := range values {
+		if !bytes.HasPrefix(es[i], h265AUDBytes) {
+			t.Errorf("access unit %d does not start with an AUD: %x", i, es[i][:8])
+		}
+		nalus, _ := h265parser.SplitNALUs(es[i])
+		var types []int
+		for _, nalu := range nalus {
+			types = append(types, h265NALUType(nalu))
+		}
+		want := []int{aud}
+		if ex.IRAP {
+			want = append(want, h265parser.NAL_UNIT_VPS, h265parser.NAL_UNIT_SPS, h265parser.NAL_UNIT_PPS)
+		}
+		for _, nalu := range ex.NALUs {
+			if typ := h265NALUType(nalu); typ != aud && !(ex.IRAP && typ >= h265parser.NAL_UNIT_VPS && typ <= h265parser.NAL_UNIT_PPS) {
+				want = append(want, typ)
+			}
+		}
+		if len(types) != len(want) {
+			t.Errorf("access unit %d: NAL unit types %v, want %v", i, types, want)
+			continue
+		}
+		for j := range types {
+			if types[j] != want[j] {
+				t.Errorf("access unit %d: NAL unit types %v, want %v", i, types, want)
+				break
+			}
+		}
+	}
+
+	d, pkts := demuxAll(t, b.Bytes(), nil)
+	if len(d.pmt.ElementaryStreamInfos) != 1 || d.pmt.ElementaryStreamInfos[0].StreamType != 0x24 {
+		t.Errorf("unexpected PMT %+v", d.pmt)
+	}
+	streams, _ := d.Streams()
+	if got, ok := streams[0].(h265parser.CodecData); !ok || !bytes.Equal(got.SPS(), hevcSPS) || got.Width() != cd.Width() {
+		t.Errorf("unexpected codec data %#v", streams[0])
+	}
+	if len(pkts) != len(values) {
+		t.Fatalf("%d packets, want %d", len(pkts), len(values))
+	}
+	for i, ex := range values {
+		slices := ex.Slices
+		if slices == nil {
+			slices = ex.NALUs
+		}
+		pkt := pkts[i]
+		if pkt.IsKeyFrame != ex.IRAP || pkt.Time != time.Duration(i)*40*time.Millisecond+time.Second || !bytes.Equal(pkt.Data, avcc(slices...)) {
+			t.Errorf("packet %d: key=%v at %s %x", i, pkt.IsKeyFrame, pkt.Time, pkt.Data)
+		}
+	}
+}
+
+// frame returns a frame that starts with hdr and is padded to size.
+func frame(hdr []byte, size int) []byte {
+	b := make([]byte, size)
+	copy(b, hdr)
+	for i := len(hdr); i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// pesStreamID returns the stream_id of the first PES packet on pid.
+func pesStreamID(t *testing.T, b []byte, pid uint16) uint8 {
+	t.Helper()
+	for _, pkt := range tsPackets(b) {
+		hdr, hdrlen, err := tsio.ParseTSPacketHeader(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint16(hdr.PID) == pid && hdr.PayloadUnitStart {
+			_, streamid, _, _, _, err := tsio.ParsePESHeader(pkt[hdrlen:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return streamid
+		}
+	}
+	t.Fatalf("no PES packet on PID %#x", pid)
+	return 0
+}
+
+func TestAudioMappings(t *testing.T) {
+	mp3, err := mp3parser.NewCodecDataFromFrame([]byte{0xff, 0xfb, 0x90, 0x64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp3Frame := frame([]byte{0xff, 0xfb, 0x90, 0x64}, 417)
+	mp3LSF, err := mp3parser.NewCodecDataFromFrame([]byte{0xff, 0xf3, 0x80, 0xc4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp3LSFFrame := frame([]byte{0xff, 0xf3, 0x80, 0xc4}, 208)
+
+	// 48 kHz stereo, 256 bytes
+	ac3Frame := frame([]byte{0x0b, 0x77, 0, 0, 0x08, 0x40, 0x40}, 256)
+	ac3, err := ac3parser.NewCodecDataFromSyncFrame(ac3Frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an independent and a dependent substream, 256 bytes each
+	eac3Frame := append(frame([]byte{0x0b, 0x77, 0x00, 0x7f, 0x34, 0x80}, 256),
+		frame([]byte{0x0b, 0x77, 0x40, 0x7f, 0x34, 0x80}, 256)...)
+	eac3, err := ac3parser.NewCodecDataFromSyncFrame(eac3Frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CELT fullband 20 ms, stereo
+	opusFrame := frame([]byte{0xfc}, 300)
+
+	values := []struct {
+		Name       string
+		CodecData  av.AudioCodecData
+		Frame      []byte
+		Duration   time.Duration
+		StreamType uint8
+		StreamID   uint8
+		Descriptor []byte // registration descriptor
+	}{
+		{"mp3", mp3, mp3Frame, 1152 * time.Second / 44100, tsio.ElementaryStreamTypeMPEG1Audio, tsio.StreamIdMP3, nil},
+		{"mp3 lsf", mp3LSF, mp3LSFFrame, 576 * time.Second / 22050, tsio.ElementaryStreamTypeMPEG2Audio, tsio.StreamIdMP3, nil},
+		{"ac3", ac3, ac3Frame, 32 * time.Millisecond, tsio.ElementaryStreamTypeAC3, tsio.StreamIdPrivateData1, tsio.RegistrationAC3},
+		{"eac3", eac3, eac3Frame, 32 * time.Millisecond, tsio.ElementaryStreamTypeEAC3, tsio.StreamIdPrivateData1, tsio.RegistrationEAC3},
+		{"opus", codec.NewOpusCodecData(48000, av.CH_STEREO), opusFrame, 20 * time.Millisecond, tsio.ElementaryStreamTypePrivatePES, tsio.StreamIdPrivateData1, tsio.RegistrationOpus},
+		{"alaw", codec.NewPCMAlawCodecData(), frame(nil, 160), 20 * time.Millisecond, tsio.ElementaryStreamTypePrivatePES, tsio.StreamIdPrivateData1, tsio.G711Registration(tsio.RegistrationALAW, 8000, 1)},
+		{"ulaw", codec.NewPCMMulawCodecData(), frame(nil, 160), 20 * time.Millisecond, tsio.ElementaryStreamTypePrivatePES, tsio.StreamIdPrivateData1, tsio.G711Registration(tsio.RegistrationULAW, 8000, 1)},
+		{"alaw 16k stereo", codec.NewPCMCodecDataWithFormat(av.PCM_ALAW, 16000, av.CH_STEREO, av.S16), frame(nil, 640), 20 * time.Millisecond, tsio.ElementaryStreamTypePrivatePES, tsio.StreamIdPrivateData1, tsio.G711Registration(tsio.RegistrationALAW, 16000, 2)},
+		{"ulaw 48k", codec.NewPCMCodecDataWithFormat(av.PCM_MULAW, 48000, av.CH_MONO, av.S16), frame(nil, 960), 20 * time.Millisecond, tsio.ElementaryStreamTypePrivatePES, tsio.StreamIdPrivateData1, tsio.G711Registration(tsio.RegistrationULAW, 48000, 1)},
+	}
+	for _, ex := range values {
+		var b bytes.Buffer
+		m := NewMuxer(&b)
+		if err = m.WriteHeader([]av.CodecData{ex.CodecData}); err != nil {
+			t.Fatal(err)
+		}
+		const count = 10
+		for i := 0; i < count; i++ {
+			if err = m.WritePacket(av.Packet{Time: time.Duration(i) * ex.Duration, Data: ex.Frame}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = m.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+
+		if id := pesStreamID(t, b.Bytes(), 0x100); id != ex.StreamID {
+			t.Errorf("%s: stream_id %#x, want %#x", ex.Name, id, ex.StreamID)
+		}
+		if ex.CodecData.Type() == av.OPUS {
+			for i, es := range pesPayloads(t, b.Bytes(), 0x100) {
+				hdrlen, size, err := tsio.ParseOpusControlHeader(es)
+				if err != nil || !bytes.Equal(es[hdrlen:hdrlen+size], ex.Frame) {
+					t.Errorf("%s: PES %d is not a control header and the packet: %v", ex.Name, i, err)
+				}
+			}
+		}
+
+		d, pkts := demuxAll(t, b.Bytes(), nil)
+		if len(d.pmt.ElementaryStreamInfos) != 1 {
+			t.Fatalf("%s: unexpected PMT %+v", ex.Name, d.pmt)
+		}
+		info := d.pmt.ElementaryStreamInfos[0]
+		desc, ok := tsio.FindDescriptor(info.Descriptors, tsio.DescriptorTagRegistration)
+		if info.StreamType != ex.StreamType || ok != (ex.Descriptor != nil) || !bytes.Equal(desc.Data, ex.Descriptor) {
+			t.Errorf("%s: stream type %#x, registration %q", ex.Name, info.StreamType, desc.Data)
+		}
+		streams, _ := d.Streams()
+		cd := streams[0].(av.AudioCodecData)
+		if cd.Type() != ex.CodecData.Type() || cd.SampleRate() != ex.CodecData.SampleRate() || cd.ChannelLayout() != ex.CodecData.ChannelLayout() {
+			t.Errorf("%s: got %v %d Hz %v", ex.Name, cd.Type(), cd.SampleRate(), cd.ChannelLayout())
+		}
+		if len(pkts) != count {
+			t.Fatalf("%s: %d packets, want %d", ex.Name, len(pkts), count)
+		}
+		for i, pkt := range pkts {
+			// PTS has 90 kHz ticks
+			diff := pkt.Time - time.Duration(i)*ex.Duration - time.Second
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff >= time.Second/90000 || !bytes.Equal(pkt.Data, ex.Frame) {
+				t.Errorf("%s: packet %d at %s, %d bytes", ex.Name, i, pkt.Time, len(pkt.Data))
+			}
+		}
+	}
+}
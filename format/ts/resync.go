@@ -0,0 +1,166 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"io"
+
+	"github.com/teocci/go-stream-av/format/ts/tsio"
+)
+
+const nullPID = 0x1fff
+
+const syncByte = 0x47
+
+// PacketSizes are the transport packet sizes the demuxer locks on to:
+// plain TS, M2TS with a 4 byte timestamp prefix and TS with 16 bytes of
+// Reed-Solomon parity.
+var PacketSizes = []int{188, 192, 204}
+
+// syncWindow is how much input resync looks at in one go. It must hold
+// three packets of the largest size.
+const syncWindow = 16 * 1024
+
+// PIDErrors counts the errors seen on one PID.
+type PIDErrors struct {
+	Continuity int // continuity_counter discontinuities
+	Transport  int // packets flagged by transport_error_indicator
+	Payload    int // PES or PSI data that failed to parse
+}
+
+type pidState struct {
+	cc    uint8
+	hascc bool
+	errs  PIDErrors
+}
+
+func (d *Demuxer) pidState(pid uint16) *pidState {
+	ps := d.pids[pid]
+	if ps == nil {
+		ps = &pidState{}
+		d.pids[pid] = ps
+	}
+	return ps
+}
+
+// checkContinuity reports a repeated packet, which is legal once and must
+// be dropped, and a gap in the continuity counter.
+func (ps *pidState) checkContinuity(hdr tsio.TSHeader) (dup bool, discontinuity bool) {
+	cc := uint8(hdr.ContinuityCounter)
+	if !hdr.HasPayload {
+		// the counter does not advance without payload
+		return
+	}
+	if ps.hascc && !hdr.DiscontinuityIndicator {
+		if cc == ps.cc {
+			dup = true
+			return
+		}
+		if cc != (ps.cc+1)&0xf {
+			ps.errs.Continuity++
+			discontinuity = true
+		}
+	}
+	ps.cc = cc
+	ps.hascc = true
+	return
+}
+
+// Errors returns the error counters of every PID that had a packet.
+func (d *Demuxer) Errors() map[uint16]PIDErrors {
+	errs := map[uint16]PIDErrors{}
+	for pid, ps := range d.pids {
+		errs[pid] = ps.errs
+	}
+	return errs
+}
+
+// SyncLosses returns how many times the demuxer had to search for the
+// sync byte again after the initial lock.
+func (d *Demuxer) SyncLosses() int {
+	return d.synclosts
+}
+
+// PacketSize returns the detected transport packet size, or 0 before the
+// first packet has been read.
+func (d *Demuxer) PacketSize() int {
+	return d.pktsize
+}
+
+func (d *Demuxer) sync() (err error) {
+	var b []byte
+	if b, err = d.r.Peek(1); err != nil {
+		return
+	}
+	if d.pktsize != 0 {
+		if b[0] == syncByte {
+			return
+		}
+		d.synclosts++
+	}
+	return d.resync()
+}
+
+// resync skips input until three sync bytes line up at one of PacketSizes.
+// Near the end of input fewer confirmations are accepted.
+func (d *Demuxer) resync() (err error) {
+	sizes := PacketSizes
+	if d.pktsize != 0 {
+		sizes = append([]int{d.pktsize}, PacketSizes...)
+	}
+	maxsize := 0
+	for _, size := range sizes {
+		if size > maxsize {
+			maxsize = size
+		}
+	}
+
+	for {
+		b, perr := d.r.Peek(syncWindow)
+		eof := perr != nil
+		if eof && len(b) == 0 {
+			err = perr
+			return
+		}
+
+		end := len(b) - 2*maxsize
+		if eof {
+			end = len(b)
+		}
+		for i := 0; i < end; i++ {
+			if b[i] != syncByte {
+				continue
+			}
+			if size := detectPacketSize(b[i:], sizes, eof); size != 0 {
+				d.pktsize = size
+				_, err = d.r.Discard(i)
+				return
+			}
+		}
+
+		if eof {
+			d.r.Discard(len(b))
+			err = io.EOF
+			return
+		}
+		if _, err = d.r.Discard(end); err != nil {
+			return
+		}
+	}
+}
+
+func detectPacketSize(b []byte, sizes []int, eof bool) int {
+	for _, size := range sizes {
+		if len(b) > 2*size {
+			if b[size] == syncByte && b[2*size] == syncByte {
+				return size
+			}
+		} else if eof && len(b) >= 188 {
+			if len(b) <= size || b[size] == syncByte {
+				return size
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+// Package ts
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package ts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/format/ts/tsio"
+)
+
+// tsPackets splits a stream of 188 byte packets.
+func tsPackets(b []byte) (pkts [][]byte) {
+	for ; len(b) >= 188; b = b[188:] {
+		pkts = append(pkts, append([]byte{}, b[:188]...))
+	}
+	return
+}
+
+// demuxAll reads every packet of a stream.
+func demuxAll(t *testing.T, b []byte, setup func(d *Demuxer)) (d *Demuxer, pkts []av.Packet) {
+	t.Helper()
+	d = NewDemuxer(bytes.NewReader(b))
+	if setup != nil {
+		setup(d)
+	}
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return
+}
+
+func samePackets(a, b []av.Packet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Idx != b[i].Idx || a[i].Time != b[i].Time || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPacketSizes(t *testing.T) {
+	var b bytes.Buffer
+	muxTestStream(t, &b, testStreams(t), 20)
+	_, want := demuxAll(t, b.Bytes(), nil)
+	if len(want) != 40 {
+		t.Fatalf("got %d packets, want 40", len(want))
+	}
+
+	values := []struct {
+		Size   int
+		Prefix int
+	}{
+		{188, 0},
+		// M2TS, a 4 byte timestamp before every packet
+		{192, 4},
+		// 16 bytes of Reed-Solomon parity after every packet
+		{204, 0},
+	}
+	for _, ex := range values {
+		var stream []byte
+		for _, pkt := range tsPackets(b.Bytes()) {
+			stream = append(stream, make([]byte, ex.Prefix)...)
+			stream = append(stream, pkt...)
+			stream = append(stream, make([]byte, ex.Size-188-ex.Prefix)...)
+		}
+		d, got := demuxAll(t, stream, nil)
+		if d.PacketSize() != ex.Size || d.SyncLosses() != 0 {
+			t.Errorf("%d: packet size %d, %d sync losses", ex.Size, d.PacketSize(), d.SyncLosses())
+		}
+		if !samePackets(got, want) {
+			t.Errorf("%d: got %d packets, want %d", ex.Size, len(got), len(want))
+		}
+	}
+}
+
+func TestResync(t *testing.T) {
+	var b bytes.Buffer
+	muxTestStream(t, &b, testStreams(t), 20)
+	_, want := demuxAll(t, b.Bytes(), nil)
+
+	// sync bytes that do not line up at any packet size
+	garbage := bytes.Repeat([]byte{syncByte, 0, 1, 2, 3}, 60)
+	pkts := tsPackets(b.Bytes())
+	var stream []byte
+	stream = append(stream, garbage...)
+	for i, pkt := range pkts {
+		if i == len(pkts)/2 {
+			stream = append(stream, garbage...)
+		}
+		stream = append(stream, pkt...)
+	}
+	d, got := demuxAll(t, stream, nil)
+	if d.PacketSize() != 188 {
+		t.Errorf("packet size %d", d.PacketSize())
+	}
+	// garbage before the first sync is not a loss
+	if d.SyncLosses() != 1 {
+		t.Errorf("%d sync losses, want 1", d.SyncLosses())
+	}
+	if !samePackets(got, want) {
+		t.Errorf("got %d packets, want %d", len(got), len(want))
+	}
+	for pid, errs := range d.Errors() {
+		if errs != (PIDErrors{}) {
+			t.Errorf("PID %#x: %+v", pid, errs)
+		}
+	}
+
+	if _, err := NewDemuxer(bytes.NewReader(garbage)).Streams(); err != io.EOF {
+		t.Errorf("expected io.EOF for garbage only, got %v", err)
+	}
+}
+
+func TestContinuityErrors(t *testing.T) {
+	var b bytes.Buffer
+	muxTestStream(t, &b, testStreams(t), 20)
+	_, want := demuxAll(t, b.Bytes(), nil)
+	pkts := tsPackets(b.Bytes())
+
+	// the second packet of a video PES in the middle of the stream
+	const videoPID = 0x100
+	mid := -1
+	for i := len(pkts) / 2; i < len(pkts); i++ {
+		hdr, _, err := tsio.ParseTSPacketHeader(pkts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.PID == videoPID && !hdr.PayloadUnitStart {
+			mid = i
+			break
+		}
+	}
+	if mid < 0 {
+		t.Fatal("no video packet to tamper with")
+	}
+	join := func(pkts [][]byte) (b []byte) {
+		for _, pkt := range pkts {
+			b = append(b, pkt...)
+		}
+		return
+	}
+	countVideo := func(pkts []av.Packet) (n int) {
+		for _, pkt := range pkts {
+			if pkt.Idx == 0 {
+				n++
+			}
+		}
+		return
+	}
+
+	// a packet sent twice is dropped and is no error
+	dup := append(append(append([][]byte{}, pkts[:mid+1]...), pkts[mid]), pkts[mid+1:]...)
+	d, got := demuxAll(t, join(dup), nil)
+	if errs := d.Errors()[videoPID]; errs != (PIDErrors{}) || !samePackets(got, want) {
+		t.Errorf("duplicate packet: %+v, %d packets", errs, len(got))
+	}
+
+	// a missing packet loses the PES it belonged to
+	missing := append(append([][]byte{}, pkts[:mid]...), pkts[mid+1:]...)
+	d, got = demuxAll(t, join(missing), nil)
+	if errs := d.Errors()[videoPID]; errs.Continuity != 1 || errs.Transport != 0 {
+		t.Errorf("missing packet: %+v", errs)
+	}
+	if n := countVideo(got); n != countVideo(want)-1 {
+		t.Errorf("missing packet: %d video packets, want %d", n, countVideo(want)-1)
+	}
+
+	// a packet flagged by transport_error_indicator is left out
+	flagged := append([][]byte{}, pkts...)
+	flagged[mid] = append([]byte{}, pkts[mid]...)
+	flagged[mid][1] |= 0x80
+	d, _ = demuxAll(t, join(flagged), nil)
+	if errs := d.Errors()[videoPID]; errs.Transport != 1 || errs.Continuity != 1 {
+		t.Errorf("transport error: %+v", errs)
+	}
+}
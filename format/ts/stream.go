@@ -28,3 +28,11 @@ type Stream struct {
 	data         []byte
 	dataLen      int
 }
+
+func (s *Stream) isVideo() bool {
+	switch s.streamType {
+	case tsio.ElementaryStreamTypeH264, tsio.ElementaryStreamTypeH265:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,424 @@
+// Package tsio
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package tsio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// SCTE-35 splice_info_section, ANSI/SCTE 35.
+
+const (
+	ElementaryStreamTypeSCTE35 = 0x86
+	TableIdSCTE35              = 0xfc
+)
+
+// RegistrationSCTE35 is the format_identifier announcing SCTE-35 in the PMT program_info loop.
+var RegistrationSCTE35 = []byte("CUEI")
+
+const (
+	SpliceNull                 = 0x00
+	SpliceSchedule             = 0x04
+	SpliceInsertCommand        = 0x05
+	TimeSignalCommand          = 0x06
+	SpliceBandwidthReservation = 0x07
+	SplicePrivateCommand       = 0xff
+)
+
+var ErrParseSCTE35 = fmt.Errorf("invalid SCTE-35 section")
+
+const ptsMask = 1<<33 - 1
+
+// SpliceTime is a splice_time(). PTS is only meaningful when Specified is set.
+type SpliceTime struct {
+	Specified bool
+	PTS       time.Duration
+}
+
+type SpliceInsert struct {
+	EventID         uint32
+	Cancel          bool
+	OutOfNetwork    bool
+	Immediate       bool
+	Time            SpliceTime // program splice time, components are not supported
+	HasDuration     bool
+	AutoReturn      bool
+	Duration        time.Duration
+	UniqueProgramID uint16
+	AvailNum        uint8
+	AvailsExpected  uint8
+}
+
+type SpliceDescriptor struct {
+	Tag  uint8
+	Data []byte
+}
+
+type SpliceInfo struct {
+	PTSAdjustment time.Duration
+	Tier          uint16
+	CommandType   uint8
+	SpliceInsert  SpliceInsert // valid when CommandType is SpliceInsertCommand
+	TimeSignal    SpliceTime   // valid when CommandType is TimeSignalCommand
+	Command       []byte       // raw body of other commands
+	Descriptors   []SpliceDescriptor
+}
+
+// PTS returns the splice time of a splice_insert or time_signal with
+// pts_adjustment applied, in the time base of the PES timestamps.
+func (self SpliceInfo) PTS() (pts time.Duration, ok bool) {
+	var st SpliceTime
+	switch self.CommandType {
+	case SpliceInsertCommand:
+		if self.SpliceInsert.Cancel || self.SpliceInsert.Immediate {
+			return
+		}
+		st = self.SpliceInsert.Time
+	case TimeSignalCommand:
+		st = self.TimeSignal
+	default:
+		return
+	}
+	if !st.Specified {
+		return
+	}
+	ts := (durationToTs(st.PTS) + durationToTs(self.PTSAdjustment)) & ptsMask
+	pts = tsToDuration(ts)
+	ok = true
+	return
+}
+
+// durationToTs rounds to the nearest tick, so that a parsed time is written
+// back as it was read.
+func durationToTs(tm time.Duration) uint64 {
+	return uint64((tm*PTS_HZ+time.Second/2)/time.Second) & ptsMask
+}
+
+func tsToDuration(ts uint64) time.Duration {
+	return time.Duration(ts) * time.Second / PTS_HZ
+}
+
+func parseSpliceTime(b []byte) (st SpliceTime, n int, err error) {
+	if len(b) < 1 {
+		err = ErrParseSCTE35
+		return
+	}
+	if b[0]&0x80 == 0 {
+		n = 1
+		return
+	}
+	if len(b) < 5 {
+		err = ErrParseSCTE35
+		return
+	}
+	st.Specified = true
+	st.PTS = tsToDuration(pio.U40BE(b) & ptsMask)
+	n = 5
+	return
+}
+
+func fillSpliceTime(b []byte, st SpliceTime) (n int) {
+	if !st.Specified {
+		b[0] = 0x7f
+		return 1
+	}
+	pio.PutU40BE(b, durationToTs(st.PTS)|0xfe<<32)
+	return 5
+}
+
+func (self *SpliceInsert) unmarshal(b []byte) (err error) {
+	if len(b) < 5 {
+		return ErrParseSCTE35
+	}
+	self.EventID = pio.U32BE(b)
+	self.Cancel = b[4]&0x80 != 0
+	n := 5
+	if self.Cancel {
+		return
+	}
+
+	if len(b) < n+1 {
+		return ErrParseSCTE35
+	}
+	flags := b[n]
+	n++
+	self.OutOfNetwork = flags&0x80 != 0
+	programSplice := flags&0x40 != 0
+	self.HasDuration = flags&0x20 != 0
+	self.Immediate = flags&0x10 != 0
+
+	if programSplice {
+		if !self.Immediate {
+			var tn int
+			if self.Time, tn, err = parseSpliceTime(b[n:]); err != nil {
+				return
+			}
+			n += tn
+		}
+	} else {
+		if len(b) < n+1 {
+			return ErrParseSCTE35
+		}
+		count := int(b[n])
+		n++
+		for i := 0; i < count; i++ {
+			// component_tag
+			if len(b) < n+1 {
+				return ErrParseSCTE35
+			}
+			n++
+			if !self.Immediate {
+				var tn int
+				if _, tn, err = parseSpliceTime(b[n:]); err != nil {
+					return
+				}
+				n += tn
+			}
+		}
+	}
+
+	if self.HasDuration {
+		if len(b) < n+5 {
+			return ErrParseSCTE35
+		}
+		self.AutoReturn = b[n]&0x80 != 0
+		self.Duration = tsToDuration(pio.U40BE(b[n:]) & ptsMask)
+		n += 5
+	}
+
+	if len(b) < n+4 {
+		return ErrParseSCTE35
+	}
+	self.UniqueProgramID = pio.U16BE(b[n:])
+	self.AvailNum = b[n+2]
+	self.AvailsExpected = b[n+3]
+	return
+}
+
+func (self SpliceInsert) marshal(b []byte) (n int) {
+	pio.PutU32BE(b[n:], self.EventID)
+	n += 4
+	if self.Cancel {
+		b[n] = 0xff
+		n++
+		return
+	}
+	b[n] = 0x7f
+	n++
+
+	flags := uint8(0x40 | 0x0f) // program_splice_flag, reserved
+	if self.OutOfNetwork {
+		flags |= 0x80
+	}
+	if self.HasDuration {
+		flags |= 0x20
+	}
+	if self.Immediate {
+		flags |= 0x10
+	}
+	b[n] = flags
+	n++
+
+	if !self.Immediate {
+		n += fillSpliceTime(b[n:], self.Time)
+	}
+	if self.HasDuration {
+		v := durationToTs(self.Duration) | 0x3f<<33
+		if self.AutoReturn {
+			v |= 1 << 39
+		}
+		pio.PutU40BE(b[n:], v)
+		n += 5
+	}
+	pio.PutU16BE(b[n:], self.UniqueProgramID)
+	n += 2
+	b[n] = self.AvailNum
+	n++
+	b[n] = self.AvailsExpected
+	n++
+	return
+}
+
+// ParseSpliceInfoSection parses a splice_info_section starting at table_id
+// and checks its CRC. Encrypted sections are rejected.
+func ParseSpliceInfoSection(b []byte) (info SpliceInfo, err error) {
+	if len(b) < 3 || b[0] != TableIdSCTE35 {
+		err = ErrParseSCTE35
+		return
+	}
+	seclen := int(pio.U16BE(b[1:]) & 0xfff)
+	if len(b) < 3+seclen || seclen < 11+4+2 {
+		err = ErrParseSCTE35
+		return
+	}
+	b = b[:3+seclen]
+	if calcCRC32(0xffffffff, b) != 0 {
+		err = fmt.Errorf("tsio: SCTE-35 crc mismatch")
+		return
+	}
+
+	n := 3
+	// protocol_version(8)
+	n++
+	if b[n]&0x80 != 0 {
+		err = fmt.Errorf("tsio: encrypted SCTE-35 not supported")
+		return
+	}
+	// encrypted_packet(1),encryption_algorithm(6),pts_adjustment(33)
+	info.PTSAdjustment = tsToDuration(pio.U40BE(b[n:]) & ptsMask)
+	n += 5
+	// cw_index(8)
+	n++
+	// tier(12),splice_command_length(12)
+	v := pio.U24BE(b[n:])
+	info.Tier = uint16(v >> 12)
+	cmdlen := int(v & 0xfff)
+	n += 3
+	info.CommandType = b[n]
+	n++
+
+	end := len(b) - 4
+	if cmdlen == 0xfff {
+		// legacy: length unknown, only commands we can parse
+		cmdlen = end - n
+	}
+	if n+cmdlen > end {
+		err = ErrParseSCTE35
+		return
+	}
+	cmd := b[n : n+cmdlen]
+
+	switch info.CommandType {
+	case SpliceInsertCommand:
+		if err = info.SpliceInsert.unmarshal(cmd); err != nil {
+			return
+		}
+	case TimeSignalCommand:
+		var tn int
+		if info.TimeSignal, tn, err = parseSpliceTime(cmd); err != nil {
+			return
+		}
+		cmdlen = tn
+	default:
+		info.Command = append([]byte(nil), cmd...)
+	}
+	n += cmdlen
+
+	if n+2 > end {
+		err = ErrParseSCTE35
+		return
+	}
+	desclen := int(pio.U16BE(b[n:]))
+	n += 2
+	if n+desclen > end {
+		err = ErrParseSCTE35
+		return
+	}
+	for desc := b[n : n+desclen]; len(desc) >= 2; {
+		l := int(desc[1])
+		if len(desc) < 2+l {
+			err = ErrParseSCTE35
+			return
+		}
+		info.Descriptors = append(info.Descriptors, SpliceDescriptor{
+			Tag:  desc[0],
+			Data: append([]byte(nil), desc[2:2+l]...),
+		})
+		desc = desc[2+l:]
+	}
+	return
+}
+
+// Len returns the size of the section written by Marshal.
+func (self SpliceInfo) Len() (n int) {
+	n = 3 + 11
+	n += self.commandLen()
+	n += 2
+	for _, desc := range self.Descriptors {
+		n += 2 + len(desc.Data)
+	}
+	n += 4
+	return
+}
+
+func (self SpliceInfo) commandLen() int {
+	switch self.CommandType {
+	case SpliceInsertCommand:
+		si := self.SpliceInsert
+		if si.Cancel {
+			return 5
+		}
+		n := 4 + 1 + 1 + 4
+		if !si.Immediate {
+			n += 1
+			if si.Time.Specified {
+				n += 4
+			}
+		}
+		if si.HasDuration {
+			n += 5
+		}
+		return n
+	case TimeSignalCommand:
+		if self.TimeSignal.Specified {
+			return 5
+		}
+		return 1
+	}
+	return len(self.Command)
+}
+
+// Marshal writes the splice_info_section, table_id through CRC_32, into b
+// which must hold Len() bytes.
+func (self SpliceInfo) Marshal(b []byte) (n int) {
+	b[n] = TableIdSCTE35
+	n++
+	// section_syntax_indicator(1)=0,private_indicator(1)=0,sap_type(2)=3,section_length(12)
+	pio.PutU16BE(b[n:], uint16(0x3<<12|(self.Len()-3)))
+	n += 2
+	// protocol_version
+	b[n] = 0
+	n++
+	// encrypted_packet(1)=0,encryption_algorithm(6)=0,pts_adjustment(33)
+	pio.PutU40BE(b[n:], durationToTs(self.PTSAdjustment))
+	n += 5
+	// cw_index
+	b[n] = 0xff
+	n++
+	cmdlen := self.commandLen()
+	pio.PutU24BE(b[n:], uint32(self.Tier&0xfff)<<12|uint32(cmdlen))
+	n += 3
+	b[n] = self.CommandType
+	n++
+
+	switch self.CommandType {
+	case SpliceInsertCommand:
+		n += self.SpliceInsert.marshal(b[n:])
+	case TimeSignalCommand:
+		n += fillSpliceTime(b[n:], self.TimeSignal)
+	default:
+		n += copy(b[n:], self.Command)
+	}
+
+	desclen := 0
+	for _, desc := range self.Descriptors {
+		desclen += 2 + len(desc.Data)
+	}
+	pio.PutU16BE(b[n:], uint16(desclen))
+	n += 2
+	for _, desc := range self.Descriptors {
+		b[n] = desc.Tag
+		b[n+1] = uint8(len(desc.Data))
+		n += 2
+		n += copy(b[n:], desc.Data)
+	}
+
+	crc := calcCRC32(0xffffffff, b[:n])
+	pio.PutU32LE(b[n:], crc)
+	n += 4
+	return
+}
@@ -0,0 +1,139 @@
+// Package tsio
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package tsio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// sample messages of ANSI/SCTE 35 2019, section 14
+var (
+	// 14.1 time_signal, placement opportunity start
+	scte35TimeSignal = "/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg=="
+	// 14.2 splice_insert
+	scte35SpliceInsert = "/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo="
+	// 14.3 time_signal, placement opportunity end
+	scte35TimeSignalEnd = "/DAvAAAAAAAA///wBQb+dGKQoAAZAhdDVUVJSAAAjn+fCAgAAAAALKChijUCAKnMZ1g="
+	// 14.4 time_signal, program start and end
+	scte35ProgramStartEnd = "/DBIAAAAAAAA///wBQb+ek2ItgAyAhdDVUVJSAAAGH+fCAgAAAAALMvDRBEAAAIXQ1VFSUgAABl/nwgIAAAAACyk26AQAACZcuND"
+)
+
+func decodeSCTE35(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSpliceInfoSamples(t *testing.T) {
+	values := []struct {
+		Name    string
+		Message string
+		Check   func(info SpliceInfo) bool
+	}{
+		{"time_signal", scte35TimeSignal, func(info SpliceInfo) bool {
+			return info.CommandType == TimeSignalCommand && info.TimeSignal.Specified &&
+				durationToTs(info.TimeSignal.PTS) == 0x072bd0050 &&
+				len(info.Descriptors) == 1 && info.Descriptors[0].Tag == 0x02 && len(info.Descriptors[0].Data) == 0x1c
+		}},
+		{"splice_insert", scte35SpliceInsert, func(info SpliceInfo) bool {
+			si := info.SpliceInsert
+			return info.CommandType == SpliceInsertCommand && si.EventID == 0x4800008f &&
+				si.OutOfNetwork && !si.Immediate && si.Time.Specified && durationToTs(si.Time.PTS) == 0x07369c02e &&
+				si.HasDuration && si.AutoReturn && durationToTs(si.Duration) == 0x00052ccf5 &&
+				len(info.Descriptors) == 1 && info.Descriptors[0].Tag == 0x00 &&
+				bytes.Equal(info.Descriptors[0].Data, []byte{'C', 'U', 'E', 'I', 0, 0, 1, 0x35})
+		}},
+		{"time_signal end", scte35TimeSignalEnd, func(info SpliceInfo) bool {
+			return info.CommandType == TimeSignalCommand && durationToTs(info.TimeSignal.PTS) == 0x0746290a0 &&
+				len(info.Descriptors) == 1
+		}},
+		{"time_signal program start and end", scte35ProgramStartEnd, func(info SpliceInfo) bool {
+			return info.CommandType == TimeSignalCommand && durationToTs(info.TimeSignal.PTS) == 0x07a4d88b6 &&
+				len(info.Descriptors) == 2 && info.Descriptors[0].Data[20] == 0x11 && info.Descriptors[1].Data[20] == 0x10
+		}},
+	}
+	for _, ex := range values {
+		b := decodeSCTE35(t, ex.Message)
+		info, err := ParseSpliceInfoSection(b)
+		if err != nil {
+			t.Errorf("%s: %v", ex.Name, err)
+			continue
+		}
+		if info.Tier != 0xfff || info.PTSAdjustment != 0 || !ex.Check(info) {
+			t.Errorf("%s: unexpected %+v", ex.Name, info)
+		}
+		if pts, ok := info.PTS(); !ok || durationToTs(pts) != firstSpliceTime(b) {
+			t.Errorf("%s: splice time %s %v", ex.Name, pts, ok)
+		}
+		out := make([]byte, info.Len())
+		if n := info.Marshal(out); n != len(b) || !bytes.Equal(out, b) {
+			t.Errorf("%s: marshaled\n%x, want\n%x", ex.Name, out, b)
+		}
+	}
+}
+
+// firstSpliceTime reads the 33-bit time of the splice_time of a time_signal
+// or splice_insert section.
+func firstSpliceTime(b []byte) uint64 {
+	n := 14
+	if b[13] == SpliceInsertCommand {
+		// event id, cancel and flags
+		n += 6
+	}
+	var v uint64
+	for _, c := range b[n : n+5] {
+		v = v<<8 | uint64(c)
+	}
+	return v & ptsMask
+}
+
+func TestSpliceInfoErrors(t *testing.T) {
+	b := decodeSCTE35(t, scte35SpliceInsert)
+	corrupt := append([]byte{}, b...)
+	corrupt[20] ^= 1
+	if _, err := ParseSpliceInfoSection(corrupt); err == nil {
+		t.Error("expected a CRC error")
+	}
+	for n := 0; n < len(b); n++ {
+		if _, err := ParseSpliceInfoSection(b[:n]); err == nil {
+			t.Errorf("expected an error for %d bytes", n)
+		}
+	}
+	encrypted := append([]byte{}, b...)
+	encrypted[4] |= 0x80
+	if _, err := ParseSpliceInfoSection(encrypted); err == nil {
+		t.Error("expected an error for an encrypted section")
+	}
+}
+
+func TestSpliceInfoRoundTrip(t *testing.T) {
+	values := []SpliceInfo{
+		{CommandType: SpliceInsertCommand, SpliceInsert: SpliceInsert{EventID: 1, Cancel: true}},
+		{CommandType: SpliceInsertCommand, Tier: 5, SpliceInsert: SpliceInsert{EventID: 2, OutOfNetwork: true, Immediate: true, UniqueProgramID: 7, AvailNum: 1, AvailsExpected: 2}},
+		{CommandType: TimeSignalCommand},
+		{CommandType: SpliceNull},
+		{CommandType: SplicePrivateCommand, Command: []byte{'a', 'b', 'c', 'd', 1}},
+	}
+	for i, info := range values {
+		b := make([]byte, info.Len())
+		if n := info.Marshal(b); n != len(b) {
+			t.Errorf("%d: marshaled %d of %d bytes", i, n, len(b))
+		}
+		got, err := ParseSpliceInfoSection(b)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		out := make([]byte, got.Len())
+		got.Marshal(out)
+		if !bytes.Equal(out, b) {
+			t.Errorf("%d: parsed %+v", i, got)
+		}
+	}
+}
@@ -12,8 +12,12 @@ import (
 )
 
 const (
-	StreamIdH264 = 0xe0
-	StreamIdAAC  = 0xc0
+	StreamIdH264         = 0xe0
+	StreamIdH265         = 0xe0
+	StreamIdAAC          = 0xc0
+	StreamIdMP3          = 0xc0
+	StreamIdPrivateData1 = 0xbd
+	StreamIdMetadata     = 0xfc
 )
 
 const (
@@ -37,8 +41,39 @@ const (
 )
 
 const (
-	ElementaryStreamTypeH264    = 0x1B
-	ElementaryStreamTypeAdtsAAC = 0x0F
+	ElementaryStreamTypeH264       = 0x1B
+	ElementaryStreamTypeH265       = 0x24
+	ElementaryStreamTypeAdtsAAC    = 0x0F
+	ElementaryStreamTypeMPEG1Audio = 0x03
+	ElementaryStreamTypeMPEG2Audio = 0x04
+	ElementaryStreamTypePrivatePES = 0x06
+	ElementaryStreamTypeAC3        = 0x81
+	ElementaryStreamTypeEAC3       = 0x87
+	ElementaryStreamTypeMetadata   = 0x15
+)
+
+const (
+	DescriptorTagRegistration = 0x05
+	DescriptorTagMetadata     = 0x26
+	DescriptorTagAC3          = 0x6a
+	DescriptorTagEAC3         = 0x7a
+	DescriptorTagExtension    = 0x7f
+
+	// extension_descriptor_tag of the Opus audio descriptor
+	ExtensionDescriptorTagOpus = 0x80
+)
+
+// format identifiers carried in registration descriptors
+var (
+	RegistrationOpus = []byte("Opus")
+	RegistrationAC3  = []byte("AC-3")
+	RegistrationEAC3 = []byte("EAC3")
+	RegistrationKLV  = []byte("KLVA")
+
+	// G.711 has no registered identifier, these are followed by the
+	// sample rate and channel count, see G711Registration
+	RegistrationALAW = []byte("ALAW")
+	RegistrationULAW = []byte("ULAW")
 )
 
 var ErrPESHeader = fmt.Errorf("invalid PES header")
@@ -202,7 +237,7 @@ func (p PMT) parseDescs(b []byte) (descs []Descriptor, err error) {
 			desc.Tag = b[n]
 			desc.Data = make([]byte, b[n+1])
 			n += 2
-			if n+len(desc.Data) < len(b) {
+			if n+len(desc.Data) <= len(b) {
 				copy(desc.Data, b[n:])
 				descs = append(descs, desc)
 				n += len(desc.Data)
@@ -285,7 +320,165 @@ func (p *PMT) Unmarshal(b []byte) (n int, err error) {
 	return
 }
 
+// FindDescriptor returns the first descriptor with the given tag.
+func FindDescriptor(descs []Descriptor, tag uint8) (desc Descriptor, ok bool) {
+	for _, desc = range descs {
+		if desc.Tag == tag {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// RegistrationFormat returns the format_identifier of a registration descriptor.
+func RegistrationFormat(descs []Descriptor) []byte {
+	if desc, ok := FindDescriptor(descs, DescriptorTagRegistration); ok && len(desc.Data) >= 4 {
+		return desc.Data[:4]
+	}
+	return nil
+}
+
+// G711Registration returns the registration descriptor data of a G.711
+// stream: the format_identifier, a 32-bit sample rate and an 8-bit channel
+// count as additional_identification_info.
+func G711Registration(format []byte, sampleRate, channels int) []byte {
+	b := make([]byte, 9)
+	copy(b, format)
+	pio.PutU32BE(b[4:], uint32(sampleRate))
+	b[8] = uint8(channels)
+	return b
+}
+
+// ParseG711Registration reads back the sample rate and channel count of
+// G711Registration, 8 kHz mono when they are missing.
+func ParseG711Registration(descs []Descriptor) (sampleRate, channels int) {
+	sampleRate, channels = 8000, 1
+	if desc, ok := FindDescriptor(descs, DescriptorTagRegistration); ok && len(desc.Data) >= 9 {
+		sampleRate = int(pio.U32BE(desc.Data[4:]))
+		channels = int(desc.Data[8])
+	}
+	return
+}
+
+// MetadataFormat returns the metadata_format_identifier of a
+// metadata_descriptor, ISO/IEC 13818-1 2.6.60.
+func MetadataFormat(descs []Descriptor) []byte {
+	desc, ok := FindDescriptor(descs, DescriptorTagMetadata)
+	if !ok {
+		return nil
+	}
+	b := desc.Data
+	n := 2
+	if len(b) >= 2 && pio.U16BE(b) == 0xffff {
+		n += 4
+	}
+	if len(b) < n+5 || b[n] != 0xff {
+		return nil
+	}
+	return b[n+1 : n+5]
+}
+
+const MetadataAUCellHeaderLength = 5
+
+// ParseMetadataAUCell parses the header of a Metadata Access Unit cell
+// that synchronous metadata PES payloads are made of.
+func ParseMetadataAUCell(b []byte) (fragment uint8, hdrlen int, datalen int, err error) {
+	if len(b) < MetadataAUCellHeaderLength {
+		err = fmt.Errorf("tsio: metadata AU cell invalid")
+		return
+	}
+	// metadata_service_id(8),sequence_number(8)
+	// cell_fragment_indication(2),decoder_config_flag(1),random_access_indicator(1),reserved(4)
+	fragment = b[2] >> 6
+	datalen = int(pio.U16BE(b[3:]))
+	hdrlen = MetadataAUCellHeaderLength
+	if len(b) < hdrlen+datalen {
+		err = fmt.Errorf("tsio: metadata AU cell length=%d exceeds payload", datalen)
+		return
+	}
+	return
+}
+
+const MaxOpusControlHeaderLength = 2 + 8
+
+// FillOpusControlHeader writes the opus_control_header that precedes every
+// Opus packet carried in a TS PES payload (no trimming, no extension).
+func FillOpusControlHeader(h []byte, size int) (n int) {
+	// control_header_prefix(11)=0x3ff
+	// start_trim_flag(1),end_trim_flag(1),control_extension_flag(1),reserved(2)
+	h[0] = 0x7f
+	h[1] = 0xe0
+	n += 2
+	for size >= 0xff {
+		h[n] = 0xff
+		n++
+		size -= 0xff
+	}
+	h[n] = byte(size)
+	n++
+	return
+}
+
+func ParseOpusControlHeader(h []byte) (hdrlen int, size int, err error) {
+	if len(h) < 3 || h[0] != 0x7f || h[1]&0xe0 != 0xe0 {
+		err = fmt.Errorf("tsio: opus control header invalid")
+		return
+	}
+	flags := h[1]
+	hdrlen = 2
+	for {
+		if hdrlen >= len(h) {
+			err = fmt.Errorf("tsio: opus control header au_size invalid")
+			return
+		}
+		v := h[hdrlen]
+		hdrlen++
+		size += int(v)
+		if v != 0xff {
+			break
+		}
+	}
+	if flags&0x10 != 0 {
+		hdrlen += 2 // start_trim
+	}
+	if flags&0x08 != 0 {
+		hdrlen += 2 // end_trim
+	}
+	if flags&0x04 != 0 {
+		if hdrlen >= len(h) {
+			err = fmt.Errorf("tsio: opus control header extension invalid")
+			return
+		}
+		hdrlen += 1 + int(h[hdrlen])
+	}
+	if hdrlen > len(h) {
+		err = fmt.Errorf("tsio: opus control header truncated")
+		return
+	}
+	return
+}
+
+type PSIHeader struct {
+	TableId           uint8
+	TableExt          uint16
+	Version           uint8
+	CurrentNext       bool
+	SectionNumber     uint8
+	LastSectionNumber uint8
+}
+
 func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int, err error) {
+	var hdr PSIHeader
+	if hdr, hdrlen, datalen, err = ParsePSIHeader(h); err != nil {
+		return
+	}
+	tableid = hdr.TableId
+	tableext = hdr.TableExt
+	return
+}
+
+func ParsePSIHeader(h []byte) (hdr PSIHeader, hdrlen int, datalen int, err error) {
 	if len(h) < 8 {
 		err = ErrPSIHeader
 		return
@@ -308,7 +501,7 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 	}
 
 	// table_id(8)
-	tableid = h[hdrlen]
+	hdr.TableId = h[hdrlen]
 	hdrlen++
 
 	// section_syntax_indicator(1)=1,private_bit(1)=0,reserved(2)=3,unused(2)=0,section_length(10)
@@ -321,27 +514,55 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 	}
 
 	// Table ID extension(16)
-	tableext = pio.U16BE(h[hdrlen:])
+	hdr.TableExt = pio.U16BE(h[hdrlen:])
 	hdrlen += 2
 
 	// resverd(2)=3
 	// version(5)
 	// Current_next_indicator(1)
+	hdr.Version = h[hdrlen] >> 1 & 0x1f
+	hdr.CurrentNext = h[hdrlen]&0x1 != 0
 	hdrlen++
 
 	// section_number(8)
+	hdr.SectionNumber = h[hdrlen]
 	hdrlen++
 
 	// last_section_number(8)
+	hdr.LastSectionNumber = h[hdrlen]
 	hdrlen++
 
 	// data
 
 	// crc(32)
+	if len(h) < hdrlen+datalen+4 {
+		err = ErrPSIHeader
+		return
+	}
+
+	return
+}
 
+// PSISectionLength returns the number of payload bytes, pointer field
+// included, needed to hold the section that starts in b.
+func PSISectionLength(b []byte) (n int, ok bool) {
+	if len(b) < 1 {
+		return
+	}
+	n = 1 + int(b[0])
+	if len(b) < n+3 {
+		return
+	}
+	n += 3 + int(pio.U16BE(b[n+1:])&0xfff)
+	ok = true
 	return
 }
 
+// VerifyPSI checks the CRC32 of a section parsed with ParsePSIHeader.
+func VerifyPSI(h []byte, hdrlen int, datalen int) bool {
+	return calcCRC32(0xffffffff, h[hdrlen-8:hdrlen+datalen+4]) == 0
+}
+
 const PSIHeaderLength = 9
 
 func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
@@ -384,7 +605,7 @@ func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
 
 func TimeToPCR(tm time.Duration) (pcr uint64) {
 	// base(33) + reserved(6) + ext(9)
-	ts := uint64(tm * PCR_HZ / time.Second)
+	ts := uint64(tm) * (PCR_HZ / 1000000) / 1000
 	base := ts / 300
 	ext := ts % 300
 	pcr = base<<15 | 0x3f<<9 | ext
@@ -395,7 +616,8 @@ func PCRToTime(pcr uint64) (tm time.Duration) {
 	base := pcr >> 15
 	ext := pcr & 0x1ff
 	ts := base*300 + ext
-	tm = time.Duration(ts) * time.Second / time.Duration(PCR_HZ)
+	// 27MHz ticks to nanoseconds without overflowing after a few minutes
+	tm = time.Duration(ts * 1000 / (PCR_HZ / 1000000))
 	return
 }
 
@@ -419,7 +641,7 @@ const (
 )
 
 func ParsePESHeader(h []byte) (hdrlen int, streamid uint8, datalen int, pts, dts time.Duration, err error) {
-	if h[0] != 0 || h[1] != 0 || h[2] != 1 {
+	if len(h) < 9 || h[0] != 0 || h[1] != 0 || h[2] != 1 {
 		err = ErrPESHeader
 		return
 	}
@@ -427,6 +649,10 @@ func ParsePESHeader(h []byte) (hdrlen int, streamid uint8, datalen int, pts, dts
 
 	flags := h[7]
 	hdrlen = int(h[8]) + 9
+	if hdrlen > len(h) {
+		err = ErrPESHeader
+		return
+	}
 
 	datalen = int(pio.U16BE(h[4:6]))
 	if datalen > 0 {
@@ -534,6 +760,9 @@ type TSHeader struct {
 	DiscontinuityIndicator bool
 	RandomAccessIndicator  bool
 	HeaderLength           uint
+	TransportError         bool
+	HasPayload             bool
+	HasPCR                 bool
 }
 
 //WriteTSHeader func
@@ -688,6 +917,51 @@ func ParseTSHeader(tshdr []byte) (pid uint16, start bool, iskeyframe bool, hdrle
 	}
 	return
 }
+
+// ParseTSPacketHeader parses the header and adaptation field of a 188 byte
+// TS packet. PCR and OPCR are returned in 27MHz ticks like WriteTSHeader takes them.
+func ParseTSPacketHeader(b []byte) (hdr TSHeader, hdrlen int, err error) {
+	if len(b) < 188 || b[0] != 0x47 {
+		err = fmt.Errorf("tshdr sync invalid")
+		return
+	}
+	hdr.TransportError = b[1]&0x80 != 0
+	hdr.PayloadUnitStart = b[1]&0x40 != 0
+	hdr.PID = uint(b[1]&0x1f)<<8 | uint(b[2])
+	hdr.HasPayload = b[3]&0x10 != 0
+	hdr.ContinuityCounter = uint(b[3] & 0xf)
+	hdrlen = 4
+
+	if b[3]&0x20 != 0 {
+		length := int(b[4])
+		hdrlen += 1 + length
+		if hdrlen > 188 {
+			err = fmt.Errorf("tshdr adaptation field length=%d invalid", length)
+			return
+		}
+		if length > 0 {
+			flags := b[5]
+			hdr.DiscontinuityIndicator = flags&0x80 != 0
+			hdr.RandomAccessIndicator = flags&0x40 != 0
+			n := 6
+			if flags&0x10 != 0 && length >= n+6-5 {
+				hdr.HasPCR = true
+				hdr.PCR = pcrTicks(pio.U48BE(b[n:]))
+				n += 6
+			}
+			if flags&0x08 != 0 && length >= n+6-5 {
+				hdr.OPCR = pcrTicks(pio.U48BE(b[n:]))
+			}
+		}
+	}
+	hdr.HeaderLength = uint(hdrlen)
+	return
+}
+
+func pcrTicks(pcr uint64) uint64 {
+	return (pcr>>15)*300 + pcr&0x1ff
+}
+
 func makeRepeatValBytes(val byte, n int) []byte {
 	b := make([]byte, n)
 	for i := range b {
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+// Package udp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package udp
+
+import (
+	"fmt"
+	"net"
+)
+
+func setSocketOptions(conn *net.UDPConn, addr *net.UDPAddr, opts Options) (err error) {
+	if opts.TTL > 0 || opts.Interface != nil {
+		err = fmt.Errorf("udp: ttl and iface are not supported on this platform")
+	}
+	return
+}
@@ -0,0 +1,84 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+// Package udp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package udp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setSocketOptions applies the TTL, and the outgoing interface for
+// multicast groups, to conn.
+func setSocketOptions(conn *net.UDPConn, addr *net.UDPAddr, opts Options) (err error) {
+	if opts.TTL <= 0 && opts.Interface == nil {
+		return
+	}
+	multicast := addr.IP.IsMulticast()
+	ip4 := addr.IP.To4() != nil
+
+	var ifaddr [4]byte
+	if multicast && opts.Interface != nil && ip4 {
+		if ifaddr, err = interfaceIPv4(opts.Interface); err != nil {
+			return
+		}
+	}
+
+	var rc syscall.RawConn
+	if rc, err = conn.SyscallConn(); err != nil {
+		return
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		s := int(fd)
+		if opts.TTL > 0 {
+			switch {
+			case ip4 && multicast:
+				err = syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(opts.TTL))
+			case ip4:
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, opts.TTL)
+			case multicast:
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, opts.TTL)
+			default:
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, opts.TTL)
+			}
+			if err != nil {
+				return
+			}
+		}
+		if multicast && opts.Interface != nil {
+			if ip4 {
+				err = syscall.SetsockoptInet4Addr(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ifaddr)
+			} else {
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, opts.Interface.Index)
+			}
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		err = fmt.Errorf("udp: set socket options: %v", err)
+	}
+	return
+}
+
+func interfaceIPv4(ifi *net.Interface) (ip [4]byte, err error) {
+	var addrs []net.Addr
+	if addrs, err = ifi.Addrs(); err != nil {
+		return
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				copy(ip[:], ip4)
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("udp: interface %s has no IPv4 address", ifi.Name)
+	return
+}
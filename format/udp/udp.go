@@ -0,0 +1,395 @@
+// Package udp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package udp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teocci/go-stream-av/av"
+	"github.com/teocci/go-stream-av/av/avutil"
+	"github.com/teocci/go-stream-av/format/ts"
+	"github.com/teocci/go-stream-av/utils/bits/pio"
+)
+
+// MPEG-TS over UDP, optionally in RTP (RFC 2250), to unicast or multicast
+// addresses. Options are given as URL query parameters:
+//
+//	udp://239.1.1.1:5000?iface=eth0&ttl=8&rate=4000000
+//
+// iface selects the interface by name or address, ttl the multicast TTL or
+// unicast hop limit, rate paces the output to the given bits per second and
+// timeout limits how long a read waits for a datagram.
+
+const (
+	TSPacketSize       = 188
+	TSPacketsPerPacket = 7
+	DatagramSize       = TSPacketSize * TSPacketsPerPacket
+
+	RTPHeaderLength = 12
+	RTPPayloadMP2T  = 33
+
+	maxDatagramSize = 65536
+)
+
+type Options struct {
+	Interface *net.Interface
+	TTL       int
+	Rate      int64 // bits per second, 0 sends as fast as written
+	Timeout   time.Duration
+	RTP       bool
+}
+
+// ParseURL splits a udp:// or rtp:// URL into the group or host address and
+// its options.
+func ParseURL(uri string) (addr *net.UDPAddr, opts Options, err error) {
+	var u *url.URL
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "udp":
+	case "rtp":
+		opts.RTP = true
+	default:
+		err = fmt.Errorf("udp: unsupported scheme %s", u.Scheme)
+		return
+	}
+	if addr, err = net.ResolveUDPAddr("udp", u.Host); err != nil {
+		return
+	}
+
+	q := u.Query()
+	if s := q.Get("iface"); s != "" {
+		if opts.Interface, err = findInterface(s); err != nil {
+			return
+		}
+	}
+	if s := q.Get("ttl"); s != "" {
+		if opts.TTL, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("udp: invalid ttl %s", s)
+			return
+		}
+	}
+	if s := q.Get("rate"); s != "" {
+		if opts.Rate, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = fmt.Errorf("udp: invalid rate %s", s)
+			return
+		}
+	}
+	if s := q.Get("timeout"); s != "" {
+		if opts.Timeout, err = time.ParseDuration(s); err != nil {
+			err = fmt.Errorf("udp: invalid timeout %s", s)
+			return
+		}
+	}
+	return
+}
+
+func findInterface(s string) (ifi *net.Interface, err error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return net.InterfaceByName(s)
+	}
+	var ifis []net.Interface
+	if ifis, err = net.Interfaces(); err != nil {
+		return
+	}
+	for i := range ifis {
+		addrs, _ := ifis[i].Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				ifi = &ifis[i]
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("udp: no interface with address %s", s)
+	return
+}
+
+// Reader returns the payload of the received datagrams as a byte stream,
+// without the RTP header when RTP is set.
+type Reader struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	rtp     bool
+	buf     []byte
+	data    []byte
+}
+
+// Listen receives on addr, joining the group when it is a multicast address.
+func Listen(addr *net.UDPAddr, opts Options) (r *Reader, err error) {
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", opts.Interface, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return
+	}
+	conn.SetReadBuffer(4 * 1024 * 1024)
+	r = &Reader{
+		conn:    conn,
+		timeout: opts.Timeout,
+		rtp:     opts.RTP,
+		buf:     make([]byte, maxDatagramSize),
+	}
+	return
+}
+
+func (self *Reader) Read(p []byte) (n int, err error) {
+	for len(self.data) == 0 {
+		if self.timeout > 0 {
+			self.conn.SetReadDeadline(time.Now().Add(self.timeout))
+		}
+		var size int
+		if size, _, err = self.conn.ReadFromUDP(self.buf); err != nil {
+			return
+		}
+		self.data = self.buf[:size]
+		if self.rtp {
+			self.data = stripRTPHeader(self.data)
+		}
+	}
+	n = copy(p, self.data)
+	self.data = self.data[n:]
+	return
+}
+
+func (self *Reader) Close() error {
+	return self.conn.Close()
+}
+
+// stripRTPHeader returns the payload of an RTP packet, or nil when b is
+// not one.
+func stripRTPHeader(b []byte) []byte {
+	if len(b) < RTPHeaderLength || b[0]>>6 != 2 {
+		return nil
+	}
+	n := RTPHeaderLength + int(b[0]&0xf)*4
+	if b[0]&0x10 != 0 {
+		// header extension
+		if len(b) < n+4 {
+			return nil
+		}
+		n += 4 + int(pio.U16BE(b[n+2:]))*4
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		// padding
+		end -= int(b[len(b)-1])
+	}
+	if n > end {
+		return nil
+	}
+	return b[n:end]
+}
+
+// Writer packs the written stream into datagrams of DatagramSize bytes.
+type Writer struct {
+	conn *net.UDPConn
+	rate int64
+	rtp  bool
+
+	buf []byte
+	n   int
+
+	seq   uint16
+	ssrc  uint32
+	start time.Time
+	sent  int64
+}
+
+// Dial sends to addr, applying the TTL and interface to multicast groups.
+func Dial(addr *net.UDPAddr, opts Options) (w *Writer, err error) {
+	var conn *net.UDPConn
+	if conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		return
+	}
+	if err = setSocketOptions(conn, addr, opts); err != nil {
+		conn.Close()
+		return
+	}
+	hdrlen := 0
+	if opts.RTP {
+		hdrlen = RTPHeaderLength
+	}
+	w = &Writer{
+		conn: conn,
+		rate: opts.Rate,
+		rtp:  opts.RTP,
+		buf:  make([]byte, hdrlen+DatagramSize),
+		n:    hdrlen,
+		seq:  uint16(rand.Uint32()),
+		ssrc: rand.Uint32(),
+	}
+	return
+}
+
+func (self *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(self.buf[self.n:], p)
+		self.n += c
+		n += c
+		p = p[c:]
+		if self.n == len(self.buf) {
+			if err = self.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Flush sends the buffered data even if the datagram is not full.
+func (self *Writer) Flush() (err error) {
+	hdrlen := 0
+	if self.rtp {
+		hdrlen = RTPHeaderLength
+	}
+	if self.n == hdrlen {
+		return
+	}
+
+	now := time.Now()
+	if self.start.IsZero() {
+		self.start = now
+	}
+	if self.rate > 0 {
+		due := self.start.Add(sendTime(self.sent, self.rate))
+		if wait := due.Sub(now); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	if self.rtp {
+		self.fillRTPHeader(now)
+	}
+
+	_, err = self.conn.Write(self.buf[:self.n])
+	self.sent += int64(self.n)
+	self.n = hdrlen
+	return
+}
+
+func (self *Writer) fillRTPHeader(now time.Time) {
+	b := self.buf
+	b[0] = 0x80
+	b[1] = RTPPayloadMP2T
+	pio.PutU16BE(b[2:], self.seq)
+	pio.PutU32BE(b[4:], rtpTimestamp(now.Sub(self.start)))
+	pio.PutU32BE(b[8:], self.ssrc)
+	self.seq++
+}
+
+// rtpTimestamp converts d to the 90kHz RTP clock, which wraps around.
+func rtpTimestamp(d time.Duration) uint32 {
+	return uint32(uint64(d/time.Microsecond) * 90 / 1000)
+}
+
+// sendTime returns when sent bytes are due at rate bits per second, split
+// in whole seconds and the rest so that it does not overflow.
+func sendTime(sent, rate int64) time.Duration {
+	bits := sent * 8
+	return time.Duration(bits/rate)*time.Second + time.Duration(bits%rate*int64(time.Second)/rate)
+}
+
+func (self *Writer) Close() (err error) {
+	if err = self.Flush(); err != nil {
+		self.conn.Close()
+		return
+	}
+	return self.conn.Close()
+}
+
+type Demuxer struct {
+	*ts.Demuxer
+	r *Reader
+}
+
+func Open(uri string) (demuxer *Demuxer, err error) {
+	var addr *net.UDPAddr
+	var opts Options
+	if addr, opts, err = ParseURL(uri); err != nil {
+		return
+	}
+	var r *Reader
+	if r, err = Listen(addr, opts); err != nil {
+		return
+	}
+	demuxer = &Demuxer{
+		Demuxer: ts.NewDemuxer(r),
+		r:       r,
+	}
+	return
+}
+
+func (self *Demuxer) Close() error {
+	return self.r.Close()
+}
+
+type Muxer struct {
+	*ts.Muxer
+	w *Writer
+}
+
+func Create(uri string) (muxer *Muxer, err error) {
+	var addr *net.UDPAddr
+	var opts Options
+	if addr, opts, err = ParseURL(uri); err != nil {
+		return
+	}
+	var w *Writer
+	if w, err = Dial(addr, opts); err != nil {
+		return
+	}
+	muxer = &Muxer{
+		Muxer: ts.NewMuxer(w),
+		w:     w,
+	}
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	if err = self.Muxer.WriteTrailer(); err != nil {
+		return
+	}
+	return self.w.Flush()
+}
+
+func (self *Muxer) Close() error {
+	return self.w.Close()
+}
+
+func isUDPURL(uri string) bool {
+	return strings.HasPrefix(uri, "udp://") || strings.HasPrefix(uri, "rtp://")
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		if !isUDPURL(uri) {
+			return
+		}
+		ok = true
+		demuxer, err = Open(uri)
+		return
+	}
+
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if !isUDPURL(uri) {
+			return
+		}
+		ok = true
+		muxer, err = Create(uri)
+		return
+	}
+
+	h.CodecTypes = ts.CodecTypes
+}
@@ -0,0 +1,132 @@
+// Package udp
+// Created by RTT.
+// Author: teocci@yandex.com on 2021-Oct-27
+package udp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTPTimestamp(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want uint32
+	}{
+		{0, 0},
+		{time.Second, 90000},
+		{40 * time.Millisecond, 3600},
+		// past the 28h where d*90000 overflowed
+		{30 * time.Hour, uint32(uint64(30*3600*90000) % (1 << 32))},
+		{100 * time.Hour, 2335228928},
+	} {
+		if got := rtpTimestamp(c.d); got != c.want {
+			t.Errorf("rtpTimestamp(%s) = %d, want %d", c.d, got, c.want)
+		}
+	}
+}
+
+func TestSendTime(t *testing.T) {
+	for _, c := range []struct {
+		sent, rate int64
+		want       time.Duration
+	}{
+		{0, 4000000, 0},
+		{500000, 4000000, time.Second},
+		{1000, 4000000, 2 * time.Millisecond},
+		// a day at 100Mbps
+		{1080000000000, 100000000, 24 * time.Hour},
+	} {
+		if got := sendTime(c.sent, c.rate); got != c.want {
+			t.Errorf("sendTime(%d, %d) = %s, want %s", c.sent, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	addr, opts, err := ParseURL("rtp://127.0.0.1:5000?ttl=8&rate=4000000&timeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Port != 5000 || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected address %s", addr)
+	}
+	if !opts.RTP || opts.TTL != 8 || opts.Rate != 4000000 || opts.Timeout != 2*time.Second {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	for _, uri := range []string{
+		"http://127.0.0.1:5000",
+		"udp://127.0.0.1:5000?ttl=x",
+		"udp://127.0.0.1:5000?rate=x",
+		"udp://127.0.0.1:5000?timeout=x",
+	} {
+		if _, _, err = ParseURL(uri); err == nil {
+			t.Errorf("%s: expected an error", uri)
+		}
+	}
+}
+
+func TestStripRTPHeader(t *testing.T) {
+	payload := []byte{0x47, 1, 2, 3}
+	hdr := []byte{0x80, RTPPayloadMP2T, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	if got := stripRTPHeader(append(hdr, payload...)); !bytes.Equal(got, payload) {
+		t.Errorf("plain header: got %x", got)
+	}
+
+	// one CSRC, a one word extension and two bytes of padding
+	b := []byte{0xb1, RTPPayloadMP2T, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, 0xbe, 0xde, 0, 1, 0, 0, 0, 0)
+	b = append(b, payload...)
+	b = append(b, 0, 2)
+	if got := stripRTPHeader(b); !bytes.Equal(got, payload) {
+		t.Errorf("extended header: got %x", got)
+	}
+
+	if got := stripRTPHeader(payload); got != nil {
+		t.Errorf("expected nil for a short packet, got %x", got)
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+	for _, rtp := range []bool{false, true} {
+		r, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, Options{RTP: rtp, Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Dial(r.conn.LocalAddr().(*net.UDPAddr), Options{RTP: rtp, Rate: 8000000})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// two full datagrams and a flushed partial one
+		data := make([]byte, 2*DatagramSize+TSPacketSize)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		start := time.Now()
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// paced to 1MB/s
+		if elapsed := time.Since(start); elapsed < 2*time.Millisecond {
+			t.Errorf("rtp=%v: sent %d bytes in %s", rtp, len(data), elapsed)
+		}
+
+		got := make([]byte, len(data))
+		if _, err = io.ReadFull(r, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("rtp=%v: data differs", rtp)
+		}
+		r.Close()
+	}
+}